@@ -0,0 +1,331 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+/*
+Command chat is an example of TCP chat server built on netpoll.
+
+Each line sent by a client is broadcast to all other clients, prefixed by the
+sender's address. Try it with netcat:
+
+	go run . -addr 127.0.0.1:7000
+	nc 127.0.0.1 7000
+
+The server shows core patterns of netpoll usage:
+
+  - connections are kept in a registry, which owns their descriptors; the
+    poller only calls back into it;
+  - descriptors are created by netpoll.HandleRead(), so they are
+    edge-triggered and must be read until EAGAIN on each event;
+  - reads are made with syscall.RawConn without waiting, so the poller's
+    goroutine is never parked by the runtime;
+  - EventReadHup means that the peer has closed its side, so the rest of
+    data is read before the connection is removed, while EventErr removes the
+    connection at once; netpoll.Desc.LastError() tells the reason;
+  - writes could block, so each connection has its own writer goroutine and
+    slow clients are dropped instead of blocking the broadcast;
+  - EventPollerClosed is received by every registered connection when the
+    poller is closed on shutdown.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+var addr = flag.String("addr", "127.0.0.1:7000", "address to listen on")
+
+const (
+	// maxLine is the maximum length of a message line.
+	maxLine = 4096
+	// outQueue is the number of messages queued for a client before it is
+	// considered too slow.
+	outQueue = 64
+	// writeTimeout limits time of writing single message to a client.
+	writeTimeout = 5 * time.Second
+)
+
+var errLineTooLong = errors.New("line is too long")
+
+func main() {
+	flag.Parse()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(ln)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.close()
+	}()
+	log.Printf("listening on %s", ln.Addr())
+	if err := s.serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// server is the chat server. It holds registry of connected clients.
+type server struct {
+	ln     net.Listener
+	poller netpoll.Poller
+
+	mu      sync.Mutex
+	closed  bool
+	clients map[*client]struct{}
+}
+
+func newServer(ln net.Listener) (*server, error) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		ln:      ln,
+		poller:  poller,
+		clients: make(map[*client]struct{}),
+	}, nil
+}
+
+// serve accepts connections until the listener is closed by close().
+func (s *server) serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if err := s.accept(conn); err != nil {
+			log.Printf("can not register %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+		}
+	}
+}
+
+// close stops accepting connections and closes the poller, which removes all
+// clients.
+func (s *server) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.ln.Close()
+	return s.poller.(netpoll.Closer).Close()
+}
+
+// accept registers conn in the poller and adds it to the registry.
+func (s *server) accept(conn net.Conn) error {
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	desc, err := netpoll.HandleRead(conn)
+	if err != nil {
+		return err
+	}
+	c := &client{
+		s:    s,
+		name: conn.RemoteAddr().String(),
+		conn: conn,
+		rc:   rc,
+		desc: desc,
+		out:  make(chan []byte, outQueue),
+	}
+
+	// Client is added before Start(), because its callback could be called
+	// right after registration.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		desc.Close()
+		return netpoll.ErrClosed
+	}
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	if err := s.poller.Start(desc, c.onEvent); err != nil {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		desc.Close()
+		return err
+	}
+	go c.writer()
+	s.broadcast(nil, fmt.Sprintf("* %s joined\n", c.name))
+	return nil
+}
+
+// remove deletes c from the registry, deregisters and closes it. It is safe
+// to call it multiple times.
+func (s *server) remove(c *client, reason string) {
+	s.mu.Lock()
+	if _, has := s.clients[c]; !has {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.clients, c)
+	s.mu.Unlock()
+
+	// Stop() returns ErrClosed when the poller is closed; registration is
+	// released by the poller then.
+	if err := s.poller.Stop(c.desc); err != nil && err != netpoll.ErrClosed {
+		log.Printf("%s: stop error: %v", c.name, err)
+	}
+	c.desc.Close()
+	// Writer sends queued messages and closes the connection.
+	close(c.out)
+	log.Printf("%s: removed: %s", c.name, reason)
+	s.broadcast(c, fmt.Sprintf("* %s left: %s\n", c.name, reason))
+}
+
+// broadcast queues msg to all clients except from. Clients which queues are
+// full are removed.
+func (s *server) broadcast(from *client, msg string) {
+	var (
+		b    = []byte(msg)
+		slow []*client
+	)
+	s.mu.Lock()
+	for c := range s.clients {
+		if c == from {
+			continue
+		}
+		select {
+		case c.out <- b:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range slow {
+		s.remove(c, "too slow")
+	}
+}
+
+// client is a connection of the chat.
+type client struct {
+	s    *server
+	name string
+	conn net.Conn
+	rc   syscall.RawConn
+	desc *netpoll.Desc
+	out  chan []byte
+
+	// line holds the beginning of a line which is not received completely
+	// yet. It is used by the poller's goroutine only.
+	line []byte
+	buf  [512]byte
+}
+
+// onEvent is called by the poller's goroutine, so it must not block.
+func (c *client) onEvent(ev netpoll.Event) {
+	switch {
+	case ev&netpoll.EventPollerClosed != 0:
+		c.s.remove(c, "server is shutting down")
+		return
+	case ev&netpoll.EventErr != 0:
+		c.s.remove(c, fmt.Sprintf("connection error: %v", c.desc.LastError()))
+		return
+	}
+	// Hangup is reported together with the rest of data, so the connection
+	// is read anyway.
+	err := c.read()
+	switch {
+	case err == io.EOF:
+		c.s.remove(c, "connection closed")
+	case err != nil:
+		c.s.remove(c, err.Error())
+	case ev&(netpoll.EventReadHup|netpoll.EventHup) != 0:
+		c.s.remove(c, "connection closed")
+	}
+}
+
+// read reads connection until EAGAIN and broadcasts received lines. It
+// returns io.EOF if the peer has closed the connection.
+func (c *client) read() error {
+	for {
+		var (
+			n    int
+			rerr error
+		)
+		err := c.rc.Read(func(fd uintptr) bool {
+			for {
+				n, rerr = syscall.Read(int(fd), c.buf[:])
+				if rerr != syscall.EINTR {
+					break
+				}
+			}
+			// Do not wait for readiness: the poller reports it.
+			return true
+		})
+		switch {
+		case err != nil:
+			return err
+		case rerr == syscall.EAGAIN:
+			return nil
+		case rerr != nil:
+			return rerr
+		case n == 0:
+			return io.EOF
+		}
+		if err := c.consume(c.buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// consume splits data into lines and broadcasts them.
+func (c *client) consume(data []byte) error {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if len(c.line)+len(data) > maxLine {
+				return errLineTooLong
+			}
+			c.line = append(c.line, data...)
+			return nil
+		}
+		line := append(c.line, data[:i]...)
+		c.line = c.line[:0]
+		data = data[i+1:]
+		if len(bytes.TrimSpace(line)) > 0 {
+			c.s.broadcast(c, fmt.Sprintf("%s: %s\n", c.name, bytes.TrimRight(line, "\r")))
+		}
+	}
+	return nil
+}
+
+// writer sends queued messages until the client is removed.
+func (c *client) writer() {
+	defer c.conn.Close()
+	for msg := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.conn.Write(msg); err != nil {
+			// Removal closes the queue, so the rest of messages is
+			// discarded below.
+			c.s.remove(c, fmt.Sprintf("write error: %v", err))
+			for range c.out {
+			}
+			return
+		}
+	}
+}
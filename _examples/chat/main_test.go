@@ -0,0 +1,94 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExampleChat(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+
+	alice, ar := dial(t, ln.Addr())
+	bob, br := dial(t, ln.Addr())
+	// Alice sees Bob joining, so both are registered.
+	expectLine(t, ar, "* "+bob.LocalAddr().String()+" joined")
+
+	// Message is sent in parts to check line assembly.
+	alice.Write([]byte("hello, "))
+	time.Sleep(10 * time.Millisecond)
+	alice.Write([]byte("bob\r\n"))
+	expectLine(t, br, alice.LocalAddr().String()+": hello, bob")
+
+	bob.Write([]byte("hi\n"))
+	expectLine(t, ar, bob.LocalAddr().String()+": hi")
+
+	// Data sent before hangup is delivered.
+	alice.Write([]byte("bye\n"))
+	alice.Close()
+	expectLine(t, br, alice.LocalAddr().String()+": bye")
+	expectLine(t, br, "* "+alice.LocalAddr().String()+" left: connection closed")
+
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve() error: %v", err)
+	}
+	// Bob is removed on shutdown and his connection is closed.
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := br.ReadString('\n'); err == nil {
+		t.Fatalf("unexpected line after shutdown: %q", line)
+	}
+	s.mu.Lock()
+	n := len(s.clients)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d clients are left in the registry after shutdown", n)
+	}
+}
+
+func dial(t *testing.T, addr net.Addr) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, exp string) {
+	t.Helper()
+	line, err := readLine(r)
+	if err != nil {
+		t.Fatalf("can not read %q: %v", exp, err)
+	}
+	// Notifications of joining clients could come in any order, so they
+	// are skipped unless expected.
+	for strings.HasSuffix(line, " joined") && line != exp {
+		if line, err = readLine(r); err != nil {
+			t.Fatalf("can not read %q: %v", exp, err)
+		}
+	}
+	if line != exp {
+		t.Fatalf("received %q; want %q", line, exp)
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimSuffix(line, "\n"), err
+}
@@ -0,0 +1,468 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+/*
+Command httpecho is an example of HTTP/1.1 server which sends request bodies
+back to clients. Both the listener and the connections are handled by
+netpoll, so idle connections cost no goroutines:
+
+	go run . -addr 127.0.0.1:8080
+	curl -d hello 127.0.0.1:8080
+
+The listener is registered with netpoll.HandleListener() in level-triggered
+mode: the poller reports it while connections are pending, so each event
+accepts exactly one of them and Accept() never blocks.
+
+Connections are registered with netpoll.HandleRead(), which makes them
+edge-triggered: an event is reported only when new data arrives, so the
+callback must read everything until EAGAIN, otherwise the rest of data would
+wait for the next packet. Reads are made with syscall.RawConn without waiting
+for readiness, so the poller's goroutine is never parked by the runtime.
+
+Only requests with Content-Length or without body are supported; keep-alive
+and pipelining work as HTTP/1.1 requires. Responses are written to the socket
+directly; only when it is not ready, netpoll/bufio.Writer is created to flush
+the rest of data on EventWrite instead of blocking the poller. So an idle
+connection holds no buffers. A client which does not read responses fills the
+buffer and is disconnected.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+	"github.com/mailru/easygo/netpoll/bufio"
+)
+
+var addr = flag.String("addr", "127.0.0.1:8080", "address to listen on")
+
+const (
+	// maxHeader is the maximum size of request line and headers.
+	maxHeader = 8 << 10
+	// maxBody is the maximum size of request body.
+	maxBody = 1 << 20
+	// writeBuffer is the size of the response buffer of a connection, which
+	// is allocated when the socket does not accept a response at once.
+	writeBuffer = maxBody + 4<<10
+	// lingerTimeout limits time of sending buffered responses to a client
+	// which connection is being closed.
+	lingerTimeout = 5 * time.Second
+)
+
+func main() {
+	flag.Parse()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(ln)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", ln.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if err := s.close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// server accepts connections and keeps the registry of them.
+type server struct {
+	ln     net.Listener
+	desc   *netpoll.Desc
+	poller netpoll.Poller
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+
+	// buf is used by callbacks to read connections.
+	buf [64 << 10]byte
+}
+
+// newServer registers ln in a new poller, which accepts connections from
+// then on.
+func newServer(ln net.Listener) (*server, error) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := netpoll.HandleListener(ln, netpoll.EventRead)
+	if err != nil {
+		poller.(netpoll.Closer).Close()
+		return nil, err
+	}
+	s := &server{
+		ln:     ln,
+		desc:   desc,
+		poller: poller,
+		conns:  make(map[*conn]struct{}),
+	}
+	if err := poller.Start(desc, s.onAccept); err != nil {
+		desc.Close()
+		poller.(netpoll.Closer).Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// close closes the listener and all connections.
+func (s *server) close() error {
+	s.poller.Stop(s.desc)
+	s.desc.Close()
+	s.ln.Close()
+	// Connections are removed by their callbacks on EventPollerClosed.
+	return s.poller.(netpoll.Closer).Close()
+}
+
+// onAccept is called by the poller when connections are pending.
+func (s *server) onAccept(ev netpoll.Event) {
+	if ev&netpoll.EventPollerClosed != 0 {
+		return
+	}
+	nc, err := s.ln.Accept()
+	if err != nil {
+		log.Printf("accept error: %v", err)
+		return
+	}
+	if err := s.serve(nc); err != nil {
+		log.Printf("%s: can not serve: %v", nc.RemoteAddr(), err)
+		nc.Close()
+	}
+}
+
+// serve registers nc in the poller and the registry.
+func (s *server) serve(nc net.Conn) error {
+	rc, err := nc.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	desc, err := netpoll.HandleRead(nc)
+	if err != nil {
+		return err
+	}
+	c := &conn{
+		s:    s,
+		nc:   nc,
+		rc:   rc,
+		desc: desc,
+	}
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	if err := s.poller.Start(desc, c.onEvent); err != nil {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		desc.Close()
+		return err
+	}
+	return nil
+}
+
+// remove deletes c from the registry and closes it. It is safe to call it
+// multiple times. If graceful is true, buffered responses are sent before
+// the connection is closed.
+func (s *server) remove(c *conn, graceful bool) {
+	s.mu.Lock()
+	_, has := s.conns[c]
+	delete(s.conns, c)
+	s.mu.Unlock()
+	if !has {
+		return
+	}
+	// Stop() returns ErrClosed when the poller is closed; registration is
+	// released by the poller then.
+	s.poller.Stop(c.desc)
+	c.desc.Close()
+	if c.w == nil {
+		c.nc.Close()
+		return
+	}
+	if graceful && c.w.Buffered() > 0 {
+		// Writer sends the rest of data on EventWrite, which is waited for
+		// by another goroutine to not block the poller.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), lingerTimeout)
+			defer cancel()
+			for c.w.Buffered() > 0 && c.w.WaitWritable(ctx) == nil {
+				time.Sleep(time.Millisecond)
+			}
+			c.w.Close()
+			c.nc.Close()
+		}()
+		return
+	}
+	c.w.Close()
+	c.nc.Close()
+}
+
+// conn is a client connection. Its fields are used by the poller's
+// goroutine only.
+type conn struct {
+	s    *server
+	nc   net.Conn
+	rc   syscall.RawConn
+	desc *netpoll.Desc
+
+	// in holds received data which is not handled yet, while out holds
+	// responses which are not written yet.
+	in  []byte
+	out []byte
+
+	// w is created when the socket does not accept a response at once.
+	// It is kept until the connection is closed, so responses are written
+	// in order.
+	w *bufio.Writer
+}
+
+var errClose = errors.New("connection must be closed")
+
+func (c *conn) onEvent(ev netpoll.Event) {
+	if ev&(netpoll.EventPollerClosed|netpoll.EventErr) != 0 {
+		c.s.remove(c, false)
+		return
+	}
+	eof, err := c.read()
+	if err == nil {
+		err = c.handle()
+	}
+	if err == nil || err == errClose {
+		if ferr := c.flush(); ferr != nil {
+			err = ferr
+		}
+	}
+	switch {
+	case err == errClose || err == nil && eof:
+		c.s.remove(c, true)
+	case err != nil:
+		c.s.remove(c, false)
+	}
+}
+
+// read appends data available in the socket to c.in until EAGAIN. It reports
+// whether the peer has closed the connection.
+func (c *conn) read() (eof bool, err error) {
+	// Callbacks are called by the single goroutine of the poller, so the
+	// read buffer is shared by all connections.
+	buf := c.s.buf[:]
+	for {
+		var (
+			n    int
+			rerr error
+		)
+		err := c.rc.Read(func(fd uintptr) bool {
+			for {
+				n, rerr = syscall.Read(int(fd), buf)
+				if rerr != syscall.EINTR {
+					break
+				}
+			}
+			// Do not wait for readiness: the poller reports it.
+			return true
+		})
+		switch {
+		case err != nil:
+			return false, err
+		case rerr == syscall.EAGAIN:
+			return false, nil
+		case rerr != nil:
+			return false, rerr
+		case n == 0:
+			return true, nil
+		}
+		c.in = append(c.in, buf[:n]...)
+		if len(c.in) > maxHeader+maxBody {
+			return false, errClose
+		}
+	}
+}
+
+// flush writes c.out to the socket as much as it accepts without waiting.
+// The rest is passed to c.w, which writes it on EventWrite.
+func (c *conn) flush() error {
+	out := c.out
+	if cap(c.out) > len(c.s.buf) {
+		// Large buffer is not kept by idle connection.
+		c.out = nil
+	} else {
+		c.out = c.out[:0]
+	}
+	if c.w != nil {
+		if _, err := c.w.Write(out); err != nil {
+			return err
+		}
+		return c.w.Flush()
+	}
+	for len(out) > 0 {
+		var (
+			n    int
+			werr error
+		)
+		err := c.rc.Write(func(fd uintptr) bool {
+			for {
+				n, werr = syscall.Write(int(fd), out)
+				if werr != syscall.EINTR {
+					break
+				}
+			}
+			return true
+		})
+		switch {
+		case err != nil:
+			return err
+		case werr == syscall.EAGAIN:
+			var err error
+			if c.w, err = bufio.NewWriterSize(c.nc, c.s.poller, writeBuffer); err != nil {
+				return err
+			}
+			if _, err := c.w.Write(out); err != nil {
+				return err
+			}
+			return c.w.Flush()
+		case werr != nil:
+			return werr
+		}
+		out = out[n:]
+	}
+	return nil
+}
+
+// handle responds to all complete requests in c.in.
+func (c *conn) handle() error {
+	for {
+		req, n, err := parseRequest(c.in)
+		if err != nil {
+			c.respond(err.(*statusError).status, nil, true)
+			return errClose
+		}
+		if n == 0 {
+			if len(c.in) == 0 {
+				c.in = nil
+			}
+			return nil
+		}
+		c.in = c.in[n:]
+		c.respond(200, req.body, req.close)
+		if req.close {
+			return errClose
+		}
+	}
+}
+
+// respond appends response to c.out.
+func (c *conn) respond(status int, body []byte, close bool) {
+	header := fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n",
+		status, statusText[status], len(body),
+	)
+	if close {
+		header += "Connection: close\r\n"
+	}
+	c.out = append(c.out, header...)
+	c.out = append(c.out, "\r\n"...)
+	c.out = append(c.out, body...)
+}
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	413: "Payload Too Large",
+	431: "Request Header Fields Too Large",
+	501: "Not Implemented",
+	505: "HTTP Version Not Supported",
+}
+
+// request is a parsed HTTP request.
+type request struct {
+	method string
+	target string
+	body   []byte
+	close  bool
+}
+
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return statusText[e.status]
+}
+
+var crlf = []byte("\r\n")
+
+// parseRequest parses request at the beginning of data. It returns the
+// number of bytes the request takes, which is zero if the request is not
+// complete yet.
+func parseRequest(data []byte) (req request, n int, err error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(data) > maxHeader {
+			return req, 0, &statusError{431}
+		}
+		return req, 0, nil
+	}
+	lines := bytes.Split(data[:end], crlf)
+
+	parts := bytes.Split(lines[0], []byte(" "))
+	if len(parts) != 3 {
+		return req, 0, &statusError{400}
+	}
+	req.method, req.target = string(parts[0]), string(parts[1])
+	switch string(parts[2]) {
+	case "HTTP/1.1":
+	case "HTTP/1.0":
+		req.close = true
+	default:
+		return req, 0, &statusError{505}
+	}
+
+	length := 0
+	for _, line := range lines[1:] {
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			return req, 0, &statusError{400}
+		}
+		name := string(bytes.TrimSpace(line[:i]))
+		value := string(bytes.TrimSpace(line[i+1:]))
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			if length, err = strconv.Atoi(value); err != nil || length < 0 {
+				return req, 0, &statusError{400}
+			}
+			if length > maxBody {
+				return req, 0, &statusError{413}
+			}
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			return req, 0, &statusError{501}
+		case strings.EqualFold(name, "Connection"):
+			if strings.EqualFold(value, "close") {
+				req.close = true
+			} else if strings.EqualFold(value, "keep-alive") {
+				req.close = false
+			}
+		}
+	}
+
+	n = end + 4 + length
+	if len(data) < n {
+		return req, 0, nil
+	}
+	req.body = data[end+4 : n]
+	return req, n, nil
+}
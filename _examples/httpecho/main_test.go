@@ -0,0 +1,191 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var idleConns = flag.Int("httpecho.idle", 1000, "number of idle connections in benchmarks")
+
+func TestExampleHTTPEcho(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Pipelined requests, the second one is sent in parts.
+	conn.Write([]byte("POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"))
+	conn.Write([]byte("POST /b HTTP/1.1\r\nContent-Le"))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte("ngth: 3\r\n\r\n"))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte("bye"))
+	for _, exp := range []string{"hello", "bye"} {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || string(body) != exp {
+			t.Errorf("response is %d %q; want 200 %q", resp.StatusCode, body, exp)
+		}
+	}
+
+	// Large body is read until EAGAIN over several events.
+	large := bytes.Repeat([]byte("x"), 256<<10)
+	resp, err := http.Post("http://"+addr+"/", "text/plain", bytes.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, large) {
+		t.Errorf("large body is echoed as %d bytes; want %d", len(body), len(large))
+	}
+
+	// Connection is closed after the response to close request.
+	conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != 200 || !resp.Close {
+		t.Fatalf("unexpected response to close request: %+v, %v", resp, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("read after close request error is %v; want EOF", err)
+	}
+
+	// Malformed request is rejected.
+	bad, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	if resp, err := http.ReadResponse(bufio.NewReader(bad), nil); err != nil || resp.StatusCode != 501 {
+		t.Errorf("unexpected response to chunked request: %+v, %v", resp, err)
+	}
+}
+
+// BenchmarkIdleConns measures requests made through one connection while
+// many other ones are idle. Memory and goroutines taken by an idle
+// connection are reported as custom metrics.
+func BenchmarkIdleConns(b *testing.B) {
+	b.Run("netpoll", func(b *testing.B) {
+		benchmarkIdleConns(b, startServer(b))
+	})
+	b.Run("net/http", func(b *testing.B) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.DefaultServeMux}
+		go srv.Serve(ln)
+		b.Cleanup(func() { srv.Close() })
+		benchmarkIdleConns(b, ln.Addr().String())
+	})
+}
+
+func init() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+}
+
+func benchmarkIdleConns(b *testing.B, addr string) {
+	const req = "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"
+	roundTrip := func(conn net.Conn, r *bufio.Reader) error {
+		if _, err := conn.Write([]byte(req)); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return err
+	}
+
+	// Baseline is measured after the first connection is served, so lazy
+	// initialization of the servers is not counted.
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer active.Close()
+	r := bufio.NewReader(active)
+	if err := roundTrip(active, r); err != nil {
+		b.Fatal(err)
+	}
+	before, goroutines := memStats()
+
+	idle := make([]net.Conn, 0, *idleConns)
+	defer func() {
+		for _, conn := range idle {
+			conn.Close()
+		}
+	}()
+	for len(idle) < *idleConns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatalf("can not open idle connection #%d: %v", len(idle), err)
+		}
+		idle = append(idle, conn)
+		// Each connection makes a request, so the server has read its state
+		// allocated.
+		if err := roundTrip(conn, bufio.NewReader(conn)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	after, goroutinesAfter := memStats()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := roundTrip(active, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	n := float64(len(idle))
+	b.ReportMetric(float64(int64(after)-int64(before))/n, "heap-B/idle-conn")
+	b.ReportMetric(float64(goroutinesAfter-goroutines)/n, "goroutines/idle-conn")
+}
+
+// memStats returns heap size and number of goroutines. Client side
+// goroutines are not created, since connections are read synchronously.
+func memStats() (heap uint64, goroutines int) {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc, runtime.NumGoroutine()
+}
+
+func startServer(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := newServer(ln)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := s.close(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return ln.Addr().String()
+}
@@ -0,0 +1,486 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+/*
+Command proxy is an example of TCP proxy built on netpoll. It forwards each
+accepted connection to the target address in both directions:
+
+	go run . -addr 127.0.0.1:8000 -target 127.0.0.1:8080
+
+Both connections of a session are registered with netpoll.HandleRead(), that
+is, with EventRead|EventEdgeTriggered, so each direction is pumped until
+EAGAIN on every event. On linux data is moved with splice(2) through a pipe
+and never copied to user space. When splice is not available (other systems,
+-splice=false or sockets which do not support it), data is read into a buffer
+and written from there.
+
+The proxy shows how to handle backpressure and ends of stream:
+
+  - if the destination is not ready for writing, reading of the source is
+    suspended until the rest of data is written: a separate one-shot write
+    descriptor reports EventWrite then, and the direction is pumped again
+    without waiting for EventRead;
+  - EventReadHup (or EventHup) means that the peer has shut down writing, so
+    the rest of data is forwarded and then the write side of the other
+    connection is shut down; the opposite direction keeps working;
+  - the session is closed when both directions are finished, or at once on
+    any error.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+var (
+	addr      = flag.String("addr", "127.0.0.1:8000", "address to listen on")
+	target    = flag.String("target", "127.0.0.1:8080", "address to forward connections to")
+	useSplice = flag.Bool("splice", true, "use splice(2) when it is available")
+)
+
+const (
+	// chunkSize is the maximum number of bytes moved by single read or
+	// splice call.
+	chunkSize = 64 << 10
+	// dialTimeout limits time of connecting to the target.
+	dialTimeout = 5 * time.Second
+)
+
+// errNoSplice is returned by newPipe() if splice(2) is not supported.
+var errNoSplice = errors.New("splice is not supported")
+
+func main() {
+	flag.Parse()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(ln, *target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.close()
+	}()
+	log.Printf("forwarding %s to %s", ln.Addr(), *target)
+	if err := s.serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// server accepts connections and holds registry of proxied sessions.
+type server struct {
+	ln     net.Listener
+	target string
+	poller netpoll.Poller
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[*session]struct{}
+}
+
+func newServer(ln net.Listener, target string) (*server, error) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		ln:       ln,
+		target:   target,
+		poller:   poller,
+		sessions: make(map[*session]struct{}),
+	}, nil
+}
+
+// serve accepts connections until the listener is closed by close().
+func (s *server) serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.proxy(conn); err != nil {
+				log.Printf("%s: can not proxy: %v", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// close stops accepting connections and closes the poller, which closes all
+// sessions.
+func (s *server) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.ln.Close()
+	return s.poller.(netpoll.Closer).Close()
+}
+
+// proxy connects to the target and starts forwarding data between it and
+// conn.
+func (s *server) proxy(conn net.Conn) error {
+	back, err := net.DialTimeout("tcp", s.target, dialTimeout)
+	if err != nil {
+		return err
+	}
+	ss := &session{s: s}
+	if ss.conns[0], err = newEnd(conn); err == nil {
+		ss.conns[1], err = newEnd(back)
+	}
+	if err == nil {
+		ss.flows[0], err = newFlow(ss, ss.conns[0], ss.conns[1])
+	}
+	if err == nil {
+		ss.flows[1], err = newFlow(ss, ss.conns[1], ss.conns[0])
+	}
+	if err != nil {
+		ss.release()
+		back.Close()
+		return err
+	}
+
+	// Session is added before Start(), because its callbacks could be
+	// called right after registration.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ss.release()
+		back.Close()
+		return netpoll.ErrClosed
+	}
+	s.sessions[ss] = struct{}{}
+	s.mu.Unlock()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, f := range ss.flows {
+		if err := s.poller.Start(f.src.read, f.onRead); err != nil {
+			ss.close(err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// remove deletes ss from the registry.
+func (s *server) remove(ss *session) {
+	s.mu.Lock()
+	delete(s.sessions, ss)
+	s.mu.Unlock()
+}
+
+// end is one of the connections of a session.
+type end struct {
+	conn net.Conn
+	// read is registered to pump data from the connection, while write is
+	// started only when the connection is not ready for writing.
+	read  *netpoll.Desc
+	write *netpoll.Desc
+}
+
+func newEnd(conn net.Conn) (*end, error) {
+	read, err := netpoll.HandleRead(conn)
+	if err != nil {
+		return nil, err
+	}
+	write, err := netpoll.HandleWriteOnce(conn)
+	if err != nil {
+		read.Close()
+		return nil, err
+	}
+	return &end{conn, read, write}, nil
+}
+
+// session is a pair of proxied connections: the accepted one and the one to
+// the target.
+type session struct {
+	s     *server
+	conns [2]*end
+	flows [2]*flow
+
+	// mu serializes callbacks of both connections, which could be called
+	// by different goroutines depending on the poller configuration, and
+	// guards the state of flows.
+	mu     sync.Mutex
+	closed bool
+}
+
+// close deregisters and closes both connections. It must be called with
+// ss.mu held. It is safe to call it multiple times.
+func (ss *session) close(err error) {
+	if ss.closed {
+		return
+	}
+	ss.closed = true
+	ss.s.remove(ss)
+	if err != nil {
+		log.Printf("%s: session error: %v", ss.conns[0].conn.RemoteAddr(), err)
+	}
+	// Stop() returns ErrClosed when the poller is closed and an error for
+	// write descriptors which are not started; both are fine here.
+	for _, e := range ss.conns {
+		ss.s.poller.Stop(e.read)
+		ss.s.poller.Stop(e.write)
+	}
+	ss.release()
+	for _, e := range ss.conns {
+		e.conn.Close()
+	}
+}
+
+// release closes descriptors and pipes of the session.
+func (ss *session) release() {
+	for _, e := range ss.conns {
+		if e != nil {
+			e.read.Close()
+			e.write.Close()
+		}
+	}
+	for _, f := range ss.flows {
+		if f != nil {
+			f.closePipe()
+		}
+	}
+}
+
+// finished is called when one of directions is finished. It closes the
+// session when both of them are.
+func (ss *session) finished() {
+	if ss.flows[0].done && ss.flows[1].done {
+		ss.close(nil)
+	}
+}
+
+// flow moves data from src to dst.
+type flow struct {
+	ss  *session
+	src *end
+	dst *end
+
+	// pipe is used by splice(2). It holds buffered bytes which are not
+	// written to dst yet. Fields are -1 when splice is not used.
+	pipe     [2]int
+	buffered int
+
+	// buf is used to copy data when splice is not used. Its pending part
+	// is not written to dst yet.
+	buf     []byte
+	pending []byte
+
+	// waiting is set while dst is not ready for writing.
+	waiting bool
+	// started is set when dst.write is started in the poller.
+	started bool
+	eof     bool
+	done    bool
+}
+
+func newFlow(ss *session, src, dst *end) (*flow, error) {
+	f := &flow{
+		ss:   ss,
+		src:  src,
+		dst:  dst,
+		pipe: [2]int{-1, -1},
+	}
+	if !*useSplice {
+		return f, nil
+	}
+	pipe, err := newPipe()
+	switch {
+	case err == errNoSplice:
+	case err != nil:
+		return nil, err
+	default:
+		f.pipe = pipe
+	}
+	return f, nil
+}
+
+func (f *flow) spliced() bool {
+	return f.pipe[0] != -1
+}
+
+func (f *flow) closePipe() {
+	if f.spliced() {
+		syscall.Close(f.pipe[0])
+		syscall.Close(f.pipe[1])
+		f.pipe = [2]int{-1, -1}
+	}
+}
+
+// onRead is called when src has data or is shut down by the peer.
+func (f *flow) onRead(ev netpoll.Event) {
+	f.ss.mu.Lock()
+	defer f.ss.mu.Unlock()
+	switch {
+	case ev&netpoll.EventPollerClosed != 0:
+		f.ss.close(nil)
+		return
+	case ev&netpoll.EventErr != 0:
+		f.ss.close(f.src.read.LastError())
+		return
+	}
+	// Hangup is reported together with the rest of data, so src is read
+	// until the end of stream anyway.
+	f.pump()
+}
+
+// onWritable is called when dst is ready for writing the rest of data.
+func (f *flow) onWritable(ev netpoll.Event) {
+	f.ss.mu.Lock()
+	defer f.ss.mu.Unlock()
+	if ev&netpoll.EventPollerClosed != 0 {
+		f.ss.close(nil)
+		return
+	}
+	// Errors of dst are reported by the next write.
+	f.waiting = false
+	f.pump()
+}
+
+// pump moves data until src has nothing to read or dst is not ready for
+// writing. When src reaches the end of stream, the write side of dst is shut
+// down. It must be called with f.ss.mu held.
+func (f *flow) pump() {
+	for !f.waiting && !f.done && !f.ss.closed {
+		var err error
+		switch {
+		case f.buffered > 0:
+			err = f.drainPipe()
+		case len(f.pending) > 0:
+			err = f.drainBuf()
+		case f.eof:
+			err = closeWrite(f.dst.conn)
+			f.done = true
+			f.ss.finished()
+		case f.spliced():
+			err = f.fillPipe()
+		default:
+			err = f.fillBuf()
+		}
+		if err == syscall.EAGAIN {
+			// Wait for EventRead of src.
+			return
+		}
+		if err != nil {
+			f.ss.close(err)
+			return
+		}
+	}
+}
+
+// fillPipe moves data from src to the pipe.
+func (f *flow) fillPipe() error {
+	n, err := splice(f.pipe[1], f.src.read.Fd(), chunkSize)
+	switch {
+	case err == syscall.EINVAL:
+		// Source does not support splice; pipe is empty, so the rest of
+		// data is copied.
+		f.closePipe()
+		return nil
+	case err != nil:
+		return err
+	case n == 0:
+		f.eof = true
+	}
+	f.buffered += n
+	return nil
+}
+
+// drainPipe moves data from the pipe to dst.
+func (f *flow) drainPipe() error {
+	n, err := splice(f.dst.write.Fd(), f.pipe[0], f.buffered)
+	if err == syscall.EAGAIN {
+		return f.arm()
+	}
+	if err != nil {
+		return err
+	}
+	f.buffered -= n
+	return nil
+}
+
+// fillBuf reads data from src to the buffer.
+func (f *flow) fillBuf() error {
+	if f.buf == nil {
+		f.buf = make([]byte, chunkSize)
+	}
+	n, err := retry(syscall.Read, f.src.read.Fd(), f.buf)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		f.eof = true
+	}
+	f.pending = f.buf[:n]
+	return nil
+}
+
+// drainBuf writes data from the buffer to dst.
+func (f *flow) drainBuf() error {
+	n, err := retry(syscall.Write, f.dst.write.Fd(), f.pending)
+	if err == syscall.EAGAIN {
+		return f.arm()
+	}
+	if err != nil {
+		return err
+	}
+	f.pending = f.pending[n:]
+	return nil
+}
+
+// arm starts waiting for EventWrite of dst. Source is not read until then,
+// so data is not buffered without limit.
+func (f *flow) arm() error {
+	p := f.ss.s.poller
+	var err error
+	if f.started {
+		err = p.Resume(f.dst.write)
+	} else {
+		err = p.Start(f.dst.write, f.onWritable)
+		f.started = err == nil
+	}
+	if err != nil {
+		return err
+	}
+	f.waiting = true
+	return nil
+}
+
+// retry calls fn until it is not interrupted by a signal.
+func retry(fn func(int, []byte) (int, error), fd int, p []byte) (n int, err error) {
+	for {
+		n, err = fn(fd, p)
+		if err != syscall.EINTR {
+			return n, err
+		}
+	}
+}
+
+// closeWrite shuts down the write side of conn.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,162 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExampleProxy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		splice bool
+	}{
+		{"splice", true},
+		{"copy", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			prev := *useSplice
+			*useSplice = test.splice
+			defer func() { *useSplice = prev }()
+
+			t.Run("echo", func(t *testing.T) {
+				backend := listen(t, func(conn net.Conn) {
+					io.Copy(conn, conn)
+					conn.(*net.TCPConn).CloseWrite()
+				})
+				s, addr := startProxy(t, backend)
+
+				// Data is larger than socket buffers, so both directions
+				// wait for writability.
+				data := make([]byte, 4<<20)
+				rand.Read(data)
+				conn := dial(t, addr)
+				go func() {
+					conn.Write(data)
+					conn.(*net.TCPConn).CloseWrite()
+				}()
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				echo, err := ioutil.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(echo, data) {
+					t.Fatalf("received %d bytes which differ from %d sent", len(echo), len(data))
+				}
+				waitSessions(t, s)
+			})
+
+			t.Run("half-close", func(t *testing.T) {
+				received := make(chan []byte, 1)
+				backend := listen(t, func(conn net.Conn) {
+					// Target is done with writing right away, while the
+					// other direction keeps working.
+					conn.Write([]byte("hello"))
+					conn.(*net.TCPConn).CloseWrite()
+					data, _ := ioutil.ReadAll(conn)
+					received <- data
+				})
+				s, addr := startProxy(t, backend)
+
+				conn := dial(t, addr)
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				greeting, err := ioutil.ReadAll(conn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if act, exp := string(greeting), "hello"; act != exp {
+					t.Errorf("received %q; want %q", act, exp)
+				}
+				conn.Write([]byte("bye"))
+				conn.(*net.TCPConn).CloseWrite()
+				select {
+				case data := <-received:
+					if act, exp := string(data), "bye"; act != exp {
+						t.Errorf("target received %q; want %q", act, exp)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("target did not receive end of stream")
+				}
+				waitSessions(t, s)
+			})
+		})
+	}
+}
+
+// listen starts a target server which calls handle for each connection.
+func listen(t *testing.T, handle func(net.Conn)) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr()
+}
+
+// startProxy starts proxy server forwarding to target.
+func startProxy(t *testing.T, target net.Addr) (*server, net.Addr) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(ln, target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+	t.Cleanup(func() {
+		if err := s.close(); err != nil {
+			t.Errorf("close() error: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("serve() error: %v", err)
+		}
+	})
+	return s, ln.Addr()
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitSessions waits until all sessions of s are finished.
+func waitSessions(t *testing.T, s *server) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.sessions)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions are not finished", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
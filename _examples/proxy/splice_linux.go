@@ -0,0 +1,23 @@
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// newPipe creates non-blocking pipe used to splice data between sockets.
+func newPipe() (p [2]int, err error) {
+	err = unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC)
+	return p, err
+}
+
+// splice moves up to n bytes from src to dst without copying them to user
+// space. It does not block; unix.EAGAIN is returned if src has no data or dst
+// is not ready for writing.
+func splice(dst, src, n int) (int, error) {
+	for {
+		m, err := unix.Splice(src, nil, dst, nil, n, unix.SPLICE_F_NONBLOCK|unix.SPLICE_F_MOVE)
+		if err != unix.EINTR {
+			return int(m), err
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import "syscall"
+
+func newPipe() ([2]int, error) {
+	return [2]int{-1, -1}, errNoSplice
+}
+
+func splice(dst, src, n int) (int, error) {
+	return 0, syscall.EINVAL
+}
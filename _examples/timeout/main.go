@@ -0,0 +1,347 @@
+// +build linux
+
+/*
+Command timeout is an example of per-connection read timeouts driven by the
+poller. It is an echo server which closes connections that send nothing for
+the given time:
+
+	go run . -addr 127.0.0.1:7000 -timeout 10s
+	nc 127.0.0.1 7000
+
+Each connection has a timerfd(2) registered in the same poller as the
+connection itself, so timeouts cost neither goroutines nor runtime timers.
+The timer is handled as follows:
+
+  - it is armed when the connection is accepted;
+  - read callback disarms it before reading and re-arms it after data is
+    read successfully;
+  - timer callback reads the timerfd first: if the timer was re-armed after
+    the event was queued, read fails with EAGAIN, and the stale event is
+    ignored; otherwise the connection is closed.
+
+SIGINT and SIGTERM are delivered to the poller as well, to shut down the
+server from its goroutine. signalfd(2) is not used because Go runtime does
+not allow to block signals in all threads; instead, signals received by
+os/signal are written to a pipe registered in the poller.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+var (
+	addr    = flag.String("addr", "127.0.0.1:7000", "address to listen on")
+	timeout = flag.Duration("timeout", 10*time.Second, "read timeout of connections")
+)
+
+func main() {
+	flag.Parse()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := newServer(ln, *timeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.notify(os.Interrupt, syscall.SIGTERM); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", ln.Addr())
+	if err := s.serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// server is the echo server. It holds registry of connections.
+type server struct {
+	ln      net.Listener
+	poller  netpoll.Poller
+	timeout time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[*conn]struct{}
+}
+
+func newServer(ln net.Listener, timeout time.Duration) (*server, error) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &server{
+		ln:      ln,
+		poller:  poller,
+		timeout: timeout,
+		conns:   make(map[*conn]struct{}),
+	}, nil
+}
+
+// notify makes the poller shut down the server when one of sigs is
+// received.
+func (s *server) notify(sigs ...os.Signal) error {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return err
+	}
+	desc, err := netpoll.NewDesc(fds[0], netpoll.EventRead|netpoll.EventOneShot, true)
+	if err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return err
+	}
+	if err = s.poller.Start(desc, func(ev netpoll.Event) {
+		if ev&netpoll.EventPollerClosed == 0 {
+			log.Printf("shutting down")
+			s.shutdown()
+		}
+	}); err != nil {
+		desc.Close()
+		unix.Close(fds[1])
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		unix.Write(fds[1], []byte{0})
+	}()
+	return nil
+}
+
+// serve accepts connections until the server is shut down. Then it closes
+// the poller.
+func (s *server) serve() error {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				return err
+			}
+			return s.poller.(netpoll.Closer).Close()
+		}
+		if err := s.accept(nc); err != nil {
+			log.Printf("can not register %s: %v", nc.RemoteAddr(), err)
+			nc.Close()
+		}
+	}
+}
+
+// shutdown stops accepting connections and closes all of them.
+func (s *server) shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	s.ln.Close()
+	for _, c := range conns {
+		c.close("server is shutting down")
+	}
+}
+
+// accept registers nc and its timer in the poller.
+func (s *server) accept(nc net.Conn) error {
+	desc, err := netpoll.HandleRead(nc)
+	if err != nil {
+		return err
+	}
+	tfd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
+	if err != nil {
+		desc.Close()
+		return os.NewSyscallError("timerfd_create", err)
+	}
+	// Timer stays readable after expiration, so it is level-triggered.
+	timer, err := netpoll.NewDesc(tfd, netpoll.EventRead, true)
+	if err != nil {
+		unix.Close(tfd)
+		desc.Close()
+		return err
+	}
+	c := &conn{
+		s:     s,
+		name:  nc.RemoteAddr().String(),
+		nc:    nc,
+		desc:  desc,
+		timer: timer,
+	}
+	if err := c.arm(); err != nil {
+		timer.Close()
+		desc.Close()
+		return err
+	}
+
+	// Connection is added before Start(), because its callbacks could be
+	// called right after registration.
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		timer.Close()
+		desc.Close()
+		return netpoll.ErrClosed
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := s.poller.Start(timer, c.onTimer); err != nil {
+		c.closeLocked(fmt.Sprintf("can not start timer: %v", err))
+		return nil
+	}
+	if err := s.poller.Start(desc, c.onRead); err != nil {
+		c.closeLocked(fmt.Sprintf("can not start connection: %v", err))
+	}
+	return nil
+}
+
+// conn is a client connection with its read timer.
+type conn struct {
+	s     *server
+	name  string
+	nc    net.Conn
+	desc  *netpoll.Desc
+	timer *netpoll.Desc
+
+	// mu serializes callbacks of the connection and the timer.
+	mu     sync.Mutex
+	closed bool
+	buf    [4096]byte
+}
+
+func (c *conn) onRead(ev netpoll.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		return
+	case ev&netpoll.EventPollerClosed != 0:
+		c.closeLocked("server is shutting down")
+		return
+	case ev&netpoll.EventErr != 0:
+		c.closeLocked(fmt.Sprintf("connection error: %v", c.desc.LastError()))
+		return
+	}
+
+	// Timer must not fire while the connection is read. Its event which is
+	// already queued is recognized as stale by onTimer().
+	if err := c.disarm(); err != nil {
+		c.closeLocked(err.Error())
+		return
+	}
+	for {
+		n, err := c.read()
+		if err == unix.EAGAIN {
+			break
+		}
+		if err != nil {
+			c.closeLocked(err.Error())
+			return
+		}
+		if n == 0 {
+			c.closeLocked("connection closed")
+			return
+		}
+		data := append([]byte(nil), c.buf[:n]...)
+		netpoll.AsyncWrite(c.s.poller, c.nc, data, func(_ int, err error) {
+			// Callback could be called by AsyncWrite() itself, while c.mu
+			// is held.
+			if err != nil {
+				go c.close(fmt.Sprintf("write error: %v", err))
+			}
+		})
+	}
+	if err := c.arm(); err != nil {
+		c.closeLocked(err.Error())
+	}
+}
+
+func (c *conn) onTimer(ev netpoll.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || ev&netpoll.EventPollerClosed != 0 {
+		return
+	}
+	var b [8]byte
+	_, err := unix.Read(c.timer.Fd(), b[:])
+	switch {
+	case err == unix.EAGAIN:
+		// Timer was disarmed or re-armed after the event was received.
+	case err != nil:
+		c.closeLocked(fmt.Sprintf("timer error: %v", err))
+	default:
+		c.closeLocked("read timeout")
+	}
+}
+
+func (c *conn) read() (int, error) {
+	for {
+		n, err := unix.Read(c.desc.Fd(), c.buf[:])
+		if err != unix.EINTR {
+			return n, err
+		}
+	}
+}
+
+// arm starts the timer, so it expires after the read timeout.
+func (c *conn) arm() error {
+	spec := unix.NsecToTimespec(int64(c.s.timeout))
+	return c.settime(unix.ItimerSpec{Value: spec})
+}
+
+// disarm stops the timer.
+func (c *conn) disarm() error {
+	return c.settime(unix.ItimerSpec{})
+}
+
+func (c *conn) settime(spec unix.ItimerSpec) error {
+	err := unix.TimerfdSettime(c.timer.Fd(), 0, &spec, nil)
+	return os.NewSyscallError("timerfd_settime", err)
+}
+
+// close removes the connection. It is safe to call it multiple times.
+func (c *conn) close(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(reason)
+}
+
+// closeLocked must be called with c.mu held.
+func (c *conn) closeLocked(reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.s.mu.Lock()
+	delete(c.s.conns, c)
+	c.s.mu.Unlock()
+
+	// Stop() returns ErrClosed when the poller is closed; registrations are
+	// released by the poller then.
+	c.s.poller.Stop(c.desc)
+	c.s.poller.Stop(c.timer)
+	c.desc.Close()
+	c.timer.Close()
+	c.nc.Close()
+	log.Printf("%s: closed: %s", c.name, reason)
+}
@@ -0,0 +1,121 @@
+// +build linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExampleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s, addr := start(t, timeout)
+
+	idle := dial(t, addr)
+	echo(t, idle, "hello")
+	begin := time.Now()
+	expectClosed(t, idle)
+	if d := time.Since(begin); d < timeout {
+		t.Errorf("idle connection is closed after %s; want at least %s", d, timeout)
+	}
+
+	// Each read re-arms the timer, so active connection is kept.
+	active := dial(t, addr)
+	for end := time.Now().Add(3 * timeout); time.Now().Before(end); {
+		echo(t, active, "ping")
+		time.Sleep(timeout / 3)
+	}
+	expectClosed(t, active)
+
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d connections are left in the registry", n)
+	}
+}
+
+func TestExampleTimeoutShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(ln, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.notify(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+
+	conn := dial(t, ln.Addr())
+	echo(t, conn, "hello")
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server is not shut down by signal")
+	}
+	expectClosed(t, conn)
+}
+
+func start(t *testing.T, timeout time.Duration) (*server, net.Addr) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newServer(ln, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+	t.Cleanup(func() {
+		s.shutdown()
+		if err := <-served; err != nil {
+			t.Errorf("serve() error: %v", err)
+		}
+	})
+	return s, ln.Addr()
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("received %q; want %q", buf, msg)
+	}
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() = %d, %v; want connection to be closed", n, err)
+	}
+}
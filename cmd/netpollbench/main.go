@@ -0,0 +1,343 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+/*
+Command netpollbench is a load testing and soak tool for netpoll pollers.
+
+It opens given number of loopback tcp connection pairs, registers server side
+of each pair in the poller and sends messages of given size and rate from the
+client side. Every report interval it prints events per second, received
+messages and bytes, dispatch and end-to-end latency percentiles, allocations
+per event and number of open files and goroutines:
+
+	netpollbench -conns 1000 -rate 100 -size 128 -mode pool -duration 1m
+
+Modes select how events are handled:
+
+	oneshot  descriptors are registered with EventOneShot; data is read in
+	         the callback and descriptor is resumed right after that.
+	edge     descriptors are registered with EventEdgeTriggered; data is read
+	         in the callback until EAGAIN.
+	pool     descriptors are registered with EventOneShot; callback only
+	         passes the connection to one of -workers goroutines, which read
+	         data and resume the descriptor.
+
+Dispatch latency is the time between the poller receiving an event (see
+netpoll.Desc.LastEvent(), which has millisecond precision) and the handler
+starting to read the connection. End-to-end latency is the time between the
+message is written by the client and is completely read by the handler.
+
+With -soak flag the tool runs for hours (8h unless -duration is given) and
+churns registrations: every -churn interval one of the pairs is stopped,
+closed and replaced by a new one, which reuses descriptors with the pool
+package. When the tool finishes, it closes all connections and the poller and
+exits with non-zero status if number of open files is not back to the one at
+start.
+
+The code is also an example of poller usage:
+
+  - callbacks are called by the poller's goroutine, so they must not block;
+    long work is passed to other goroutines, while descriptor is kept
+    one-shot to not receive events until the work is done;
+  - edge-triggered descriptors must be read until EAGAIN, while one-shot
+    ones could be read partially to not starve other connections;
+  - callback could still be running when Stop() returns, so the state it
+    uses must be guarded;
+  - connections are read with syscall.RawConn without blocking, so runtime
+    does not park the goroutine calling the callback.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+	"github.com/mailru/easygo/netpoll/pool"
+	"github.com/mailru/easygo/netpoll/telemetry"
+)
+
+var (
+	backend  = flag.String("backend", "", "poller backend: epoll, kqueue or poll (default is the best one for the platform)")
+	conns    = flag.Int("conns", 100, "number of connection pairs")
+	mode     = flag.String("mode", "oneshot", "event handling mode: oneshot, edge or pool")
+	workers  = flag.Int("workers", runtime.GOMAXPROCS(0), "number of workers in pool mode")
+	rate     = flag.Int("rate", 100, "messages per second sent to each connection; 0 means as fast as possible")
+	size     = flag.Int("size", 64, "message size in bytes, at least 8")
+	duration = flag.Duration("duration", 10*time.Second, "test duration")
+	report   = flag.Duration("report", time.Second, "report interval")
+	soak     = flag.Bool("soak", false, "soak mode: run for hours while churning registrations")
+	churn    = flag.Duration("churn", 0, "interval of replacing one connection pair with a new one; 0 disables churn")
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	flag.Parse()
+	if *soak {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		if !set["duration"] {
+			*duration = 8 * time.Hour
+		}
+		if !set["report"] {
+			*report = time.Minute
+		}
+		if !set["churn"] {
+			*churn = 10 * time.Millisecond
+		}
+	}
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	event, err := modeEvent(*mode)
+	if err != nil {
+		return err
+	}
+	if *conns <= 0 {
+		return fmt.Errorf("number of connections must be positive")
+	}
+	if *size < headerSize {
+		return fmt.Errorf("message size must be at least %d bytes", headerSize)
+	}
+	if *mode == "pool" && *workers <= 0 {
+		return fmt.Errorf("number of workers must be positive")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	// Files opened by the runtime and the listener are not counted as
+	// leaks.
+	baseline := openFiles()
+
+	p, err := netpoll.New(&netpoll.Config{
+		Backend: netpoll.Backend(*backend),
+	})
+	if err != nil {
+		return err
+	}
+	b := &bench{
+		ln:     ln,
+		poller: telemetry.Wrap(p),
+		conns:  pool.New(event),
+	}
+	if *mode == "pool" {
+		// Each registered connection is queued at most once, because its
+		// descriptor is one-shot. So the queue does not fill up and callbacks
+		// do not block the poller.
+		b.work = make(chan *pair, *conns)
+		for i := 0; i < *workers; i++ {
+			b.wg.Add(1)
+			go b.worker()
+		}
+	}
+	log.Printf(
+		"backend=%s mode=%s conns=%d rate=%d size=%d duration=%s churn=%s",
+		p, *mode, *conns, *rate, *size, *duration, *churn,
+	)
+
+	pairs := make([]*pair, 0, *conns)
+	cleanup := func() {
+		for _, x := range pairs {
+			b.stop(x)
+		}
+		b.poller.Close()
+		if b.work != nil {
+			close(b.work)
+			b.wg.Wait()
+		}
+	}
+	for len(pairs) < *conns {
+		x, err := b.start()
+		if err != nil {
+			cleanup()
+			return err
+		}
+		pairs = append(pairs, x)
+	}
+
+	var (
+		deadline = time.After(*duration)
+		reports  = time.NewTicker(*report)
+		churns   <-chan time.Time
+		churned  uint64
+	)
+	defer reports.Stop()
+	if *churn > 0 {
+		t := time.NewTicker(*churn)
+		defer t.Stop()
+		churns = t.C
+	}
+	r := newReporter(b)
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-reports.C:
+			r.report(len(pairs), churned)
+		case <-churns:
+			i := rand.Intn(len(pairs))
+			b.stop(pairs[i])
+			x, err := b.start()
+			if err != nil {
+				pairs = append(pairs[:i], pairs[i+1:]...)
+				cleanup()
+				return err
+			}
+			pairs[i] = x
+			churned++
+		}
+	}
+	r.report(len(pairs), churned)
+	cleanup()
+
+	if n := atomic.LoadUint64(&b.errors); n > 0 {
+		log.Printf("%d errors occurred", n)
+	}
+	runtime.GC()
+	if n := openFiles(); n > baseline {
+		return fmt.Errorf("%d files are open after cleanup; want %d", n, baseline)
+	}
+	return nil
+}
+
+// modeEvent returns descriptor event for given handling mode.
+func modeEvent(mode string) (netpoll.Event, error) {
+	switch mode {
+	case "oneshot", "pool":
+		return netpoll.EventRead | netpoll.EventOneShot, nil
+	case "edge":
+		return netpoll.EventRead | netpoll.EventEdgeTriggered, nil
+	default:
+		return 0, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// reporter prints metrics collected since the previous report.
+type reporter struct {
+	b      *bench
+	last   time.Time
+	events uint64
+	msgs   uint64
+	bytes  uint64
+	allocs uint64
+}
+
+func newReporter(b *bench) *reporter {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return &reporter{
+		b:      b,
+		last:   time.Now(),
+		allocs: mem.Mallocs,
+	}
+}
+
+func (r *reporter) report(conns int, churned uint64) {
+	var (
+		now    = time.Now()
+		sec    = now.Sub(r.last).Seconds()
+		snap   = r.b.poller.Snapshot()
+		events = snap.Events[netpoll.EventRead]
+		msgs   = atomic.LoadUint64(&r.b.msgs)
+		bytes  = atomic.LoadUint64(&r.b.bytes)
+		mem    runtime.MemStats
+	)
+	runtime.ReadMemStats(&mem)
+
+	var allocs float64
+	if n := events - r.events; n > 0 {
+		allocs = float64(mem.Mallocs-r.allocs) / float64(n)
+	}
+	dp50, dp99 := r.b.dispatch.percentiles()
+	ep50, ep99 := r.b.latency.percentiles()
+	log.Printf(
+		"conns=%d churned=%d events/s=%.0f msgs/s=%.0f MB/s=%.2f "+
+			"dispatch p50=%s p99=%s e2e p50=%s p99=%s callback p99=%s "+
+			"allocs/event=%.2f heap=%dKB files=%d goroutines=%d errors=%d",
+		conns, churned,
+		float64(events-r.events)/sec,
+		float64(msgs-r.msgs)/sec,
+		float64(bytes-r.bytes)/sec/(1<<20),
+		dp50, dp99, ep50, ep99, snap.CallbackLatencyP99,
+		allocs, mem.HeapAlloc>>10, openFiles(), runtime.NumGoroutine(),
+		atomic.LoadUint64(&r.b.errors),
+	)
+	r.last = now
+	r.events = events
+	r.msgs = msgs
+	r.bytes = bytes
+	r.allocs = mem.Mallocs
+}
+
+// openFiles returns number of files opened by the process.
+func openFiles() int {
+	d, err := os.Open("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// Directory itself is not counted.
+	return len(names) - 1
+}
+
+// samples is the number of last latency samples used to compute
+// percentiles.
+const samples = 8192
+
+// recorder holds last latency samples since the previous percentiles()
+// call.
+type recorder struct {
+	mu      sync.Mutex
+	samples [samples]time.Duration
+	n       int
+}
+
+func (r *recorder) add(d time.Duration) {
+	r.mu.Lock()
+	r.samples[r.n%samples] = d
+	r.n++
+	r.mu.Unlock()
+}
+
+// percentiles returns 50th and 99th percentiles and resets the recorder.
+func (r *recorder) percentiles() (p50, p99 time.Duration) {
+	r.mu.Lock()
+	n := r.n
+	if n > samples {
+		n = samples
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, r.samples[:n])
+	r.n = 0
+	r.mu.Unlock()
+
+	if n == 0 {
+		return 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[(n-1)*50/100], sorted[(n-1)*99/100]
+}
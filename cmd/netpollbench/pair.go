@@ -0,0 +1,262 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll"
+	"github.com/mailru/easygo/netpoll/pool"
+	"github.com/mailru/easygo/netpoll/telemetry"
+)
+
+// headerSize is the size of message header which holds the time the message
+// is sent at in unix nanoseconds.
+const headerSize = 8
+
+// readSize is the size of buffer the connection is read with.
+const readSize = 64 << 10
+
+// maxReads limits number of reads made on single event of a one-shot
+// descriptor. The rest of data is read on the next event, which is received
+// right after Resume().
+const maxReads = 16
+
+// bench holds state shared by all connection pairs.
+type bench struct {
+	ln     net.Listener
+	poller *telemetry.TelemetryPoller
+	conns  *pool.ConnPool
+
+	work chan *pair
+	wg   sync.WaitGroup
+
+	msgs   uint64
+	bytes  uint64
+	errors uint64
+
+	dispatch recorder
+	latency  recorder
+}
+
+// pair is a loopback connection pair. Server side is handled by the poller,
+// while client side sends messages.
+type pair struct {
+	b      *bench
+	pc     *pool.PooledConn
+	client net.Conn
+	rc     syscall.RawConn
+	stop   chan struct{}
+	done   chan struct{}
+
+	// mu guards the fields below. Callback is not synchronized with Stop(),
+	// so it must check closed field before touching the connection.
+	mu     sync.Mutex
+	closed bool
+	buf    []byte
+	pos    int
+	header [headerSize]byte
+
+	// State of read(2) made by rc, kept to avoid allocations.
+	readFn func(uintptr) bool
+	rn     int
+	rerr   error
+}
+
+// start opens new connection pair, registers it in the poller and starts
+// sending messages.
+func (b *bench) start() (*pair, error) {
+	client, err := net.Dial("tcp", b.ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	server, err := b.ln.Accept()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	rc, err := server.(syscall.Conn).SyscallConn()
+	if err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	pc, err := b.conns.Handle(server)
+	if err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	p := &pair{
+		b:      b,
+		pc:     pc,
+		client: client,
+		rc:     rc,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		buf:    make([]byte, readSize),
+	}
+	p.readFn = func(fd uintptr) bool {
+		for {
+			p.rn, p.rerr = unix.Read(int(fd), p.buf)
+			if p.rerr != unix.EINTR {
+				break
+			}
+		}
+		// Do not wait for readiness.
+		return true
+	}
+	err = b.poller.StartWithOptions(pc.Desc(), p.onEvent, netpoll.WithOnError(b.onError))
+	if err != nil {
+		client.Close()
+		b.conns.Put(pc)
+		return nil, err
+	}
+	go p.send()
+	return p, nil
+}
+
+// stop deregisters and closes the pair. The pooled connection is returned to
+// the pool, so its descriptor is reused by further start() calls.
+func (b *bench) stop(p *pair) {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	if err := b.poller.Stop(p.pc.Desc()); err != nil {
+		b.onError(err)
+	}
+	close(p.stop)
+	p.client.Close()
+	<-p.done
+	b.conns.Put(p.pc)
+}
+
+func (b *bench) onError(err error) {
+	if atomic.AddUint64(&b.errors, 1) == 1 {
+		log.Printf("first error: %v", err)
+	}
+}
+
+// worker handles connections passed by callbacks in pool mode.
+func (b *bench) worker() {
+	defer b.wg.Done()
+	for p := range b.work {
+		p.handle(true)
+	}
+}
+
+func (p *pair) onEvent(ev netpoll.Event) {
+	if ev&netpoll.EventPollerClosed != 0 {
+		return
+	}
+	switch {
+	case p.b.work != nil:
+		p.b.work <- p
+	case p.pc.Desc().Event()&netpoll.EventOneShot != 0:
+		p.handle(true)
+	default:
+		p.handle(false)
+	}
+}
+
+// handle reads data and resumes one-shot descriptor if resume is true.
+// Otherwise descriptor is edge-triggered, so all available data is read.
+func (p *pair) handle(resume bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	desc := p.pc.Desc()
+	if _, at := desc.LastEvent(); !at.IsZero() {
+		p.b.dispatch.add(time.Since(at))
+	}
+	for i := 0; !resume || i < maxReads; i++ {
+		if err := p.rc.Read(p.readFn); err != nil {
+			p.b.onError(err)
+			return
+		}
+		if p.rerr == unix.EAGAIN {
+			break
+		}
+		if p.rerr != nil {
+			p.b.onError(p.rerr)
+			return
+		}
+		if p.rn == 0 {
+			// Connection is closed by the peer. Descriptor is left
+			// unarmed until stop().
+			p.b.onError(errors.New("unexpected EOF"))
+			return
+		}
+		p.consume(p.buf[:p.rn])
+	}
+	if resume {
+		if err := p.b.poller.Resume(desc); err != nil {
+			p.b.onError(err)
+		}
+	}
+}
+
+// consume splits data into messages and records their latency.
+func (p *pair) consume(data []byte) {
+	atomic.AddUint64(&p.b.bytes, uint64(len(data)))
+	for len(data) > 0 {
+		n := *size - p.pos
+		if n > len(data) {
+			n = len(data)
+		}
+		if p.pos < headerSize {
+			copy(p.header[p.pos:], data[:n])
+		}
+		p.pos += n
+		data = data[n:]
+		if p.pos < *size {
+			return
+		}
+		sent := int64(binary.BigEndian.Uint64(p.header[:]))
+		p.b.latency.add(time.Since(time.Unix(0, sent)))
+		atomic.AddUint64(&p.b.msgs, 1)
+		p.pos = 0
+	}
+}
+
+// send writes messages to the client side until stop() is called.
+func (p *pair) send() {
+	defer close(p.done)
+	var tick <-chan time.Time
+	if *rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(*rate))
+		defer t.Stop()
+		tick = t.C
+	}
+	msg := make([]byte, *size)
+	for {
+		if tick != nil {
+			select {
+			case <-p.stop:
+				return
+			case <-tick:
+			}
+		}
+		binary.BigEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+		if _, err := p.client.Write(msg); err != nil {
+			select {
+			case <-p.stop:
+			default:
+				p.b.onError(err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package netpoll
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// PartialReadError is passed to AsyncReadFull() callback when buffer could
+// not be filled. It holds number of bytes read before the error.
+type PartialReadError struct {
+	// N is the number of bytes read into the beginning of the buffer.
+	N int
+	// Err is io.EOF if connection is closed before any byte is read,
+	// io.ErrUnexpectedEOF if it is closed after that, or other error which
+	// stopped reading.
+	Err error
+}
+
+func (e *PartialReadError) Error() string {
+	return fmt.Sprintf("read %d bytes: %v", e.N, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *PartialReadError) Unwrap() error {
+	return e.Err
+}
+
+// AsyncReadFull reads exactly len(buf) bytes from conn without blocking.
+// It registers one-shot read descriptor for conn in p and reads available
+// data on each event, until buf is full. Then the descriptor is stopped and
+// closed, and done is called with nil error. If buf could not be filled,
+// done is called with *PartialReadError.
+//
+// Returned cancel function stops reading at once. After it is called, done is
+// not called, unless it is already being called. Data read before that stays
+// in buf.
+//
+// Note that descriptor is created with Options.SetNonblock, so conn is put
+// into non-blocking mode, which is the mode of connections created by net
+// package anyway. Caller must not read conn or touch buf until done is
+// called or reading is canceled.
+func AsyncReadFull(p Poller, conn net.Conn, buf []byte, done func(err error)) (cancel func()) {
+	if len(buf) == 0 {
+		done(nil)
+		return func() {}
+	}
+	desc, err := HandleWithOptions(conn, EventRead|EventOneShot, Options{SetNonblock: true})
+	if err != nil {
+		done(&PartialReadError{Err: err})
+		return func() {}
+	}
+	r := &asyncReader{
+		p:    p,
+		desc: desc,
+		buf:  buf,
+		done: done,
+	}
+	if err = p.Start(desc, r.onRead); err != nil {
+		desc.Close()
+		done(&PartialReadError{Err: err})
+		return func() {}
+	}
+	return r.cancel
+}
+
+type asyncReader struct {
+	p    Poller
+	desc *Desc
+	buf  []byte
+	done func(error)
+
+	// mu guards fields below. It is held while data is read, so cancel()
+	// does not return before the callback stops touching buf.
+	mu       sync.Mutex
+	n        int
+	finished bool
+}
+
+func (r *asyncReader) onRead(ev Event) {
+	r.mu.Lock()
+	if r.finished {
+		r.mu.Unlock()
+		return
+	}
+	var err error
+	if ev&EventPollerClosed != 0 {
+		err = ErrClosed
+	} else {
+		// Hangup and errors are reported by read(2).
+		err = r.read()
+	}
+	if err == errAgain {
+		if err = r.p.Resume(r.desc); err == nil {
+			r.mu.Unlock()
+			return
+		}
+	}
+	r.finish()
+	n := r.n
+	r.mu.Unlock()
+
+	if err != nil {
+		err = &PartialReadError{N: n, Err: err}
+	}
+	r.done(err)
+}
+
+// read reads data until buf is full. It returns errAgain if there is no data
+// available yet.
+func (r *asyncReader) read() error {
+	for r.n < len(r.buf) {
+		n, err := readNonblock(uintptr(r.desc.fd()), r.buf[r.n:])
+		if err == errAgain {
+			return err
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+		if n == 0 {
+			if r.n == 0 {
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+		r.n += n
+	}
+	return nil
+}
+
+func (r *asyncReader) cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.finished {
+		r.finish()
+	}
+}
+
+// finish deregisters and closes the descriptor. It must be called with r.mu
+// held.
+func (r *asyncReader) finish() {
+	r.finished = true
+	// Stop() returns ErrClosed when the poller is closed; registration is
+	// released by the poller then.
+	r.p.Stop(r.desc)
+	r.desc.Close()
+}
@@ -0,0 +1,208 @@
+package netpoll
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// AsyncWrite writes data to conn without blocking. It makes non-blocking
+// write right away, and only if data could not be written completely, the
+// rest is written when p reports EventWrite of a one-shot descriptor created
+// for conn. Then the descriptor is stopped and closed, and done is called
+// with number of written bytes and the write error, if any. Note that done
+// could be called before AsyncWrite returns.
+//
+// Writes to the same conn made while previous ones are not done are queued
+// and performed in the order of AsyncWrite calls, so data is not interleaved;
+// if one of them fails, the rest are done with the same error. Caller must
+// not modify data until done is called.
+//
+// Note that conn must implement syscall.Conn or Filer (possibly through a
+// wrapper, see Handle()) and be comparable, as it is used to find the queue.
+func AsyncWrite(p Poller, conn net.Conn, data []byte, done func(n int, err error)) {
+	asyncWriters.mu.Lock()
+	if w, ok := asyncWriters.m[conn]; ok {
+		w.queue = append(w.queue, &asyncWrite{data: data, done: done})
+		asyncWriters.mu.Unlock()
+		return
+	}
+	write, err := rawWriter(conn)
+	if err != nil {
+		asyncWriters.mu.Unlock()
+		done(0, err)
+		return
+	}
+	w := &asyncWriter{
+		p:     p,
+		conn:  conn,
+		write: write,
+		queue: []*asyncWrite{{data: data, done: done}},
+	}
+	if asyncWriters.m == nil {
+		asyncWriters.m = make(map[net.Conn]*asyncWriter)
+	}
+	asyncWriters.m[conn] = w
+	asyncWriters.mu.Unlock()
+
+	w.run()
+}
+
+// asyncWriters holds queues of connections which have AsyncWrite() calls in
+// progress.
+var asyncWriters struct {
+	mu sync.Mutex
+	m  map[net.Conn]*asyncWriter
+}
+
+type asyncWrite struct {
+	data []byte
+	n    int
+	done func(int, error)
+}
+
+// asyncWriter writes queued data to conn. Its run() method is called by a
+// single goroutine at a time: first by AsyncWrite() and then by the poller
+// after descriptor is armed. The queue is guarded by asyncWriters.mu, since
+// new writes are appended concurrently.
+type asyncWriter struct {
+	p     Poller
+	conn  net.Conn
+	write func([]byte) (int, error)
+	desc  *Desc
+	queue []*asyncWrite
+}
+
+// run writes queued data until the queue is empty or socket is not ready.
+func (w *asyncWriter) run() {
+	for {
+		asyncWriters.mu.Lock()
+		x := w.queue[0]
+		asyncWriters.mu.Unlock()
+
+		n, err := w.write(x.data[x.n:])
+		x.n += n
+		if err == errAgain {
+			if err = w.arm(); err == nil {
+				return
+			}
+		}
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		asyncWriters.mu.Lock()
+		done, n := x.done, x.n
+		w.queue = w.queue[1:]
+		last := len(w.queue) == 0
+		if last {
+			delete(asyncWriters.m, w.conn)
+		}
+		asyncWriters.mu.Unlock()
+
+		if last {
+			w.release()
+		}
+		done(n, nil)
+		if last {
+			return
+		}
+	}
+}
+
+// arm starts waiting for EventWrite.
+func (w *asyncWriter) arm() error {
+	if w.desc != nil {
+		return w.p.Resume(w.desc)
+	}
+	desc, err := HandleWriteOnce(w.conn)
+	if err != nil {
+		return err
+	}
+	if err = w.p.Start(desc, w.onWrite); err != nil {
+		desc.Close()
+		return err
+	}
+	w.desc = desc
+	return nil
+}
+
+func (w *asyncWriter) onWrite(ev Event) {
+	if ev&EventPollerClosed != 0 {
+		w.fail(ErrClosed)
+		return
+	}
+	// Hangup and errors are reported by write(2).
+	w.run()
+}
+
+// fail calls all queued callbacks with err.
+func (w *asyncWriter) fail(err error) {
+	asyncWriters.mu.Lock()
+	queue := w.queue
+	w.queue = nil
+	delete(asyncWriters.m, w.conn)
+	asyncWriters.mu.Unlock()
+
+	w.release()
+	for _, x := range queue {
+		x.done(x.n, err)
+	}
+}
+
+func (w *asyncWriter) release() {
+	if w.desc != nil {
+		w.p.Stop(w.desc)
+		w.desc.Close()
+		w.desc = nil
+	}
+}
+
+// rawWriter returns function making non-blocking writes to conn's file
+// descriptor.
+func rawWriter(conn net.Conn) (func([]byte) (int, error), error) {
+	if err := platformError(); err != nil {
+		return nil, err
+	}
+	var rc syscall.RawConn
+	switch x := unwrap(conn, isSyscallConn).(type) {
+	case Filer:
+		fd, err := filerFd(x)
+		if err != nil {
+			return nil, err
+		}
+		return func(p []byte) (int, error) {
+			return nonblockWrite(fd, p)
+		}, nil
+	case syscall.Conn:
+		var err error
+		if rc, err = x.SyscallConn(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrNotFiler
+	}
+	return func(p []byte) (n int, err error) {
+		cerr := rc.Write(func(fd uintptr) bool {
+			n, err = nonblockWrite(int(fd), p)
+			// Do not wait for readiness.
+			return true
+		})
+		if cerr != nil {
+			return n, cerr
+		}
+		return n, err
+	}, nil
+}
+
+// nonblockWrite writes p to fd. It returns errAgain if fd is not ready, and
+// the write error wrapped into os.SyscallError otherwise.
+func nonblockWrite(fd int, p []byte) (int, error) {
+	n, err := writeNonblock(fd, p)
+	if err != nil && err != errAgain {
+		err = os.NewSyscallError("write", err)
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package netpoll
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrBackendRegistered is returned by RegisterBackend() when backend with
+	// the same name is already registered.
+	ErrBackendRegistered = fmt.Errorf("backend is already registered")
+
+	// ErrBackendReserved is returned by RegisterBackend() when the name is
+	// empty or is reserved by built-in backends.
+	ErrBackendReserved = fmt.Errorf("backend name is reserved")
+)
+
+// BackendFactory creates Poller with given config. Config passed to it has
+// defaults applied, e.g. non-nil ErrorLog.
+type BackendFactory func(*Config) (Poller, error)
+
+// registry holds backends added by RegisterBackend(). It is initialized
+// statically, so RegisterBackend() could be called from init() functions of
+// other packages.
+var registry = struct {
+	mu        sync.RWMutex
+	factories map[Backend]BackendFactory
+}{
+	factories: make(map[Backend]BackendFactory),
+}
+
+// RegisterBackend makes poller implementation available by given name, so
+// New() uses factory when Config.Backend is equal to the name.
+// It is intended to be called from init() of the package implementing the
+// backend. It is safe to call it concurrently with New().
+//
+// Built-in backend names and "auto" are reserved; ErrBackendReserved is
+// returned for them. ErrBackendRegistered is returned if name is already
+// registered.
+func RegisterBackend(name string, factory func(*Config) (Poller, error)) error {
+	b := Backend(name)
+	switch b {
+	case BackendAuto, "auto", BackendEpoll, BackendKqueue, BackendPoll, BackendURing, BackendPollOneoff:
+		return ErrBackendReserved
+	}
+	if factory == nil {
+		return fmt.Errorf("netpoll: nil factory for %q backend", name)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, has := registry.factories[b]; has {
+		return ErrBackendRegistered
+	}
+	registry.factories[b] = factory
+	return nil
+}
+
+// Backends returns sorted names of backends available on current operating
+// system, including registered ones.
+func Backends() []string {
+	registry.mu.RLock()
+	names := make([]string, 0, len(builtinBackends)+len(registry.factories))
+	for b := range registry.factories {
+		names = append(names, string(b))
+	}
+	registry.mu.RUnlock()
+
+	for _, b := range builtinBackends {
+		names = append(names, string(b))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// registered returns poller created by the registered factory of the
+// config's backend. It returns false if backend is not registered.
+func registered(cfg Config) (Poller, bool, error) {
+	registry.mu.RLock()
+	factory, has := registry.factories[cfg.Backend]
+	registry.mu.RUnlock()
+	if !has {
+		return nil, false, nil
+	}
+	p, err := factory(&cfg)
+	return p, true, err
+}
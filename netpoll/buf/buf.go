@@ -0,0 +1,224 @@
+/*
+Package buf provides preallocated scatter-gather buffer for reading and
+writing connections from netpoll callbacks.
+
+Buffer holds a fixed list of chunks allocated once. Data is read into the
+free space of all chunks by single readv(2) call and written by writev(2):
+
+	b := buf.New(4, 4096)
+	poller.Start(desc, buf.ReadReady(conn, b, func(ev netpoll.Event, b *buf.Buffer, err error) {
+		if err != nil {
+			// handle error
+		}
+		b.WriteTo(dst)
+	}))
+
+Thus callbacks do not need to allocate memory for each read.
+*/
+package buf
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// ErrFull is returned by Buffer.ReadOnce() when there is no free space in the
+// buffer.
+var ErrFull = fmt.Errorf("buffer is full")
+
+// Buffer is a scatter-gather buffer of fixed number of chunks.
+// It is not goroutine safe.
+type Buffer struct {
+	chunks [][]byte
+	size   int
+	n      int
+
+	// iovs and bufs are reused to avoid allocations.
+	iovs [][]byte
+	bufs net.Buffers
+
+	// Last used connection and state of the readv call. They are kept to not
+	// allocate raw connection and closure on each read.
+	conn   syscall.Conn
+	rc     syscall.RawConn
+	readFn func(uintptr) bool
+	rn     int
+	rerr   error
+}
+
+// New creates Buffer of n chunks, each of given size.
+func New(n, size int) *Buffer {
+	mem := make([]byte, n*size)
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		chunks[i] = mem[i*size : (i+1)*size : (i+1)*size]
+	}
+	b := &Buffer{
+		chunks: chunks,
+		size:   size,
+		iovs:   make([][]byte, 0, n),
+		bufs:   make(net.Buffers, 0, n),
+	}
+	b.readFn = func(fd uintptr) bool {
+		b.rn, b.rerr = readv(fd, b.iovs)
+		// Do not wait for readiness.
+		return true
+	}
+	return b
+}
+
+// Len returns number of buffered bytes.
+func (b *Buffer) Len() int {
+	return b.n
+}
+
+// Cap returns total capacity of the buffer.
+func (b *Buffer) Cap() int {
+	return len(b.chunks) * b.size
+}
+
+// Reset discards all buffered data.
+func (b *Buffer) Reset() {
+	b.n = 0
+}
+
+// Buffers returns buffered data as net.Buffers. Returned value is valid until
+// the next call of any Buffer method.
+func (b *Buffer) Buffers() net.Buffers {
+	bufs := b.bufs[:0]
+	for rest, i := b.n, 0; rest > 0; i++ {
+		c := b.chunks[i]
+		if rest < len(c) {
+			c = c[:rest]
+		}
+		bufs = append(bufs, c)
+		rest -= len(c)
+	}
+	b.bufs = bufs
+	return bufs
+}
+
+// Bytes returns a copy of buffered data.
+func (b *Buffer) Bytes() []byte {
+	p := make([]byte, 0, b.n)
+	for _, c := range b.Buffers() {
+		p = append(p, c...)
+	}
+	return p
+}
+
+// free returns free space of the buffer as a list of slices.
+func (b *Buffer) free() [][]byte {
+	iovs := b.iovs[:0]
+	i, off := b.n/b.size, b.n%b.size
+	for ; i < len(b.chunks); i++ {
+		iovs = append(iovs, b.chunks[i][off:])
+		off = 0
+	}
+	b.iovs = iovs
+	return iovs
+}
+
+// ReadOnce reads available data from r into the free space of the buffer.
+//
+// It is not an io.ReaderFrom: it does not read until io.EOF. If r implements
+// syscall.Conn, which is true for connections from the net package, it makes
+// single non-blocking readv(2) call and returns zero and nil error if there is
+// no data available yet. Otherwise single Read() call is made.
+//
+// It returns io.EOF if end of stream is reached and ErrFull if the buffer has
+// no free space.
+func (b *Buffer) ReadOnce(r io.Reader) (n int, err error) {
+	iovs := b.free()
+	if len(iovs) == 0 {
+		return 0, ErrFull
+	}
+	var m int
+	if sc, ok := r.(syscall.Conn); ok {
+		m, err = b.readv(sc)
+	} else {
+		m, err = r.Read(iovs[0])
+		if m == 0 && err == nil {
+			err = io.ErrNoProgress
+		}
+	}
+	b.n += m
+	return m, err
+}
+
+// readv reads into b.iovs.
+func (b *Buffer) readv(sc syscall.Conn) (n int, err error) {
+	if b.conn != sc {
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		b.conn, b.rc = sc, rc
+	}
+	err = b.rc.Read(b.readFn)
+	n, rerr := b.rn, b.rerr
+	b.rerr = nil
+	switch {
+	case err != nil:
+		return 0, err
+	case rerr == errAgain:
+		return 0, nil
+	case rerr != nil:
+		return 0, rerr
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo writes buffered data to w and resets the buffer. Data is written by
+// writev(2) when w is a connection from the net package.
+//
+// If not all data was written, the rest is kept in the buffer.
+func (b *Buffer) WriteTo(w io.Writer) (n int64, err error) {
+	bufs := b.Buffers()
+	n, err = bufs.WriteTo(w)
+	b.discard(int(n))
+	return n, err
+}
+
+// discard removes first n bytes from the buffer.
+func (b *Buffer) discard(n int) {
+	if n >= b.n {
+		b.n = 0
+		return
+	}
+	// Move the rest to the beginning. It happens on partial writes only.
+	rest := b.Bytes()[n:]
+	b.n = 0
+	for i := 0; len(rest) > 0; i++ {
+		m := copy(b.chunks[i], rest)
+		rest = rest[m:]
+		b.n += m
+	}
+}
+
+// ReadReadyFn is a callback which receives data read from the connection into
+// preallocated buffer.
+type ReadReadyFn func(ev netpoll.Event, b *Buffer, err error)
+
+// ReadReady returns netpoll.CallbackFn which reads available data from conn
+// into b on read events and calls fn with it. Events which are not related
+// to reading are passed to fn with nil error and unchanged b.
+//
+// Note that fn must consume the data (e.g. by calling b.WriteTo() or
+// b.Reset()), otherwise the buffer eventually becomes full and fn receives
+// ErrFull.
+func ReadReady(conn net.Conn, b *Buffer, fn ReadReadyFn) netpoll.CallbackFn {
+	return func(ev netpoll.Event) {
+		var err error
+		if ev&(netpoll.EventRead|netpoll.EventReadHup) != 0 {
+			_, err = b.ReadOnce(conn)
+		}
+		fn(ev, b, err)
+	}
+}
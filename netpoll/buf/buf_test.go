@@ -0,0 +1,177 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package buf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+func TestBufferReadWrite(t *testing.T) {
+	src, dst := connPair(t)
+
+	data := []byte("hello, scatter-gather world")
+	if _, err := src.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks are smaller than data to make readv fill several of them.
+	b := New(4, 8)
+	var n int
+	for n < len(data) {
+		m, err := b.ReadOnce(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if act := b.Bytes(); !bytes.Equal(act, data) {
+		t.Fatalf("read %q; want %q", act, data)
+	}
+	if bufs := b.Buffers(); len(bufs) != 4 {
+		t.Fatalf("data is stored in %d chunks; want 4", len(bufs))
+	}
+
+	// No data available: must not block.
+	if m, err := b.ReadOnce(dst); m != 0 || err != nil {
+		t.Fatalf("ReadOnce() = %d, %v; want 0, nil", m, err)
+	}
+
+	if _, err := b.WriteTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("Len() after WriteTo() is %d; want 0", b.Len())
+	}
+	p := make([]byte, len(data))
+	src.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(src, p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data) {
+		t.Fatalf("written %q; want %q", p, data)
+	}
+}
+
+func TestBufferFullAndEOF(t *testing.T) {
+	src, dst := connPair(t)
+
+	b := New(1, 4)
+	if _, err := src.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if n, err := b.ReadOnce(dst); n != 4 || err != nil {
+		t.Fatalf("ReadOnce() = %d, %v; want 4, nil", n, err)
+	}
+	if _, err := b.ReadOnce(dst); err != ErrFull {
+		t.Fatalf("ReadOnce() error is %v; want %v", err, ErrFull)
+	}
+	b.Reset()
+	if n, err := b.ReadOnce(dst); n != 1 || err != nil {
+		t.Fatalf("ReadOnce() = %d, %v; want 1, nil", n, err)
+	}
+	if _, err := b.ReadOnce(dst); err != io.EOF {
+		t.Fatalf("ReadOnce() error is %v; want %v", err, io.EOF)
+	}
+}
+
+func TestReadReady(t *testing.T) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(netpoll.Closer).Close()
+
+	src, dst := connPair(t)
+	desc, err := netpoll.HandleRead(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	received := make(chan []byte, 1)
+	b := New(2, 16)
+	err = poller.Start(desc, ReadReady(dst, b, func(ev netpoll.Event, b *Buffer, err error) {
+		if err != nil || b.Len() == 0 {
+			return
+		}
+		received <- b.Bytes()
+		b.Reset()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = src.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if string(p) != "ping" {
+			t.Fatalf("received %q; want %q", p, "ping")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no data received")
+	}
+}
+
+func BenchmarkReadReady(b *testing.B) {
+	benchmarkRead(b, func(conn net.Conn) func() {
+		buf := New(4, 1024)
+		return func() {
+			buf.ReadOnce(conn)
+			buf.Reset()
+		}
+	})
+}
+
+func BenchmarkReadAlloc(b *testing.B) {
+	benchmarkRead(b, func(conn net.Conn) func() {
+		return func() {
+			p := make([]byte, 4096)
+			conn.Read(p)
+		}
+	})
+}
+
+func benchmarkRead(b *testing.B, reader func(net.Conn) func()) {
+	src, dst := connPair(b)
+	read := reader(dst)
+	data := make([]byte, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.Write(data)
+		read()
+	}
+}
+
+// connPair returns connected pair of unix stream connections.
+func connPair(tb testing.TB) (net.Conn, net.Conn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		conns[i] = conn
+		tb.Cleanup(func() { conn.Close() })
+	}
+	return conns[0], conns[1]
+}
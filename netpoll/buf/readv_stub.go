@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package buf
+
+import "fmt"
+
+func readv(fd uintptr, iovs [][]byte) (n int, err error) {
+	return 0, fmt.Errorf("readv is not supported on this operating system")
+}
+
+// errAgain is never returned on current operating system.
+var errAgain = fmt.Errorf("operation would block")
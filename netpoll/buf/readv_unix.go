@@ -0,0 +1,45 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package buf
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// errAgain is returned by non-blocking reads when there is no data.
+var errAgain error = syscall.EAGAIN
+
+// minIovec is a number of iovecs allocated on stack by readv.
+const minIovec = 8
+
+// readv makes readv(2) call for fd. It retries on EINTR.
+func readv(fd uintptr, iovs [][]byte) (n int, err error) {
+	var arr [minIovec]unix.Iovec
+	vecs := arr[:0]
+	for _, p := range iovs {
+		if len(p) == 0 {
+			continue
+		}
+		v := unix.Iovec{Base: &p[0]}
+		v.SetLen(len(p))
+		vecs = append(vecs, v)
+	}
+	if len(vecs) == 0 {
+		return 0, nil
+	}
+	for {
+		r, _, errno := unix.Syscall(unix.SYS_READV, fd,
+			uintptr(unsafe.Pointer(&vecs[0])), uintptr(len(vecs)),
+		)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, syscall.Errno(errno)
+		}
+		return int(r), nil
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Package bufio provides buffered writer which flushes data when the socket
+becomes writable, and buffered reader which is filled when it is readable.
+
+Writer never blocks. When socket buffer is full, Writer registers its
+descriptor in the poller for EventWrite and continues flushing when the event
+fires:
+
+	w, err := bufio.NewWriter(conn, poller)
+	if err != nil {
+		// handle error
+	}
+	w.Write(header)
+	w.Write(body)
+	if err := w.Flush(); err != nil {
+		// handle error
+	}
+
+Reader is its counterpart for reading: poller callback fills its buffer
+without blocking, and the application consumes buffered data, pausing the
+descriptor while too much of it is buffered. See Reader for example.
+*/
+package bufio
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+var (
+	// ErrFull is returned by Writer.Write() when data could not be put
+	// into the buffer because socket is not ready for writing.
+	ErrFull = fmt.Errorf("bufio: buffer is full")
+
+	// ErrClosed is returned by Writer methods after Close().
+	ErrClosed = fmt.Errorf("bufio: writer is closed")
+
+	// ErrPollerClosed is returned by Writer methods when poller is closed
+	// while data is waiting for socket readiness.
+	ErrPollerClosed = fmt.Errorf("bufio: poller is closed")
+)
+
+// DefaultSize is the size of the buffer used by NewWriter().
+const DefaultSize = 4096
+
+// Writer implements buffering for a net.Conn. It is safe for concurrent
+// use.
+type Writer struct {
+	conn   net.Conn
+	rc     syscall.RawConn
+	poller netpoll.Poller
+	desc   *netpoll.Desc
+
+	mu      sync.Mutex
+	closed  bool
+	err     error
+	started bool
+	armed   bool
+	// space is closed and replaced when buffered data is written.
+	space chan struct{}
+
+	// buf contains data to be written in buf[r:w].
+	buf []byte
+	r   int
+	w   int
+
+	// State of write(2) made by rc, kept to avoid allocations.
+	writeFn func(uintptr) bool
+	src     []byte
+	wn      int
+	werr    error
+}
+
+// NewWriter creates Writer with buffer of DefaultSize bytes.
+func NewWriter(conn net.Conn, poller netpoll.Poller) (*Writer, error) {
+	return NewWriterSize(conn, poller, DefaultSize)
+}
+
+// NewWriterSize creates Writer with buffer of at least size bytes.
+// Socket readiness is waited using given poller.
+//
+// Note that conn should not be written directly after this call.
+func NewWriterSize(conn net.Conn, poller netpoll.Poller, size int) (*Writer, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("bufio: %T does not implement syscall.Conn", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := netpoll.HandleWriteOnce(conn)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = DefaultSize
+	}
+	w := &Writer{
+		conn:   conn,
+		rc:     rc,
+		poller: poller,
+		desc:   desc,
+		space:  make(chan struct{}),
+		buf:    make([]byte, size),
+	}
+	w.writeFn = func(fd uintptr) bool {
+		w.wn, w.werr = write(fd, w.src)
+		// Do not wait for readiness.
+		return true
+	}
+	return w, nil
+}
+
+// Conn returns underlying connection.
+func (w *Writer) Conn() net.Conn {
+	return w.conn
+}
+
+// Size returns size of the buffer.
+func (w *Writer) Size() int {
+	return len(w.buf)
+}
+
+// Buffered returns number of bytes written to the buffer but not to the
+// socket yet.
+func (w *Writer) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w - w.r
+}
+
+// Available returns number of bytes which could be written to the buffer.
+func (w *Writer) Available() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.buf) - (w.w - w.r)
+}
+
+// Write writes p into the buffer. When the buffer becomes full, it is
+// flushed to the socket. If socket is not ready and there is no space left
+// for the rest of p, the number of written bytes and ErrFull are returned;
+// WaitWritable() could be used to wait until the buffer is flushed.
+// It never blocks.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		if w.w == w.r && !w.armed && len(p) >= len(w.buf) {
+			// Large write with empty buffer; write directly to avoid
+			// copying.
+			m, err := w.write(p)
+			n += m
+			p = p[m:]
+			if err != nil {
+				return n, err
+			}
+			if m > 0 {
+				continue
+			}
+		}
+		if w.w == len(w.buf) && w.r > 0 {
+			w.w = copy(w.buf, w.buf[w.r:w.w])
+			w.r = 0
+		}
+		m := copy(w.buf[w.w:], p)
+		w.w += m
+		n += m
+		p = p[m:]
+		if w.w == len(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+			if w.r == 0 && w.w == len(w.buf) && len(p) > 0 {
+				// Socket is not ready and buffer is still full.
+				return n, ErrFull
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes buffered data to the socket as much as possible without
+// blocking. If socket is not ready, the rest of data is written when poller
+// reports EventWrite.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.check(); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// WaitWritable blocks until there is free space in the buffer, an error
+// occurs or ctx is done.
+func (w *Writer) WaitWritable(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if err := w.check(); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		if w.w-w.r < len(w.buf) {
+			w.mu.Unlock()
+			return nil
+		}
+		space := w.space
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-space:
+		}
+	}
+}
+
+// Close stops waiting for socket readiness and releases the descriptor.
+// Data which is not flushed yet is discarded. Underlying connection is not
+// closed.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if w.started {
+		w.poller.Stop(w.desc)
+	}
+	w.buf = nil
+	w.r, w.w = 0, 0
+	return w.desc.Close()
+}
+
+func (w *Writer) check() error {
+	if w.closed {
+		return ErrClosed
+	}
+	return w.err
+}
+
+// write writes p to the socket without blocking. It must be called with
+// w.mu held.
+func (w *Writer) write(p []byte) (int, error) {
+	w.src = p
+	err := w.rc.Write(w.writeFn)
+	w.src = nil
+	if err == nil && w.werr != errAgain {
+		err = w.werr
+	}
+	if err != nil {
+		return w.wn, w.fail(err)
+	}
+	return w.wn, nil
+}
+
+// flush must be called with w.mu held.
+func (w *Writer) flush() error {
+	written := false
+	for w.r < w.w {
+		n, err := w.write(w.buf[w.r:w.w])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		w.r += n
+		written = true
+	}
+	if w.r == w.w {
+		w.r, w.w = 0, 0
+	}
+	if written {
+		close(w.space)
+		w.space = make(chan struct{})
+	}
+	if w.r < w.w {
+		return w.arm()
+	}
+	return nil
+}
+
+func (w *Writer) arm() error {
+	if w.armed {
+		return nil
+	}
+	var err error
+	if w.started {
+		err = w.poller.Resume(w.desc)
+	} else {
+		err = w.poller.Start(w.desc, w.onWrite)
+		w.started = err == nil
+	}
+	if err != nil {
+		return w.fail(err)
+	}
+	w.armed = true
+	return nil
+}
+
+func (w *Writer) onWrite(ev netpoll.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.armed = false
+	if w.closed || w.err != nil {
+		return
+	}
+	if ev&netpoll.EventPollerClosed != 0 {
+		w.fail(ErrPollerClosed)
+		return
+	}
+	// Hangup and errors are reported by write(2).
+	w.flush()
+}
+
+// fail stores err to be returned by further calls and wakes up waiters.
+func (w *Writer) fail(err error) error {
+	w.err = err
+	close(w.space)
+	w.space = make(chan struct{})
+	return err
+}
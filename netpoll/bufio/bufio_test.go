@@ -0,0 +1,386 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package bufio
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+func TestWriterFlush(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	w, err := NewWriterSize(conn, poller, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if n, err := w.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("Write() = %d, %v; want 5, nil", n, err)
+	}
+	if n := w.Buffered(); n != 5 {
+		t.Fatalf("Buffered() is %d; want 5", n)
+	}
+	// Nothing must be sent before Flush().
+	peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, _ := peer.Read(make([]byte, 16)); n != 0 {
+		t.Fatalf("received %d bytes before Flush()", n)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.Buffered(); n != 0 {
+		t.Fatalf("Buffered() is %d after Flush(); want 0", n)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	p := make([]byte, 16)
+	if n, err := io.ReadFull(peer, p[:5]); n != 5 || err != nil || string(p[:5]) != "hello" {
+		t.Fatalf("read %q, %v; want %q", p[:n], err, "hello")
+	}
+}
+
+func TestWriterEventWrite(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	w, err := NewWriterSize(conn, poller, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Data is larger than socket buffers, so it could not be written without
+	// waiting for EventWrite.
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		p, _ := ioutil.ReadAll(io.LimitReader(peer, int64(len(data))))
+		received <- p
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Write in chunks which are not aligned to the buffer size.
+	for p := data; len(p) > 0; {
+		chunk := p
+		if len(chunk) > 1000 {
+			chunk = chunk[:1000]
+		}
+		n, err := w.Write(chunk)
+		p = p[n:]
+		if err == ErrFull {
+			err = w.WaitWritable(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case act := <-received:
+		if !bytes.Equal(act, data) {
+			t.Fatalf("received %d bytes which differ from sent %d bytes", len(act), len(data))
+		}
+	case <-ctx.Done():
+		t.Fatalf("data is not flushed")
+	}
+}
+
+func TestWriterFull(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	w, err := NewWriterSize(conn, poller, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Write until both socket and writer buffers are full.
+	var total int
+	for {
+		n, err := w.Write(make([]byte, 4096))
+		total += n
+		if err == ErrFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := w.Available(); n != 0 {
+		t.Fatalf("Available() is %d; want 0", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.WaitWritable(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitWritable() error is %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	go io.CopyN(ioutil.Discard, peer, int64(total))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.WaitWritable(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	poller := newPoller(t)
+	conn, _ := connPair(t)
+	w, err := NewWriter(conn, poller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write() error is %v; want %v", err, ErrClosed)
+	}
+	if err := w.Flush(); err != ErrClosed {
+		t.Errorf("Flush() error is %v; want %v", err, ErrClosed)
+	}
+	// Connection must stay open.
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Errorf("connection is closed by Close(): %v", err)
+	}
+}
+
+func TestReaderWraparound(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	pool := new(countingPool)
+	r := startReader(t, poller, conn, &ReaderConfig{Size: 16, Pool: pool})
+
+	peer.Write([]byte("0123456789"))
+	waitBuffered(t, r, 10)
+	if n, err := r.Discard(6); n != 6 || err != nil {
+		t.Fatalf("Discard() = %d, %v; want 6, nil", n, err)
+	}
+	// Data is wrapped around the end of the buffer.
+	peer.Write([]byte("abcdefghij"))
+	waitBuffered(t, r, 14)
+	p, err := r.Peek(14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := string(p), "6789abcdefghij"; act != exp {
+		t.Fatalf("Peek() = %q; want %q", act, exp)
+	}
+	if _, err := r.Peek(17); err != ErrTooLarge {
+		t.Fatalf("Peek() beyond buffer size error is %v; want %v", err, ErrTooLarge)
+	}
+
+	if n, err := r.Discard(10); n != 10 || err != nil {
+		t.Fatalf("Discard() = %d, %v; want 10, nil", n, err)
+	}
+	peer.Write([]byte("klmnopqr"))
+	waitBuffered(t, r, 12)
+	if err := r.ReadN(make([]byte, 13)); err != ErrNotEnough {
+		t.Fatalf("ReadN() of unavailable data error is %v; want %v", err, ErrNotEnough)
+	}
+	b := make([]byte, 12)
+	if err := r.ReadN(b); err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := string(b), "ghijklmnopqr"; act != exp {
+		t.Fatalf("ReadN() = %q; want %q", act, exp)
+	}
+	// Drained buffer is returned to the pool.
+	if n := pool.used(); n != 0 {
+		t.Fatalf("%d buffers are not returned to the pool", n)
+	}
+}
+
+func TestReaderBackpressure(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	if _, err := NewReader(conn, poller, &ReaderConfig{Size: 16, HighWatermark: 32}); err != ErrInvalidWatermarks {
+		t.Fatalf("NewReader() error is %v; want %v", err, ErrInvalidWatermarks)
+	}
+
+	var high, low int32
+	r := startReader(t, poller, conn, &ReaderConfig{
+		Size:            64,
+		HighWatermark:   32,
+		LowWatermark:    8,
+		OnHighWatermark: func() { atomic.AddInt32(&high, 1) },
+		OnLowWatermark:  func() { atomic.AddInt32(&low, 1) },
+	})
+
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if _, err := peer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, r.Paused)
+	n := r.Buffered()
+	if n < 32 {
+		t.Fatalf("paused with %d bytes buffered; want at least 32", n)
+	}
+	// Nothing must be read while descriptor is paused.
+	time.Sleep(20 * time.Millisecond)
+	if m := r.Buffered(); m != n {
+		t.Fatalf("Buffered() is %d while paused; want %d", m, n)
+	}
+
+	var received []byte
+	p := make([]byte, n-9)
+	if err := r.ReadN(p); err != nil {
+		t.Fatal(err)
+	}
+	received = append(received, p...)
+	if !r.Paused() || atomic.LoadInt32(&low) != 0 {
+		t.Fatalf("unpaused above the low watermark")
+	}
+	for len(received) < len(data) {
+		waitFor(t, func() bool { return r.Buffered() > 0 })
+		p := make([]byte, r.Buffered())
+		if err := r.ReadN(p); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, p...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received data differs from sent")
+	}
+	if h, l := atomic.LoadInt32(&high), atomic.LoadInt32(&low); h < 2 || h != l {
+		t.Fatalf("high and low watermarks are reached %d and %d times; want equal and at least 2", h, l)
+	}
+}
+
+func TestReaderEOF(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := connPair(t)
+	pool := new(countingPool)
+	r := startReader(t, poller, conn, &ReaderConfig{Size: 16, Pool: pool})
+
+	peer.Write([]byte("abc"))
+	peer.Close()
+	waitFor(t, func() bool {
+		_, err := r.Peek(4)
+		return err != ErrNotEnough
+	})
+	if _, err := r.Peek(4); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Peek() after end of stream error is %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+	if n, err := r.Discard(5); n != 3 || err != io.ErrUnexpectedEOF {
+		t.Fatalf("Discard() = %d, %v; want 3, %v", n, err, io.ErrUnexpectedEOF)
+	}
+	if _, err := r.Peek(1); err != io.EOF {
+		t.Fatalf("Peek() of drained reader error is %v; want %v", err, io.EOF)
+	}
+	if err := r.ReadN(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("ReadN() of drained reader error is %v; want %v", err, io.EOF)
+	}
+	if n, err := r.Fill(); n != 0 || err != io.EOF {
+		t.Fatalf("Fill() = %d, %v; want 0, %v", n, err, io.EOF)
+	}
+	if n := pool.used(); n != 0 {
+		t.Fatalf("%d buffers are not returned to the pool", n)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Peek(1); err != ErrReaderClosed {
+		t.Fatalf("Peek() after Close() error is %v; want %v", err, ErrReaderClosed)
+	}
+}
+
+// startReader creates Reader for conn and starts its descriptor.
+func startReader(tb testing.TB, poller netpoll.Poller, conn net.Conn, config *ReaderConfig) *Reader {
+	r, err := NewReader(conn, poller, config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { r.Close() })
+	if err := poller.Start(r.Desc(), func(netpoll.Event) { r.Fill() }); err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+func waitBuffered(tb testing.TB, r *Reader, n int) {
+	tb.Helper()
+	waitFor(tb, func() bool { return r.Buffered() >= n })
+	if m := r.Buffered(); m != n {
+		tb.Fatalf("Buffered() is %d; want %d", m, n)
+	}
+}
+
+func waitFor(tb testing.TB, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("condition is not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// countingPool counts buffers which are not returned.
+type countingPool struct {
+	SyncPool
+	n int32
+}
+
+func (p *countingPool) Get(size int) []byte {
+	atomic.AddInt32(&p.n, 1)
+	return p.SyncPool.Get(size)
+}
+
+func (p *countingPool) Put(b []byte) {
+	atomic.AddInt32(&p.n, -1)
+	p.SyncPool.Put(b)
+}
+
+func (p *countingPool) used() int {
+	return int(atomic.LoadInt32(&p.n))
+}
+
+func newPoller(tb testing.TB) netpoll.Poller {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { poller.(netpoll.Closer).Close() })
+	return poller
+}
+
+// connPair returns connected pair of unix stream connections.
+func connPair(tb testing.TB) (net.Conn, net.Conn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		conns[i] = conn
+		tb.Cleanup(func() { conn.Close() })
+	}
+	return conns[0], conns[1]
+}
@@ -0,0 +1,9 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package bufio
+
+import "fmt"
+
+func read(fd uintptr, p []byte) (n int, err error) {
+	return 0, fmt.Errorf("read is not supported on this operating system")
+}
@@ -0,0 +1,19 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package bufio
+
+import "syscall"
+
+// read makes read(2) call for fd. It retries on EINTR.
+func read(fd uintptr, p []byte) (n int, err error) {
+	for {
+		n, err = syscall.Read(int(fd), p)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
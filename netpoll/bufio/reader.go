@@ -0,0 +1,493 @@
+package bufio
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+var (
+	// ErrNotEnough is returned by Reader methods when less data is
+	// buffered than requested and the end of stream is not reached yet.
+	ErrNotEnough = fmt.Errorf("bufio: not enough data buffered")
+
+	// ErrTooLarge is returned by Reader methods when requested more data
+	// than the buffer could hold.
+	ErrTooLarge = fmt.Errorf("bufio: requested size exceeds buffer size")
+
+	// ErrReaderClosed is returned by Reader methods after Close().
+	ErrReaderClosed = fmt.Errorf("bufio: reader is closed")
+
+	// ErrInvalidWatermarks is returned by NewReader() when watermarks do
+	// not fit the buffer.
+	ErrInvalidWatermarks = fmt.Errorf("bufio: invalid watermarks")
+)
+
+// Pool provides buffers for Reader.
+type Pool interface {
+	// Get returns buffer of at least size bytes.
+	Get(size int) []byte
+	// Put releases buffer returned by Get().
+	Put([]byte)
+}
+
+// SyncPool is a Pool backed by sync.Pool for each requested size. Zero value
+// is ready to use.
+type SyncPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+// Get implements Pool.Get() method.
+func (p *SyncPool) Get(size int) []byte {
+	if b, ok := p.pool(size).Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, size)
+}
+
+// Put implements Pool.Put() method.
+func (p *SyncPool) Put(b []byte) {
+	b = b[:cap(b)]
+	p.pool(len(b)).Put(&b)
+}
+
+func (p *SyncPool) pool(size int) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sp, ok := p.pools[size]
+	if !ok {
+		if p.pools == nil {
+			p.pools = make(map[int]*sync.Pool)
+		}
+		sp = new(sync.Pool)
+		p.pools[size] = sp
+	}
+	return sp
+}
+
+// defaultPool is used by readers created without ReaderConfig.Pool.
+var defaultPool = new(SyncPool)
+
+// ReaderConfig contains options for Reader.
+type ReaderConfig struct {
+	// Size is the buffer size. If zero, DefaultSize is used.
+	Size int
+
+	// Pool provides buffers. If nil, buffers are shared by all readers
+	// created without a pool.
+	Pool Pool
+
+	// HighWatermark is the number of buffered bytes at which the read
+	// descriptor is paused. If zero, Size is used, that is, descriptor is
+	// paused when the buffer is full.
+	HighWatermark int
+
+	// LowWatermark is the number of buffered bytes at which paused
+	// descriptor is unpaused. If zero, half of HighWatermark is used. It
+	// must be less than HighWatermark.
+	LowWatermark int
+
+	// OnHighWatermark is called when the descriptor is paused.
+	OnHighWatermark func()
+
+	// OnLowWatermark is called when the descriptor is unpaused.
+	OnLowWatermark func()
+}
+
+// Reader implements buffering of data received by a net.Conn without
+// blocking. It is safe for concurrent use.
+//
+// Reader owns read descriptor of the connection, returned by Desc(), which
+// should be started by the caller with a callback calling Fill(). Buffered
+// data is consumed by Peek(), Discard() and ReadN(), which never block:
+//
+//	r, err := bufio.NewReader(conn, poller, nil)
+//	if err != nil {
+//		// handle error
+//	}
+//	poller.Start(r.Desc(), func(ev netpoll.Event) {
+//		_, err := r.Fill()
+//		for {
+//			header, err := r.Peek(4)
+//			if err != nil {
+//				break
+//			}
+//			...
+//		}
+//	})
+//
+// When HighWatermark bytes are buffered, the descriptor is paused, so
+// connection is not read until buffered data is consumed down to
+// LowWatermark bytes. Buffer is taken from the pool when data arrives and
+// returned when all of it is consumed, so idle connections hold no memory.
+type Reader struct {
+	conn   net.Conn
+	rc     syscall.RawConn
+	poller netpoll.Poller
+	pauser netpoll.Pauser
+	desc   *netpoll.Desc
+	pool   Pool
+	size   int
+	high   int
+	low    int
+	onHigh func()
+	onLow  func()
+
+	mu     sync.Mutex
+	closed bool
+	paused bool
+	// err is the error which stopped reading, io.EOF at the end of stream.
+	err error
+
+	// buf contains n bytes of data starting at off, possibly wrapped
+	// around the end of buffer. It is nil when there is no data.
+	buf []byte
+	off int
+	n   int
+
+	// State of read(2) made by rc, kept to avoid allocations.
+	readFn func(uintptr) bool
+	dst    []byte
+	rn     int
+	rerr   error
+}
+
+// NewReader creates Reader for conn with given config, which could be nil.
+// Poller must implement netpoll.Pauser, as Poller instances returned by
+// netpoll.New() do.
+//
+// Note that conn should not be read directly after this call.
+func NewReader(conn net.Conn, poller netpoll.Poller, config *ReaderConfig) (*Reader, error) {
+	var c ReaderConfig
+	if config != nil {
+		c = *config
+	}
+	if c.Size <= 0 {
+		c.Size = DefaultSize
+	}
+	if c.Pool == nil {
+		c.Pool = defaultPool
+	}
+	if c.HighWatermark == 0 {
+		c.HighWatermark = c.Size
+	}
+	if c.LowWatermark == 0 {
+		c.LowWatermark = c.HighWatermark / 2
+	}
+	if c.HighWatermark < 0 || c.HighWatermark > c.Size || c.LowWatermark < 0 || c.LowWatermark >= c.HighWatermark {
+		return nil, ErrInvalidWatermarks
+	}
+	pauser, ok := poller.(netpoll.Pauser)
+	if !ok {
+		return nil, fmt.Errorf("bufio: %T does not implement netpoll.Pauser", poller)
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("bufio: %T does not implement syscall.Conn", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := netpoll.HandleRead(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		conn:   conn,
+		rc:     rc,
+		poller: poller,
+		pauser: pauser,
+		desc:   desc,
+		pool:   c.Pool,
+		size:   c.Size,
+		high:   c.HighWatermark,
+		low:    c.LowWatermark,
+		onHigh: c.OnHighWatermark,
+		onLow:  c.OnLowWatermark,
+	}
+	r.readFn = func(fd uintptr) bool {
+		r.rn, r.rerr = read(fd, r.dst)
+		// Do not wait for readiness.
+		return true
+	}
+	return r, nil
+}
+
+// Conn returns underlying connection.
+func (r *Reader) Conn() net.Conn {
+	return r.conn
+}
+
+// Desc returns edge-triggered read descriptor of the connection.
+func (r *Reader) Desc() *netpoll.Desc {
+	return r.desc
+}
+
+// Size returns size of the buffer.
+func (r *Reader) Size() int {
+	return r.size
+}
+
+// Buffered returns number of bytes which could be consumed.
+func (r *Reader) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// Paused reports whether the descriptor is paused by the high watermark.
+func (r *Reader) Paused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+// Fill reads data available in the connection into the buffer without
+// blocking. It is intended to be called by the descriptor's callback.
+//
+// It returns number of bytes read. It returns io.EOF when the end of stream
+// is reached, and the read error otherwise; further calls return the same
+// error, while buffered data could still be consumed.
+func (r *Reader) Fill() (n int, err error) {
+	r.mu.Lock()
+	n, err = r.fill()
+	var paused bool
+	if err == nil {
+		paused, err = r.checkHigh()
+	}
+	r.mu.Unlock()
+
+	if paused && r.onHigh != nil {
+		r.onHigh()
+	}
+	return n, err
+}
+
+// fill must be called with r.mu held.
+func (r *Reader) fill() (n int, err error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.buf == nil {
+		r.buf = r.pool.Get(r.size)[:r.size]
+	}
+	for r.n < r.size {
+		// Free space could be split into two parts by the end of the
+		// buffer.
+		i := r.off + r.n
+		end := r.size
+		if i >= r.size {
+			i -= r.size
+			end = r.off
+		}
+		r.dst = r.buf[i:end]
+		err = r.rc.Read(r.readFn)
+		m, rerr := r.rn, r.rerr
+		r.dst, r.rerr = nil, nil
+		if err == nil {
+			err = rerr
+		}
+		n += m
+		r.n += m
+		if err == errAgain {
+			err = nil
+			break
+		}
+		if err != nil {
+			r.err = err
+			break
+		}
+		if m == 0 {
+			r.err = io.EOF
+			err = io.EOF
+			break
+		}
+		// Short read does not stop reading, since descriptor is
+		// edge-triggered and end of stream could be received together with
+		// the data.
+	}
+	if r.n == 0 {
+		r.release()
+	}
+	return n, err
+}
+
+// checkHigh pauses the descriptor if the high watermark is reached. It must
+// be called with r.mu held.
+func (r *Reader) checkHigh() (paused bool, err error) {
+	if r.paused || r.n < r.high {
+		return false, nil
+	}
+	if err = r.pauser.Pause(r.desc); err != nil {
+		r.err = err
+		return false, err
+	}
+	r.paused = true
+	return true, nil
+}
+
+// Peek returns the next n bytes without consuming them. Returned slice is
+// valid until the next call of Peek(), Discard(), ReadN() or Close().
+//
+// If less than n bytes are buffered, Peek returns ErrNotEnough, or the error
+// which stopped reading: io.EOF if there is no data left, or
+// io.ErrUnexpectedEOF if connection is closed in the middle of the data.
+func (r *Reader) Peek(n int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.check(n); err != nil {
+		return nil, err
+	}
+	if r.off+n > r.size {
+		r.linearize()
+	}
+	return r.buf[r.off : r.off+n], nil
+}
+
+// Discard skips the next n bytes. If less than n bytes are buffered, it
+// skips all of them and returns the number of skipped bytes and the error
+// like Peek() does.
+func (r *Reader) Discard(n int) (discarded int, err error) {
+	r.mu.Lock()
+	if n > r.n {
+		discarded = r.n
+		err = r.short()
+	} else {
+		discarded = n
+	}
+	if r.closed {
+		discarded, err = 0, ErrReaderClosed
+	}
+	unpaused, uerr := r.consume(discarded)
+	r.mu.Unlock()
+
+	if unpaused && r.onLow != nil {
+		r.onLow()
+	}
+	if uerr != nil {
+		err = uerr
+	}
+	return discarded, err
+}
+
+// ReadN reads exactly len(p) bytes into p. If less bytes are buffered, it
+// reads nothing and returns the error like Peek() does. Unlike Peek() and
+// Discard() calls, it copies data even if it is wrapped around the end of
+// the buffer.
+func (r *Reader) ReadN(p []byte) error {
+	r.mu.Lock()
+	if err := r.check(len(p)); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	end := r.off + len(p)
+	if end > r.size {
+		end = r.size
+	}
+	m := copy(p, r.buf[r.off:end])
+	copy(p[m:], r.buf)
+	unpaused, err := r.consume(len(p))
+	r.mu.Unlock()
+
+	if unpaused && r.onLow != nil {
+		r.onLow()
+	}
+	return err
+}
+
+// Close releases the descriptor and the buffer. Buffered data is discarded.
+// Underlying connection is not closed.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrReaderClosed
+	}
+	r.closed = true
+	// Stop() returns an error if descriptor is not started or the poller
+	// is closed; both are fine here.
+	r.poller.Stop(r.desc)
+	r.release()
+	r.n = 0
+	return r.desc.Close()
+}
+
+// check returns an error if n bytes could not be consumed. It must be called
+// with r.mu held.
+func (r *Reader) check(n int) error {
+	switch {
+	case r.closed:
+		return ErrReaderClosed
+	case n > r.size:
+		return ErrTooLarge
+	case n > r.n:
+		return r.short()
+	}
+	return nil
+}
+
+// short returns the error for the consumer when not enough data is
+// buffered. It must be called with r.mu held.
+func (r *Reader) short() error {
+	switch {
+	case r.err == nil:
+		return ErrNotEnough
+	case r.err == io.EOF && r.n > 0:
+		return io.ErrUnexpectedEOF
+	}
+	return r.err
+}
+
+// consume drops n bytes from the beginning of data and unpauses the
+// descriptor if the low watermark is reached. It must be called with r.mu
+// held.
+func (r *Reader) consume(n int) (unpaused bool, err error) {
+	if n == 0 {
+		return false, nil
+	}
+	r.off += n
+	if r.off >= r.size {
+		r.off -= r.size
+	}
+	r.n -= n
+	if r.n == 0 {
+		r.release()
+	}
+	if !r.paused || r.n > r.low {
+		return false, nil
+	}
+	if err := r.pauser.Unpause(r.desc); err != nil {
+		r.err = err
+		return false, err
+	}
+	r.paused = false
+	return true, nil
+}
+
+// linearize moves data to the beginning of new buffer, so it is not
+// wrapped. It must be called with r.mu held.
+func (r *Reader) linearize() {
+	buf := r.pool.Get(r.size)[:r.size]
+	m := copy(buf, r.buf[r.off:])
+	copy(buf[m:r.n], r.buf)
+	r.pool.Put(r.buf)
+	r.buf, r.off = buf, 0
+}
+
+// release returns empty buffer to the pool. It must be called with r.mu held.
+func (r *Reader) release() {
+	if r.buf != nil {
+		r.pool.Put(r.buf)
+		r.buf = nil
+	}
+	r.off = 0
+}
@@ -0,0 +1,22 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package bufio
+
+import "syscall"
+
+// errAgain is returned by non-blocking writes when socket buffer is full.
+var errAgain error = syscall.EAGAIN
+
+// write makes write(2) call for fd. It retries on EINTR.
+func write(fd uintptr, p []byte) (n int, err error) {
+	for {
+		n, err = syscall.Write(int(fd), p)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
@@ -0,0 +1,85 @@
+package netpoll
+
+import "sync"
+
+// defaultState holds the Poller used by package-level Start(), Stop() and
+// Resume() functions. It is set once, by SetDefault() or by New(nil) on
+// first use, so all accesses are synchronized by once.
+type defaultState struct {
+	once sync.Once
+	p    Poller
+	err  error
+}
+
+// defaultPoller is not created on package import.
+var defaultPoller defaultState
+
+// loadDefault returns the default poller initializing it if needed.
+func loadDefault() (Poller, error) {
+	defaultPoller.once.Do(func() {
+		p, err := New(nil)
+		if err != nil {
+			defaultPoller.err = err
+			return
+		}
+		defaultPoller.p = p
+	})
+	return defaultPoller.p, defaultPoller.err
+}
+
+// Default returns the Poller used by package-level Start(), Stop() and
+// Resume() functions, creating it by New(nil) on first use. It returns nil
+// if the poller could not be created; package-level functions return the
+// error then.
+func Default() Poller {
+	p, _ := loadDefault()
+	return p
+}
+
+// SetDefault makes p the Poller returned by Default(), e.g. to use a poller
+// with non-default Config. It must be called before the first use of
+// Default() and package-level functions; otherwise it returns
+// ErrDefaultInitialized and the default poller is not changed. So does the
+// second SetDefault() call. It panics if p is nil.
+func SetDefault(p Poller) error {
+	if p == nil {
+		panic("netpoll: SetDefault() with nil poller")
+	}
+	set := false
+	defaultPoller.once.Do(func() {
+		defaultPoller.p = p
+		set = true
+	})
+	if !set {
+		return ErrDefaultInitialized
+	}
+	return nil
+}
+
+// Start starts observing desc with Default() poller.
+// See Starter for details.
+func Start(desc *Desc, cb CallbackFn) error {
+	p, err := loadDefault()
+	if err != nil {
+		return err
+	}
+	return p.Start(desc, cb)
+}
+
+// Stop stops observing desc with Default() poller.
+func Stop(desc *Desc) error {
+	p, err := loadDefault()
+	if err != nil {
+		return err
+	}
+	return p.Stop(desc)
+}
+
+// Resume resumes observing desc with Default() poller.
+func Resume(desc *Desc) error {
+	p, err := loadDefault()
+	if err != nil {
+		return err
+	}
+	return p.Resume(desc)
+}
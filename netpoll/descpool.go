@@ -0,0 +1,87 @@
+package netpoll
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	descPool    sync.Pool
+	descPooling int32
+)
+
+// EnableDescPool enables or disables reuse of descriptors released by
+// ReleaseDesc(). When enabled, Handle() and other constructors of
+// descriptors for connections and listeners take them from the pool instead
+// of allocating new ones. It is disabled by default.
+//
+// Pooling is useful under high connection churn, but it makes use of a
+// descriptor after ReleaseDesc() a hard to find bug: such descriptor could
+// be already handling other connection. Thus descriptors are never pooled
+// implicitly, Close() does not release them.
+func EnableDescPool(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&descPooling, v)
+}
+
+// ReleaseDesc closes desc and puts it into the pool used by constructors
+// when EnableDescPool(true) is called. Caller must not use desc or keep
+// references to it after the call.
+//
+// Descriptor must be stopped in all pollers before release, otherwise
+// ErrRegistered is returned and desc is left untouched. The error of
+// closing the underlying file is returned, but desc is released anyway.
+// Repeated call returns ErrDescReleased, unless desc is already taken from
+// the pool by a constructor; such misuse could not be detected.
+func ReleaseDesc(desc *Desc) error {
+	if desc.registered() {
+		return ErrRegistered
+	}
+	if !atomic.CompareAndSwapInt32(&desc.released, 0, 1) {
+		return ErrDescReleased
+	}
+	err := desc.Close()
+	desc.reset()
+	descPool.Put(desc)
+	return err
+}
+
+// acquireDesc returns zero descriptor, taking it from the pool if pooling
+// is enabled.
+func acquireDesc() *Desc {
+	if atomic.LoadInt32(&descPooling) != 0 {
+		if desc, _ := descPool.Get().(*Desc); desc != nil {
+			atomic.StoreInt32(&desc.released, 0)
+			return desc
+		}
+	}
+	return new(Desc)
+}
+
+// reset clears state of released descriptor, so it does not keep
+// references to the file, handler and observers.
+func (h *Desc) reset() {
+	h.file = nil
+	atomic.StoreInt32(&h.sysfd, -1)
+	h.owned = false
+	h.event = 0
+	h.armed = 0
+	h.lowat = 0
+	h.paused = false
+	h.lazy = nil
+	h.proc = nil
+	h.handler = nil
+	h.cb = nil
+	h.sock = sockUnknown
+	atomic.StoreUint64(&h.last, 0)
+	if h.LastError() != nil {
+		h.setLastError(nil)
+	}
+	h.observers.mu.Lock()
+	atomic.StoreInt32(&h.regs, 0)
+	h.observers.clear()
+	h.observers.mu.Unlock()
+}
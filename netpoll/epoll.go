@@ -3,7 +3,17 @@
 package netpoll
 
 import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -22,6 +32,14 @@ const (
 	EPOLLET      = unix.EPOLLET
 	EPOLLONESHOT = unix.EPOLLONESHOT
 
+	// EPOLLEXCLUSIVE sets exclusive wakeup mode (Linux 4.5+).
+	EPOLLEXCLUSIVE = unix.EPOLLEXCLUSIVE
+
+	// EPOLLMSG is defined by Linux, but is never reported by the kernel.
+	// The value is given explicitly to be checked against unix.EPOLLMSG by
+	// tests.
+	EPOLLMSG = 0x400
+
 	// _EPOLLCLOSED is a special EpollEvent value the receipt of which means
 	// that the epoll instance is closed.
 	_EPOLLCLOSED = 0x20
@@ -47,105 +65,649 @@ func (evt EpollEvent) String() (str string) {
 	name(EPOLLHUP, "EPOLLHUP")
 	name(EPOLLET, "EPOLLET")
 	name(EPOLLONESHOT, "EPOLLONESHOT")
+	name(EPOLLEXCLUSIVE, "EPOLLEXCLUSIVE")
+	name(EPOLLMSG, "EPOLLMSG")
 	name(_EPOLLCLOSED, "_EPOLLCLOSED")
 
 	return
 }
 
+// IsReadable reports whether evt has EPOLLIN or EPOLLPRI bit set.
+func (evt EpollEvent) IsReadable() bool {
+	return evt&EPOLLIN != 0 || evt&EPOLLPRI != 0
+}
+
+// IsWritable reports whether evt has EPOLLOUT bit set.
+func (evt EpollEvent) IsWritable() bool {
+	return evt&EPOLLOUT != 0
+}
+
+// IsError reports whether evt has EPOLLERR or EPOLLHUP bit set.
+func (evt EpollEvent) IsError() bool {
+	return evt&EPOLLERR != 0 || evt&EPOLLHUP != 0
+}
+
+// IsClosed reports whether evt is received because epoll instance is
+// closed.
+func (evt EpollEvent) IsClosed() bool {
+	return evt&_EPOLLCLOSED != 0
+}
+
+var (
+	_ encoding.BinaryMarshaler   = EpollEvent(0)
+	_ encoding.BinaryUnmarshaler = (*EpollEvent)(nil)
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler. Event is encoded as
+// 4-byte big-endian uint32.
+func (evt EpollEvent) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(evt))
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It returns
+// ErrInvalidEncoding if b is not 4 bytes long.
+func (evt *EpollEvent) UnmarshalBinary(b []byte) error {
+	if len(b) != 4 {
+		return ErrInvalidEncoding
+	}
+	*evt = EpollEvent(binary.BigEndian.Uint32(b))
+	return nil
+}
+
 // Epoll represents single epoll instance.
 type Epoll struct {
-	mu sync.RWMutex
+	// lastID is accessed atomically, so it is the first field to be 64-bit
+	// aligned on 32-bit platforms.
+	lastID uint64
+
+	mu  sync.RWMutex
+	sys syscallInterface
 
 	fd       int
-	eventFd  int
+	notifier closeNotifier
+	maxFd    int
 	closed   bool
 	waitDone chan struct{}
+	noLoop   bool
+	// closeDone is closed when the first Close() call releases resources.
+	closeDone chan struct{}
+	// done is closed when Close() or the wait loop has notified callbacks
+	// about closing, see Done(). err is the fatal error which made the wait
+	// loop close the instance, see EpollConfig.FatalPolicy.
+	done  chan struct{}
+	err   error
+	fatal FatalPolicy
+	// fdClosed is set by the first one of Close() and the wait loop which
+	// closes fd.
+	fdClosed int32
+	// stopping is set by Close(), so the wait loop exits on any return from
+	// epoll_wait(2), even if it could not be woken up by the notifier.
+	stopping int32
+	ordered  bool
+
+	name  string
+	log   Logger
+	trace StructuredLogger
+
+	// callbacks is indexed by descriptor. Unlike map it has no per-entry
+	// overhead and is scanned by GC as a single array. Registrations with
+	// nil callback hold nopCallback.
+	callbacks    []epollHandler
+	count        int
+	maxCount     int
+	soft         softLimit
+	closeWorkers int
+	eintrBackoff time.Duration
+	maxEINTR     int
+	ctlRetries   int
+	notifyOnDel  bool
 
-	callbacks map[int]func(EpollEvent)
+	quiet      quietHook
+	stale      staleSweep
+	idle       idleTracker
+	batchBegin int
+	batchMax   int
+	stats      *epollStats
+
+	// buffers allocates event arrays of the wait loop. waitEvents is the
+	// initial one, allocated by EpollCreate() to report its errors.
+	buffers    eventBuffers
+	waitEvents []unix.EpollEvent
+
+	// links is indexed by descriptor too. It keeps registrations in a list
+	// ordered by Add() calls, so Close() notifies them in that order. head
+	// and tail are -1 when the list is empty.
+	links        []epollLink
+	head, tail   int32
+	reverseClose bool
+
+	pollMu     sync.Mutex
+	pollEvents []unix.EpollEvent
+}
+
+// FDEvent represents events which are ready on a file descriptor.
+type FDEvent struct {
+	FD     int
+	Events EpollEvent
 }
 
 // EpollConfig contains options for Epoll instance configuration.
 type EpollConfig struct {
 	// OnWaitError will be called from goroutine, waiting for events.
+	// If OnWaitError is nil, errors are written to ErrorLog.
+	// Panic in the wait loop is reported as an error with the stack trace of
+	// the wait goroutine; the loop stops then.
 	OnWaitError func(error)
+
+	// ErrorLog is used to log internally generated messages, including wait
+	// loop errors when OnWaitError is nil.
+	// If ErrorLog is nil, messages are written by the standard log package.
+	ErrorLog Logger
+
+	// DisableWaitLoop prevents EpollCreate from starting the wait loop
+	// goroutine. Ready events then should be retrieved by Poll() method.
+	DisableWaitLoop bool
+
+	// OrderedPerFD makes the wait loop to merge all events received for the
+	// same descriptor within one epoll_wait() call, so the callback of each
+	// descriptor is called once per iteration with all the events ORed.
+	// Kernel usually reports a descriptor once per call, thus it is useful
+	// mostly as a guarantee for protocols which require ordered processing.
+	OrderedPerFD bool
+
+	// CloseWorkers limits number of goroutines which call callbacks with
+	// _EPOLLCLOSED on Close(). If it is zero, one goroutine is used per
+	// 65536 registrations, up to GOMAXPROCS. Thus callbacks of
+	// different descriptors could be called concurrently on Close() of
+	// large instances. Set it to 1 to call all of them sequentially.
+	CloseWorkers int
+
+	// EINTRBackoff is a pause of the wait loop before epoll_wait() is
+	// retried after EINTR. Actual pause is chosen randomly between a half of
+	// EINTRBackoff and EINTRBackoff, so loops of different instances do not
+	// wake up simultaneously. It is useful under high signal rates, e.g.
+	// SIGPROF during profiling, when immediate retries waste CPU.
+	// Zero means no pause.
+	EINTRBackoff time.Duration
+
+	// MaxEINTR is a number of consecutive EINTR errors of epoll_wait() after
+	// which the wait loop reports ErrTooManyEINTR and stops. It prevents
+	// endless loop in environments where signal delivery is broken.
+	// Zero means no limit.
+	MaxEINTR int
+
+	// CtlRetries is a number of times epoll_ctl() is retried by Add(), Mod()
+	// and Del() after EINTR. Retries are made at once, since the instance
+	// lock is held meanwhile. Other errors, such as EBADF or ENOSPC, are
+	// returned at once too.
+	// Default value is 3. Negative value disables retries.
+	CtlRetries int
+
+	// FatalPolicy is the same as in Config. Errors of epoll_wait() which are
+	// not temporary and ErrTooManyEINTR are fatal. Note that the policy is
+	// applied after OnWaitError returns.
+	FatalPolicy FatalPolicy
+
+	// ReverseCloseOrder makes Close() to call callbacks with _EPOLLCLOSED
+	// in reverse order of registration. By default they are called in
+	// order of registration. Note that the order is observable only when
+	// callbacks are called sequentially, see CloseWorkers.
+	ReverseCloseOrder bool
+
+	// InitialBatchSize is the number of events the wait loop and Poll()
+	// receive by single epoll_wait() call initially. When the whole batch
+	// is filled, the wait loop doubles it up to MaxBatchSize. Larger batches
+	// reduce number of system calls under load at the expense of memory.
+	// Default values are 1024 and 32768.
+	InitialBatchSize int
+	MaxBatchSize     int
+
+	// MaxFDs is the expected limit of descriptor numbers. When positive,
+	// tables of registrations are allocated for descriptors below MaxFDs at
+	// once, so Add() does not grow them on the way. Larger descriptors are
+	// still accepted. Note that tables take about 40 bytes per descriptor.
+	MaxFDs int
+
+	// MaxDescriptors is the same as in Config: when it is positive and the
+	// number of registrations reaches it, Add() and AddPaused() return
+	// ErrTooManyDescriptors.
+	MaxDescriptors int
+
+	// SoftLimit and OnSoftLimit are the same as in Config. OnSoftLimit is
+	// called by Add() and AddPaused().
+	SoftLimit   float64
+	OnSoftLimit func(current, max int)
+
+	// Name is the same as in Config. If it is empty, unique name such as
+	// "epoll-1" is generated.
+	Name string
+
+	// CollectStats enables measuring of the wait loop work returned by
+	// Stats(). It costs two clock readings per wait iteration.
+	CollectStats bool
+
+	// OnIdle and IdleThreshold are the same as in Config. OnIdle is not
+	// called when DisableWaitLoop is set.
+	OnIdle        func(idleFor time.Duration)
+	IdleThreshold time.Duration
+
+	// StaleCheckInterval enables detection of registrations which
+	// descriptors are closed without Del(). Kernel silently removes closed
+	// descriptor from the interest list, while its callback stays
+	// registered: Add() of the reused descriptor number fails with
+	// ErrRegistered then. Every StaleCheckInterval the wait loop checks by
+	// fcntl(F_GETFD) next StaleCheckBatch registrations, so the sweep of n
+	// registrations takes n/StaleCheckBatch intervals and does not block
+	// the loop for long. Descriptor which number is already reused by
+	// another file could not be detected.
+	// Zero disables the checks; they are not made when DisableWaitLoop is
+	// set. Default StaleCheckBatch is 1024.
+	StaleCheckInterval time.Duration
+	StaleCheckBatch    int
+
+	// OnStaleRegistration is called from goroutine, waiting for events, with
+	// each closed descriptor found by the checks. Like callbacks, it blocks
+	// the wait loop while it is running.
+	OnStaleRegistration func(fd int)
+
+	// RemoveStale makes the checks to remove found registrations before
+	// OnStaleRegistration is called.
+	RemoveStale bool
+
+	// NotifyOnDel makes Del() and DelHandler() to call the removed callback
+	// with _EPOLLCLOSED, as Close() does, so resources bound to the
+	// registration could be released in one place. The callback is called
+	// synchronously, after the registration is removed and the lock is
+	// released, thus it could call methods of the instance.
+	NotifyOnDel bool
+
+	// NumaBind makes the wait loop receive events into arrays bound to NUMA
+	// node NumaNode, see package numa. Negative NumaNode means the node of
+	// the CPU the EpollCreate() caller runs on. It is worth enabling when
+	// the process is bound to the node, e.g. by numactl(8), so the kernel
+	// and the wait loop do not touch remote memory on every epoll_wait().
+	// Arrays of Poll() are allocated from Go heap regardless of NumaBind.
+	NumaBind bool
+	NumaNode int
+
+	// onStale is used by poller instead of OnStaleRegistration to get the
+	// handler of the registration.
+	onStale func(fd int, h epollHandler)
 }
 
 func (c *EpollConfig) withDefaults() (config EpollConfig) {
 	if c != nil {
 		config = *c
 	}
-	if config.OnWaitError == nil {
-		config.OnWaitError = defaultOnWaitError
+	if config.ErrorLog == nil {
+		config.ErrorLog = defaultLogger
+	}
+	if config.InitialBatchSize == 0 {
+		config.InitialBatchSize = defaultInitialBatchSize
+	}
+	if config.MaxBatchSize == 0 {
+		config.MaxBatchSize = defaultMaxBatchSize
+	}
+	if config.CtlRetries == 0 {
+		config.CtlRetries = defaultCtlRetries
+	}
+	if config.StaleCheckBatch <= 0 {
+		config.StaleCheckBatch = defaultStaleCheckBatch
+	}
+	if config.onStale == nil && config.OnStaleRegistration != nil {
+		fn := config.OnStaleRegistration
+		config.onStale = func(fd int, _ epollHandler) { fn(fd) }
+	}
+	if config.Name == "" {
+		config.Name = autoName("epoll")
 	}
 	return config
 }
 
+const (
+	defaultInitialBatchSize = 1024
+	defaultMaxBatchSize     = 32768
+	defaultStaleCheckBatch  = 1024
+	defaultCtlRetries       = 3
+)
+
 // EpollCreate creates new epoll instance.
-// It starts the wait loop in separate goroutine.
+// It starts the wait loop in separate goroutine unless DisableWaitLoop is set.
 func EpollCreate(c *EpollConfig) (*Epoll, error) {
-	config := c.withDefaults()
+	return epollCreate(c, realSyscalls{})
+}
+
+// NewEpoll is the same as EpollCreate(), but it also returns cleanup function
+// which closes the instance, making `defer cleanup()` possible right after
+// the error check. Cleanup logs close errors to the ErrorLog, except
+// ErrClosed, so it is safe to call it after explicit Close().
+func NewEpoll(c *EpollConfig) (*Epoll, func(), error) {
+	return newEpoll(c, realSyscalls{})
+}
+
+func newEpoll(c *EpollConfig, sys syscallInterface) (*Epoll, func(), error) {
+	ep, err := epollCreate(c, sys)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := ep.fd
+	cleanup := func() {
+		if err := ep.Close(); err != nil && err != ErrClosed {
+			logRecord(ep.log, LogRecord{
+				Level:   LevelError,
+				Message: "close error",
+				Poller:  ep.name,
+				Op:      "close",
+				FD:      fd,
+				Err:     err,
+			})
+		}
+	}
+	return ep, cleanup, nil
+}
 
-	fd, err := unix.EpollCreate1(0)
+func epollCreate(c *EpollConfig, sys syscallInterface) (*Epoll, error) {
+	config := c.withDefaults()
+	if config.InitialBatchSize <= 0 || config.MaxBatchSize < config.InitialBatchSize {
+		return nil, ErrInvalidBatchSize
+	}
+	buffers, err := newEventBuffers(&config)
 	if err != nil {
 		return nil, err
 	}
 
-	r0, _, errno := unix.Syscall(unix.SYS_EVENTFD2, 0, 0, 0)
-	if errno != 0 {
-		return nil, errno
+	fd, err := sys.EpollCreate1(0)
+	if err != nil {
+		return nil, fmt.Errorf("netpoll: epoll_create1: %w", err)
+	}
+
+	notifier, err := newCloseNotifier(sys, config.ErrorLog)
+	if err != nil {
+		sys.Close(fd)
+		return nil, err
 	}
-	eventFd := int(r0)
 
 	// Set finalizer for write end of socket pair to avoid data races when
 	// closing Epoll instance and EBADF errors on writing ctl bytes from callers.
-	err = unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, eventFd, &unix.EpollEvent{
+	err = sys.EpollCtl(fd, unix.EPOLL_CTL_ADD, notifier.fd(), &unix.EpollEvent{
 		Events: unix.EPOLLIN,
-		Fd:     int32(eventFd),
+		Fd:     int32(notifier.fd()),
 	})
 	if err != nil {
-		unix.Close(fd)
-		unix.Close(eventFd)
-		return nil, err
+		sys.Close(fd)
+		notifier.close()
+		return nil, fmt.Errorf("netpoll: epoll_ctl: %w", err)
 	}
 
 	ep := &Epoll{
-		fd:        fd,
-		eventFd:   eventFd,
-		callbacks: make(map[int]func(EpollEvent)),
-		waitDone:  make(chan struct{}),
+		sys:          sys,
+		fd:           fd,
+		notifier:     notifier,
+		maxFd:        maxFD(),
+		waitDone:     make(chan struct{}),
+		closeDone:    make(chan struct{}),
+		done:         make(chan struct{}),
+		fatal:        config.FatalPolicy,
+		noLoop:       config.DisableWaitLoop,
+		ordered:      config.OrderedPerFD,
+		closeWorkers: config.CloseWorkers,
+		eintrBackoff: config.EINTRBackoff,
+		maxEINTR:     config.MaxEINTR,
+		ctlRetries:   config.CtlRetries,
+		notifyOnDel:  config.NotifyOnDel,
+		quiet:        newQuietHook(config.IdleThreshold, config.OnIdle),
+		stale:        newStaleSweep(&config),
+		head:         -1,
+		tail:         -1,
+		reverseClose: config.ReverseCloseOrder,
+		maxCount:     config.MaxDescriptors,
+		soft:         newSoftLimit(config.SoftLimit, config.MaxDescriptors, config.OnSoftLimit),
+		batchBegin:   config.InitialBatchSize,
+		batchMax:     config.MaxBatchSize,
+		buffers:      buffers,
+		name:         config.Name,
+		log:          config.ErrorLog,
+		trace:        structuredLogger(config.ErrorLog),
+	}
+
+	if config.CollectStats {
+		ep.stats = new(epollStats)
+	}
+	if config.MaxFDs > 0 {
+		ep.grow(config.MaxFDs - 1)
 	}
 
 	// Запускаем горутину, которая отслеживает изменения
-	go ep.wait(config.OnWaitError)
+	if !ep.noLoop {
+		if ep.waitEvents, err = buffers.alloc(ep.batchBegin); err != nil {
+			sys.Close(fd)
+			notifier.close()
+			return nil, err
+		}
+		go ep.wait(config.OnWaitError)
+	}
 
 	return ep, nil
 }
 
+// MaxFD is a conservative upper bound for file descriptor values. It is used
+// when the limit could not be retrieved from the system or is unlimited.
+const MaxFD = 1<<30 - 1
+
+// maxFD returns the maximum file descriptor value that could be opened by the
+// process. It uses hard RLIMIT_NOFILE limit, because soft limit could be
+// raised up to it at any time.
+func maxFD() int {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err != nil {
+		return MaxFD
+	}
+	if rlim.Max == unix.RLIM_INFINITY || rlim.Max == 0 || rlim.Max-1 > MaxFD {
+		return MaxFD
+	}
+	return int(rlim.Max - 1)
+}
+
+func (ep *Epoll) validFd(fd int) bool {
+	return fd >= 0 && fd <= ep.maxFd
+}
+
+// isClosed reports whether Close() was called.
+func (ep *Epoll) isClosed() bool {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	return ep.closed
+}
+
+// invalidFd returns error for descriptor which is out of allowed range.
+// Closed instance returns ErrClosed for any descriptor, so cleanup code,
+// e.g. in callbacks called by Close(), gets the same error even if the
+// descriptor is closed already.
+func (ep *Epoll) invalidFd() error {
+	if ep.isClosed() {
+		return ErrClosed
+	}
+	return ErrInvalidFD
+}
+
+// closeFd closes epoll descriptor once. It is called by the wait loop on
+// exit, and by Close() when there is no wait loop.
+func (ep *Epoll) closeFd() error {
+	if !atomic.CompareAndSwapInt32(&ep.fdClosed, 0, 1) {
+		return nil
+	}
+	return ep.sys.Close(ep.fd)
+}
+
+// closeNotifier is used to wake up the wait loop when Epoll is closed.
+type closeNotifier interface {
+	// write makes fd() readable.
+	write() error
+	// fd returns descriptor which is registered in epoll instance.
+	fd() int
+	// close releases underlying resources.
+	close() error
+}
+
+// newCloseNotifier creates eventfd based notifier. It falls back to the pipe
+// based one if eventfd2 syscall is not available (Linux < 2.6.27).
+func newCloseNotifier(sys syscallInterface, l Logger) (closeNotifier, error) {
+	fd, err := sys.Eventfd()
+	if err == nil {
+		return eventfdNotifier{fd, sys}, nil
+	}
+	if err != unix.ENOSYS {
+		return nil, fmt.Errorf("netpoll: eventfd2: %w", err)
+	}
+	l.Printf("netpoll: eventfd2 is not available, falling back to pipe")
+
+	var p [2]int
+	if err := sys.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return nil, fmt.Errorf("netpoll: pipe2: %w", err)
+	}
+	return pipeNotifier{r: p[0], w: p[1], sys: sys}, nil
+}
+
 // closeBytes used for writing to eventfd.
 var closeBytes = []byte{1, 0, 0, 0, 0, 0, 0, 0}
 
+// eventfdNotifier is a closeNotifier backed by eventfd.
+type eventfdNotifier struct {
+	efd int
+	sys syscallInterface
+}
+
+func (e eventfdNotifier) write() error {
+	_, err := e.sys.Write(e.efd, closeBytes)
+	return err
+}
+
+func (e eventfdNotifier) fd() int {
+	return e.efd
+}
+
+func (e eventfdNotifier) close() error {
+	return e.sys.Close(e.efd)
+}
+
+// pipeNotifier is a closeNotifier backed by pipe.
+type pipeNotifier struct {
+	r, w int
+	sys  syscallInterface
+}
+
+func (p pipeNotifier) write() error {
+	_, err := p.sys.Write(p.w, closeBytes[:1])
+	return err
+}
+
+func (p pipeNotifier) fd() int {
+	return p.r
+}
+
+func (p pipeNotifier) close() error {
+	err := p.sys.Close(p.w)
+	if err2 := p.sys.Close(p.r); err == nil {
+		err = err2
+	}
+	return err
+}
+
 // Close stops wait loop and closes all underlying resources.
+//
+// Only the first call does the work and returns its error. Subsequent and
+// concurrent calls block until the first one releases resources and return
+// ErrClosed then; note that they do not wait for callbacks called with
+// EPOLLCLOSED, so they are safe to be made from there.
+//
+// If the wait loop could not be woken up, Close() returns the error, but only
+// after the loop is stopped: it retries the wake up every closeWakeRetry,
+// and the loop also stops on any other return from epoll_wait(2).
+//
+// Callbacks are called with EPOLLCLOSED without locks held, so they could
+// call methods of the instance, which return ErrClosed then. By default they
+// are called one after another by the goroutine which releases resources,
+// in order of registration, see EpollConfig.ReverseCloseOrder. Large
+// instances or EpollConfig.CloseWorkers spread them over several
+// goroutines. Close() returns and Done() is closed after all of them return.
 func (ep *Epoll) Close() (err error) {
 	ep.mu.Lock()
-	{
-		if ep.closed {
-			ep.mu.Unlock()
-			return ErrClosed
-		}
-		ep.closed = true
+	if ep.closed {
+		ep.mu.Unlock()
+		<-ep.closeDone
+		return ErrClosed
+	}
+	ep.closed = true
+	atomic.StoreInt32(&ep.stopping, 1)
+	wakeErr := ep.notifier.write()
+	ep.mu.Unlock()
 
-		if _, err = unix.Write(ep.eventFd, closeBytes); err != nil {
-			ep.mu.Unlock()
+	switch {
+	case ep.noLoop:
+		// Нет цикла ожидания, который закроет дескриптор epoll за нас.
+		err = ep.closeFd()
+		close(ep.waitDone)
+	case wakeErr != nil && wakeErr != unix.EAGAIN:
+		// Цикл ожидания не разбудить: повторяем попытки, пока он не
+		// завершится. Ресурсы освобождаем только после его выхода, иначе
+		// он останется ждать на закрытом дескрипторе
+		err = wakeErr
+		ep.rewake()
+	default:
+		// EAGAIN означает, что уведомление уже ожидает чтения.
+		<-ep.waitDone
+	}
+
+	if rerr := ep.release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// closeWakeRetry is the interval of wake up retries made by Close() if the
+// first one fails.
+const closeWakeRetry = 10 * time.Millisecond
+
+// rewake retries to wake the wait loop up until it exits.
+func (ep *Epoll) rewake() {
+	t := time.NewTicker(closeWakeRetry)
+	defer t.Stop()
+	for {
+		select {
+		case <-ep.waitDone:
 			return
+		case <-t.C:
+			ep.notifier.write()
 		}
 	}
-	ep.mu.Unlock()
-
-	<-ep.waitDone
+}
 
-	if err = unix.Close(ep.eventFd); err != nil {
+// closeSelf closes the instance from the wait loop after its fatal error, see
+// FatalCloseSelf. Unlike Close() it does not wake up and wait for the loop,
+// which has exited already.
+func (ep *Epoll) closeSelf(onError func(error), cause error, iter uint64) {
+	ep.mu.Lock()
+	if ep.closed {
+		// Close() ждет завершения цикла и освободит ресурсы сам
+		ep.mu.Unlock()
 		return
 	}
+	ep.closed = true
+	ep.err = cause
+	ep.mu.Unlock()
+
+	if err := ep.release(); err != nil {
+		ep.waitError(onError, err, iter)
+	}
+}
+
+// release frees resources of the instance and notifies registered callbacks
+// about closing. It is called once, after the wait loop is stopped.
+func (ep *Epoll) release() (err error) {
+	err = ep.notifier.close()
+	defer close(ep.done)
 
 	ep.mu.Lock()
 	// Set callbacks to nil preventing long mu.Lock() hold.
@@ -153,143 +715,979 @@ func (ep *Epoll) Close() (err error) {
 	// current epoll instance.
 	// Setting callbacks to nil is safe here because no one should read after
 	// closed flag is true.
-	callbacks := ep.callbacks
-	ep.callbacks = nil
+	callbacks, n := ep.callbacks, ep.count
+	links, head, tail := ep.links, ep.head, ep.tail
+	ep.callbacks, ep.count = nil, 0
+	ep.links, ep.head, ep.tail = nil, -1, -1
 	ep.mu.Unlock()
+	close(ep.closeDone)
 
-	for _, cb := range callbacks {
-		if cb != nil {
-			cb(_EPOLLCLOSED)
+	if n > 0 && ep.trace != nil {
+		ep.trace.Log(LogRecord{
+			Level:   LevelWarn,
+			Message: "descriptors are still registered on close",
+			Poller:  ep.name,
+			Op:      "close",
+			FD:      -1,
+			Count:   n,
+		})
+	}
+
+	ep.idle.begin()
+	defer ep.idle.end()
+	ordered := make([]epollHandler, 0, n)
+	if ep.reverseClose {
+		for fd := tail; fd >= 0; fd = links[fd].prev {
+			ordered = append(ordered, callbacks[fd])
+		}
+	} else {
+		for fd := head; fd >= 0; fd = links[fd].next {
+			ordered = append(ordered, callbacks[fd])
 		}
 	}
+	notifyClosed(ordered, closeWorkers(ep.closeWorkers, n))
 
 	return
 }
 
-// Add добавляет файловые дескрипторы для отслеживания с помощью epoll
+const (
+	// closeParallelMin is a number of registrations per goroutine calling
+	// callbacks on Close() when EpollConfig.CloseWorkers is zero.
+	closeParallelMin = 1 << 16
+	// closeBatch is a number of callbacks table items processed by
+	// Close() goroutine at once.
+	closeBatch = 4096
+)
+
+func closeWorkers(limit, n int) int {
+	if limit <= 0 {
+		limit = runtime.GOMAXPROCS(0)
+	}
+	if w := n / closeParallelMin; w < limit {
+		limit = w
+	}
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
+
+// notifyClosed calls each non-nil callback with _EPOLLCLOSED event using
+// given number of goroutines. Goroutines take batches of callbacks in turn,
+// so callbacks are called in order of the slice when workers is 1.
+func notifyClosed(callbacks []epollHandler, workers int) {
+	// Notified callbacks are dropped from the slice, so they could be
+	// collected while the rest is notified.
+	notify := func(callbacks []epollHandler) {
+		for i, cb := range callbacks {
+			if cb != nil {
+				callbacks[i] = nil
+				cb.handleEpoll(_EPOLLCLOSED)
+			}
+		}
+	}
+	if workers <= 1 {
+		notify(callbacks)
+		return
+	}
+	var (
+		wg   sync.WaitGroup
+		next int64
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				end := int(atomic.AddInt64(&next, closeBatch))
+				begin := end - closeBatch
+				if begin >= len(callbacks) {
+					return
+				}
+				if end > len(callbacks) {
+					end = len(callbacks)
+				}
+				notify(callbacks[begin:end])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// epollStats holds counters of EpollStats. It is allocated separately to
+// keep 64-bit fields aligned for atomic access on 32-bit platforms.
+type epollStats struct {
+	iterations uint64
+	events     uint64
+	busy       int64
+	suppressed uint64
+}
+
+// Name returns the name of the instance, see EpollConfig.Name.
+func (ep *Epoll) Name() string {
+	return ep.name
+}
+
+// Done returns a channel which is closed when the instance is closed, either
+// by Close() or by the wait loop, see EpollConfig.FatalPolicy, and callbacks
+// have been called with EPOLLCLOSED.
+func (ep *Epoll) Done() <-chan struct{} {
+	return ep.done
+}
+
+// Err returns the fatal error which made the wait loop close the instance.
+// It returns nil if the instance is open or is closed by Close().
+func (ep *Epoll) Err() error {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	return ep.err
+}
+
+// Stats returns counters of the wait loop work. Counters are zero if
+// EpollConfig.CollectStats is not set. It is safe to call it concurrently
+// with the wait loop.
+func (ep *Epoll) Stats() (s EpollStats) {
+	s.Poller = ep.name
+	ep.mu.RLock()
+	s.Descriptors = ep.count
+	ep.mu.RUnlock()
+	if ep.stats == nil {
+		return s
+	}
+	s.Iterations = atomic.LoadUint64(&ep.stats.iterations)
+	s.Events = atomic.LoadUint64(&ep.stats.events)
+	s.BusyTime = time.Duration(atomic.LoadInt64(&ep.stats.busy))
+	s.Suppressed = atomic.LoadUint64(&ep.stats.suppressed)
+	return s
+}
+
+// WaitIdle blocks until callbacks which are called at the moment return, or
+// ctx is done. In the latter case ctx.Err() is returned.
+// It must not be called from callbacks.
+func (ep *Epoll) WaitIdle(ctx context.Context) error {
+	return ep.idle.wait(ctx)
+}
+
+// HandlerID identifies a registration made by Epoll.Add(). IDs are unique
+// within an Epoll instance, so a stale ID does not match a later
+// registration of the same descriptor.
+type HandlerID uint64
+
+// handlerID returns new ID for registration of fd. Lower 32 bits of ID hold
+// fd, so the registration is found without lookup table.
+func (ep *Epoll) handlerID(fd int) HandlerID {
+	return HandlerID(atomic.AddUint64(&ep.lastID, 1)<<32 | uint64(uint32(fd)))
+}
+
+func (id HandlerID) fd() int {
+	return int(uint32(id))
+}
+
+// Add добавляет файловые дескрипторы для отслеживания с помощью epoll и
+// возвращает идентификатор регистрации для DelHandler()
 // Важно! _EPOLLCLOSED вызывается для каждого коллбека когда epoll закрывается
-func (ep *Epoll) Add(fd int, events EpollEvent, cb func(EpollEvent)) (err error) {
+func (ep *Epoll) Add(fd int, events EpollEvent, cb func(EpollEvent)) (HandlerID, error) {
+	if cb == nil {
+		cb = nopCallback
+	}
+	return ep.add(fd, events, epollFunc(cb), false)
+}
+
+// AddPaused регистрирует коллбек для дескриптора, но не добавляет его к
+// отслеживанию в ядре: события не приходят до вызова Mod(), который делает
+// это с переданной маской. Del() и Close() работают как обычно
+func (ep *Epoll) AddPaused(fd int, cb func(EpollEvent)) (HandlerID, error) {
+	if cb == nil {
+		cb = nopCallback
+	}
+	return ep.add(fd, 0, epollFunc(cb), true)
+}
+
+// AddSimple is the same as Add() but does not return ID of registration.
+func (ep *Epoll) AddSimple(fd int, events EpollEvent, cb func(EpollEvent)) error {
+	_, err := ep.Add(fd, events, cb)
+	return err
+}
+
+// add registers fd with handler h which must not be nil. Paused fd is not
+// added to the kernel interest list.
+func (ep *Epoll) add(fd int, events EpollEvent, h epollHandler, paused bool) (id HandlerID, err error) {
+	if !ep.validFd(fd) {
+		return 0, ep.invalidFd()
+	}
+
 	// Создаем ивент
 	ev := &unix.EpollEvent{
 		Events: uint32(events),
 		Fd:     int32(fd),
 	}
 
+	defer ep.traceCtl("add", fd, events, &err)
+
+	// Предупреждение о приближении к лимиту вызывается после снятия блокировки
+	var soft int
+	defer func() { ep.soft.notify(soft) }()
+
 	ep.mu.Lock()
 	defer ep.mu.Unlock()
 
 	if ep.closed {
-		return ErrClosed
+		return 0, ErrClosed
 	}
 
 	// Проверяем, не сохранен ли уже коллбек для данного файлового дескриптора
-	if _, has := ep.callbacks[fd]; has {
-		return ErrRegistered
+	if ep.registered(fd) {
+		return 0, ErrRegistered
+	}
+	if ep.maxCount > 0 && ep.count >= ep.maxCount {
+		return 0, ErrTooManyDescriptors
 	}
 	// Сохраняем коллбек
-	ep.callbacks[fd] = cb
+	ep.grow(fd)
+	ep.callbacks[fd] = h
+	ep.count++
+	ep.link(fd)
+	id = ep.handlerID(fd)
+	ep.links[fd].id = id
+	ep.links[fd].paused = paused
+	ep.links[fd].held = false
+	if paused {
+		soft = ep.soft.added(ep.count)
+		return id, nil
+	}
 
 	// Подключаем файловый дескриптор к отслеживанию с помощью epoll
-	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_ADD, fd, ev)
+	if err = ep.ctl(unix.EPOLL_CTL_ADD, fd, ev); err != nil {
+		// Откатываем сохранение коллбека, так как дескриптор не добавлен
+		ep.callbacks[fd] = nil
+		ep.count--
+		ep.unlink(fd)
+		return 0, ctlError(err)
+	}
+	soft = ep.soft.added(ep.count)
+	return id, nil
+}
+
+// epollHandler receives events of a registered descriptor. Storing
+// interface lets to register objects which already exist, such as *Desc,
+// without allocating a closure for each of them.
+type epollHandler interface {
+	handleEpoll(EpollEvent)
+}
+
+// epollFunc adapts callback passed to Add() to epollHandler.
+type epollFunc func(EpollEvent)
+
+func (fn epollFunc) handleEpoll(ev EpollEvent) { fn(ev) }
+
+// nopCallback is stored for registrations with nil callback.
+func nopCallback(EpollEvent) {}
+
+// registered reports whether fd has a callback. It must be called with
+// ep.mu held.
+func (ep *Epoll) registered(fd int) bool {
+	return fd < len(ep.callbacks) && ep.callbacks[fd] != nil
+}
+
+// grow makes callbacks table large enough to hold fd. Table is at least
+// doubled, so Add() takes amortized constant time. It must be called with
+// ep.mu held for writing.
+func (ep *Epoll) grow(fd int) {
+	if fd < len(ep.callbacks) {
+		return
+	}
+	n := 2 * len(ep.callbacks)
+	if n <= fd {
+		n = fd + 1
+	}
+	if n < 64 {
+		n = 64
+	}
+	if n > ep.maxFd+1 {
+		n = ep.maxFd + 1
+	}
+	callbacks := make([]epollHandler, n)
+	copy(callbacks, ep.callbacks)
+	ep.callbacks = callbacks
+	links := make([]epollLink, n)
+	copy(links, ep.links)
+	ep.links = links
 }
 
-// Del удаляет файловый дескриптор из отслеживания с помощью epoll
+// epollLink is an item of the list of registrations.
+type epollLink struct {
+	prev, next int32
+	id         HandlerID
+	// paused is true for registration made by AddPaused() until Mod().
+	paused bool
+	// held is true for registration paused by pause() until unpause().
+	// Mod() does not re-arm such registration.
+	held bool
+}
+
+// link appends fd to the end of the list of registrations. It must be
+// called with ep.mu held for writing.
+func (ep *Epoll) link(fd int) {
+	l := &ep.links[fd]
+	l.prev, l.next = ep.tail, -1
+	if ep.tail >= 0 {
+		ep.links[ep.tail].next = int32(fd)
+	} else {
+		ep.head = int32(fd)
+	}
+	ep.tail = int32(fd)
+}
+
+// unlink removes fd from the list of registrations. It must be called with
+// ep.mu held for writing.
+func (ep *Epoll) unlink(fd int) {
+	l := ep.links[fd]
+	if l.prev >= 0 {
+		ep.links[l.prev].next = l.next
+	} else {
+		ep.head = l.next
+	}
+	if l.next >= 0 {
+		ep.links[l.next].prev = l.prev
+	} else {
+		ep.tail = l.prev
+	}
+}
+
+// Del удаляет файловый дескриптор из отслеживания с помощью epoll независимо
+// от идентификатора регистрации
 func (ep *Epoll) Del(fd int) (err error) {
+	if !ep.validFd(fd) {
+		return ep.invalidFd()
+	}
+
+	defer ep.traceCtl("del", fd, 0, &err)
+
+	// Коллбек удаленной регистрации вызывается после снятия блокировки
+	var removed epollHandler
+	defer func() { ep.notifyDel(removed) }()
+
 	ep.mu.Lock()
 	defer ep.mu.Unlock()
 
 	if ep.closed {
 		return ErrClosed
 	}
-	if _, ok := ep.callbacks[fd]; !ok {
+	if !ep.registered(fd) {
 		return ErrNotRegistered
 	}
+	removed = ep.callbacks[fd]
+	return ep.del(fd)
+}
+
+// DelHandler удаляет регистрацию, сделанную Add(), по ее идентификатору.
+// Если дескриптор был с тех пор удален или зарегистрирован заново,
+// возвращается ErrNotRegistered
+func (ep *Epoll) DelHandler(id HandlerID) (err error) {
+	fd := id.fd()
+	if !ep.validFd(fd) {
+		return ep.invalidFd()
+	}
+
+	defer ep.traceCtl("del", fd, 0, &err)
 
-	// Удаляем коллбек
-	delete(ep.callbacks, fd)
+	var removed epollHandler
+	defer func() { ep.notifyDel(removed) }()
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.closed {
+		return ErrClosed
+	}
+	if !ep.registered(fd) || ep.links[fd].id != id {
+		return ErrNotRegistered
+	}
+	removed = ep.callbacks[fd]
+	return ep.del(fd)
+}
+
+// notifyDel calls handler h removed by Del() or DelHandler() with
+// _EPOLLCLOSED if EpollConfig.NotifyOnDel is set. It must be called without
+// ep.mu held.
+func (ep *Epoll) notifyDel(h epollHandler) {
+	if h != nil && ep.notifyOnDel {
+		h.handleEpoll(_EPOLLCLOSED)
+	}
+}
+
+// del removes registration of fd. It must be called with ep.mu held for
+// writing.
+func (ep *Epoll) del(fd int) error {
+	// Удаляем коллбек. Он удаляется даже при ошибке, так как в этом случае
+	// дескриптор уже не отслеживается ядром
+	ep.callbacks[fd] = nil
+	ep.count--
+	ep.soft.removed(ep.count)
+	ep.unlink(fd)
+	if ep.links[fd].paused {
+		// Ядро о дескрипторе не знает
+		return nil
+	}
 
 	// Удаляем файловый дескриптор
-	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_DEL, fd, nil)
+	return ctlError(ep.ctl(unix.EPOLL_CTL_DEL, fd, nil))
 }
 
-// Mod изменяет настройки для отслеживания файлового дескриптора
+// Mod изменяет настройки для отслеживания файлового дескриптора.
+// Дескриптор, зарегистрированный AddPaused(), добавляется к отслеживанию в ядре
 func (ep *Epoll) Mod(fd int, events EpollEvent) (err error) {
+	if !ep.validFd(fd) {
+		return ep.invalidFd()
+	}
+
 	// Создаем ивент
 	ev := &unix.EpollEvent{
 		Events: uint32(events),
 		Fd:     int32(fd),
 	}
 
+	defer ep.traceCtl("mod", fd, events, &err)
+
 	ep.mu.RLock()
-	defer ep.mu.RUnlock()
+	paused, err := ep.mod(fd, ev)
+	ep.mu.RUnlock()
+	if !paused {
+		return err
+	}
 
+	// Добавление приостановленного дескриптора меняет состояние регистрации,
+	// поэтому делается под блокировкой на запись
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.modPaused(fd, ev)
+}
+
+// modPaused is the same as mod() but also adds fd registered by AddPaused()
+// to the kernel interest list. It must be called with ep.mu held for
+// writing.
+func (ep *Epoll) modPaused(fd int, ev *unix.EpollEvent) error {
+	paused, err := ep.mod(fd, ev)
+	if !paused {
+		return err
+	}
+	if err = ep.ctl(unix.EPOLL_CTL_ADD, fd, ev); err != nil {
+		return ctlError(err)
+	}
+	ep.links[fd].paused = false
+	return nil
+}
+
+// pause disarms fd until unpause(), so Mod() calls made meanwhile, e.g. by
+// auto resume, do nothing. Registration is modified with empty event set,
+// which still receives EPOLLHUP and EPOLLERR; EPOLLONESHOT makes them to be
+// delivered once. It returns nil if fd is paused already.
+func (ep *Epoll) pause(fd int) (err error) {
+	if !ep.validFd(fd) {
+		return ep.invalidFd()
+	}
+	defer ep.traceCtl("mod", fd, EPOLLONESHOT, &err)
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
 	if ep.closed {
 		return ErrClosed
 	}
-	if _, ok := ep.callbacks[fd]; !ok {
+	if !ep.registered(fd) {
 		return ErrNotRegistered
 	}
+	l := &ep.links[fd]
+	if l.held {
+		return nil
+	}
+	if !l.paused {
+		// Ядро о дескрипторе знает, снимаем его готовность.
+		ev := unix.EpollEvent{Events: uint32(EPOLLONESHOT), Fd: int32(fd)}
+		if err = ep.ctl(unix.EPOLL_CTL_MOD, fd, &ev); err != nil {
+			return ctlError(err)
+		}
+	}
+	l.held = true
+	return nil
+}
+
+// unpause re-arms fd paused by pause() with events. It returns nil if fd is
+// not paused.
+func (ep *Epoll) unpause(fd int, events EpollEvent) (err error) {
+	if !ep.validFd(fd) {
+		return ep.invalidFd()
+	}
+	defer ep.traceCtl("mod", fd, events, &err)
 
-	// Изменяем настройки
-	return unix.EpollCtl(ep.fd, unix.EPOLL_CTL_MOD, fd, ev)
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.closed {
+		return ErrClosed
+	}
+	if !ep.registered(fd) {
+		return ErrNotRegistered
+	}
+	if !ep.links[fd].held {
+		return nil
+	}
+	ep.links[fd].held = false
+	ev := unix.EpollEvent{Events: uint32(events), Fd: int32(fd)}
+	if err = ep.modPaused(fd, &ev); err != nil {
+		ep.links[fd].held = true
+	}
+	return err
 }
 
-const (
-	maxWaitEventsBegin = 1024
-	maxWaitEventsStop  = 32768
-)
+// mod changes events of fd if it is registered and neither paused nor held.
+// It must be called with ep.mu held.
+func (ep *Epoll) mod(fd int, ev *unix.EpollEvent) (paused bool, err error) {
+	if ep.closed {
+		return false, ErrClosed
+	}
+	if !ep.registered(fd) {
+		return false, ErrNotRegistered
+	}
+	if ep.links[fd].held {
+		// Приостановлен pause(): ждем unpause().
+		return false, nil
+	}
+	if ep.links[fd].paused {
+		return true, nil
+	}
+
+	// Изменяем настройки. Если ядро не знает о дескрипторе, коллбек остается
+	// до вызова Del()
+	return false, ctlError(ep.ctl(unix.EPOLL_CTL_MOD, fd, ev))
+}
+
+// ctl makes epoll_ctl() call on the instance, retrying it after EINTR as
+// configured by EpollConfig.CtlRetries. It must be called with ep.mu held.
+func (ep *Epoll) ctl(op, fd int, ev *unix.EpollEvent) error {
+	err := ep.epollCtl(op, fd, ev)
+	for i := 0; err == unix.EINTR && i < ep.ctlRetries; i++ {
+		err = ep.epollCtl(op, fd, ev)
+	}
+	return err
+}
+
+// epollCtl calls unix.EpollCtl() directly when the instance uses real
+// syscalls. Passing ev through syscallInterface makes it escape, so callers
+// could not keep it on the stack and registration would allocate.
+func (ep *Epoll) epollCtl(op, fd int, ev *unix.EpollEvent) error {
+	if _, ok := ep.sys.(realSyscalls); ok {
+		return unix.EpollCtl(ep.fd, op, fd, ev)
+	}
+	if ev == nil {
+		return ep.sys.EpollCtl(ep.fd, op, fd, nil)
+	}
+	arg := *ev
+	return ep.sys.EpollCtl(ep.fd, op, fd, &arg)
+}
+
+// CtlError is returned by Epoll Add(), Mod() and Del() methods when
+// epoll_ctl() fails with an errno that has a package-level meaning.
+// It matches Err by errors.Is() and unwraps to Errno, so the original errno
+// could be retrieved by errors.As().
+type CtlError struct {
+	Err   error
+	Errno syscall.Errno
+}
+
+func (e *CtlError) Error() string {
+	return e.Err.Error() + ": " + e.Errno.Error()
+}
+
+// Is reports whether target is e.Err.
+func (e *CtlError) Is(target error) bool {
+	return target == e.Err
+}
+
+// Unwrap returns e.Errno.
+func (e *CtlError) Unwrap() error {
+	return e.Errno
+}
+
+// ctlError translates epoll_ctl() errno to package errors.
+// Other errors are returned as is.
+func ctlError(err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	var pkg error
+	switch errno {
+	case unix.EEXIST:
+		pkg = ErrRegistered
+	case unix.ENOENT:
+		pkg = ErrNotRegistered
+	case unix.EPERM:
+		pkg = ErrNotPollable
+	case unix.EBADF:
+		pkg = ErrDescInvalid
+	default:
+		return err
+	}
+	return &CtlError{Err: pkg, Errno: errno}
+}
+
+// traceCtl writes registration lifecycle record to the structured logger.
+// It is called after the lock is released.
+func (ep *Epoll) traceCtl(op string, fd int, events EpollEvent, err *error) {
+	if ep.trace == nil {
+		return
+	}
+	rec := LogRecord{
+		Level:   LevelDebug,
+		Message: "registration " + op,
+		Poller:  ep.name,
+		Op:      op,
+		FD:      fd,
+		Err:     *err,
+	}
+	if events != 0 {
+		rec.Events = events.String()
+	}
+	ep.trace.Log(rec)
+}
+
+// waitError reports an error occurred in the wait loop on given iteration.
+func (ep *Epoll) waitError(onError func(error), err error, iter uint64) {
+	if onError != nil {
+		onError(err)
+		return
+	}
+	logRecord(ep.log, LogRecord{
+		Level:     LevelError,
+		Message:   "wait loop error",
+		Poller:    ep.name,
+		Op:        "wait",
+		FD:        -1,
+		Err:       err,
+		Iteration: iter,
+	})
+}
+
+// Poll returns events which are ready at the moment without blocking and
+// without calling registered callbacks. It returns at most
+// EpollConfig.InitialBatchSize events per call; the rest of them will be
+// returned by subsequent calls.
+//
+// Poll is intended for integration into an existing event loop. It should be
+// used with an instance created with DisableWaitLoop option; otherwise events
+// are shared between the wait loop and Poll() callers in unspecified way.
+func (ep *Epoll) Poll() ([]FDEvent, error) {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+
+	if ep.closed {
+		return nil, ErrClosed
+	}
+
+	ep.pollMu.Lock()
+	defer ep.pollMu.Unlock()
+
+	if ep.pollEvents == nil {
+		ep.pollEvents = make([]unix.EpollEvent, ep.batchBegin)
+	}
+	var (
+		n   int
+		err error
+	)
+	for {
+		n, err = ep.sys.EpollWait(ep.fd, ep.pollEvents, 0)
+		if err == nil || !IsTemporaryError(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]FDEvent, 0, n)
+	for _, ev := range ep.pollEvents[:n] {
+		fd := int(ev.Fd)
+		if fd == ep.notifier.fd() {
+			continue
+		}
+		ret = append(ret, FDEvent{
+			FD:     fd,
+			Events: EpollEvent(ev.Events),
+		})
+	}
+	return ret, nil
+}
+
+// jitter returns random duration in [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
 
 func (ep *Epoll) wait(onError func(error)) {
-	// Отложенная функция, которая автоматически закрывает файловый дескриптор epoll и канал завершения работы
+	// Номер итерации цикла ожидания
+	var iter uint64
+	// Фатальная ошибка, из-за которой цикл завершился
+	var fatal error
+
+	// Отложенная функция, которая автоматически закрывает файловый дескриптор epoll и канал завершения работы.
+	// После этого применяем FatalPolicy: паника здесь уже не перехватывается
+	// recover() ниже, поэтому завершает процесс
 	defer func() {
-		if err := unix.Close(ep.fd); err != nil {
-			onError(err)
+		if err := ep.closeFd(); err != nil {
+			ep.waitError(onError, err, iter)
 		}
 		close(ep.waitDone)
+		if fatal == nil {
+			return
+		}
+		switch ep.fatal {
+		case FatalCloseSelf:
+			ep.closeSelf(onError, fatal, iter)
+		case FatalPanic:
+			panic(&PollerError{Poller: ep.name, Op: "wait", FD: -1, Err: fatal})
+		}
+	}()
+	// Паника внутри цикла не должна терять стек: передаем его в onError.
+	// После этого цикл завершается, а Close() остается обязательным
+	defer func() {
+		if r := recover(); r != nil {
+			ep.waitError(onError, fmt.Errorf("wait loop panic: %v\n%s", r, debug.Stack()), iter)
+		}
 	}()
 
-	// Создаем начальные массивы для событий и коллбеков для цикла
-	events := make([]unix.EpollEvent, maxWaitEventsBegin)
-	callbacks := make([]func(EpollEvent), 0, maxWaitEventsBegin)
+	// Начальный массив событий создан в EpollCreate(), коллбеки создаем здесь.
+	// Массив событий освобождаем после выхода из epoll_wait(), если он
+	// выделен вне кучи Go
+	events := ep.waitEvents
+	ep.waitEvents = nil
+	defer func() { ep.buffers.free(events) }()
+	callbacks := make([]epollHandler, 0, ep.batchBegin)
 
-	for {
+	// Накопитель масок событий по дескрипторам для режима OrderedPerFD
+	var acc map[int]EpollEvent
+	if ep.ordered {
+		acc = make(map[int]EpollEvent)
+	}
+
+	// Количество подряд идущих EINTR
+	var eintr int
+
+	for ; ; iter++ {
 		// Ждем от системы когда что-то поменяется в отслеживаемых файловых дескрипторах
-		n, err := unix.EpollWait(ep.fd, events, -1)
+		n, err := ep.sys.EpollWait(ep.fd, events, minTimeout(ep.quiet.msec(), ep.stale.msec()))
+		if atomic.LoadInt32(&ep.stopping) != 0 {
+			// Close() уже вызван, даже если нас не удалось разбудить
+			return
+		}
+		if err == unix.EINTR {
+			if eintr++; ep.maxEINTR > 0 && eintr > ep.maxEINTR {
+				fatal = ErrTooManyEINTR
+				ep.waitError(onError, fatal, iter)
+				return
+			}
+			if ep.eintrBackoff > 0 {
+				time.Sleep(jitter(ep.eintrBackoff))
+			}
+			continue
+		}
+		eintr = 0
 		if err != nil {
-			if temporaryErr(err) {
+			if IsTemporaryError(err) {
 				continue
 			}
-			onError(err)
+			fatal = err
+			ep.waitError(onError, err, iter)
 			return
 		}
+		var busy time.Time
+		if ep.stats != nil {
+			busy = time.Now()
+		}
 
 		// Обновляем размер слайса коллбеков
 		callbacks = callbacks[:n]
 
-		// Получаем коллбеки для обновленных файловых дескрипторов
+		// Получаем коллбеки для обновленных файловых дескрипторов.
+		// Блокировка удерживается только на время копирования не более n
+		// указателей, а сами коллбеки вызываются без нее, поэтому Add() и
+		// Del() не ждут завершения коллбеков
 		ep.mu.RLock()
 		for i := 0; i < n; i++ {
 			fd := int(events[i].Fd)
-			if fd == ep.eventFd { // signal to close
+			if fd == ep.notifier.fd() { // signal to close
 				ep.mu.RUnlock()
 				return
 			}
-			callbacks[i] = ep.callbacks[fd]
+			if fd < len(ep.callbacks) {
+				callbacks[i] = ep.callbacks[fd]
+			}
 		}
 		ep.mu.RUnlock()
 
+		// Объединяем события одного дескриптора: коллбек вызывается только
+		// для первого вхождения дескриптора с накопленной маской
+		if acc != nil {
+			for i := 0; i < n; i++ {
+				fd := int(events[i].Fd)
+				ev, has := acc[fd]
+				if has {
+					callbacks[i] = nil
+				}
+				acc[fd] = ev | EpollEvent(events[i].Events)
+			}
+		}
+
 		// Вызываем коллбек для каждого обновленного файлового дескриптора
+		delivered := 0
+		ep.idle.begin()
 		for i := 0; i < n; i++ {
 			if cb := callbacks[i]; cb != nil {
-				cb(EpollEvent(events[i].Events))
+				delivered++
+				ev := EpollEvent(events[i].Events)
+				if acc != nil {
+					ev = acc[int(events[i].Fd)]
+				}
+				cb.handleEpoll(ev)
 				callbacks[i] = nil
 			}
 		}
+		ep.idle.end()
+		for fd := range acc {
+			delete(acc, fd)
+		}
+		ep.quiet.update(delivered > 0)
+		ep.sweepStale()
+		if ep.stats != nil {
+			atomic.AddUint64(&ep.stats.iterations, 1)
+			atomic.AddUint64(&ep.stats.events, uint64(delivered))
+			atomic.AddInt64(&ep.stats.busy, int64(time.Since(busy)))
+		}
 
 		// Расширяем при необходимости массивый элементов если не слезало
-		if n == len(events) && n*2 <= maxWaitEventsStop {
-			events = make([]unix.EpollEvent, n*2)
-			callbacks = make([]func(EpollEvent), 0, n*2)
+		if n == len(events) && n < ep.batchMax {
+			m := n * 2
+			if m > ep.batchMax {
+				m = ep.batchMax
+			}
+			// Если память на узле NUMA кончилась, продолжаем со старым массивом
+			if grown, err := ep.buffers.alloc(m); err == nil {
+				ep.buffers.free(events)
+				events = grown
+				callbacks = make([]epollHandler, 0, m)
+			}
+		}
+	}
+}
+
+// minTimeout returns the shortest of epoll_wait() timeouts a and b, where
+// negative value means infinite timeout.
+func minTimeout(a, b int) int {
+	if a < 0 || b >= 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// staleSweep holds state of the checks enabled by
+// EpollConfig.StaleCheckInterval. It is used by the wait goroutine only, so
+// it is not synchronized.
+type staleSweep struct {
+	interval time.Duration
+	batch    int
+	remove   bool
+	fn       func(fd int, h epollHandler)
+	// next is the time of the next check, which starts from cursor
+	// descriptor.
+	next   time.Time
+	cursor int
+	// found holds registrations to be checked, kept to avoid allocations.
+	found []staleEntry
+}
+
+type staleEntry struct {
+	fd int
+	id HandlerID
+}
+
+func newStaleSweep(config *EpollConfig) staleSweep {
+	if config.StaleCheckInterval <= 0 || config.onStale == nil && !config.RemoveStale {
+		return staleSweep{}
+	}
+	return staleSweep{
+		interval: config.StaleCheckInterval,
+		batch:    config.StaleCheckBatch,
+		remove:   config.RemoveStale,
+		fn:       config.onStale,
+		next:     time.Now().Add(config.StaleCheckInterval),
+	}
+}
+
+// msec returns time left until the next check in milliseconds rounded up, or
+// -1 if the checks are disabled.
+func (s *staleSweep) msec() int {
+	if s.interval <= 0 {
+		return -1
+	}
+	d := time.Until(s.next)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// sweepStale checks next batch of registrations if it is time to.
+func (ep *Epoll) sweepStale() {
+	s := &ep.stale
+	if s.interval <= 0 || time.Now().Before(s.next) {
+		return
+	}
+	// Следующая проверка отсчитывается от конца текущей, чтобы медленные
+	// коллбеки не вызывали проверки подряд
+	defer func() {
+		s.next = time.Now().Add(s.interval)
+	}()
+
+	// Собираем зарегистрированные дескрипторы, начиная с курсора. Пустые
+	// ячейки таблицы тоже ограничены, чтобы проход по разреженной таблице
+	// не занимал цикл надолго
+	s.found = s.found[:0]
+	ep.mu.RLock()
+	if ep.closed {
+		ep.mu.RUnlock()
+		return
+	}
+	n := len(ep.callbacks)
+	for i := 0; i < n && i < 64*s.batch && len(s.found) < s.batch; i++ {
+		if s.cursor >= n {
+			s.cursor = 0
+		}
+		fd := s.cursor
+		s.cursor++
+		if ep.callbacks[fd] != nil {
+			s.found = append(s.found, staleEntry{fd, ep.links[fd].id})
+		}
+	}
+	ep.mu.RUnlock()
+
+	// Проверяем дескрипторы без блокировки: регистрация могла измениться,
+	// поэтому перед удалением сверяем ее идентификатор
+	for _, e := range s.found {
+		if checkFd(e.fd) != unix.EBADF {
+			continue
+		}
+		ep.mu.Lock()
+		if ep.closed || !ep.registered(e.fd) || ep.links[e.fd].id != e.id {
+			ep.mu.Unlock()
+			continue
+		}
+		h := ep.callbacks[e.fd]
+		if s.remove {
+			// Ядро уже удалило дескриптор, поэтому ошибка ожидаема
+			ep.del(e.fd)
+		}
+		ep.mu.Unlock()
+		if s.fn != nil {
+			s.fn(e.fd, h)
 		}
 	}
 }
@@ -0,0 +1,61 @@
+// +build linux
+
+package netpoll
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll/numa"
+)
+
+// maxNumaEvents limits size of event arrays allocated on NUMA node, so they
+// could be addressed by array pointer on 32-bit platforms too.
+const maxNumaEvents = 1 << 26
+
+// eventBuffers allocates event arrays of the wait loop, see
+// EpollConfig.NumaBind. Zero value allocates them from Go heap.
+type eventBuffers struct {
+	numa bool
+	node int
+}
+
+func newEventBuffers(c *EpollConfig) (eventBuffers, error) {
+	if !c.NumaBind {
+		return eventBuffers{}, nil
+	}
+	if c.MaxBatchSize > maxNumaEvents {
+		return eventBuffers{}, ErrInvalidBatchSize
+	}
+	node := c.NumaNode
+	if node < 0 {
+		var err error
+		if node, err = numa.CurrentNode(); err != nil {
+			return eventBuffers{}, err
+		}
+	}
+	return eventBuffers{numa: true, node: node}, nil
+}
+
+// alloc returns array of n events.
+func (b eventBuffers) alloc(n int) ([]unix.EpollEvent, error) {
+	if !b.numa {
+		return make([]unix.EpollEvent, n), nil
+	}
+	mem, err := numa.NumaAlloc(n*int(unsafe.Sizeof(unix.EpollEvent{})), b.node)
+	if err != nil {
+		return nil, err
+	}
+	return (*[maxNumaEvents]unix.EpollEvent)(unsafe.Pointer(&mem[0]))[:n:n], nil
+}
+
+// free releases array returned by alloc(). Arrays from Go heap are left to
+// garbage collector.
+func (b eventBuffers) free(events []unix.EpollEvent) {
+	if !b.numa || cap(events) == 0 {
+		return
+	}
+	size := cap(events) * int(unsafe.Sizeof(unix.EpollEvent{}))
+	numa.NumaFree((*[maxNumaEvents * unsafe.Sizeof(unix.EpollEvent{})]byte)(unsafe.Pointer(&events[:1][0]))[:size:size])
+}
@@ -0,0 +1,52 @@
+// +build linux
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// syscallInterface describes system calls used by Epoll.
+// It makes possible to test Epoll without a real kernel.
+type syscallInterface interface {
+	EpollCreate1(flag int) (fd int, err error)
+	EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error
+	EpollWait(epfd int, events []unix.EpollEvent, msec int) (n int, err error)
+	Eventfd() (fd int, err error)
+	Pipe2(p []int, flags int) error
+	Write(fd int, p []byte) (n int, err error)
+	Close(fd int) error
+}
+
+// realSyscalls implements syscallInterface by making real system calls.
+type realSyscalls struct{}
+
+func (realSyscalls) EpollCreate1(flag int) (int, error) {
+	return unix.EpollCreate1(flag)
+}
+
+func (realSyscalls) EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error {
+	return unix.EpollCtl(epfd, op, fd, event)
+}
+
+func (realSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	return unix.EpollWait(epfd, events, msec)
+}
+
+func (realSyscalls) Eventfd() (int, error) {
+	r0, _, errno := unix.Syscall(unix.SYS_EVENTFD2, 0, 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r0), nil
+}
+
+func (realSyscalls) Pipe2(p []int, flags int) error {
+	return unix.Pipe2(p, flags)
+}
+
+func (realSyscalls) Write(fd int, p []byte) (int, error) {
+	return unix.Write(fd, p)
+}
+
+func (realSyscalls) Close(fd int) error {
+	return unix.Close(fd)
+}
@@ -4,69 +4,2035 @@ package netpoll
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll/numa"
 )
 
-func TestEpollCreate(t *testing.T) {
-	s, err := EpollCreate(epollConfig(t))
+func TestPollerStartAllocs(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	desc, _, _ := socketPairDesc(t)
+	cb := func(Event) {}
+	for _, test := range []struct {
+		name  string
+		start func() error
+	}{
+		{"Start", func() error { return poller.Start(desc, cb) }},
+		{"StartWithOptions", func() error { return poller.(FullPoller).StartWithOptions(desc, cb) }},
+	} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := test.start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s() allocates %v times; want 0", test.name, allocs)
+		}
+	}
+}
+
+func TestSockState(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+	var fds [2]int
+	if err = unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	var sock, pipe sockState
+	if !sock.is(r) {
+		t.Errorf("socket is not detected")
+	}
+	if pipe.is(fds[0]) {
+		t.Errorf("pipe is detected as socket")
+	}
+	// Result of the first check is kept.
+	if !sock.is(fds[0]) || pipe.is(r) {
+		t.Errorf("socket check is not cached")
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	for _, test := range []struct {
+		release string
+		exp     kernelVersion
+		ok      bool
+	}{
+		{"5.15.0-91-generic", kernelVersion{5, 15, 0}, true},
+		{"2.6.32-5-amd64", kernelVersion{2, 6, 32}, true},
+		{"4.19.0+", kernelVersion{4, 19, 0}, true},
+		{"6.1", kernelVersion{6, 1, 0}, true},
+		{"3.10.0.el7.x86_64", kernelVersion{3, 10, 0}, true},
+		{"", kernelVersion{}, false},
+		{"linux", kernelVersion{}, false},
+	} {
+		v, ok := parseKernelVersion(test.release)
+		if v != test.exp || ok != test.ok {
+			t.Errorf("parseKernelVersion(%q) = %v, %t; want %v, %t", test.release, v, ok, test.exp, test.ok)
+		}
+	}
+}
+
+func TestCheckKernel(t *testing.T) {
+	defer func(v bool) { epollRDHupAvailable = v }(epollRDHupAvailable)
+
+	for _, test := range []struct {
+		version  kernelVersion
+		rdhup    bool
+		warnings int
+	}{
+		{kernelVersion{5, 4, 0}, true, 0},
+		{kernelVersion{2, 6, 27}, true, 0},
+		{kernelVersion{2, 6, 26}, true, 1},
+		{kernelVersion{2, 6, 16}, false, 2},
+	} {
+		epollRDHupAvailable = true
+		var warnings int
+		checkKernel(test.version, LoggerFunc(func(string, ...interface{}) {
+			warnings++
+		}))
+		if epollRDHupAvailable != test.rdhup || warnings != test.warnings {
+			t.Errorf(
+				"checkKernel(%v) makes EPOLLRDHUP available: %t with %d warnings; want %t with %d",
+				test.version, epollRDHupAvailable, warnings, test.rdhup, test.warnings,
+			)
+		}
+		exp := EpollEvent(EPOLLIN)
+		if test.rdhup {
+			exp |= EPOLLRDHUP
+		}
+		if act := toEpollEvent(EventRead); act != exp {
+			t.Errorf("toEpollEvent(EventRead) is %v; want %v", act, exp)
+		}
+	}
+}
+
+func TestEpollCreate(t *testing.T) {
+	s, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEpollMaxFDs(t *testing.T) {
+	config := epollConfig(t)
+	config.MaxFDs = 1000
+	ep, err := epollCreate(config, scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+	if n := len(ep.callbacks); n < config.MaxFDs && n <= ep.maxFd {
+		t.Fatalf("callbacks table holds %d descriptors; want %d", n, config.MaxFDs)
+	}
+	table := &ep.callbacks[0]
+	for fd := 0; fd < len(ep.callbacks); fd++ {
+		if err := ep.AddSimple(fd, EPOLLIN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table != &ep.callbacks[0] {
+		t.Errorf("callbacks table is reallocated by Add()")
+	}
+}
+
+func TestEpollMaxDescriptors(t *testing.T) {
+	const max = 3
+	config := epollConfig(t)
+	config.MaxDescriptors = max
+	ep, err := epollCreate(config, scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCount := func(exp int) {
+		t.Helper()
+		if n := ep.Stats().Descriptors; n != exp {
+			t.Errorf("Stats().Descriptors is %d; want %d", n, exp)
+		}
+	}
+	for fd := 0; fd < max-1; fd++ {
+		if err := ep.AddSimple(fd, EPOLLIN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ep.AddPaused(max-1, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(max)
+	if err := ep.AddSimple(max, EPOLLIN, nil); err != ErrTooManyDescriptors {
+		t.Fatalf("Add() above the limit error is %v; want %v", err, ErrTooManyDescriptors)
+	}
+	if _, err := ep.AddPaused(max, nil); err != ErrTooManyDescriptors {
+		t.Fatalf("AddPaused() above the limit error is %v; want %v", err, ErrTooManyDescriptors)
+	}
+	checkCount(max)
+
+	if err := ep.Del(0); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(max - 1)
+	if err := ep.AddSimple(max, EPOLLIN, nil); err != nil {
+		t.Fatalf("Add() after Del() error is %v", err)
+	}
+	checkCount(max)
+
+	if err := ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(0)
+}
+
+func TestEpollCreatePipeFallback(t *testing.T) {
+	var logger testLogger
+	config := epollConfig(t)
+	config.ErrorLog = &logger
+
+	s, err := epollCreate(config, noEventfdSyscalls{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.notifier.(pipeNotifier); !ok {
+		t.Fatalf("notifier is %T; want pipeNotifier", s.notifier)
+	}
+	if n := len(logger.messages()); n != 1 {
+		t.Errorf("logged %d messages; want 1", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close() is not returned")
+	}
+}
+
+func TestEpollCreateErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		sys  failSyscalls
+		err  unix.Errno
+	}{
+		{"epoll_create1", failSyscalls{create: unix.EMFILE}, unix.EMFILE},
+		{"eventfd2", failSyscalls{eventfd: unix.ENFILE}, unix.ENFILE},
+		{"pipe2", failSyscalls{eventfd: unix.ENOSYS, pipe: unix.EMFILE}, unix.EMFILE},
+		{"epoll_ctl", failSyscalls{ctl: unix.ENOMEM}, unix.ENOMEM},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := epollConfig(t)
+			config.ErrorLog = new(testLogger)
+			_, err := epollCreate(config, test.sys)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("epollCreate() error is %v; want %v", err, test.err)
+			}
+			var errno unix.Errno
+			if !errors.As(err, &errno) || errno != test.err {
+				t.Errorf("errors.As() gives %v; want %v", errno, test.err)
+			}
+			if prefix := "netpoll: " + test.name + ": "; !strings.HasPrefix(err.Error(), prefix) {
+				t.Errorf("error message is %q; want it to start with %q", err, prefix)
+			}
+		})
+	}
+}
+
+func TestEpollEventPredicates(t *testing.T) {
+	for _, test := range []struct {
+		event                               EpollEvent
+		readable, writable, isError, closed bool
+	}{
+		{0, false, false, false, false},
+		{EPOLLIN, true, false, false, false},
+		{EPOLLPRI, true, false, false, false},
+		{EPOLLOUT, false, true, false, false},
+		{EPOLLERR, false, false, true, false},
+		{EPOLLHUP | EPOLLIN, true, false, true, false},
+		{EPOLLRDHUP, false, false, false, false},
+		{_EPOLLCLOSED, false, false, false, true},
+	} {
+		act := [...]bool{
+			test.event.IsReadable(),
+			test.event.IsWritable(),
+			test.event.IsError(),
+			test.event.IsClosed(),
+		}
+		exp := [...]bool{test.readable, test.writable, test.isError, test.closed}
+		if act != exp {
+			t.Errorf("%s: IsReadable(), IsWritable(), IsError(), IsClosed() are %v; want %v", test.event, act, exp)
+		}
+	}
+}
+
+func TestEpollEventBinary(t *testing.T) {
+	evt := EpollEvent(EPOLLIN | EPOLLRDHUP | _EPOLLCLOSED)
+	b, err := evt.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0, 0, 0x20, 0x21}; !bytes.Equal(b, exp) {
+		t.Fatalf("MarshalBinary() is %#v; want %#v", b, exp)
+	}
+	var act EpollEvent
+	if err := act.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if act != evt {
+		t.Errorf("UnmarshalBinary() decoded %s; want %s", act, evt)
+	}
+	for _, b := range [][]byte{nil, {1, 2, 3}, {1, 2, 3, 4, 5}} {
+		if err := act.UnmarshalBinary(b); err != ErrInvalidEncoding {
+			t.Errorf("UnmarshalBinary(%v) error is %v; want %v", b, err, ErrInvalidEncoding)
+		}
+	}
+}
+
+func TestEpollEventConstants(t *testing.T) {
+	if EPOLLMSG != unix.EPOLLMSG {
+		t.Errorf("EPOLLMSG is %#x; want %#x", EPOLLMSG, unix.EPOLLMSG)
+	}
+	for _, test := range []struct {
+		event EpollEvent
+		exp   string
+	}{
+		{EPOLLMSG, "EPOLLMSG"},
+		{EPOLLIN | EPOLLMSG, "EPOLLIN|EPOLLMSG"},
+	} {
+		if act := test.event.String(); act != test.exp {
+			t.Errorf("String() of %#x is %q; want %q", uint32(test.event), act, test.exp)
+		}
+	}
+}
+
+func TestNewEpoll(t *testing.T) {
+	var logger testLogger
+	config := epollConfig(t)
+	config.ErrorLog = &logger
+
+	ep, cleanup, err := NewEpoll(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Cleanup after explicit Close() must not log ErrClosed.
+	cleanup()
+	if msgs := logger.messages(); len(msgs) != 0 {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+
+	// Cleanup must log close errors.
+	config.OnWaitError = nil
+	_, cleanup, err = newEpoll(config, closeErrSyscalls{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	var n int
+	for _, msg := range logger.messages() {
+		if strings.Contains(msg, "close error") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("logged %d close errors; want 1: %v", n, logger.messages())
+	}
+}
+
+func TestEpollWaitPanic(t *testing.T) {
+	errs := make(chan error, 1)
+	ep, err := epollCreate(&EpollConfig{
+		OnWaitError: func(err error) { errs <- err },
+	}, panicSyscalls{newFakeSyscalls()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg string
+	select {
+	case err := <-errs:
+		msg = err.Error()
+	case <-time.After(time.Second):
+		t.Fatalf("no error reported after wait loop panic")
+	}
+	if !strings.HasPrefix(msg, "wait loop panic: injected\n") {
+		t.Errorf("unexpected error: %q", msg)
+	}
+	if !strings.Contains(msg, "panicSyscalls.EpollWait") {
+		t.Errorf("error does not contain stack trace of the panic: %q", msg)
+	}
+	if err := ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEpollFatalPolicy(t *testing.T) {
+	for _, policy := range []FatalPolicy{FatalContinue, FatalCloseSelf} {
+		t.Run(policy.String(), func(t *testing.T) {
+			sys := fatalSyscalls{newFakeSyscalls()}
+			errs := make(chan error, 1)
+			ep, err := epollCreate(&EpollConfig{
+				OnWaitError: func(err error) { errs <- err },
+				FatalPolicy: policy,
+			}, sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan EpollEvent, 1)
+			if err := ep.AddSimple(42, EPOLLIN, func(ev EpollEvent) { events <- ev }); err != nil {
+				t.Fatal(err)
+			}
+
+			sys.wait <- nil
+			if err := <-errs; err != unix.EINVAL {
+				t.Fatalf("wait error is %v; want %v", err, unix.EINVAL)
+			}
+			if policy == FatalContinue {
+				select {
+				case <-ep.Done():
+					t.Fatalf("Done() is closed by the wait loop")
+				case ev := <-events:
+					t.Fatalf("callback is called with %s", ev)
+				case <-time.After(10 * time.Millisecond):
+				}
+				if err := ep.Err(); err != nil {
+					t.Errorf("Err() is %v; want nil", err)
+				}
+				if err := ep.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if ev := <-events; ev != _EPOLLCLOSED {
+				t.Errorf("callback is called with %s; want %s", ev, EpollEvent(_EPOLLCLOSED))
+			}
+			<-ep.Done()
+
+			var want error = unix.EINVAL
+			if policy == FatalContinue {
+				want = nil
+			}
+			if err := ep.Err(); err != want {
+				t.Errorf("Err() is %v; want %v", err, want)
+			}
+			if err := ep.Close(); err != ErrClosed {
+				t.Errorf("Close() error is %v; want %v", err, ErrClosed)
+			}
+			if err := ep.AddSimple(43, EPOLLIN, func(EpollEvent) {}); err != ErrClosed {
+				t.Errorf("Add() error is %v; want %v", err, ErrClosed)
+			}
+		})
+	}
+}
+
+func TestEpollFatalPanic(t *testing.T) {
+	if os.Getenv("NETPOLL_TEST_FATAL_PANIC") == "" {
+		// The panic crashes the process, so the test runs itself in a
+		// subprocess.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEpollFatalPanic$")
+		cmd.Env = append(os.Environ(), "NETPOLL_TEST_FATAL_PANIC=1")
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatalf("process is not crashed; output:\n%s", out)
+		}
+		const want = "panic: netpoll[fatal]: wait fd=-1: invalid argument"
+		if !bytes.Contains(out, []byte(want)) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+		return
+	}
+
+	sys := fatalSyscalls{newFakeSyscalls()}
+	_, err := epollCreate(&EpollConfig{
+		OnWaitError: func(error) {},
+		FatalPolicy: FatalPanic,
+		Name:        "fatal",
+	}, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys.wait <- nil
+	time.Sleep(time.Second)
+}
+
+func TestEpollFakeSyscalls(t *testing.T) {
+	sys := newFakeSyscalls()
+	ep, err := epollCreate(epollConfig(t), sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const fd = 42
+	sys.ctlErr[unix.EPOLL_CTL_MOD] = unix.ENOENT
+
+	events := make(chan EpollEvent, 2)
+	if err = ep.AddSimple(fd, EPOLLIN, func(evt EpollEvent) { events <- evt }); err != nil {
+		t.Fatal(err)
+	}
+	if err = ep.Mod(fd, EPOLLOUT); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Mod() error is %v; want %v", err, unix.ENOENT)
+	}
+
+	sys.wait <- []unix.EpollEvent{{Fd: fd, Events: unix.EPOLLIN}}
+	if evt := <-events; evt != EPOLLIN {
+		t.Errorf("callback called with %s; want %s", evt, EpollEvent(EPOLLIN))
+	}
+
+	if err = ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if evt := <-events; evt != _EPOLLCLOSED {
+		t.Errorf("callback called with %s; want %s", evt, EpollEvent(_EPOLLCLOSED))
+	}
+
+	exp := []string{
+		"epoll_create1",
+		"eventfd",
+		"epoll_ctl(1, 101)",
+		"epoll_ctl(1, 42)",
+		"epoll_ctl(3, 42)",
+		"write(101)",
+		"close(100)",
+		"close(101)",
+	}
+	// Calls of epoll_wait are made concurrently, thus skip them.
+	var act []string
+	for _, call := range sys.history() {
+		if call != "epoll_wait" {
+			act = append(act, call)
+		}
+	}
+	if strings.Join(act, ",") != strings.Join(exp, ",") {
+		t.Errorf("unexpected syscalls:\nact: %v\nexp: %v", act, exp)
+	}
+}
+
+func TestEpollOrderedPerFD(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ordered bool
+		exp     []string
+	}{
+		{
+			name: "unordered",
+			exp: []string{
+				"1:EPOLLIN", "2:EPOLLIN", "1:EPOLLOUT",
+			},
+		},
+		{
+			name:    "ordered",
+			ordered: true,
+			exp: []string{
+				"1:EPOLLIN|EPOLLOUT", "2:EPOLLIN",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sys := newFakeSyscalls()
+			config := epollConfig(t)
+			config.OrderedPerFD = test.ordered
+			ep, err := epollCreate(config, sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ep.Close()
+
+			calls := make(chan string, 8)
+			for _, fd := range []int{1, 2} {
+				fd := fd
+				err := ep.AddSimple(fd, EPOLLIN|EPOLLOUT, func(evt EpollEvent) {
+					calls <- fmt.Sprintf("%d:%s", fd, evt)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sys.wait <- []unix.EpollEvent{
+				{Fd: 1, Events: unix.EPOLLIN},
+				{Fd: 2, Events: unix.EPOLLIN},
+				{Fd: 1, Events: unix.EPOLLOUT},
+			}
+			for i, exp := range test.exp {
+				if act := <-calls; act != exp {
+					t.Errorf("#%d callback call is %q; want %q", i, act, exp)
+				}
+			}
+		})
+	}
+}
+
+func TestObservePollerClosed(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	desc, err := NewDesc(r, EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 1)
+	if _, err = Observe(desc, func(e Event) { events <- e }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = poller.(Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e != EventPollerClosed {
+			t.Fatalf("observer received %s; want %s", e, Event(EventPollerClosed))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("observer did not receive EventPollerClosed")
+	}
+	if _, err = Observe(desc, func(Event) {}); err != ErrNotRegistered {
+		t.Fatalf("Observe() after Close() error is %v; want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestEpollCtlErrors(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		op    int
+		errno unix.Errno
+		exp   error
+		// registered tells whether fd must be registered after the call.
+		registered bool
+	}{
+		{"add-eexist", unix.EPOLL_CTL_ADD, unix.EEXIST, ErrRegistered, false},
+		{"add-eperm", unix.EPOLL_CTL_ADD, unix.EPERM, ErrNotPollable, false},
+		{"add-ebadf", unix.EPOLL_CTL_ADD, unix.EBADF, ErrDescInvalid, false},
+		{"add-enomem", unix.EPOLL_CTL_ADD, unix.ENOMEM, nil, false},
+		{"mod-enoent", unix.EPOLL_CTL_MOD, unix.ENOENT, ErrNotRegistered, true},
+		{"mod-ebadf", unix.EPOLL_CTL_MOD, unix.EBADF, ErrDescInvalid, true},
+		{"del-enoent", unix.EPOLL_CTL_DEL, unix.ENOENT, ErrNotRegistered, false},
+		{"del-ebadf", unix.EPOLL_CTL_DEL, unix.EBADF, ErrDescInvalid, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sys := newFakeSyscalls()
+			ep, err := epollCreate(epollConfig(t), sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ep.Close()
+
+			const fd = 42
+			cb := func(EpollEvent) {}
+			if test.op != unix.EPOLL_CTL_ADD {
+				if err = ep.AddSimple(fd, EPOLLIN, cb); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sys.ctlErr[test.op] = test.errno
+			switch test.op {
+			case unix.EPOLL_CTL_ADD:
+				err = ep.AddSimple(fd, EPOLLIN, cb)
+			case unix.EPOLL_CTL_MOD:
+				err = ep.Mod(fd, EPOLLOUT)
+			case unix.EPOLL_CTL_DEL:
+				err = ep.Del(fd)
+			}
+			delete(sys.ctlErr, test.op)
+
+			if test.exp == nil {
+				if err != test.errno {
+					t.Errorf("error is %v; want raw %v", err, test.errno)
+				}
+			} else if !errors.Is(err, test.exp) {
+				t.Errorf("error is %v; want %v", err, test.exp)
+			}
+			var errno unix.Errno
+			if !errors.As(err, &errno) || errno != test.errno {
+				t.Errorf("errors.As() gives %v; want %v", errno, test.errno)
+			}
+
+			// Check that callbacks map agrees with the kernel.
+			err = ep.Mod(fd, EPOLLIN)
+			if test.registered && err != nil {
+				t.Errorf("descriptor is not registered after the call: %v", err)
+			}
+			if !test.registered {
+				if err != ErrNotRegistered {
+					t.Errorf("descriptor is still registered after the call: Mod() error is %v", err)
+				}
+				if err = ep.AddSimple(fd, EPOLLIN, cb); err != nil {
+					t.Errorf("could not add descriptor again: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestEpollCtlRetries(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		retries int
+		errs    []error
+		exp     error
+		calls   int
+	}{
+		{"eintr-once", 0, []error{unix.EINTR}, nil, 2},
+		{"eintr-default-limit", 0, []error{unix.EINTR, unix.EINTR, unix.EINTR}, nil, 4},
+		{"eintr-exhausted", 0, []error{unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR}, unix.EINTR, 4},
+		{"eintr-then-enospc", 0, []error{unix.EINTR, unix.ENOSPC}, unix.ENOSPC, 2},
+		{"eintr-disabled", -1, []error{unix.EINTR}, unix.EINTR, 1},
+		{"ebadf", 0, []error{unix.EBADF}, ErrDescInvalid, 1},
+		{"enospc", 5, []error{unix.ENOSPC}, unix.ENOSPC, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sys := &ctlErrSyscalls{fakeSyscalls: newFakeSyscalls()}
+			config := epollConfig(t)
+			config.CtlRetries = test.retries
+			ep, err := epollCreate(config, sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ep.Close()
+
+			const fd = 42
+			sys.errs, sys.calls = test.errs, 0
+			err = ep.AddSimple(fd, EPOLLIN, nil)
+			if test.exp == nil && err != nil || test.exp != nil && !errors.Is(err, test.exp) {
+				t.Errorf("Add() error is %v; want %v", err, test.exp)
+			}
+			if sys.calls != test.calls {
+				t.Errorf("epoll_ctl() is called %d times; want %d", sys.calls, test.calls)
+			}
+			if registered := ep.Mod(fd, EPOLLOUT) == nil; registered != (test.exp == nil) {
+				t.Errorf("descriptor is registered: %t; want %t", registered, test.exp == nil)
+			}
+		})
+	}
+}
+
+// TestEpollModConcurrent checks that concurrent Mod() calls made under the
+// read lock do not mix up arguments of epoll_ctl(2): otherwise events of one
+// descriptor are routed to the callback of another one.
+func TestEpollModConcurrent(t *testing.T) {
+	ep, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const n = 8
+	var (
+		fds    [n]int
+		events [n]chan EpollEvent
+	)
+	for i := range fds {
+		var p [2]int
+		if err := unix.Pipe(p[:]); err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(p[0])
+		defer unix.Close(p[1])
+		// Дескриптор всегда доступен для чтения.
+		if _, err := unix.Write(p[1], []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		fds[i] = p[0]
+		ch := make(chan EpollEvent, 1)
+		events[i] = ch
+		err := ep.AddSimple(fds[i], EPOLLIN|EPOLLONESHOT, func(ev EpollEvent) {
+			if ev&_EPOLLCLOSED == 0 {
+				ch <- ev
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range fds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				select {
+				case <-events[i]:
+				case <-time.After(time.Second):
+					errs <- fmt.Errorf("descriptor #%d received no events after %d Mod() calls", i, j)
+					return
+				}
+				if err := ep.Mod(fds[i], EPOLLIN|EPOLLONESHOT); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEpollAddPaused(t *testing.T) {
+	sys := newFakeSyscalls()
+	ep, err := epollCreate(epollConfig(t), sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const fd = 42
+	if _, err := ep.AddPaused(fd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ep.AddPaused(fd, nil); err != ErrRegistered {
+		t.Errorf("repeated AddPaused() error is %v; want %v", err, ErrRegistered)
+	}
+	if err := ep.Del(fd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ep.AddPaused(fd, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Paused descriptor is added on the first Mod() only.
+	for i := 0; i < 2; i++ {
+		if err := ep.Mod(fd, EPOLLIN); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ep.Del(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []string{
+		"epoll_create1",
+		"eventfd",
+		"epoll_ctl(1, 101)",
+		"epoll_ctl(1, 42)",
+		"epoll_ctl(3, 42)",
+		"epoll_ctl(2, 42)",
+	}
+	var act []string
+	for _, call := range sys.history() {
+		if call != "epoll_wait" {
+			act = append(act, call)
+		}
+	}
+	if strings.Join(act, ",") != strings.Join(exp, ",") {
+		t.Errorf("unexpected syscalls:\nact: %v\nexp: %v", act, exp)
+	}
+}
+
+func TestEpollDelHandler(t *testing.T) {
+	ep, err := epollCreate(epollConfig(t), newFakeSyscalls())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const fd = 42
+	first, err := ep.Add(fd, EPOLLIN, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.DelHandler(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.DelHandler(first); err != ErrNotRegistered {
+		t.Errorf("repeated DelHandler() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	// Stale ID must not remove new registration of the same descriptor.
+	second, err := ep.Add(fd, EPOLLIN, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatalf("Add() returned the same ID %#x twice", first)
+	}
+	if err := ep.DelHandler(first); err != ErrNotRegistered {
+		t.Errorf("DelHandler() with stale ID error is %v; want %v", err, ErrNotRegistered)
+	}
+	if err := ep.Del(fd); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.DelHandler(second); err != ErrNotRegistered {
+		t.Errorf("DelHandler() after Del() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	third, err := ep.Add(fd, EPOLLIN, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.DelHandler(third); err != ErrClosed {
+		t.Errorf("DelHandler() after Close() error is %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestEpollAddClosed(t *testing.T) {
+	s, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddSimple(42, 0, nil); err != ErrClosed {
+		t.Fatalf("Add() = %s; want %s", err, ErrClosed)
+	}
+}
+
+func TestEpollNotifyOnDel(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%t", notify), func(t *testing.T) {
+			config := epollConfig(t)
+			config.NotifyOnDel = notify
+			ep, err := epollCreate(config, newFakeSyscalls())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var closed []int
+			callback := func(fd int) func(EpollEvent) {
+				return func(ev EpollEvent) {
+					if !ev.IsClosed() {
+						return
+					}
+					closed = append(closed, fd)
+					// Callback could call the instance, since the lock is
+					// released.
+					if err := ep.Del(fd); err != ErrNotRegistered && err != ErrClosed {
+						t.Errorf("Del() from callback is %v; want %v", err, ErrNotRegistered)
+					}
+				}
+			}
+			if err = ep.AddSimple(10, EPOLLIN, callback(10)); err != nil {
+				t.Fatal(err)
+			}
+			id, err := ep.Add(11, EPOLLIN, callback(11))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ep.AddSimple(12, EPOLLIN, callback(12)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ep.Del(10); err != nil {
+				t.Fatal(err)
+			}
+			if err = ep.DelHandler(id); err != nil {
+				t.Fatal(err)
+			}
+			var exp []int
+			if notify {
+				exp = []int{10, 11}
+			}
+			if fmt.Sprint(closed) != fmt.Sprint(exp) {
+				t.Errorf("callbacks notified by Del() are %v; want %v", closed, exp)
+			}
+
+			// Removed callbacks are not notified by Close() again.
+			if err = ep.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if exp = append(exp, 12); fmt.Sprint(closed) != fmt.Sprint(exp) {
+				t.Errorf("callbacks notified are %v; want %v", closed, exp)
+			}
+		})
+	}
+}
+
+func TestEpollInvalidFD(t *testing.T) {
+	s, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, test := range []struct {
+		fd  int
+		err error
+	}{
+		{-1, ErrInvalidFD},
+		{1 << 30, ErrInvalidFD},
+		{s.maxFd + 1, ErrInvalidFD},
+		{s.maxFd, ErrNotRegistered},
+	} {
+		if test.err == ErrInvalidFD {
+			if err := s.AddSimple(test.fd, EPOLLIN, nil); err != ErrInvalidFD {
+				t.Errorf("Add(%d) = %v; want %v", test.fd, err, ErrInvalidFD)
+			}
+		}
+		if err := s.Mod(test.fd, EPOLLIN); err != test.err {
+			t.Errorf("Mod(%d) = %v; want %v", test.fd, err, test.err)
+		}
+		if err := s.Del(test.fd); err != test.err {
+			t.Errorf("Del(%d) = %v; want %v", test.fd, err, test.err)
+		}
+	}
+}
+
+func TestEpollPoll(t *testing.T) {
+	config := epollConfig(t)
+	config.DisableWaitLoop = true
+
+	ep, err := EpollCreate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	called := false
+	if err = ep.AddSimple(fds[0], EPOLLIN, func(EpollEvent) { called = true }); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := ep.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Poll() = %v; want no events", events)
+	}
+
+	if _, err = unix.Write(fds[1], []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	events, err = ep.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].FD != fds[0] || events[0].Events&EPOLLIN == 0 {
+		t.Fatalf("Poll() = %v; want EPOLLIN event for fd %d", events, fds[0])
+	}
+	if called {
+		t.Errorf("callback was called by Poll()")
+	}
+
+	if err = ep.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ep.Poll(); err != ErrClosed {
+		t.Errorf("Poll() error is %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestPollerExclusive(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	desc, err := NewDesc(r, EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 1)
+	err = poller.StartWithOptions(desc, func(e Event) {
+		unix.Read(r, make([]byte, 8))
+		// Do not block the wait loop on hangup events received after the
+		// socket pair is closed.
+		select {
+		case events <- e:
+		default:
+		}
+	}, WithExclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unix.Write(w, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e&EventRead == 0 {
+			t.Errorf("got %s; want %s", e, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+}
+
+func TestEpollDel(t *testing.T) {
+	ln := RunEchoServer(t)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := conn.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.AddSimple(int(f.Fd()), EPOLLIN, func(events EpollEvent) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Del(int(f.Fd())); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEpollCtlDuringCallback checks that the wait loop does not hold ep.mu
+// while callbacks run, so slow callback does not block registrations.
+func TestEpollCtlDuringCallback(t *testing.T) {
+	sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+	ep, err := epollCreate(epollConfig(t), sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	var (
+		entered = make(chan struct{})
+		release = make(chan struct{})
+	)
+	defer close(release)
+	err = ep.AddSimple(1, EPOLLIN, func(ev EpollEvent) {
+		if ev&_EPOLLCLOSED != 0 {
+			return
+		}
+		close(entered)
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys.wait <- []unix.EpollEvent{{Fd: 1, Events: unix.EPOLLIN}}
+	<-entered
+
+	done := make(chan error, 1)
+	go func() {
+		if err := ep.AddSimple(2, EPOLLIN, func(EpollEvent) {}); err != nil {
+			done <- err
+			return
+		}
+		if err := ep.Mod(2, EPOLLOUT); err != nil {
+			done <- err
+			return
+		}
+		done <- ep.Del(2)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Add(), Mod() and Del() are blocked by running callback")
+	}
+}
+
+func TestEpollCloseWorkers(t *testing.T) {
+	for _, workers := range []int{0, 1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			const n = 3*closeParallelMin + 100
+			calls := make([]int32, n)
+			sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+			config := epollConfig(t)
+			config.CloseWorkers = workers
+			ep, err := epollCreate(config, sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep.maxFd = n
+			for fd := 0; fd < n; fd++ {
+				fd := fd
+				if err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) {
+					if ev == _EPOLLCLOSED {
+						atomic.AddInt32(&calls[fd], 1)
+					}
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Holes in the callbacks table must be skipped.
+			for fd := 0; fd < n; fd += 3 {
+				if err := ep.Del(fd); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ep.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for fd, c := range calls {
+				exp := int32(1)
+				if fd%3 == 0 {
+					exp = 0
+				}
+				if c != exp {
+					t.Fatalf("callback of fd %d called %d times; want %d", fd, c, exp)
+				}
+			}
+		})
+	}
+	for _, test := range []struct {
+		limit, n, exp int
+	}{
+		{1, 10 * closeParallelMin, 1},
+		{4, 0, 1},
+		{4, closeParallelMin - 1, 1},
+		{4, 2 * closeParallelMin, 2},
+		{4, 10 * closeParallelMin, 4},
+	} {
+		if act := closeWorkers(test.limit, test.n); act != test.exp {
+			t.Errorf("closeWorkers(%d, %d) = %d; want %d", test.limit, test.n, act, test.exp)
+		}
+	}
+}
+
+func TestEpollEINTRBackoff(t *testing.T) {
+	const (
+		n       = 5
+		backoff = 10 * time.Millisecond
+	)
+	sys := &eintrSyscalls{
+		n:    n,
+		done: make(chan time.Time, 1),
+	}
+	config := epollConfig(t)
+	config.EINTRBackoff = backoff
+	start := time.Now()
+	ep, err := epollCreate(config, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	select {
+	case end := <-sys.done:
+		// Each pause is at least a half of backoff.
+		if d := end.Sub(start); d < n*backoff/2 {
+			t.Fatalf("%d retries took %s; want at least %s", n, d, n*backoff/2)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait loop did not retry after EINTR")
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := jitter(backoff); d < backoff/2 || d > backoff {
+			t.Fatalf("jitter(%s) = %s; want value in [%s, %s]", backoff, d, backoff/2, backoff)
+		}
+	}
+}
+
+func TestEpollMaxEINTR(t *testing.T) {
+	const (
+		n   = 100
+		max = 3
+	)
+	sys := &eintrSyscalls{
+		n:    n,
+		done: make(chan time.Time, 1),
+	}
+	errs := make(chan error, 1)
+	ep, err := epollCreate(&EpollConfig{
+		MaxEINTR: max,
+		OnWaitError: func(err error) {
+			errs <- err
+		},
+	}, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrTooManyEINTR {
+			t.Fatalf("wait error is %v; want %v", err, ErrTooManyEINTR)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait loop did not stop after %d interruptions", max)
+	}
+	if calls := n - atomic.LoadInt32(&sys.n); calls != max+1 {
+		t.Errorf("epoll_wait() is called %d times; want %d", calls, max+1)
+	}
+}
+
+func TestEpollBatchSize(t *testing.T) {
+	for _, test := range []struct {
+		begin, max int
+	}{
+		{-1, 0},
+		{0, -1},
+		{65536, 0},
+		{16, 8},
+	} {
+		_, err := epollCreate(&EpollConfig{
+			InitialBatchSize: test.begin,
+			MaxBatchSize:     test.max,
+		}, scaleSyscalls{})
+		if err != ErrInvalidBatchSize {
+			t.Errorf("epollCreate() with batch sizes %d and %d error is %v; want %v", test.begin, test.max, err, ErrInvalidBatchSize)
+		}
+	}
+
+	sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+	config := epollConfig(t)
+	config.InitialBatchSize = 2
+	config.MaxBatchSize = 3
+	ep, err := epollCreate(config, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const n = 5
+	calls := make(chan int, n)
+	events := make([]unix.EpollEvent, n)
+	for fd := 0; fd < n; fd++ {
+		fd := fd
+		events[fd] = unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLIN}
+		err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) {
+			if ev&_EPOLLCLOSED == 0 {
+				calls <- fd
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The batch grows from 2 to 3 events after the first full one.
+	for i, exp := range []int{2, 3, 3} {
+		sys.wait <- events
+		for j := 0; j < exp; j++ {
+			if fd := <-calls; fd != j {
+				t.Fatalf("round #%d: callback of fd %d called; want %d", i, fd, j)
+			}
+		}
+		// Next round blocks the wait loop until this one is processed.
+		select {
+		case fd := <-calls:
+			t.Fatalf("round #%d: unexpected callback of fd %d", i, fd)
+		default:
+		}
+	}
+}
+
+func TestEpollNumaBind(t *testing.T) {
+	config := epollConfig(t)
+	config.InitialBatchSize = 1
+	config.MaxBatchSize = 4
+	config.NumaBind = true
+	config.NumaNode = -1
+	ep, err := EpollCreate(config)
+	if errors.Is(err, numa.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	// All pipes are ready at once, so the batch grows and its array is
+	// reallocated on the node.
+	const n = 8
+	calls := make(chan int, n)
+	for i := 0; i < n; i++ {
+		var fds [2]int
+		if err := unix.Pipe(fds[:]); err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fds[0])
+		defer unix.Close(fds[1])
+		if _, err := unix.Write(fds[1], []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		fd := fds[0]
+		err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) {
+			// Pipes stay readable, so callbacks are called repeatedly.
+			select {
+			case calls <- fd:
+			default:
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[int]bool)
+	for len(seen) < n {
+		select {
+		case fd := <-calls:
+			seen[fd] = true
+		case <-time.After(time.Second):
+			t.Fatalf("got events of %d descriptors; want %d", len(seen), n)
+		}
+	}
+}
+
+func TestEpollStats(t *testing.T) {
+	sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+	config := epollConfig(t)
+	config.CollectStats = true
+	config.Name = "stats"
+	ep, err := epollCreate(config, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+
+	const (
+		n      = 3
+		rounds = 2
+		delay  = time.Millisecond
+	)
+	calls := make(chan int, n)
+	events := make([]unix.EpollEvent, n)
+	for fd := 0; fd < n; fd++ {
+		fd := fd
+		events[fd] = unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLIN}
+		err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) {
+			if ev&_EPOLLCLOSED == 0 {
+				time.Sleep(delay)
+				calls <- fd
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < rounds; i++ {
+		sys.wait <- events
+		for j := 0; j < n; j++ {
+			<-calls
+		}
+	}
+	// Counters are updated after the last callback returns.
+	var stats EpollStats
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if stats = ep.Stats(); stats.Iterations == rounds {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.Iterations != rounds || stats.Events != n*rounds {
+		t.Errorf("Stats() is %+v; want %d iterations and %d events", stats, rounds, n*rounds)
+	}
+	if stats.Poller != "stats" {
+		t.Errorf("Stats() poller is %q; want %q", stats.Poller, "stats")
+	}
+	if act := stats.BusyPerEvent(); act < delay {
+		t.Errorf("BusyPerEvent() is %s; want at least %s", act, delay)
+	}
+
+	ep, err = EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+	if stats := ep.Stats(); stats != (EpollStats{Poller: ep.Name()}) {
+		t.Errorf("Stats() without CollectStats is %+v; want zero counters", stats)
+	}
+}
+
+// TestPollerSpuriousFilter reproduces edge-triggered wakeups without data,
+// such as ones made by the kernel after EPOLL_CTL_MOD, by injecting bare
+// EPOLLIN events for an empty socket.
+func TestPollerSpuriousFilter(t *testing.T) {
+	sys := newFakeSyscalls()
+	config := epollConfig(t)
+	config.CollectStats = true
+	ep, err := epollCreate(config, sys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ep.Close()
+	p := poller{ep, errorHandler{}}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	events := make(chan Event, 1)
+	desc := &Desc{sysfd: int32(fds[0]), event: EventRead | EventEdgeTriggered}
+	err = p.StartWithOptions(desc, func(ev Event) {
+		if ev&EventPollerClosed == 0 {
+			events <- ev
+		}
+	}, WithSpuriousFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inject := func(ev uint32) {
+		sys.wait <- []unix.EpollEvent{{Fd: int32(fds[0]), Events: ev}}
+	}
+	expect := func(exp Event) {
+		select {
+		case ev := <-events:
+			if ev != exp {
+				t.Fatalf("callback received %v; want %v", ev, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback is not called; want %v", exp)
+		}
+	}
+
+	inject(unix.EPOLLIN)
+	for deadline := time.Now().Add(time.Second); ep.Stats().Suppressed == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("spurious event is not suppressed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("callback received spurious %v", ev)
+	default:
+	}
+
+	if _, err = unix.Write(fds[1], []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	inject(unix.EPOLLIN)
+	expect(EventRead)
+	if _, err = unix.Read(fds[0], make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hangup and error notifications are delivered without data.
+	inject(unix.EPOLLIN | unix.EPOLLRDHUP)
+	expect(EventRead | EventReadHup)
+	inject(unix.EPOLLIN | unix.EPOLLERR)
+	expect(EventRead | EventErr)
+
+	if n := ep.Stats().Suppressed; n != 1 {
+		t.Errorf("Stats().Suppressed is %d; want 1", n)
+	}
+}
+
+func TestReadOOB(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	client, conn := tcpConnPair(t)
+	sendOOB := func(b byte) {
+		rc, err := client.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var serr error
+		if err = rc.Control(func(fd uintptr) {
+			serr = unix.Send(int(fd), []byte{b}, unix.MSG_OOB)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if serr != nil {
+			t.Fatal(serr)
+		}
+	}
+
+	desc, err := Handle(conn, EventRead|EventPriority|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	type result struct {
+		b   byte
+		err error
+	}
+	results := make(chan result, 2)
+	err = poller.Start(desc, func(ev Event) {
+		if ev&EventPriority == 0 {
+			return
+		}
+		b, err := ReadOOB(conn)
+		results <- result{b, err}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func() result {
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(time.Second):
+			t.Fatalf("EventPriority is not received")
+		}
+		return result{}
+	}
+
+	sendOOB('!')
+	if r := receive(); r.err != nil || r.b != '!' {
+		t.Fatalf("ReadOOB() = %q, %v; want %q, nil", r.b, r.err, '!')
+	}
+	if _, err = ReadOOB(conn); err != ErrNoUrgentData {
+		t.Fatalf("ReadOOB() of read urgent data error is %v; want %v", err, ErrNoUrgentData)
+	}
+
+	// With SO_OOBINLINE urgent byte is received with normal data.
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_OOBINLINE, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendOOB('?')
+	if r := receive(); r.err != ErrOOBInline {
+		t.Fatalf("ReadOOB() with SO_OOBINLINE error is %v; want %v", r.err, ErrOOBInline)
+	}
+	// Urgent byte read before SO_OOBINLINE is set returns to the stream.
+	buf := make([]byte, 2)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "!?" {
+		t.Fatalf("Read() = %q, %v; want %q inline", buf, err, "!?")
+	}
+
+	if _, err = ReadOOB(stubConn{}); err != ErrNotFiler {
+		t.Errorf("ReadOOB() of connection without descriptor error is %v; want %v", err, ErrNotFiler)
+	}
+}
+
+func TestEpollCloseCallback(t *testing.T) {
+	ep, err := EpollCreate(epollConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	errs := make(chan map[string]error, 1)
+	err = ep.AddSimple(r, EPOLLIN, func(ev EpollEvent) {
+		if ev&_EPOLLCLOSED == 0 {
+			return
+		}
+		_, pollErr := ep.Poll()
+		errs <- map[string]error{
+			"Add":        ep.AddSimple(w, EPOLLIN, nil),
+			"Del":        ep.Del(r),
+			"Mod":        ep.Mod(r, EPOLLIN),
+			"Del(-1)":    ep.Del(-1),
+			"Poll":       pollErr,
+			"Close":      ep.Close(),
+			"Add(MaxFD)": ep.AddSimple(MaxFD+1, EPOLLIN, nil),
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ep.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() is blocked by the callback")
+	}
+	for name, err := range <-errs {
+		if err != ErrClosed {
+			t.Errorf("%s() within close callback error is %v; want %v", name, err, ErrClosed)
+		}
+	}
+}
+
+// TestEpollCloseCallbackWorkers checks that callbacks called by Close()
+// from several goroutines could call the instance, and all of them return
+// before Close() and Done().
+func TestEpollCloseCallbackWorkers(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			const n = 2 * closeParallelMin
+			sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+			config := epollConfig(t)
+			config.CloseWorkers = workers
+			ep, err := epollCreate(config, sys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep.maxFd = n
+			var (
+				returned int32
+				failed   int32
+			)
+			for fd := 0; fd < n; fd++ {
+				fd := fd
+				if err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) {
+					if ev != _EPOLLCLOSED {
+						return
+					}
+					if ep.Del(fd) != ErrClosed || ep.Close() != ErrClosed {
+						atomic.AddInt32(&failed, 1)
+					}
+					atomic.AddInt32(&returned, 1)
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan int32, 1)
+			go func() {
+				<-ep.Done()
+				done <- atomic.LoadInt32(&returned)
+			}()
+			closed := make(chan error, 1)
+			go func() { closed <- ep.Close() }()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Close() is blocked by callbacks")
+			}
+			if act := atomic.LoadInt32(&returned); act != n {
+				t.Errorf("Close() returned after %d callbacks; want %d", act, n)
+			}
+			if act := <-done; act != n {
+				t.Errorf("Done() is closed after %d callbacks; want %d", act, n)
+			}
+			if failed != 0 {
+				t.Errorf("%d callbacks did not get ErrClosed from the instance", failed)
+			}
+		})
+	}
+}
+
+func TestEpollConcurrentClose(t *testing.T) {
+	ep, err := EpollCreate(epollConfig(t))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = s.Close(); err != nil {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	var closed int32
+	err = ep.AddSimple(r, EPOLLIN, func(ev EpollEvent) {
+		if ev&_EPOLLCLOSED != 0 {
+			atomic.AddInt32(&closed, 1)
+		}
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			err := ep.Close()
+			// Every call returns after resources are released.
+			select {
+			case <-ep.closeDone:
+			default:
+				t.Errorf("Close() returned %v before the first call completed", err)
+			}
+			errs <- err
+		}()
+	}
+	var ok int
+	for i := 0; i < n; i++ {
+		switch err := <-errs; err {
+		case nil:
+			ok++
+		case ErrClosed:
+		default:
+			t.Errorf("unexpected Close() error: %v", err)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d of Close() calls succeeded; want 1", ok)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("callback called with EPOLLCLOSED %d times; want 1", n)
+	}
 }
 
-func TestEpollAddClosed(t *testing.T) {
-	s, err := EpollCreate(epollConfig(t))
+func TestEpollCloseWakeError(t *testing.T) {
+	sys := writeErrSyscalls{newFakeSyscalls()}
+	ep, err := epollCreate(epollConfig(t), sys)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = s.Close(); err != nil {
+	const fd = 42
+	events := make(chan EpollEvent, 2)
+	if err := ep.AddSimple(fd, EPOLLIN, func(ev EpollEvent) { events <- ev }); err != nil {
 		t.Fatal(err)
 	}
-	if err = s.Add(42, 0, nil); err != ErrClosed {
-		t.Fatalf("Add() = %s; want %s", err, ErrClosed)
+
+	const n = 4
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- ep.Close() }()
 	}
-}
 
-func TestEpollDel(t *testing.T) {
-	ln := RunEchoServer(t)
-	defer ln.Close()
+	// Close() retries the wake up and does not release resources until the
+	// wait loop is stopped.
+	time.Sleep(5 * closeWakeRetry)
+	select {
+	case err := <-errs:
+		t.Fatalf("Close() returned %v before the wait loop is stopped", err)
+	case ev := <-events:
+		t.Fatalf("callback called with %s before the wait loop is stopped", ev)
+	default:
+	}
+	var writes int
+	for _, call := range sys.history() {
+		if strings.HasPrefix(call, "write(") {
+			writes++
+		}
+	}
+	if writes < 2 {
+		t.Errorf("wake up is made %d times; want retries", writes)
+	}
 
-	conn, err := net.Dial("tcp", ln.Addr().String())
+	// The wait loop stops on its next wake up, even if it is not made by
+	// the notifier.
+	sys.wait <- []unix.EpollEvent{{Fd: fd, Events: unix.EPOLLIN}}
+	var failed int
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			switch {
+			case err == unix.EIO:
+				failed++
+			case err != ErrClosed:
+				t.Errorf("unexpected Close() error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Close() is not returned after the wait loop is stopped")
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d of Close() calls returned %v; want 1", failed, unix.EIO)
+	}
+	if ev := <-events; ev != _EPOLLCLOSED {
+		t.Errorf("callback called with %s; want %s", ev, EpollEvent(_EPOLLCLOSED))
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected callback call with %s", ev)
+	default:
+	}
+	var closes int
+	for _, call := range sys.history() {
+		if call == fmt.Sprintf("close(%d)", ep.fd) {
+			closes++
+		}
+	}
+	if closes != 1 {
+		t.Errorf("epoll descriptor closed %d times; want 1: %v", closes, sys.history())
+	}
+}
+
+func TestEpollLowWatermarkUnsupported(t *testing.T) {
+	poller, err := New(config(t))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer conn.Close()
+	defer poller.(Closer).Close()
 
-	s, err := EpollCreate(epollConfig(t))
+	r, w, err := socketPair()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+	pipe := openPipes(t, 1)[0]
 
-	f, err := conn.(filer).File()
+	// Linux ignores SO_RCVLOWAT in poll of unix sockets.
+	for _, fd := range []int{r, pipe[0]} {
+		desc, err := NewDesc(fd, EventRead, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = poller.StartWithOptions(desc, func(Event) {}, WithLowWatermark(8))
+		if err != ErrUnsupportedOption {
+			t.Errorf("StartWithOptions() error is %v; want %v", err, ErrUnsupportedOption)
+		}
+	}
+}
+
+func TestEpollStaleRegistration(t *testing.T) {
+	stale := make(chan int, 4)
+	config := epollConfig(t)
+	config.StaleCheckInterval = time.Millisecond
+	// Checking single registration per tick makes the sweep to go through
+	// several ticks.
+	config.StaleCheckBatch = 1
+	config.RemoveStale = true
+	config.OnStaleRegistration = func(fd int) {
+		stale <- fd
+	}
+	ep, err := EpollCreate(config)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ep.Close()
+
+	var fds [3][2]int
+	for i := range fds {
+		if err := unix.Pipe(fds[i][:]); err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fds[i][1])
+		if err := ep.AddSimple(fds[i][0], EPOLLIN, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer unix.Close(fds[0][0])
+	defer unix.Close(fds[2][0])
 
-	err = s.Add(int(f.Fd()), EPOLLIN, func(events EpollEvent) {})
+	// Close descriptor without Del().
+	closed := fds[1][0]
+	unix.Close(closed)
+	select {
+	case fd := <-stale:
+		if fd != closed {
+			t.Fatalf("OnStaleRegistration() is called with %d; want %d", fd, closed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnStaleRegistration() is not called")
+	}
+	if err := ep.Del(closed); err != ErrNotRegistered {
+		t.Errorf("Del() of stale registration error is %v; want %v", err, ErrNotRegistered)
+	}
+	// Give the sweep a chance to go through the table again.
+	select {
+	case fd := <-stale:
+		t.Errorf("unexpected OnStaleRegistration() call with %d", fd)
+	case <-time.After(20 * time.Millisecond):
+	}
+	for _, fd := range []int{fds[0][0], fds[2][0]} {
+		if err := ep.Del(fd); err != nil {
+			t.Errorf("Del(%d) error: %v", fd, err)
+		}
+	}
+}
+
+func TestEpollStaleRegistrationDesc(t *testing.T) {
+	stale := make(chan *Desc, 1)
+	c := config(t)
+	c.StaleCheckInterval = time.Millisecond
+	c.OnStaleRegistration = func(desc *Desc) {
+		stale <- desc
+	}
+	poller, err := New(c)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err = s.Del(int(f.Fd())); err != nil {
-		t.Errorf("unexpected error: %s", err)
-	}
+	defer poller.(Closer).Close()
 
-	if err = s.Close(); err != nil {
+	var fds [2]int
+	if err := unix.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	desc, err := NewDesc(fds[0], EventRead, false)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if err := poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(fds[0])
+	select {
+	case act := <-stale:
+		if act != desc {
+			t.Errorf("OnStaleRegistration() is called with %p; want %p", act, desc)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnStaleRegistration() is not called")
+	}
+	// Registration is kept without RemoveStale.
+	if !desc.registered() {
+		t.Errorf("stale descriptor is stopped without RemoveStale")
+	}
 }
 
 func TestEpollServer(t *testing.T) {
@@ -87,7 +2053,7 @@ func TestEpollServer(t *testing.T) {
 
 	// Add listener fd to epoll instance to know when there are new incoming
 	// connections.
-	ep.Add(ln, EPOLLIN, func(evt EpollEvent) {
+	ep.AddSimple(ln, EPOLLIN, func(evt EpollEvent) {
 		if evt&_EPOLLCLOSED != 0 {
 			return
 		}
@@ -103,7 +2069,7 @@ func TestEpollServer(t *testing.T) {
 
 		// Add connection fd to epoll instance to get notifications about
 		// available data.
-		ep.Add(conn, EPOLLIN|EPOLLET|EPOLLHUP|EPOLLRDHUP, func(evt EpollEvent) {
+		ep.AddSimple(conn, EPOLLIN|EPOLLET|EPOLLHUP|EPOLLRDHUP, func(evt EpollEvent) {
 			// If EPOLLRDHUP is supported, it will be triggered after conn
 			// close() or shutdown(). In older versions EPOLLHUP is triggered.
 			if evt&_EPOLLCLOSED != 0 {
@@ -219,6 +2185,209 @@ func RunEchoServer(tb testing.TB) net.Listener {
 	return ln
 }
 
+// noEventfdSyscalls makes real syscalls except eventfd2, which is reported as
+// not implemented.
+type noEventfdSyscalls struct {
+	realSyscalls
+}
+
+func (noEventfdSyscalls) Eventfd() (int, error) {
+	return -1, unix.ENOSYS
+}
+
+// failSyscalls makes real syscalls, except those for which an error is set.
+type failSyscalls struct {
+	realSyscalls
+	create, eventfd, pipe, ctl error
+}
+
+func (s failSyscalls) EpollCreate1(flag int) (int, error) {
+	if s.create != nil {
+		return -1, s.create
+	}
+	return s.realSyscalls.EpollCreate1(flag)
+}
+
+func (s failSyscalls) Eventfd() (int, error) {
+	if s.eventfd != nil {
+		return -1, s.eventfd
+	}
+	return s.realSyscalls.Eventfd()
+}
+
+func (s failSyscalls) Pipe2(p []int, flags int) error {
+	if s.pipe != nil {
+		return s.pipe
+	}
+	return s.realSyscalls.Pipe2(p, flags)
+}
+
+func (s failSyscalls) EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error {
+	if s.ctl != nil {
+		return s.ctl
+	}
+	return s.realSyscalls.EpollCtl(epfd, op, fd, event)
+}
+
+// closeErrSyscalls makes real syscalls, but reports an error from each
+// close(2) call.
+type closeErrSyscalls struct {
+	realSyscalls
+}
+
+func (s closeErrSyscalls) Close(fd int) error {
+	s.realSyscalls.Close(fd)
+	return unix.EIO
+}
+
+// eintrSyscalls makes real syscalls, but reports EINTR from first n calls of
+// epoll_wait(2). Time of the first real call is sent to done.
+type eintrSyscalls struct {
+	realSyscalls
+	n    int32
+	done chan time.Time
+}
+
+func (s *eintrSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	if atomic.AddInt32(&s.n, -1) >= 0 {
+		return -1, unix.EINTR
+	}
+	select {
+	case s.done <- time.Now():
+	default:
+	}
+	return s.realSyscalls.EpollWait(epfd, events, msec)
+}
+
+// writeErrSyscalls is fakeSyscalls which fails each write(2), so the wait
+// loop could not be woken up by Close().
+type writeErrSyscalls struct {
+	*fakeSyscalls
+}
+
+func (s writeErrSyscalls) Write(fd int, p []byte) (int, error) {
+	s.record("write(%d)", fd)
+	return -1, unix.EIO
+}
+
+// panicSyscalls is fakeSyscalls which panics in epoll_wait(2).
+type panicSyscalls struct {
+	*fakeSyscalls
+}
+
+func (s panicSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	panic("injected")
+}
+
+// fatalSyscalls makes epoll_wait() fail with EINVAL when nil is sent to the
+// wait channel.
+type fatalSyscalls struct {
+	*fakeSyscalls
+}
+
+func (s fatalSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	if evs := <-s.wait; evs != nil {
+		return copy(events, evs), nil
+	}
+	return -1, unix.EINVAL
+}
+
+// ctlErrSyscalls is fakeSyscalls which returns errs from subsequent
+// epoll_ctl(2) calls one by one, and succeeds after them. It counts the calls.
+type ctlErrSyscalls struct {
+	*fakeSyscalls
+	errs  []error
+	calls int
+}
+
+func (s *ctlErrSyscalls) EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return s.fakeSyscalls.EpollCtl(epfd, op, fd, event)
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+// fakeSyscalls implements syscallInterface without a kernel. It records all
+// calls and returns events sent to wait channel from EpollWait().
+type fakeSyscalls struct {
+	mu     sync.Mutex
+	calls  []string
+	nextFd int
+	ctlErr map[int]error
+
+	wait chan []unix.EpollEvent
+}
+
+func newFakeSyscalls() *fakeSyscalls {
+	return &fakeSyscalls{
+		nextFd: 100,
+		ctlErr: make(map[int]error),
+		wait:   make(chan []unix.EpollEvent, 1),
+	}
+}
+
+func (f *fakeSyscalls) record(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeSyscalls) history() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeSyscalls) newFd() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fd := f.nextFd
+	f.nextFd++
+	return fd
+}
+
+func (f *fakeSyscalls) EpollCreate1(flag int) (int, error) {
+	f.record("epoll_create1")
+	return f.newFd(), nil
+}
+
+func (f *fakeSyscalls) EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error {
+	f.record("epoll_ctl(%d, %d)", op, fd)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ctlErr[op]
+}
+
+func (f *fakeSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	f.record("epoll_wait")
+	return copy(events, <-f.wait), nil
+}
+
+func (f *fakeSyscalls) Eventfd() (int, error) {
+	f.record("eventfd")
+	return f.newFd(), nil
+}
+
+func (f *fakeSyscalls) Pipe2(p []int, flags int) error {
+	f.record("pipe2")
+	p[0], p[1] = f.newFd(), f.newFd()
+	return nil
+}
+
+func (f *fakeSyscalls) Write(fd int, p []byte) (int, error) {
+	f.record("write(%d)", fd)
+	f.wait <- []unix.EpollEvent{{Fd: int32(fd), Events: unix.EPOLLIN}}
+	return len(p), nil
+}
+
+func (f *fakeSyscalls) Close(fd int) error {
+	f.record("close(%d)", fd)
+	return nil
+}
+
 func epollConfig(tb testing.TB) *EpollConfig {
 	return &EpollConfig{
 		OnWaitError: func(err error) {
@@ -226,3 +2395,369 @@ func epollConfig(tb testing.TB) *EpollConfig {
 		},
 	}
 }
+
+// scaleSyscalls implements syscallInterface for benchmarks with large number
+// of registrations. It accepts any descriptor and returns events sent to wait
+// channel from EpollWait().
+type scaleSyscalls struct {
+	wait chan []unix.EpollEvent
+}
+
+// scaleNotifierFd is a descriptor returned by scaleSyscalls.Eventfd(). It is
+// greater than any registered one.
+const scaleNotifierFd = 1 << 29
+
+func (s scaleSyscalls) EpollCreate1(flag int) (int, error) {
+	return 3, nil
+}
+
+func (s scaleSyscalls) EpollCtl(epfd int, op int, fd int, event *unix.EpollEvent) error {
+	return nil
+}
+
+func (s scaleSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	return copy(events, <-s.wait), nil
+}
+
+func (s scaleSyscalls) Eventfd() (int, error) {
+	return scaleNotifierFd, nil
+}
+
+func (s scaleSyscalls) Pipe2(p []int, flags int) error {
+	return unix.ENOSYS
+}
+
+func (s scaleSyscalls) Write(fd int, p []byte) (int, error) {
+	s.wait <- []unix.EpollEvent{{Fd: int32(fd), Events: unix.EPOLLIN}}
+	return len(p), nil
+}
+
+func (s scaleSyscalls) Close(fd int) error {
+	return nil
+}
+
+// newScaleEpoll returns Epoll instance with n registrations which do not use
+// kernel.
+func newScaleEpoll(tb testing.TB, n int, cb func(int) func(EpollEvent)) (*Epoll, scaleSyscalls) {
+	sys := scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)}
+	ep, err := epollCreate(epollConfig(tb), sys)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ep.maxFd = scaleNotifierFd - 1
+	for fd := 0; fd < n; fd++ {
+		if err := ep.AddSimple(fd, EPOLLIN, cb(fd)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return ep, sys
+}
+
+// BenchmarkEpollScale measures costs of registrations, dispatch and Close()
+// of Epoll with large number of registered descriptors. System calls are
+// not made, so only the costs of the package are measured.
+func BenchmarkEpollScale(b *testing.B) {
+	nop := func(fd int) func(EpollEvent) {
+		// Each registration has its own closure, like ones made by
+		// Poller.Start().
+		return func(ev EpollEvent) {
+			if ev == 0 {
+				panic(fd)
+			}
+		}
+	}
+	for _, n := range []int{100000, 500000, 1000000} {
+		b.Run(fmt.Sprintf("%d/Add", n), func(b *testing.B) {
+			ep, _ := newScaleEpoll(b, n, nop)
+			defer ep.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ep.AddSimple(n+i, EPOLLIN, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/Del", n), func(b *testing.B) {
+			ep, _ := newScaleEpoll(b, n+b.N, nop)
+			defer ep.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ep.Del(n + i); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/Dispatch", n), func(b *testing.B) {
+			done := make(chan struct{}, 1)
+			ep, sys := newScaleEpoll(b, n, func(int) func(EpollEvent) {
+				return func(ev EpollEvent) {
+					if ev&_EPOLLCLOSED == 0 {
+						done <- struct{}{}
+					}
+				}
+			})
+			defer ep.Close()
+			events := make([][]unix.EpollEvent, 1024)
+			for i := range events {
+				events[i] = []unix.EpollEvent{{
+					Fd:     int32(i * 7919 % n),
+					Events: unix.EPOLLIN,
+				}}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sys.wait <- events[i%len(events)]
+				<-done
+			}
+		})
+		b.Run(fmt.Sprintf("%d/Close", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				ep, _ := newScaleEpoll(b, n, nop)
+				b.StartTimer()
+				if err := ep.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d/GC", n), func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			ep, _ := newScaleEpoll(b, n, nop)
+			defer ep.Close()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(n), "B/reg")
+		})
+	}
+}
+
+// BenchmarkEpollSmall measures registration and removal of a descriptor by
+// Epoll with few registered ones, which is the case of small services.
+// Lookups index the table by descriptor number, so the cost does not depend
+// on the number of registrations.
+func BenchmarkEpollSmall(b *testing.B) {
+	for _, n := range []int{8, 32, 128} {
+		b.Run(fmt.Sprintf("%d/AddDel", n), func(b *testing.B) {
+			ep, _ := newScaleEpoll(b, n, func(int) func(EpollEvent) { return nil })
+			defer ep.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fd := i % n
+				if err := ep.Del(fd); err != nil {
+					b.Fatal(err)
+				}
+				if err := ep.AddSimple(fd, EPOLLIN, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCallbacksMapLookup measures lookups of callbacks by descriptor
+// number like ones made by the wait loop: in the table of Epoll, in a single
+// map guarded by RWMutex and in a map split into 256 locked shards. Parallel
+// runs use at least 16 goroutines to show the cost of lock contention.
+func BenchmarkCallbacksMapLookup(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		keys := make([]int, 4096)
+		for i := range keys {
+			keys[i] = i * 7919 % n
+		}
+		ep, _ := newScaleEpoll(b, n, func(int) func(EpollEvent) { return nil })
+		single := newSingleCallbacks(ep)
+		sharded := newShardedCallbacks(ep)
+		for _, impl := range []struct {
+			name string
+			get  func(fd int) epollHandler
+		}{
+			{"table", func(fd int) epollHandler {
+				ep.mu.RLock()
+				h := ep.callbacks[fd]
+				ep.mu.RUnlock()
+				return h
+			}},
+			{"map", single.get},
+			{"sharded", sharded.get},
+		} {
+			get := impl.get
+			b.Run(fmt.Sprintf("%s/%d/serial", impl.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if get(keys[i%len(keys)]) == nil {
+						b.Fatal("callback is not found")
+					}
+				}
+			})
+			b.Run(fmt.Sprintf("%s/%d/parallel", impl.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetParallelism((16 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+				var seed uint32
+				b.RunParallel(func(pb *testing.PB) {
+					i := int(atomic.AddUint32(&seed, 1) * 997)
+					for pb.Next() {
+						if get(keys[i%len(keys)]) == nil {
+							panic("callback is not found")
+						}
+						i++
+					}
+				})
+			})
+		}
+		ep.Close()
+	}
+}
+
+// singleCallbacks is a map of callbacks guarded by single lock.
+type singleCallbacks struct {
+	mu sync.RWMutex
+	m  map[int]epollHandler
+}
+
+func newSingleCallbacks(ep *Epoll) *singleCallbacks {
+	s := &singleCallbacks{m: make(map[int]epollHandler)}
+	for fd, h := range ep.callbacks {
+		if h != nil {
+			s.m[fd] = h
+		}
+	}
+	return s
+}
+
+func (s *singleCallbacks) get(fd int) epollHandler {
+	s.mu.RLock()
+	h := s.m[fd]
+	s.mu.RUnlock()
+	return h
+}
+
+// shardedCallbacks is a map of callbacks split into 256 shards with their own
+// locks. Shards are padded to cache line size, so their locks do not share
+// cache lines.
+type shardedCallbacks [256]struct {
+	mu sync.Mutex
+	m  map[int]epollHandler
+	_  [48]byte
+}
+
+func newShardedCallbacks(ep *Epoll) *shardedCallbacks {
+	s := new(shardedCallbacks)
+	for i := range s {
+		s[i].m = make(map[int]epollHandler)
+	}
+	for fd, h := range ep.callbacks {
+		if h != nil {
+			s[fd&255].m[fd] = h
+		}
+	}
+	return s
+}
+
+func (s *shardedCallbacks) get(fd int) epollHandler {
+	sh := &s[fd&255]
+	sh.mu.Lock()
+	h := sh.m[fd]
+	sh.mu.Unlock()
+	return h
+}
+
+// BenchmarkEpollMaxFDs measures registration of descriptors up to the limit
+// of open files with and without pre-allocated tables.
+func BenchmarkEpollMaxFDs(b *testing.B) {
+	ep, err := epollCreate(epollConfig(b), scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := ep.maxFd + 1
+	ep.Close()
+	if n > 100000 {
+		n = 100000
+	}
+	for _, max := range []int{0, n} {
+		b.Run(fmt.Sprintf("MaxFDs=%d", max), func(b *testing.B) {
+			config := epollConfig(b)
+			config.MaxFDs = max
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ep, err := epollCreate(config, scaleSyscalls{wait: make(chan []unix.EpollEvent, 1)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for fd := 0; fd < n; fd++ {
+					if err := ep.AddSimple(fd, EPOLLIN, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				ep.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// scaleConn is a connection structure of an application which implements
+// Handler.
+type scaleConn struct {
+	desc   *Desc
+	events int
+}
+
+func (c *scaleConn) HandleEvent(Event) { c.events++ }
+
+// BenchmarkPollerStartHandler compares memory used by registrations made by
+// Start() with a closure per connection and by StartHandler(). Time of the
+// benchmark is the time of full garbage collection.
+func BenchmarkPollerStartHandler(b *testing.B) {
+	const n = 100000
+	for _, test := range []struct {
+		name  string
+		start func(poller, *scaleConn) error
+	}{
+		{"Closure", func(p poller, c *scaleConn) error {
+			return p.Start(c.desc, func(ev Event) { c.HandleEvent(ev) })
+		}},
+		{"Handler", func(p poller, c *scaleConn) error {
+			return p.StartHandler(c.desc, c)
+		}},
+	} {
+		b.Run(fmt.Sprintf("%d/%s", n, test.name), func(b *testing.B) {
+			ep, _ := newScaleEpoll(b, 0, nil)
+			defer ep.Close()
+			ep.grow(n)
+			p := poller{ep, errorHandler{}}
+
+			conns := make([]*scaleConn, n)
+			for i := range conns {
+				conns[i] = &scaleConn{desc: &Desc{sysfd: int32(i), event: EventRead}}
+			}
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for _, c := range conns {
+				if err := test.start(p, c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			b.ReportMetric(float64(int64(after.HeapAlloc-before.HeapAlloc))/n, "B/conn")
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/n, "allocs/conn")
+		})
+	}
+}
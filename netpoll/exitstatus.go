@@ -0,0 +1,9 @@
+// +build !plan9
+
+package netpoll
+
+import "syscall"
+
+// ExitStatus is the exit status of a process reported by ProcessStatus().
+// It is syscall.WaitStatus on all systems except plan9.
+type ExitStatus = syscall.WaitStatus
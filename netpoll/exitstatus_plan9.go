@@ -0,0 +1,7 @@
+package netpoll
+
+import "syscall"
+
+// ExitStatus is the exit status of a process reported by ProcessStatus().
+// Processes could not be watched on plan9, so it is never filled here.
+type ExitStatus = syscall.Waitmsg
@@ -1,8 +1,14 @@
 package netpoll
 
 import (
+	"errors"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // filer describes an object that has ability to return os.File.
@@ -11,25 +17,358 @@ type filer interface {
 	File() (*os.File, error)
 }
 
+// Filer describes a connection which gives access to its file descriptor,
+// such as a custom wrapper which does not implement syscall.Conn. It is
+// checked by Handle* functions before File() and SyscallConn() methods.
+//
+// Descriptor is used as is, without making a copy. So it is not owned by the
+// created Desc: Close() of the Desc does not close it, and it must stay open
+// until the Desc is stopped and closed, since its number could be reused
+// right after that. Note that O_NONBLOCK options change the mode of the
+// connection's descriptor then.
+type Filer interface {
+	// NetpollFd returns file descriptor of the connection.
+	NetpollFd() (fd int, err error)
+}
+
+// Unwrapper describes a connection wrapper, such as a middleware collecting
+// metrics, which gives access to the wrapped connection. Handle* functions
+// unwrap connections which do not provide a file descriptor themselves.
+type Unwrapper interface {
+	// Unwrap returns the wrapped connection.
+	Unwrap() net.Conn
+}
+
+// netConner describes *tls.Conn, which gives access to the underlying
+// connection since Go 1.18.
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// maxUnwrap limits the length of a wrappers chain to not loop forever on
+// wrappers referring to each other.
+const maxUnwrap = 32
+
+// unwrap returns the first connection of x's wrappers chain, starting with
+// x itself, for which ok returns true. It returns x if there is no one.
+func unwrap(x interface{}, ok func(interface{}) bool) interface{} {
+	y := x
+	for i := 0; i < maxUnwrap; i++ {
+		if ok(y) {
+			return y
+		}
+		var next net.Conn
+		switch c := y.(type) {
+		case netConner:
+			next = c.NetConn()
+		case Unwrapper:
+			next = c.Unwrap()
+		}
+		if next == nil {
+			break
+		}
+		y = next
+	}
+	return x
+}
+
+func isFiler(x interface{}) bool {
+	switch x.(type) {
+	case Filer, filer:
+		return true
+	}
+	return false
+}
+
+func isSyscallConn(x interface{}) bool {
+	switch x.(type) {
+	case Filer, syscall.Conn:
+		return true
+	}
+	return false
+}
+
+// filerFd returns file descriptor of f.
+func filerFd(f Filer) (int, error) {
+	fd, err := f.NetpollFd()
+	if err != nil {
+		return -1, err
+	}
+	if fd < 0 {
+		return -1, ErrInvalidFD
+	}
+	return fd, nil
+}
+
 // Desc is a network connection within netpoll descriptor.
-// It's methods are not goroutine safe.
+// It's methods are not goroutine safe, except LastEvent(), LastError() and
+// Close(), which is safe to be called while the poller or a callback reads
+// the descriptor number.
 type Desc struct {
-	file  *os.File
+	// last holds the last event received by poller in lower 16 bits and
+	// its unix time in milliseconds in the rest. It is placed first to be
+	// 64-bit aligned for atomic access on 32-bit platforms.
+	last uint64
+
+	file *os.File
+	// sysfd is accessed atomically, see Close().
+	sysfd int32
+	owned bool
 	event Event
+
+	// lastErr holds errorValue with the last error reported by poller.
+	lastErr atomic.Value
+
+	observers observers
+
+	// handler or cb are set by StartHandler() and Start() of epoll poller,
+	// which register the descriptor itself instead of a closure. sock is
+	// filled by epoll poller on the first EPOLLERR of such registration.
+	handler Handler
+	cb      CallbackFn
+	sock    sockState
+
+	// armed is the event mask registered by kqueue poller at the last
+	// Start() or Resume(). It lets Resume() to remove filters which are not
+	// requested anymore after Update().
+	armed Event
+
+	// lowat is the low watermark set by WithLowWatermark(), which kqueue
+	// poller applies to the read filter each time it is added.
+	lowat int
+
+	// paused is set by Pause() of a poller and cleared by Unpause() and
+	// Stop(). Epoll poller does not use it: the state is kept by Epoll
+	// under its lock, see Epoll.pause().
+	paused bool
+
+	// released is non-zero when descriptor is put into the pool by
+	// ReleaseDesc().
+	released int32
+
+	// regs is the number of pollers the descriptor is registered in. It is
+	// changed under observers.mu and read atomically.
+	regs int32
+
+	// lazy is the registration deferred by StartLazy() until Arm().
+	lazy *lazyStart
+
+	// proc is set for descriptors made by HandleProcess().
+	proc *procWatch
+}
+
+// lazyStart is a registration made by the first Arm() call, unless it is
+// canceled by Stop() before.
+type lazyStart struct {
+	once  sync.Once
+	done  int32
+	start func() error
+	err   error
+}
+
+// errorValue wraps error to store it in atomic.Value, which requires values
+// of the same concrete type.
+type errorValue struct {
+	err error
 }
 
 // NewDesc creates descriptor from custom fd.
-func NewDesc(fd uintptr, ev Event) *Desc {
-	return &Desc{os.NewFile(fd, ""), ev}
+// If owned is true, then Close() closes the fd. Otherwise fd is left open and
+// caller is responsible for closing it after descriptor is stopped.
+//
+// Note that the mode of fd is not changed. Caller should put it into
+// non-blocking mode itself when edge-triggered events are used.
+func NewDesc(fd int, ev Event, owned bool) (*Desc, error) {
+	if err := platformError(); err != nil {
+		return nil, err
+	}
+	if err := validEvent(ev); err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, ErrInvalidFD
+	}
+	if err := checkFd(fd); err != nil {
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	return &Desc{
+		sysfd: int32(fd),
+		owned: owned,
+		event: ev,
+	}, nil
 }
 
 // Close closes underlying file.
+// Descriptors created by NewDesc() with owned set to false are not closed.
 func (h *Desc) Close() error {
-	return h.file.Close()
+	if h.file != nil {
+		return h.file.Close()
+	}
+	if !h.owned {
+		return nil
+	}
+	fd := atomic.SwapInt32(&h.sysfd, -1)
+	if fd == -1 {
+		return os.ErrClosed
+	}
+	return os.NewSyscallError("close", closeFd(int(fd)))
+}
+
+// LastEvent returns the last event passed by poller to the descriptor's
+// callback and the time it was received with millisecond precision.
+// It returns zero values if there were no events.
+//
+// It is intended for debugging purposes only. The value is updated
+// concurrently by the poller, so it could be stale right after the call.
+func (h *Desc) LastEvent() (Event, time.Time) {
+	v := atomic.LoadUint64(&h.last)
+	if v == 0 {
+		return 0, time.Time{}
+	}
+	ms := int64(v >> 16)
+	return Event(v & 0xffff), time.Unix(ms/1e3, ms%1e3*1e6)
+}
+
+func (h *Desc) setLastEvent(event Event) {
+	ms := uint64(time.Now().UnixNano() / 1e6)
+	atomic.StoreUint64(&h.last, ms<<16|uint64(event))
+}
+
+// LastError returns the last error reported by poller for the descriptor.
+// For sockets it is the pending socket error (SO_ERROR) fetched by poller when
+// EventErr is received, such as syscall.ECONNRESET or syscall.ETIMEDOUT.
+// Note that fetching clears the pending error of the socket.
+// It also could be an error of automatic resume made due to WithAutoResume()
+// option.
+// It returns nil if there were no errors. Like LastEvent(), it is safe to
+// call it from any goroutine, but the result is advisory only.
+func (h *Desc) LastError() error {
+	v, _ := h.lastErr.Load().(errorValue)
+	return v.err
+}
+
+func (h *Desc) setLastError(err error) {
+	h.lastErr.Store(errorValue{err})
+}
+
+// Event returns the event mask of the descriptor. Pollers use it as the only
+// source of requested events: Start() registers the descriptor with it and
+// Resume() re-arms the descriptor with it.
+func (h *Desc) Event() Event {
+	return h.event
+}
+
+// Fd returns the file descriptor number. It returns -1 after Close() of the
+// descriptor created by NewDesc() with owned set to true.
+// It is intended for logging and debugging; the number could be reused by
+// another file once the descriptor is closed.
+func (h *Desc) Fd() int {
+	return h.fd()
+}
+
+// Update sets the event mask of the descriptor. The mask must be valid for
+// NewDesc(), otherwise ErrInvalidEvent is returned. For started descriptor
+// new mask takes effect on the next Resume() call; EventOneShot and
+// EventEdgeTriggered bits could not be changed then and ErrRegistered is
+// returned on such attempt.
+//
+// Like other Desc methods it is not goroutine safe, e.g. it should not be
+// called concurrently with Resume().
+func (h *Desc) Update(event Event) error {
+	if err := validEvent(event); err != nil {
+		return err
+	}
+	const behavior = EventOneShot | EventEdgeTriggered
+	if h.registered() && (event^h.event)&behavior != 0 {
+		return ErrRegistered
+	}
+	h.event = event
+	return nil
 }
 
+// Arm makes the registration deferred by StartLazy(), that is, calls Start()
+// of the poller. Only the first call does the work; subsequent calls return
+// its error. After Stop() of descriptor which is not armed Arm() returns
+// ErrNotRegistered. For descriptors which are not started by StartLazy()
+// Arm() does nothing and returns nil.
+//
+// Arm is safe to be called concurrently, but like StartLazy() it must not be
+// called with Start() or Stop() of the same descriptor in parallel.
+func (h *Desc) Arm() error {
+	l := h.lazy
+	if l == nil {
+		return nil
+	}
+	l.once.Do(func() {
+		l.err = l.start()
+		l.start = nil
+		atomic.StoreInt32(&l.done, 1)
+	})
+	return l.err
+}
+
+// Pending reports whether desc has the registration deferred by StartLazy(),
+// which is neither made by Arm() nor canceled by Stop() yet.
+func (h *Desc) Pending() bool {
+	l := h.lazy
+	return l != nil && atomic.LoadInt32(&l.done) == 0
+}
+
+// startLazy implements StartLazy() method of the pollers: it validates
+// event mask of desc and defers the rest to s.Start() called by Arm().
+func startLazy(s Starter, desc *Desc, cb CallbackFn) error {
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	desc.lazy = &lazyStart{start: func() error {
+		return s.Start(desc, cb)
+	}}
+	return nil
+}
+
+// stopLazy cancels the registration deferred by StartLazy() if the
+// descriptor is not armed yet. It reports whether the registration is
+// canceled, so Stop() has nothing to remove from the poller.
+func stopLazy(desc *Desc) (canceled bool) {
+	l := desc.lazy
+	if l == nil {
+		return false
+	}
+	l.once.Do(func() {
+		l.err = ErrNotRegistered
+		l.start = nil
+		atomic.StoreInt32(&l.done, 1)
+		canceled = true
+	})
+	return canceled
+}
+
+// sockState caches whether the descriptor is a socket, so epoll poller
+// calls fstat(2) only when the socket error is needed the first time.
+type sockState int32
+
+const (
+	sockUnknown sockState = iota
+	sockYes
+	sockNo
+)
+
+// fd returns descriptor's file descriptor number.
+// Note that it does not use os.File.Fd() method, which puts the file into
+// blocking mode.
 func (h *Desc) fd() int {
-	return int(h.file.Fd())
+	return int(atomic.LoadInt32(&h.sysfd))
+}
+
+// validEvent checks that ev is a valid event mask for descriptor.
+func validEvent(ev Event) error {
+	if ev&(EventRead|EventWrite) == 0 {
+		return ErrInvalidEvent
+	}
+	if ev&^(EventRead|EventWrite|EventPriority|EventOneShot|EventEdgeTriggered) != 0 {
+		return ErrInvalidEvent
+	}
+	return nil
 }
 
 // Must is a helper that wraps a call to a function returning (*Desc, error).
@@ -42,6 +381,45 @@ func Must(desc *Desc, err error) *Desc {
 	return desc
 }
 
+// Options contains options for descriptor creation.
+//
+// Note that O_NONBLOCK is a property of the open file description, not of the
+// file descriptor number. That is, descriptor returned by Handle() is a dup of
+// the connection's one and shares the flag with it. Go's runtime netpoller
+// requires the flag to be set to serve deadlines and to not block an OS thread
+// in Read() and Write() calls on the source connection. So clearing it is
+// usually only useful for descriptors that are not owned by the runtime.
+type Options struct {
+	// SetNonblock sets O_NONBLOCK flag on the descriptor.
+	// It is essential for edge-triggered mode, where descriptor must be read
+	// or written until EAGAIN.
+	SetNonblock bool
+
+	// ClearNonblock clears O_NONBLOCK flag on the descriptor.
+	ClearNonblock bool
+
+	// Borrow makes descriptor to use the file descriptor of conn as is,
+	// taken by SyscallConn().Control(), instead of a duplicate made by
+	// File(). It saves a descriptor per connection and does not touch
+	// conn's file, so deadlines keep working on conn with any Go version.
+	// Borrowed descriptor is not owned: Close() does not close it, and it
+	// must be stopped before conn is closed, since the number could be
+	// reused right after that. Note that O_NONBLOCK options then change the
+	// mode of conn itself.
+	// Connections which do not implement syscall.Conn are duplicated by
+	// File() as without the option.
+	Borrow bool
+}
+
+// defaultOptions returns options which are used by Handle* constructors for
+// given event. Edge-triggered descriptors are put into non-blocking mode,
+// while others are left as is.
+func defaultOptions(event Event) Options {
+	return Options{
+		SetNonblock: event&EventEdgeTriggered != 0,
+	}
+}
+
 // HandleRead creates read descriptor for further use in Poller methods.
 // It is the same as Handle(conn, EventRead|EventEdgeTriggered).
 func HandleRead(conn net.Conn) (*Desc, error) {
@@ -76,44 +454,417 @@ func HandleReadWrite(conn net.Conn) (*Desc, error) {
 // Handle creates new Desc with given conn and event.
 // Returned descriptor could be used as argument to Start(), Resume() and
 // Stop() methods of some Poller implementation.
+//
+// If event has EventEdgeTriggered bit set, descriptor is put into
+// non-blocking mode. Otherwise the mode is left untouched.
+// Use HandleWithOptions() to control it explicitly.
+//
+// Wrappers, such as *tls.Conn or connections implementing Unwrapper, are
+// unwrapped until a connection with a file descriptor is found. Note that
+// readiness is then reported for the raw socket: for TLS it means encrypted
+// bytes arrived, not that a whole record could be decrypted, so Read() of
+// the wrapper could still block. On the other hand, data already decrypted
+// and buffered by the wrapper produces no events.
 func Handle(conn net.Conn, event Event) (*Desc, error) {
-	desc, err := handle(conn, event)
+	return HandleWithOptions(conn, event, defaultOptions(event))
+}
+
+// HandleWithOptions creates new Desc with given conn, event and options.
+func HandleWithOptions(conn net.Conn, event Event, opts Options) (*Desc, error) {
+	if opts.SetNonblock && opts.ClearNonblock {
+		return nil, ErrNonblockConflict
+	}
+
+	var (
+		desc *Desc
+		err  error
+	)
+	if opts.Borrow {
+		desc, err = borrow(conn, event)
+	} else {
+		desc, err = handle(conn, event)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Set the file back to non blocking mode since conn.File() sets underlying
-	// os.File to blocking mode. This is useful to get conn.Set{Read}Deadline
-	// methods still working on source Conn.
+	// conn.File() could set underlying os.File to blocking mode depending on
+	// Go version. Setting the file back to non blocking mode is useful to get
+	// conn.Set{Read}Deadline methods still working on source Conn.
 	//
 	// See https://golang.org/pkg/net/#TCPConn.File
 	// See /usr/local/go/src/net/net.go: conn.File()
-	if err = setNonblock(desc.fd(), true); err != nil {
-		return nil, os.NewSyscallError("setnonblock", err)
+	if opts.SetNonblock || opts.ClearNonblock {
+		if err = setNonblock(desc.fd(), opts.SetNonblock); err != nil {
+			desc.Close()
+			return nil, os.NewSyscallError("setnonblock", err)
+		}
 	}
 
 	return desc, nil
 }
 
+// HandleWithBehavior creates new Desc with given conn, events and behavior.
+// Unlike Handle(), events must contain only EventRead or EventWrite bits, and
+// behavior modifiers are given separately. Otherwise ErrInvalidEvent is
+// returned.
+func HandleWithBehavior(conn net.Conn, events Event, behavior Behavior) (*Desc, error) {
+	if events == 0 || events&^(EventRead|EventWrite) != 0 {
+		return nil, ErrInvalidEvent
+	}
+	if behavior&^(BehaviorOneShot|BehaviorEdgeTriggered) != 0 {
+		return nil, ErrInvalidEvent
+	}
+	return Handle(conn, events|Event(behavior))
+}
+
 // HandleListener returns descriptor for a net.Listener.
 func HandleListener(ln net.Listener, event Event) (*Desc, error) {
 	return handle(ln, event)
 }
 
+// HandleSyscallConn creates new Desc with given sc and event, as Handle()
+// does for net.Conn. It is useful for types which implement only
+// syscall.Conn, such as *os.File or custom connections.
+//
+// Descriptor holds a duplicate of sc's file descriptor, so it should be
+// closed independently of sc.
+func HandleSyscallConn(sc syscall.Conn, event Event) (*Desc, error) {
+	if err := platformError(); err != nil {
+		return nil, err
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fd   int
+		derr error
+	)
+	if err = rc.Control(func(x uintptr) {
+		fd, derr = dupFd(int(x))
+	}); err != nil {
+		return nil, err
+	}
+	if derr != nil {
+		return nil, os.NewSyscallError("dup", derr)
+	}
+	if defaultOptions(event).SetNonblock {
+		if err = setNonblock(fd, true); err != nil {
+			closeFd(fd)
+			return nil, os.NewSyscallError("setnonblock", err)
+		}
+	}
+	desc := acquireDesc()
+	atomic.StoreInt32(&desc.sysfd, int32(fd))
+	desc.owned = true
+	desc.event = event
+	return desc, nil
+}
+
+// HandleFile creates new Desc with given f and event. Descriptor is taken by
+// f.SyscallConn(), because f.Fd() puts the file into blocking mode, which
+// breaks deadlines and makes reads of f to block an OS thread. Like
+// HandleSyscallConn(), it holds a duplicate of f's descriptor.
+//
+// Note that pollers treat regular files differently: epoll rejects them with
+// ErrNotPollable, poll(2) reports them always ready, and kqueue reports them
+// readable until the end of file is reached.
+func HandleFile(f *os.File, event Event) (*Desc, error) {
+	return HandleSyscallConn(f, event)
+}
+
 func handle(x interface{}, event Event) (*Desc, error) {
-	f, ok := x.(filer)
-	if !ok {
-		return nil, ErrNotFiler
+	file, fd, err := dupFile(x)
+	if err != nil {
+		return nil, err
+	}
+	desc := acquireDesc()
+	desc.file = file
+	atomic.StoreInt32(&desc.sysfd, int32(fd))
+	desc.event = event
+	return desc, nil
+}
+
+// borrow returns descriptor which shares the file descriptor of x. It falls
+// back to handle() if x does not implement syscall.Conn.
+func borrow(x interface{}, event Event) (*Desc, error) {
+	if err := platformError(); err != nil {
+		return nil, err
+	}
+	var sc syscall.Conn
+	switch y := unwrap(x, isSyscallConn).(type) {
+	case Filer:
+		return handle(y, event)
+	case syscall.Conn:
+		sc = y
+	default:
+		return handle(x, event)
+	}
+	fd, err := controlFd(sc)
+	if err != nil {
+		return nil, err
+	}
+	desc := acquireDesc()
+	atomic.StoreInt32(&desc.sysfd, int32(fd))
+	desc.event = event
+	return desc, nil
+}
+
+// dupFile returns a copy of x's file and its descriptor number. If x is
+// Filer, no copy is made: file is nil and descriptor is x's own one.
+func dupFile(x interface{}) (*os.File, int, error) {
+	if err := platformError(); err != nil {
+		return nil, -1, err
+	}
+	var f filer
+	switch y := unwrap(x, isFiler).(type) {
+	case Filer:
+		fd, err := filerFd(y)
+		return nil, fd, err
+	case filer:
+		f = y
+	default:
+		return nil, -1, ErrNotFiler
 	}
 
 	// Get a copy of fd.
 	file, err := f.File()
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
+	fd, err := controlFd(file)
+	if err != nil {
+		file.Close()
+		return nil, -1, err
+	}
+	return file, fd, nil
+}
 
-	return &Desc{
-		file:  file,
-		event: event,
-	}, nil
+// Reset reconfigures descriptor to handle conn with given event, as if it was
+// created by Handle(conn, event). It allows to reuse Desc structures for new
+// connections, e.g. by a pool.
+//
+// Unlike Handle(), descriptor number is taken by SyscallConn().Control() as
+// with Borrow option, so no duplicate is made and no file is allocated.
+// Descriptor is not owned then and must be stopped before conn is closed.
+// Connections which do not implement syscall.Conn are duplicated by File().
+//
+// Previous file of the descriptor is closed if it was not closed yet. Its last
+// event and last error are cleared.
+// It returns ErrRegistered if descriptor is still started in some poller, and
+// ErrNotFiler if descriptor could not be taken from conn. Descriptor is left
+// untouched in both cases.
+func (h *Desc) Reset(conn net.Conn, event Event) error {
+	if h.registered() {
+		return ErrRegistered
+	}
+	file, fd, err := resetFd(conn)
+	if err != nil {
+		return err
+	}
+	if opts := defaultOptions(event); opts.SetNonblock {
+		if err = setNonblock(fd, true); err != nil {
+			if file != nil {
+				file.Close()
+			}
+			return os.NewSyscallError("setnonblock", err)
+		}
+	}
+	if err := h.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}
+
+	h.file = file
+	atomic.StoreInt32(&h.sysfd, int32(fd))
+	h.owned = false
+	h.event = event
+	atomic.StoreUint64(&h.last, 0)
+	if h.LastError() != nil {
+		h.setLastError(nil)
+	}
+	return nil
+}
+
+// resetFd returns descriptor of conn for Reset(). File is non-nil only if
+// conn is duplicated by File().
+func resetFd(conn net.Conn) (*os.File, int, error) {
+	if err := platformError(); err != nil {
+		return nil, -1, err
+	}
+	switch y := unwrap(conn, isSyscallConn).(type) {
+	case Filer:
+	case syscall.Conn:
+		fd, err := controlFd(y)
+		return nil, fd, err
+	}
+	return dupFile(conn)
+}
+
+// controlFd returns file descriptor number of sc taken by
+// SyscallConn().Control(), so its mode is not changed.
+func controlFd(sc syscall.Conn) (fd int, err error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd = -1
+	err = rc.Control(func(x uintptr) {
+		fd = int(x)
+	})
+	return fd, err
+}
+
+// drainBufferSize is a size of buffer used by DrainUntilEOF().
+const drainBufferSize = 32 << 10
+
+// DrainUntilEOF reads all data remaining in the kernel buffer of conn and
+// writes it to w. It is intended to be used in callbacks receiving
+// EventReadHup (see Event.PeerClosedWrite()), when peer has shut down writing
+// but data sent before is still unread.
+//
+// DrainUntilEOF never blocks waiting for data. It returns io.EOF when end of
+// stream is reached, or nil if there is no data available right now but end
+// of stream was not met yet.
+// Note that conn must implement syscall.Conn, otherwise ErrNotFiler is
+// returned.
+func DrainUntilEOF(conn net.Conn, w io.Writer) (n int64, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrNotFiler
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, drainBufferSize)
+	for {
+		var (
+			m    int
+			rerr error
+		)
+		err = rc.Read(func(fd uintptr) bool {
+			m, rerr = readNonblock(fd, buf)
+			// Do not wait for readiness.
+			return true
+		})
+		if err != nil {
+			return n, err
+		}
+		if rerr == errAgain {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		k, werr := w.Write(buf[:m])
+		n += int64(k)
+		if werr != nil {
+			return n, werr
+		}
+		if k < m {
+			return n, io.ErrShortWrite
+		}
+	}
+}
+
+// ReadOOB reads a byte of TCP urgent data, sent by peer with MSG_OOB flag,
+// from conn without blocking. It is intended to be called from callback
+// receiving EventPriority, which is reported when urgent data arrives.
+//
+// It returns ErrNoUrgentData if there is no urgent byte to be read, e.g. it is
+// read already, and syscall.EAGAIN if urgent data is announced by peer but
+// is not received yet. Note that only the last urgent byte is kept by the
+// kernel, so the earlier ones are lost if they are not read in time.
+//
+// When SO_OOBINLINE option is set for the socket, urgent byte is received
+// in the normal data stream at the urgent mark instead, and ReadOOB returns
+// ErrOOBInline. EventPriority is still reported then, so the callback could
+// switch to reading the data. Beware that on linux urgent bytes which were
+// already read by ReadOOB are received in the normal stream too, once the
+// option is set.
+// Note that conn must implement syscall.Conn or Filer, possibly behind
+// wrappers, otherwise ErrNotFiler is returned.
+func ReadOOB(conn net.Conn) (byte, error) {
+	var sc syscall.Conn
+	switch y := unwrap(conn, isSyscallConn).(type) {
+	case Filer:
+		fd, err := filerFd(y)
+		if err != nil {
+			return 0, err
+		}
+		return recvOOB(fd)
+	case syscall.Conn:
+		sc = y
+	default:
+		return 0, ErrNotFiler
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		b    byte
+		rerr error
+	)
+	if err = rc.Control(func(fd uintptr) {
+		b, rerr = recvOOB(int(fd))
+	}); err != nil {
+		return 0, err
+	}
+	return b, rerr
+}
+
+// WriteOrWait writes data to the descriptor. If it could not be written at
+// once due to EAGAIN, desc is started in p to write the rest of data when
+// EventWrite is received. Then desc is stopped and fn is called with nil
+// if all data has been written or with the write error.
+//
+// Note that desc must be created with EventWrite and must not be started in
+// p. Caller must not modify data until fn is called. If data is written at
+// once, fn is called before WriteOrWait returns.
+//
+// Non-nil error is returned if data could not be written at once neither
+// waiting for EventWrite could be started. In this case fn is not called.
+func WriteOrWait(p Poller, desc *Desc, data []byte, fn func(error)) error {
+	if desc.event&EventWrite == 0 {
+		return ErrInvalidEvent
+	}
+	n, err := writeNonblock(desc.fd(), data)
+	data = data[n:]
+	if err != nil && err != errAgain {
+		return os.NewSyscallError("write", err)
+	}
+	if len(data) == 0 {
+		fn(nil)
+		return nil
+	}
+	return p.Start(desc, func(event Event) {
+		if event&EventPollerClosed != 0 {
+			fn(ErrClosed)
+			return
+		}
+		n, err := writeNonblock(desc.fd(), data)
+		data = data[n:]
+		switch {
+		case err == errAgain:
+			// Wait for the next EventWrite.
+			if desc.event&EventOneShot == 0 {
+				return
+			}
+			if err = p.Resume(desc); err == nil {
+				return
+			}
+		case err != nil:
+			err = os.NewSyscallError("write", err)
+		}
+		p.Stop(desc)
+		fn(err)
+	})
 }
@@ -1,9 +1,54 @@
-// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!wasip1
 
 package netpoll
 
-import "fmt"
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// errAgain is never returned on current operating system, since all
+// descriptor operations fail with ErrUnsupportedPlatform.
+var errAgain = fmt.Errorf("operation would block")
+
+// platformError returns ErrUnsupportedPlatform for current operating system.
+func platformError() error {
+	return ErrUnsupportedPlatform{runtime.GOOS}
+}
 
 func setNonblock(fd int, nonblocking bool) (err error) {
-	return fmt.Errorf("setNonblock is not supported on this operating system")
+	return platformError()
+}
+
+func checkFd(fd int) (err error) {
+	return platformError()
+}
+
+func dupFd(fd int) (int, error) {
+	return -1, platformError()
+}
+
+func closeFd(fd int) (err error) {
+	return platformError()
+}
+
+func readNonblock(fd uintptr, p []byte) (n int, err error) {
+	return 0, platformError()
+}
+
+func writeNonblock(fd int, p []byte) (n int, err error) {
+	return 0, platformError()
+}
+
+func recvOOB(fd int) (byte, error) {
+	return 0, platformError()
+}
+
+func shutdownWrite(fd int) error {
+	return platformError()
+}
+
+func connAborted(errno syscall.Errno) bool {
+	return false
 }
@@ -2,8 +2,103 @@
 
 package netpoll
 
-import "syscall"
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errAgain is returned by non-blocking calls when operation would block.
+var errAgain error = syscall.EAGAIN
+
+// platformError returns nil, because netpoll is implemented for current
+// operating system.
+func platformError() error {
+	return nil
+}
 
 func setNonblock(fd int, nonblocking bool) (err error) {
 	return syscall.SetNonblock(fd, nonblocking)
 }
+
+func checkFd(fd int) (err error) {
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err
+}
+
+// dupFd returns a duplicate of fd with close-on-exec flag set.
+func dupFd(fd int) (int, error) {
+	return unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+}
+
+func closeFd(fd int) (err error) {
+	return syscall.Close(fd)
+}
+
+func readNonblock(fd uintptr, p []byte) (n int, err error) {
+	for {
+		n, err = syscall.Read(int(fd), p)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// writeNonblock writes p to fd until it is written entirely or error occurs.
+func writeNonblock(fd int, p []byte) (n int, err error) {
+	for n < len(p) {
+		m, err := syscall.Write(fd, p[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if m > 0 {
+			n += m
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// recvOOB reads urgent byte from socket fd without blocking.
+func recvOOB(fd int) (byte, error) {
+	var p [1]byte
+	for {
+		n, _, err := unix.Recvfrom(fd, p[:], unix.MSG_OOB|unix.MSG_DONTWAIT)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EINVAL:
+			// Нет срочных данных, либо они приходят в основном потоке
+			if inline, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_OOBINLINE); inline != 0 {
+				return 0, ErrOOBInline
+			}
+			return 0, ErrNoUrgentData
+		case err == unix.EAGAIN:
+			return 0, err
+		case err != nil:
+			return 0, os.NewSyscallError("recv", err)
+		case n == 0:
+			return 0, io.EOF
+		}
+		return p[0], nil
+	}
+}
+
+// shutdownWrite shuts down the write side of socket fd.
+func shutdownWrite(fd int) error {
+	return syscall.Shutdown(fd, syscall.SHUT_WR)
+}
+
+// connAborted reports whether errno means that connection was dropped
+// before it was accepted.
+func connAborted(errno syscall.Errno) bool {
+	return errno == unix.ECONNRESET || errno == unix.ECONNABORTED
+}
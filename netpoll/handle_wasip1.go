@@ -0,0 +1,76 @@
+// +build wasip1
+
+package netpoll
+
+import "syscall"
+
+// errAgain is returned by non-blocking calls when operation would block.
+var errAgain error = syscall.EAGAIN
+
+// platformError returns nil, because netpoll is implemented for current
+// operating system.
+func platformError() error {
+	return nil
+}
+
+func setNonblock(fd int, nonblocking bool) (err error) {
+	return syscall.SetNonblock(fd, nonblocking)
+}
+
+func checkFd(fd int) (err error) {
+	var st syscall.Stat_t
+	return syscall.Fstat(fd, &st)
+}
+
+// dupFd returns ENOSYS, because WASI has no way to duplicate descriptors.
+func dupFd(fd int) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+func closeFd(fd int) (err error) {
+	return syscall.Close(fd)
+}
+
+func readNonblock(fd uintptr, p []byte) (n int, err error) {
+	for {
+		n, err = syscall.Read(int(fd), p)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// writeNonblock writes p to fd until it is written entirely or error occurs.
+func writeNonblock(fd int, p []byte) (n int, err error) {
+	for n < len(p) {
+		m, err := syscall.Write(fd, p[n:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if m > 0 {
+			n += m
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// shutdownWrite shuts down the write side of socket fd.
+func shutdownWrite(fd int) error {
+	return syscall.Shutdown(fd, syscall.SHUT_WR)
+}
+
+// recvOOB returns ENOSYS, because WASI sockets have no urgent data.
+func recvOOB(fd int) (byte, error) {
+	return 0, syscall.ENOSYS
+}
+
+func connAborted(errno syscall.Errno) bool {
+	return errno == syscall.ECONNRESET || errno == syscall.ECONNABORTED
+}
@@ -0,0 +1,117 @@
+package netpoll
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// idleTracker counts callbacks which are in progress and lets to wait until
+// there are none.
+type idleTracker struct {
+	mu      sync.Mutex
+	n       int
+	waiters []chan struct{}
+}
+
+// begin marks that callbacks are going to be called.
+func (t *idleTracker) begin() {
+	t.mu.Lock()
+	t.n++
+	t.mu.Unlock()
+}
+
+// end marks that callbacks marked by begin() are returned.
+func (t *idleTracker) end() {
+	t.mu.Lock()
+	t.n--
+	if t.n == 0 {
+		for _, ch := range t.waiters {
+			close(ch)
+		}
+		t.waiters = nil
+	}
+	t.mu.Unlock()
+}
+
+// wait blocks until there are no callbacks in progress or ctx is done.
+func (t *idleTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.n == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	t.waiters = append(t.waiters, ch)
+	t.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// quietHook calls fn once the wait loop has not delivered any events for
+// threshold. It is used by the wait goroutine only, so it is not
+// synchronized.
+type quietHook struct {
+	threshold time.Duration
+	fn        func(time.Duration)
+	// since is the time of the last delivered event or of the loop start.
+	since time.Time
+	fired bool
+}
+
+func newQuietHook(threshold time.Duration, fn func(time.Duration)) quietHook {
+	if threshold <= 0 || fn == nil {
+		return quietHook{}
+	}
+	return quietHook{
+		threshold: threshold,
+		fn:        fn,
+		since:     time.Now(),
+	}
+}
+
+// timeout returns time left until fn must be called. It returns negative
+// value if there is nothing to wait, that is, the hook is disabled or it
+// has fired already in current quiet period.
+func (h *quietHook) timeout() time.Duration {
+	if h.fn == nil || h.fired {
+		return -1
+	}
+	if d := h.threshold - time.Since(h.since); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// msec returns timeout() in milliseconds rounded up, as expected by
+// epoll_wait() and poll().
+func (h *quietHook) msec() int {
+	d := h.timeout()
+	if d < 0 {
+		return -1
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// update must be called after each wait iteration. Delivered events start
+// new quiet period.
+func (h *quietHook) update(delivered bool) {
+	if h.fn == nil {
+		return
+	}
+	now := time.Now()
+	if delivered {
+		h.since = now
+		h.fired = false
+		return
+	}
+	if d := now.Sub(h.since); !h.fired && d >= h.threshold {
+		h.fired = true
+		h.fn(d)
+	}
+}
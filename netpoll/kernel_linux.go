@@ -0,0 +1,94 @@
+// +build linux
+
+package netpoll
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// epollRDHupAvailable reports whether the kernel supports EPOLLRDHUP, which
+// appeared in Linux 2.6.17. When it is false, pollers do not request it, so
+// EventReadHup is not reported and end of stream is detected by reading.
+var epollRDHupAvailable = true
+
+// kernelVersion is major, minor and patch numbers of Linux release.
+type kernelVersion [3]int
+
+// Minimal versions of features used by the package. EPOLLRDHUP is checked
+// against 2.6.17, where it was introduced, rather than 3.1.
+//
+// Note that Go itself requires Linux 2.6.32 or newer, so on supported
+// toolchains checkKernel() never finds a feature missing. The check is kept
+// for custom or patched runtimes, and it documents what the package needs.
+var (
+	kernelEPOLLRDHUP = kernelVersion{2, 6, 17}
+	kernelEventfd2   = kernelVersion{2, 6, 27}
+)
+
+func (v kernelVersion) less(w kernelVersion) bool {
+	for i := range v {
+		if v[i] != w[i] {
+			return v[i] < w[i]
+		}
+	}
+	return false
+}
+
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// parseKernelVersion parses release string such as "5.15.0-91-generic".
+// Missing numbers are zero.
+func parseKernelVersion(release string) (v kernelVersion, ok bool) {
+	if i := strings.IndexFunc(release, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	}); i >= 0 {
+		release = release[:i]
+	}
+	parts := strings.SplitN(release, ".", len(v))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return v, i > 0
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// checkKernel adjusts the package to the kernel of version v and warns about
+// missing features to l.
+func checkKernel(v kernelVersion, l Logger) {
+	if v.less(kernelEPOLLRDHUP) {
+		epollRDHupAvailable = false
+		logRecord(l, LogRecord{
+			Level:   LevelWarn,
+			Message: "kernel " + v.String() + " does not support EPOLLRDHUP, EventReadHup is not reported",
+			Op:      "init",
+			FD:      -1,
+		})
+	}
+	if v.less(kernelEventfd2) {
+		logRecord(l, LogRecord{
+			Level:   LevelWarn,
+			Message: "kernel " + v.String() + " does not support eventfd2, pipes are used to wake up epoll",
+			Op:      "init",
+			FD:      -1,
+		})
+	}
+}
+
+func init() {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return
+	}
+	if v, ok := parseKernelVersion(unix.ByteSliceToString(uts.Release[:])); ok {
+		checkKernel(v, defaultLogger)
+	}
+}
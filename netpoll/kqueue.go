@@ -1,10 +1,14 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
 // +build darwin dragonfly freebsd netbsd openbsd
 
 package netpoll
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -182,6 +186,11 @@ const (
 	EV_ERROR = unix.EV_ERROR
 )
 
+// NOTE_LOWAT is a filter flag of EVFILT_READ for sockets. It makes the
+// filter to return only when amount of data in the socket buffer is at least
+// the value of Kevent.Data.
+const NOTE_LOWAT = unix.NOTE_LOWAT
+
 // filterCount is a constant number of available filters which can be
 // registered for an identifier.
 const filterCount = 8
@@ -202,29 +211,68 @@ type Kevents [8]Kevent
 // registered identifier.
 type KeventHandler func(Kevent)
 
+// keventsHandler is a function that will be called with all events occured on
+// registered identifier within single wait iteration.
+type keventsHandler func([]Kevent)
+
 // KqueueConfig contains options for configuration kqueue instance.
 type KqueueConfig struct {
 	// OnWaitError will be called from goroutine, waiting for events.
+	// If OnWaitError is nil, errors are written to ErrorLog.
 	OnWaitError func(error)
+
+	// ErrorLog is used to log internally generated messages, including wait
+	// loop errors when OnWaitError is nil.
+	// If ErrorLog is nil, messages are written by the standard log package.
+	ErrorLog Logger
+
+	// OnIdle and IdleThreshold are the same as in Config.
+	OnIdle        func(idleFor time.Duration)
+	IdleThreshold time.Duration
+
+	// MaxDescriptors is the same as in Config: when it is positive and the
+	// number of registrations reaches it, Add() returns
+	// ErrTooManyDescriptors.
+	MaxDescriptors int
+
+	// SoftLimit and OnSoftLimit are the same as in Config. OnSoftLimit is
+	// called by Add().
+	SoftLimit   float64
+	OnSoftLimit func(current, max int)
+
+	// Name is the same as in Config. If it is empty, unique name such as
+	// "kqueue-1" is generated.
+	Name string
 }
 
 func (c *KqueueConfig) withDefaults() (config KqueueConfig) {
 	if c != nil {
 		config = *c
 	}
-	if config.OnWaitError == nil {
-		config.OnWaitError = defaultOnWaitError
+	if config.ErrorLog == nil {
+		config.ErrorLog = defaultLogger
+	}
+	if config.Name == "" {
+		config.Name = autoName("kqueue")
 	}
 	return config
 }
 
 // Kqueue represents kqueue instance.
 type Kqueue struct {
-	mu     sync.RWMutex          // Для синхронизации доступа
-	fd     int                   // Файловый дескриптор обработчика
-	cb     map[int]KeventHandler // Коллбеки для отслеживаемых дескрипторов
-	done   chan struct{}         // Канал завершения
+	mu     sync.RWMutex           // Для синхронизации доступа
+	fd     int                    // Файловый дескриптор обработчика
+	cb     map[int]keventsHandler // Коллбеки для отслеживаемых дескрипторов
+	done   chan struct{}          // Канал завершения
+	idle   idleTracker            // Учет выполняющихся коллбеков
+	quiet  quietHook              // Вызов OnIdle после периода тишины
 	closed bool
+	max    int       // Ограничение числа дескрипторов
+	soft   softLimit // Предупреждение о приближении к ограничению
+
+	name  string
+	log   Logger
+	trace StructuredLogger
 }
 
 // KqueueCreate creates new kqueue instance.
@@ -239,9 +287,15 @@ func KqueueCreate(c *KqueueConfig) (*Kqueue, error) {
 	}
 
 	kq := &Kqueue{
-		fd:   fd,
-		cb:   make(map[int]KeventHandler),
-		done: make(chan struct{}),
+		fd:    fd,
+		cb:    make(map[int]keventsHandler),
+		done:  make(chan struct{}),
+		quiet: newQuietHook(config.IdleThreshold, config.OnIdle),
+		max:   config.MaxDescriptors,
+		soft:  newSoftLimit(config.SoftLimit, config.MaxDescriptors, config.OnSoftLimit),
+		name:  config.Name,
+		log:   config.ErrorLog,
+		trace: structuredLogger(config.ErrorLog),
 	}
 
 	// Запускаем горутину, которая отслеживает события
@@ -257,12 +311,29 @@ func (k *Kqueue) Close() error {
 	return nil
 }
 
+// WaitIdle blocks until callbacks which are called at the moment return, or
+// ctx is done. In the latter case ctx.Err() is returned.
+// It must not be called from callbacks.
+func (k *Kqueue) WaitIdle(ctx context.Context) error {
+	return k.idle.wait(ctx)
+}
+
 // Add добавляет обработчик события для конкретного файлового дескриптора и маски событий
-func (k *Kqueue) Add(fd int, events Kevents, n int, cb KeventHandler) error {
+func (k *Kqueue) Add(fd int, events Kevents, n int, cb KeventHandler) (err error) {
+	return k.add(fd, events, n, func(evs []Kevent) {
+		for _, ev := range evs {
+			cb(ev)
+		}
+	})
+}
+
+// add регистрирует обработчик, который получает все события дескриптора за одну
+// итерацию цикла ожидания одним вызовом
+func (k *Kqueue) add(fd int, events Kevents, n int, cb keventsHandler) (err error) {
 	// Получаем типы событий
 	var kevs [filterCount]unix.Kevent_t
 	for i := 0; i < n; i++ {
-		kevs[i] = evGet(fd, events[i].Filter, events[i].Flags)
+		kevs[i] = evGet(fd, events[i])
 	}
 
 	// Получаем указатель
@@ -274,6 +345,12 @@ func (k *Kqueue) Add(fd int, events Kevents, n int, cb KeventHandler) error {
 	}
 	changes := *(*[]unix.Kevent_t)(unsafe.Pointer(hdr))
 
+	defer k.traceCtl("add", fd, events[:n], &err)
+
+	// Предупреждение о приближении к лимиту вызывается после снятия блокировки
+	var soft int
+	defer func() { k.soft.notify(soft) }()
+
 	// Блокировка мьютексом
 	k.mu.Lock()
 	defer k.mu.Unlock()
@@ -286,21 +363,99 @@ func (k *Kqueue) Add(fd int, events Kevents, n int, cb KeventHandler) error {
 	if _, has := k.cb[fd]; has {
 		return ErrRegistered
 	}
+	if k.max > 0 && len(k.cb) >= k.max {
+		return ErrTooManyDescriptors
+	}
 
 	// Сохраняем коллбек
 	k.cb[fd] = cb
 
 	// Подключаемся к событиям
-	_, err := unix.Kevent(k.fd, changes, nil, nil)
+	if _, err = unix.Kevent(k.fd, changes, nil, nil); err == nil {
+		soft = k.soft.added(len(k.cb))
+	}
 
 	return err
 }
 
+// procKey returns key of the callbacks map for process pid. Keys of
+// processes are negative, so they do not clash with descriptors.
+func procKey(pid int) int {
+	return ^pid
+}
+
+// addProc регистрирует обработчик событий процесса pid с фильтром
+// EVFILT_PROC и флагами fflags. После NOTE_EXIT ядро удаляет фильтр само
+func (k *Kqueue) addProc(pid int, fflags uint32, cb keventsHandler) (err error) {
+	ev := Kevent{
+		Filter: EVFILT_PROC,
+		Flags:  EV_ADD | EV_CLEAR,
+		Fflags: fflags,
+	}
+	changes := []unix.Kevent_t{evGet(pid, ev)}
+
+	defer k.traceCtl("add", pid, []Kevent{ev}, &err)
+
+	var soft int
+	defer func() { k.soft.notify(soft) }()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.closed {
+		return ErrClosed
+	}
+	key := procKey(pid)
+	if _, has := k.cb[key]; has {
+		return ErrRegistered
+	}
+	if k.max > 0 && len(k.cb) >= k.max {
+		return ErrTooManyDescriptors
+	}
+
+	if _, err = unix.Kevent(k.fd, changes, nil, nil); err != nil {
+		return err
+	}
+	k.cb[key] = cb
+	soft = k.soft.added(len(k.cb))
+	return nil
+}
+
+// delProc удаляет обработчик событий процесса pid. Фильтр завершившегося
+// процесса уже удален ядром, поэтому ENOENT и ESRCH не считаются ошибкой
+func (k *Kqueue) delProc(pid int) (err error) {
+	defer k.traceCtl("del", pid, nil, &err)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.closed {
+		return ErrClosed
+	}
+	key := procKey(pid)
+	if _, has := k.cb[key]; !has {
+		return ErrNotRegistered
+	}
+	delete(k.cb, key)
+	k.soft.removed(len(k.cb))
+
+	changes := []unix.Kevent_t{evGet(pid, Kevent{Filter: EVFILT_PROC, Flags: EV_DELETE})}
+	if _, err = unix.Kevent(k.fd, changes, nil, nil); err == unix.ENOENT || err == unix.ESRCH {
+		err = nil
+	}
+	return err
+}
+
+// Name returns the name of the instance, see KqueueConfig.Name.
+func (k *Kqueue) Name() string {
+	return k.name
+}
+
 // Mod модифицирует события привязанные к конкретному дескриптору
-func (k *Kqueue) Mod(fd int, events Kevents, n int) error {
+func (k *Kqueue) Mod(fd int, events Kevents, n int) (err error) {
 	var kevs [filterCount]unix.Kevent_t
 	for i := 0; i < n; i++ {
-		kevs[i] = evGet(fd, events[i].Filter, events[i].Flags)
+		kevs[i] = evGet(fd, events[i])
 	}
 
 	arr := unsafe.Pointer(&kevs)
@@ -311,6 +466,8 @@ func (k *Kqueue) Mod(fd int, events Kevents, n int) error {
 	}
 	changes := *(*[]unix.Kevent_t)(unsafe.Pointer(hdr))
 
+	defer k.traceCtl("mod", fd, events[:n], &err)
+
 	k.mu.RLock()
 	defer k.mu.RUnlock()
 
@@ -321,14 +478,16 @@ func (k *Kqueue) Mod(fd int, events Kevents, n int) error {
 		return ErrNotRegistered
 	}
 
-	_, err := unix.Kevent(k.fd, changes, nil, nil)
+	_, err = unix.Kevent(k.fd, changes, nil, nil)
 
 	return err
 }
 
 // Del removes callback for fd. Note that it does not cleanups events for fd in
 // kqueue. You should close fd or call Mod() with EV_DELETE flag set.
-func (k *Kqueue) Del(fd int) error {
+func (k *Kqueue) Del(fd int) (err error) {
+	defer k.traceCtl("del", fd, nil, &err)
+
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
@@ -340,10 +499,48 @@ func (k *Kqueue) Del(fd int) error {
 	}
 
 	delete(k.cb, fd)
+	k.soft.removed(len(k.cb))
 
 	return nil
 }
 
+// traceCtl writes registration lifecycle record to the structured logger.
+// It is called after the lock is released.
+func (k *Kqueue) traceCtl(op string, fd int, events []Kevent, err *error) {
+	if k.trace == nil {
+		return
+	}
+	rec := LogRecord{
+		Level:   LevelDebug,
+		Message: "registration " + op,
+		Poller:  k.name,
+		Op:      op,
+		FD:      fd,
+		Err:     *err,
+	}
+	if len(events) > 0 {
+		rec.Events = fmt.Sprint(events)
+	}
+	k.trace.Log(rec)
+}
+
+// waitError reports an error occurred in the wait loop on given iteration.
+func (k *Kqueue) waitError(onError func(error), err error, iter uint64) {
+	if onError != nil {
+		onError(err)
+		return
+	}
+	logRecord(k.log, LogRecord{
+		Level:     LevelError,
+		Message:   "wait loop error",
+		Poller:    k.name,
+		Op:        "wait",
+		FD:        -1,
+		Err:       err,
+		Iteration: iter,
+	})
+}
+
 func (k *Kqueue) wait(onError func(error)) {
 	const (
 		// Начальное значение ожидающих файловых дескрипторов
@@ -352,31 +549,48 @@ func (k *Kqueue) wait(onError func(error)) {
 		maxWaitEventsStop = 1 << 15 // 32768
 	)
 
+	// Номер итерации цикла ожидания
+	var iter uint64
+
 	// Отложенная функция, которая закрывает файловый дескриптор и закрывает канал
 	defer func() {
 		if err := unix.Close(k.fd); err != nil {
-			onError(err)
+			k.waitError(onError, err, iter)
 		}
 		close(k.done)
 	}()
 
-	// Создаем массивы ивентов и коллбеков
-	evs := make([]unix.Kevent_t, maxWaitEventsBegin)
-	cbs := make([]KeventHandler, maxWaitEventsBegin)
+	// Создаем массивы ивентов и групп событий по дескрипторам
+	var (
+		evs    = make([]unix.Kevent_t, maxWaitEventsBegin)
+		kevs   = make([]Kevent, maxWaitEventsBegin)
+		ids    = make([]int, maxWaitEventsBegin)
+		groups = make([]keventGroup, 0, maxWaitEventsBegin)
+		index  = make(map[int]int)
+	)
 
-	for {
+	for ; ; iter++ {
 		// Получаем количество обновленных дескрипторов
-		n, err := unix.Kevent(k.fd, nil, evs, nil)
+		var timeout *unix.Timespec
+		if d := k.quiet.timeout(); d >= 0 {
+			ts := unix.NsecToTimespec(int64(d))
+			timeout = &ts
+		}
+		n, err := unix.Kevent(k.fd, nil, evs, timeout)
 		if err != nil {
-			if temporaryErr(err) {
+			if IsTemporaryError(err) {
 				continue
 			}
-			onError(err)
+			k.waitError(onError, err, iter)
 			return
 		}
 
-		// Обновляем размер под нужное нам количество
-		cbs = cbs[:n]
+		// Группируем события по дескрипторам, чтобы вызвать коллбек
+		// дескриптора один раз за итерацию
+		groups = groups[:0]
+		for fd := range index {
+			delete(index, fd)
+		}
 		k.mu.RLock()
 		for i := 0; i < n; i++ {
 			fd := int(evs[i].Ident) // Получаем файловый дескриптор в котором изменения были
@@ -384,37 +598,79 @@ func (k *Kqueue) wait(onError func(error)) {
 				k.mu.RUnlock()
 				return
 			}
-			cbs[i] = k.cb[fd] // Получаем коллбек текущего файлового дескриптора
+			if evs[i].Filter == EVFILT_PROC {
+				// Идентификатор события процесса - его pid
+				fd = procKey(fd)
+			}
+			g, has := index[fd]
+			if !has {
+				g = len(groups)
+				index[fd] = g
+				// Получаем коллбек текущего файлового дескриптора
+				groups = append(groups, keventGroup{cb: k.cb[fd]})
+			}
+			groups[g].n++
+			ids[i] = g
 		}
 		k.mu.RUnlock()
 
+		// Раскладываем события так, чтобы события одного дескриптора шли подряд
+		off := 0
+		for i := range groups {
+			groups[i].off = off
+			off += groups[i].n
+			groups[i].n = 0
+		}
+		for i := 0; i < n; i++ {
+			g := &groups[ids[i]]
+			e := evs[i]
+			kevs[g.off+g.n] = Kevent{
+				Filter: KeventFilter(e.Filter),
+				Flags:  KeventFlag(e.Flags),
+				Data:   e.Data,
+				Fflags: e.Fflags,
+			}
+			g.n++
+		}
+
 		// Идем по коллбекам
-		for i, cb := range cbs {
-			if cb != nil {
-				e := evs[i] // Событие для данного коллбека
+		delivered := false
+		k.idle.begin()
+		for i := range groups {
+			g := &groups[i]
+			if g.cb != nil {
+				delivered = true
 				// Вызываем данный коллбек
-				cb(Kevent{
-					Filter: KeventFilter(e.Filter),
-					Flags:  KeventFlag(e.Flags),
-					Data:   e.Data,
-					Fflags: e.Fflags,
-				})
-				cbs[i] = nil
+				g.cb(kevs[g.off : g.off+g.n])
+				g.cb = nil
 			}
 		}
+		k.idle.end()
+		k.quiet.update(delivered)
 
 		// Расширяем массивы при необходимости
 		if n == len(evs) && n*2 <= maxWaitEventsStop {
 			evs = make([]unix.Kevent_t, n*2)
-			cbs = make([]KeventHandler, n*2)
+			kevs = make([]Kevent, n*2)
+			ids = make([]int, n*2)
 		}
 	}
 }
 
-func evGet(fd int, filter KeventFilter, flags KeventFlag) unix.Kevent_t {
+// keventGroup описывает события одного дескриптора, полученные за одну
+// итерацию цикла ожидания
+type keventGroup struct {
+	cb  keventsHandler
+	off int
+	n   int
+}
+
+func evGet(fd int, ev Kevent) unix.Kevent_t {
 	return unix.Kevent_t{
 		Ident:  uint64(fd),
-		Filter: int16(filter),
-		Flags:  uint16(flags),
+		Filter: int16(ev.Filter),
+		Flags:  uint16(ev.Flags),
+		Fflags: ev.Fflags,
+		Data:   ev.Data,
 	}
 }
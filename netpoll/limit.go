@@ -0,0 +1,73 @@
+package netpoll
+
+import "math"
+
+// softLimitBand is the hysteresis of the soft limit as a fraction of
+// MaxDescriptors: after OnSoftLimit is called, occupancy must drop this much
+// below the threshold before the next crossing is reported.
+const softLimitBand = 0.05
+
+// softLimit reports crossings of Config.SoftLimit. It is used under the lock
+// of the poller which guards the registrations count, so it is not
+// synchronized itself.
+type softLimit struct {
+	fn func(current, max int)
+	// high is the occupancy which fires fn; low is the occupancy below which
+	// the next crossing is reported again.
+	high, low int
+	max       int
+	fired     bool
+}
+
+// newSoftLimit returns softLimit for fraction of max descriptors. It is
+// disabled unless both max and fraction are positive and fn is not nil.
+func newSoftLimit(fraction float64, max int, fn func(current, max int)) softLimit {
+	if fn == nil || max <= 0 || fraction <= 0 {
+		return softLimit{}
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	// Epsilon keeps e.g. 0.07*100 from being rounded up to 8.
+	high := int(math.Ceil(fraction*float64(max) - 1e-9))
+	if high < 1 {
+		high = 1
+	}
+	band := int(softLimitBand * float64(max))
+	if band < 1 {
+		band = 1
+	}
+	return softLimit{
+		fn:   fn,
+		high: high,
+		low:  high - band,
+		max:  max,
+	}
+}
+
+// added must be called after registration which made n descriptors
+// registered. It returns n if fn must be called by notify(), or zero
+// otherwise.
+func (s *softLimit) added(n int) int {
+	if s.fn == nil || s.fired || n < s.high {
+		return 0
+	}
+	s.fired = true
+	return n
+}
+
+// removed must be called after removal which left n descriptors registered.
+func (s *softLimit) removed(n int) {
+	if s.fired && n < s.low {
+		s.fired = false
+	}
+}
+
+// notify calls fn with the value returned by added(), if it is not zero. It
+// must be called after the lock of the poller is released, so fn could use
+// the poller.
+func (s *softLimit) notify(n int) {
+	if n != 0 {
+		s.fn(n, s.max)
+	}
+}
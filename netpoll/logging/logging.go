@@ -0,0 +1,191 @@
+/*
+Package logging provides netpoll.Poller wrapper which logs every call of the
+poller and every event received by callbacks.
+
+It is intended for development and debugging only:
+
+	p, err := netpoll.New(nil)
+	if err != nil {
+		// handle error
+	}
+	p = logging.LoggingPoller(p, netpoll.StdLogger(nil))
+
+Records are written at netpoll.LevelDebug with following fields:
+
+	Poller   – name of the wrapped poller, if it implements netpoll.Namer;
+	Op       – "start", "stop", "resume" or "event";
+	FD       – file descriptor, see netpoll.Desc.Fd();
+	Events   – descriptor event mask for start, or received events for event;
+	Err      – error returned by the wrapped poller, if any;
+	Duration – callback execution time for event.
+
+Logger implementing netpoll.StructuredLogger receives records as is, while
+plain netpoll.Logger receives all of them formatted by LogRecord.String().
+
+Note the performance impact. Logger is called synchronously from goroutine,
+waiting for events, so each event is delayed by record formatting and writing,
+which usually takes much longer than the callback itself. Events of other
+descriptors wait for it too. Each event also costs two clock readings, and
+each registration allocates a closure, even for netpoll.StartHandler().
+*/
+package logging
+
+import (
+	"context"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// poller logs calls of the wrapped poller.
+type poller struct {
+	p    netpoll.Poller
+	l    netpoll.Logger
+	name string
+}
+
+var (
+	_ netpoll.FullPoller = (*poller)(nil)
+	_ netpoll.Namer      = (*poller)(nil)
+)
+
+// LoggingPoller returns Poller which logs calls of p and events received by
+// callbacks to logger. If logger is nil, the standard logger of the log
+// package is used.
+//
+// Returned Poller implements netpoll.FullPoller and netpoll.Namer. Its
+// Close() and WaitIdle() call the methods of p if it implements
+// netpoll.Closer and netpoll.Idler respectively; otherwise they do nothing
+// and return nil. Its Name() returns the name of p, or empty string if p does
+// not implement netpoll.Namer.
+func LoggingPoller(p netpoll.Poller, logger netpoll.Logger) netpoll.Poller {
+	if logger == nil {
+		logger = netpoll.StdLogger(nil)
+	}
+	var name string
+	if n, ok := p.(netpoll.Namer); ok {
+		name = n.Name()
+	}
+	return &poller{p, logger, name}
+}
+
+// Start implements netpoll.Poller.
+func (p *poller) Start(desc *netpoll.Desc, cb netpoll.CallbackFn) error {
+	return p.started(desc, p.p.Start(desc, p.callback(desc, cb)))
+}
+
+// StartWithOptions implements netpoll.Poller.
+func (p *poller) StartWithOptions(desc *netpoll.Desc, cb netpoll.CallbackFn, opts ...netpoll.StartOption) error {
+	return p.started(desc, p.p.StartWithOptions(desc, p.callback(desc, cb), opts...))
+}
+
+// StartDuplex implements netpoll.Poller. Events are logged by each of the
+// callbacks, so the ones passed to both of them, such as netpoll.EventHup,
+// are logged twice.
+func (p *poller) StartDuplex(desc *netpoll.Desc, onRead, onWrite netpoll.CallbackFn) error {
+	if onRead != nil {
+		onRead = p.callback(desc, onRead)
+	}
+	if onWrite != nil {
+		onWrite = p.callback(desc, onWrite)
+	}
+	return p.started(desc, p.p.StartDuplex(desc, onRead, onWrite))
+}
+
+// StartCtxFn implements netpoll.Poller.
+func (p *poller) StartCtxFn(desc *netpoll.Desc, ctx context.Context, fn func(context.Context, netpoll.Event)) error {
+	cb := p.callback(desc, func(event netpoll.Event) {
+		fn(ctx, event)
+	})
+	return p.started(desc, p.p.StartCtxFn(desc, ctx, func(_ context.Context, event netpoll.Event) {
+		cb(event)
+	}))
+}
+
+// Stop implements netpoll.Poller.
+func (p *poller) Stop(desc *netpoll.Desc) error {
+	err := p.p.Stop(desc)
+	p.log(netpoll.LogRecord{
+		Message: "poller stop",
+		Op:      "stop",
+		FD:      desc.Fd(),
+		Err:     err,
+	})
+	return err
+}
+
+// Resume implements netpoll.Poller.
+func (p *poller) Resume(desc *netpoll.Desc) error {
+	err := p.p.Resume(desc)
+	p.log(netpoll.LogRecord{
+		Message: "poller resume",
+		Op:      "resume",
+		FD:      desc.Fd(),
+		Err:     err,
+	})
+	return err
+}
+
+// Name implements netpoll.Namer.
+func (p *poller) Name() string {
+	return p.name
+}
+
+// Close implements netpoll.Closer.
+func (p *poller) Close() error {
+	if c, ok := p.p.(netpoll.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WaitIdle implements netpoll.Idler.
+func (p *poller) WaitIdle(ctx context.Context) error {
+	if i, ok := p.p.(netpoll.Idler); ok {
+		return i.WaitIdle(ctx)
+	}
+	return nil
+}
+
+func (p *poller) started(desc *netpoll.Desc, err error) error {
+	p.log(netpoll.LogRecord{
+		Message: "poller start",
+		Op:      "start",
+		FD:      desc.Fd(),
+		Events:  desc.Event().String(),
+		Err:     err,
+	})
+	return err
+}
+
+// callback returns callback which logs events passed to cb and its
+// execution time. Note that cb could be nil.
+func (p *poller) callback(desc *netpoll.Desc, cb netpoll.CallbackFn) netpoll.CallbackFn {
+	return func(event netpoll.Event) {
+		begin := time.Now()
+		if cb != nil {
+			cb(event)
+		}
+		p.log(netpoll.LogRecord{
+			Message:  "poller event",
+			Op:       "event",
+			FD:       desc.Fd(),
+			Events:   event.String(),
+			Duration: time.Since(begin),
+		})
+	}
+}
+
+func (p *poller) log(rec netpoll.LogRecord) {
+	rec.Level = netpoll.LevelDebug
+	rec.Poller = p.name
+	if sl, ok := p.l.(netpoll.StructuredLogger); ok {
+		sl.Log(rec)
+		return
+	}
+	if p.name != "" {
+		p.l.Printf("netpoll[%s]: %s", p.name, rec)
+		return
+	}
+	p.l.Printf("netpoll: %s", rec)
+}
@@ -0,0 +1,206 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+func TestLoggingPoller(t *testing.T) {
+	var (
+		stub = newStubPoller()
+		l    recordLogger
+		p    = LoggingPoller(stub, &l)
+		desc = &netpoll.Desc{}
+	)
+	err := p.Start(desc, func(netpoll.Event) {
+		time.Sleep(time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.fire(desc, netpoll.EventRead|netpoll.EventHup)
+	if err := p.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(desc); err != netpoll.ErrNotRegistered {
+		t.Fatalf("unexpected Stop() error: %v", err)
+	}
+
+	exp := []string{"start", "event", "resume", "stop", "stop"}
+	if len(l.recs) != len(exp) {
+		t.Fatalf("got %d records; want %d: %+v", len(l.recs), len(exp), l.recs)
+	}
+	for i, rec := range l.recs {
+		if rec.Op != exp[i] {
+			t.Errorf("record #%d op is %q; want %q", i, rec.Op, exp[i])
+		}
+		if rec.Level != netpoll.LevelDebug {
+			t.Errorf("record #%d level is %s; want %s", i, rec.Level, netpoll.LevelDebug)
+		}
+		if rec.FD != 0 {
+			t.Errorf("record #%d fd is %d; want 0", i, rec.FD)
+		}
+	}
+	if ev := l.recs[1]; ev.Events != (netpoll.EventRead|netpoll.EventHup).String() || ev.Duration < time.Millisecond {
+		t.Errorf("unexpected event record: %+v", ev)
+	}
+	if err := l.recs[4].Err; err != netpoll.ErrNotRegistered {
+		t.Errorf("failed stop record error is %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+}
+
+func TestLoggingPollerPlain(t *testing.T) {
+	var (
+		stub  = newStubPoller()
+		lines []string
+		p     = LoggingPoller(stub, netpoll.LoggerFunc(func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}))
+		desc = &netpoll.Desc{}
+	)
+	onRead := 0
+	if err := p.StartDuplex(desc, func(netpoll.Event) { onRead++ }, nil); err != nil {
+		t.Fatal(err)
+	}
+	stub.fire(desc, netpoll.EventRead)
+	if onRead != 1 {
+		t.Fatalf("onRead is called %d times; want 1", onRead)
+	}
+	// Plain logger receives records of all levels.
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2: %q", len(lines), lines)
+	}
+	if !strings.Contains(lines[1], "events="+netpoll.EventRead.String()) || !strings.Contains(lines[1], "duration=") {
+		t.Errorf("unexpected event line: %q", lines[1])
+	}
+}
+
+func TestLoggingPollerHandler(t *testing.T) {
+	var (
+		stub = newStubPoller()
+		l    recordLogger
+		p    = LoggingPoller(stub, &l)
+		desc = &netpoll.Desc{}
+		h    countHandler
+	)
+	if err := netpoll.StartHandler(p, desc, &h); err != nil {
+		t.Fatal(err)
+	}
+	stub.fire(desc, netpoll.EventWrite)
+	if h != 1 {
+		t.Errorf("handler is called %d times; want 1", h)
+	}
+	if n := len(l.recs); n != 2 || l.recs[1].Op != "event" {
+		t.Errorf("unexpected records: %+v", l.recs)
+	}
+	if err := p.(netpoll.Closer).Close(); err != errStubClosed {
+		t.Errorf("Close() = %v; want %v", err, errStubClosed)
+	}
+}
+
+func TestLoggingPollerName(t *testing.T) {
+	var (
+		stub  = newStubPoller()
+		lines []string
+		p     = LoggingPoller(namedPoller{stub, "ingress-0"}, netpoll.LoggerFunc(func(format string, args ...interface{}) {
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}))
+		desc = &netpoll.Desc{}
+	)
+	if act := p.(netpoll.Namer).Name(); act != "ingress-0" {
+		t.Errorf("Name() is %q; want %q", act, "ingress-0")
+	}
+	if err := p.Start(desc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "netpoll[ingress-0]: poller start") {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+	if act := LoggingPoller(stub, nil).(netpoll.Namer).Name(); act != "" {
+		t.Errorf("Name() of unnamed poller is %q; want empty", act)
+	}
+}
+
+// namedPoller adds netpoll.Namer to the stub.
+type namedPoller struct {
+	*stubPoller
+	name string
+}
+
+func (p namedPoller) Name() string { return p.name }
+
+type countHandler int
+
+func (h *countHandler) HandleEvent(netpoll.Event) { *h++ }
+
+// recordLogger is a netpoll.StructuredLogger which stores all records.
+type recordLogger struct {
+	recs []netpoll.LogRecord
+}
+
+func (l *recordLogger) Printf(string, ...interface{}) {}
+
+func (l *recordLogger) Log(rec netpoll.LogRecord) {
+	l.recs = append(l.recs, rec)
+}
+
+var errStubClosed = fmt.Errorf("stub poller closed")
+
+// stubPoller is a netpoll.Poller which calls callbacks only by fire() calls.
+type stubPoller struct {
+	callbacks map[*netpoll.Desc]netpoll.CallbackFn
+}
+
+func newStubPoller() *stubPoller {
+	return &stubPoller{
+		callbacks: make(map[*netpoll.Desc]netpoll.CallbackFn),
+	}
+}
+
+func (p *stubPoller) Start(desc *netpoll.Desc, cb netpoll.CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
+
+func (p *stubPoller) StartWithOptions(desc *netpoll.Desc, cb netpoll.CallbackFn, _ ...netpoll.StartOption) error {
+	if _, has := p.callbacks[desc]; has {
+		return netpoll.ErrRegistered
+	}
+	p.callbacks[desc] = cb
+	return nil
+}
+
+func (p *stubPoller) StartDuplex(desc *netpoll.Desc, onRead, onWrite netpoll.CallbackFn) error {
+	return p.Start(desc, netpoll.Duplex(onRead, onWrite))
+}
+
+func (p *stubPoller) StartCtxFn(desc *netpoll.Desc, ctx context.Context, fn func(context.Context, netpoll.Event)) error {
+	return p.Start(desc, netpoll.ContextCallback(ctx, fn))
+}
+
+func (p *stubPoller) Stop(desc *netpoll.Desc) error {
+	if _, has := p.callbacks[desc]; !has {
+		return netpoll.ErrNotRegistered
+	}
+	delete(p.callbacks, desc)
+	return nil
+}
+
+func (p *stubPoller) Resume(desc *netpoll.Desc) error {
+	return nil
+}
+
+func (p *stubPoller) Close() error {
+	return errStubClosed
+}
+
+func (p *stubPoller) fire(desc *netpoll.Desc, event netpoll.Event) {
+	p.callbacks[desc](event)
+}
@@ -8,6 +8,8 @@
 Для получения дополнительной информации нужно смотреть описание API контретной операционной системы:
 	- epoll on linux;
 	- kqueue on bsd;
+	- poll_oneoff on wasip1;
+	- poll, если он запрошен в Config.Backend (для отладки);
 
 Функция Handle создает netpoll.Desc для дальнейшего использования в методах пулера:
 
@@ -43,8 +45,14 @@ Poller описывает платформозависимый интерфей
 package netpoll
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
@@ -61,10 +69,95 @@ var (
 	// registered within the poller instance.
 	ErrRegistered = fmt.Errorf("file descriptor is already registered in poller instance")
 
+	// ErrTooManyDescriptors is returned by Poller Start() method and by Add()
+	// methods of Epoll and Kqueue to indicate that the number of registered
+	// descriptors reached the limit set by Config.MaxDescriptors.
+	ErrTooManyDescriptors = fmt.Errorf("too many descriptors are registered in poller instance")
+
 	// ErrNotRegistered is returned by Poller Stop() and Resume() methods to
 	// indicate that connection with the same underlying file descriptor was
 	// not registered before within the poller instance.
 	ErrNotRegistered = fmt.Errorf("file descriptor was not registered before in poller instance")
+
+	// ErrInvalidFD is returned by Poller methods to indicate that given file
+	// descriptor is negative or exceeds the maximum descriptor value allowed
+	// by the system.
+	ErrInvalidFD = fmt.Errorf("file descriptor is out of allowed range")
+
+	// ErrInvalidEvent is returned by NewDesc to indicate that given event
+	// mask has no EventRead or EventWrite bits set or contains bits which
+	// could not be requested from the poller.
+	ErrInvalidEvent = fmt.Errorf("invalid event mask")
+
+	// ErrNonblockConflict is returned by HandleWithOptions() when both
+	// SetNonblock and ClearNonblock options are set.
+	ErrNonblockConflict = fmt.Errorf("SetNonblock and ClearNonblock options are mutually exclusive")
+
+	// ErrUnsupportedOption is returned by Poller StartWithOptions() method to
+	// indicate that some of given options could not be honored by the poller.
+	ErrUnsupportedOption = fmt.Errorf("option is not supported by the poller")
+
+	// ErrNotPollable is returned by Poller methods to indicate that file
+	// descriptor does not support polling, e.g. it refers to a regular file.
+	ErrNotPollable = fmt.Errorf("file descriptor does not support polling")
+
+	// ErrDescInvalid is returned by Poller methods to indicate that file
+	// descriptor is not open, e.g. it was closed before the call.
+	ErrDescInvalid = fmt.Errorf("file descriptor is not valid")
+
+	// ErrTooManyEINTR is passed to OnWaitError when epoll_wait() is
+	// interrupted more than EpollConfig.MaxEINTR times in a row. The wait
+	// loop is stopped after that.
+	ErrTooManyEINTR = fmt.Errorf("wait is interrupted too many times in a row")
+
+	// ErrDescReleased is returned by ReleaseDesc() when descriptor is
+	// already released.
+	ErrDescReleased = fmt.Errorf("descriptor is already released")
+
+	// ErrInvalidBatchSize is returned by EpollCreate() when
+	// EpollConfig.InitialBatchSize is not positive or MaxBatchSize is less
+	// than it.
+	ErrInvalidBatchSize = fmt.Errorf("invalid wait batch size")
+
+	// ErrInvalidEncoding is returned by EpollEvent.UnmarshalBinary() when
+	// data has unexpected length.
+	ErrInvalidEncoding = fmt.Errorf("invalid binary encoding length")
+
+	// ErrProxyLimit is reported by Proxy() when connection sends more data
+	// than allowed by ProxyOptions.
+	ErrProxyLimit = fmt.Errorf("proxy byte limit is exceeded")
+
+	// ErrProxyIdle is reported by Proxy() when no data is moved for
+	// ProxyOptions.IdleTimeout.
+	ErrProxyIdle = fmt.Errorf("proxy idle timeout")
+
+	// ErrDefaultInitialized is returned by SetDefault() when default poller
+	// is already in use.
+	ErrDefaultInitialized = fmt.Errorf("default poller is already initialized")
+
+	// ErrNoUrgentData is returned by ReadOOB() when there is no urgent data
+	// to be read, e.g. it is already read.
+	ErrNoUrgentData = fmt.Errorf("no urgent data")
+
+	// ErrOOBInline is returned by ReadOOB() when SO_OOBINLINE option is set
+	// for the socket, so urgent data is received in the normal data stream.
+	ErrOOBInline = fmt.Errorf("urgent data is received inline")
+
+	// ErrInvalidPID is returned by HandleProcess() when process ID is not
+	// positive.
+	ErrInvalidPID = fmt.Errorf("invalid process id")
+
+	// ErrNotProcess is returned by ProcessStatus() when descriptor is not
+	// made by HandleProcess().
+	ErrNotProcess = fmt.Errorf("descriptor does not watch a process")
+
+	// ErrNoExitStatus is returned by ProcessStatus() when process has
+	// exited, but the system does not report its exit status.
+	ErrNoExitStatus = fmt.Errorf("exit status of the process is not available")
+
+	// ErrWaitTimeout is returned by WaitForEvent() when timeout expires
+	// before any of wanted events is received.
+	ErrWaitTimeout = fmt.Errorf("timeout waiting for event")
 )
 
 // Event Описывает битовую маску конфигурации netpoll
@@ -74,9 +167,15 @@ type Event uint16
 const (
 	EventRead  Event = 0x1
 	EventWrite       = 0x2
+
+	// EventPriority is requested and received for exceptional conditions
+	// of the descriptor, such as arrival of TCP urgent data, see ReadOOB().
+	// It is supported by epoll and poll pollers.
+	EventPriority Event = 0x100
 )
 
-// Event значения, которые описывают поведение Poller
+// Event значения, которые описывают поведение Poller.
+// Для большей типобезопасности лучше использовать значения Behavior.
 const (
 	EventOneShot       Event = 0x4
 	EventEdgeTriggered       = 0x8
@@ -97,6 +196,19 @@ const (
 	EventPollerClosed = 0x8000
 )
 
+// PeerClosedWrite reports whether ev means that peer has shut down writing
+// (half-close), while the connection is still alive in the other direction.
+// In this case data sent by peer before shutdown could still be buffered, so
+// it is worth to read it until io.EOF, e.g. using DrainUntilEOF().
+// It returns false for full hangup or error conditions.
+func (ev Event) PeerClosedWrite() bool {
+	if ev&EventReadHup == 0 || ev&(EventWriteHup|EventErr) != 0 {
+		return false
+	}
+	// Some backends report EventHup on any end of stream.
+	return ev&EventHup == 0 || hupOnReadEOF
+}
+
 // Строковое представление события
 func (ev Event) String() (str string) {
 	name := func(event Event, name string) {
@@ -111,6 +223,7 @@ func (ev Event) String() (str string) {
 
 	name(EventRead, "EventRead")
 	name(EventWrite, "EventWrite")
+	name(EventPriority, "EventPriority")
 	name(EventOneShot, "EventOneShot")
 	name(EventEdgeTriggered, "EventEdgeTriggered")
 	name(EventReadHup, "EventReadHup")
@@ -119,11 +232,51 @@ func (ev Event) String() (str string) {
 	name(EventErr, "EventErr")
 	name(EventPollerClosed, "EventPollerClosed")
 
+	// Bits which have no names are printed as a number, so they are not
+	// lost.
+	const known = EventRead | EventWrite | EventPriority | EventOneShot | EventEdgeTriggered |
+		EventReadHup | EventWriteHup | EventHup | EventErr | EventPollerClosed
+	if rest := ev &^ known; rest != 0 {
+		if str != "" {
+			str += "|"
+		}
+		str += fmt.Sprintf("%#x", uint16(rest))
+	}
+
 	return
 }
 
-// Poller интерфейс, который описывает базовые методы для всех платформ
-type Poller interface {
+// Behavior describes modifiers of Poller behavior for a descriptor.
+// Unlike Event, it does not describe types of events.
+type Behavior uint16
+
+// Behavior values that could be passed to HandleWithBehavior().
+// They are the same as EventOneShot and EventEdgeTriggered.
+const (
+	BehaviorOneShot       = Behavior(EventOneShot)
+	BehaviorEdgeTriggered = Behavior(EventEdgeTriggered)
+)
+
+// String returns string representation of behavior.
+func (b Behavior) String() (str string) {
+	name := func(behavior Behavior, name string) {
+		if (b & behavior) == 0 {
+			return
+		}
+		if str != "" {
+			str += "|"
+		}
+		str += name
+	}
+
+	name(BehaviorOneShot, "BehaviorOneShot")
+	name(BehaviorEdgeTriggered, "BehaviorEdgeTriggered")
+
+	return
+}
+
+// Starter describes an object which is able to start observing descriptors.
+type Starter interface {
 	// Start добавляет к списку обзервером новый дескриптор и устанавливает функцию
 	//
 	// Помните, что если дескриптор сконфигурирован с режимом OneShot, пулер
@@ -135,11 +288,105 @@ type Poller interface {
 	// Множественные вызовы с одним и тем же дескриптором приведут к непредвиденному поведению.
 	Start(*Desc, CallbackFn) error
 
+	// StartWithOptions is the same as Start() but allows to configure the
+	// registration with given options.
+	// It returns ErrUnsupportedOption if some of the options could not be
+	// honored by the poller.
+	StartWithOptions(*Desc, CallbackFn, ...StartOption) error
+
+	// StartDuplex registers descriptor for both EventRead and EventWrite and
+	// routes events to onRead and onWrite callbacks. Descriptor's event mask
+	// is extended with EventRead|EventWrite, so it is kept by Resume().
+	// There is no separate callback for hangups and errors: they are passed
+	// to both callbacks. See Duplex() for the routing details.
+	StartDuplex(desc *Desc, onRead, onWrite CallbackFn) error
+
+	// StartCtxFn is the same as Start() but passes ctx to each fn call. See
+	// ContextCallback() for details.
+	StartCtxFn(desc *Desc, ctx context.Context, fn func(context.Context, Event)) error
+}
+
+// HandlerStarter describes an object which is able to register descriptors
+// with Handler instead of callback. Poller instances returned by New()
+// implement it. See StartHandler() for pollers which do not.
+type HandlerStarter interface {
+	// StartHandler is the same as Start() but passes events to
+	// h.HandleEvent(). It lets to register a pointer to existing connection
+	// structure instead of allocating a closure for each descriptor.
+	StartHandler(desc *Desc, h Handler) error
+}
+
+// StartHandler starts observing desc with p, passing its events to
+// h.HandleEvent(). It calls p.StartHandler() if p implements HandlerStarter,
+// and p.Start() with h.HandleEvent callback otherwise.
+func StartHandler(p Poller, desc *Desc, h Handler) error {
+	if s, ok := p.(HandlerStarter); ok {
+		return s.StartHandler(desc, h)
+	}
+	return p.Start(desc, h.HandleEvent)
+}
+
+// PausedStarter describes an object which is able to register descriptors
+// without arming them. Poller instances returned by New() implement it. See
+// StartPaused() for pollers which do not.
+type PausedStarter interface {
+	// StartPaused is the same as Start() but does not arm the descriptor.
+	// Registration is made at once, so ErrRegistered and other errors are
+	// returned early, but events are not delivered until Resume() is
+	// called. It is useful to prepare registration of a connection while
+	// application level handshake is not complete yet.
+	// Stop() and Close() work for paused descriptors as for started ones.
+	StartPaused(desc *Desc, cb CallbackFn) error
+}
+
+// StartPaused registers desc in p without arming it. It calls
+// p.StartPaused() if p implements PausedStarter. Otherwise registration is
+// made by p.StartWithOptions(), which is honored by wrappers of pollers
+// returned by New() and fails with ErrUnsupportedOption for others.
+func StartPaused(p Poller, desc *Desc, cb CallbackFn) error {
+	if s, ok := p.(PausedStarter); ok {
+		return s.StartPaused(desc, cb)
+	}
+	return p.StartWithOptions(desc, cb, startPaused)
+}
+
+// LazyStarter describes an object which is able to defer registration of
+// descriptors. Poller instances returned by New() implement it. See
+// StartLazy() for pollers which do not.
+type LazyStarter interface {
+	// StartLazy is the same as Start() but defers the registration until
+	// desc.Arm() is called, so descriptors which turn out to be unused, e.g.
+	// speculative connections of a pool, cost no system calls. Only the
+	// event mask is validated at once; other errors, including ErrClosed
+	// and ErrRegistered, are returned by Arm(). Stop() of descriptor which
+	// is not armed cancels the registration. Close() does not call
+	// callbacks of such descriptors, since the poller does not know them.
+	StartLazy(desc *Desc, cb CallbackFn) error
+}
+
+// StartLazy defers registration of desc in p until desc.Arm() is called. It
+// calls p.StartLazy() if p implements LazyStarter. Otherwise Arm() calls
+// p.Start(), so wrappers of pollers, such as telemetry, see the registration
+// when it is actually made. In that case Stop() cancels the registration
+// which is not armed yet only if it reaches a poller returned by New();
+// see Desc.Pending().
+func StartLazy(p Poller, desc *Desc, cb CallbackFn) error {
+	if s, ok := p.(LazyStarter); ok {
+		return s.StartLazy(desc, cb)
+	}
+	return startLazy(p, desc, cb)
+}
+
+// Stopper describes an object which is able to stop observing descriptors.
+type Stopper interface {
 	// Stop удаляет дескриптор из списка отслеживания
 	//
 	// Помните, что данный вызов не вызывает desc.Close(). Это надо делать руками.
 	Stop(*Desc) error
+}
 
+// Resumer describes an object which is able to resume observing descriptors.
+type Resumer interface {
 	// Resume включает снова дескриптор в список обработки
 	//
 	// Это полезно, когда дескриптор сконфигурирован с EventOneShot.
@@ -150,26 +397,714 @@ type Poller interface {
 	Resume(*Desc) error
 }
 
+// Pauser describes an object which is able to pause delivery of events of
+// started descriptors without stopping them, e.g. to apply backpressure.
+// Poller instances returned by New() implement it.
+type Pauser interface {
+	// Pause stops delivery of EventRead and EventWrite of desc, keeping it
+	// registered. It returns nil if desc is paused already.
+	//
+	// Whether EventHup and EventErr are still delivered depends on the
+	// poller. Epoll and poll(2) pollers deliver them at most once until
+	// Unpause(), since the kernel reports them regardless of requested
+	// events; kqueue and wasi pollers do not deliver them.
+	Pause(*Desc) error
+
+	// Unpause re-arms paused desc with its event mask, so events which
+	// became ready during the pause, e.g. data received by level-triggered
+	// descriptor, are delivered then. It returns nil if desc is not paused.
+	//
+	// Note that Unpause() and Resume() are different: Resume() re-arms
+	// one-shot descriptor after an event and does nothing for paused
+	// descriptor, while Unpause() ends the pause.
+	Unpause(*Desc) error
+}
+
+// Closer describes an object which is able to release poller resources.
+type Closer interface {
+	// Close stops observing of all descriptors and releases underlying
+	// resources. Callbacks of descriptors which are still registered are
+	// called with EventPollerClosed.
+	// Callbacks are called without holding poller locks. Within them, and
+	// after Close() at all, Stop() and Resume() return ErrClosed without
+	// blocking, even for descriptors which are closed already, and so do
+	// Start*() methods for valid descriptors. Thus it is safe to run generic
+	// cleanup code there, including Desc.Close().
+	// Once Close() has returned and callbacks called by the poller at the
+	// moment have finished (see Idler), the poller keeps no references to
+	// callbacks, handlers and descriptors, so they could be collected even
+	// if the poller itself is still reachable.
+	Close() error
+}
+
+// Idler describes an object which is able to wait for callbacks which are in
+// progress.
+type Idler interface {
+	// WaitIdle blocks until all callbacks which are in progress at the moment
+	// return, or ctx is done. In the latter case it returns ctx.Err().
+	// It is useful for graceful shutdown after Close().
+	// Note that it must not be called from callbacks, since it waits for
+	// the calling callback too.
+	WaitIdle(ctx context.Context) error
+}
+
+// Namer describes an object which has a name. Poller instances returned by
+// New() implement it, see Config.Name.
+type Namer interface {
+	Name() string
+}
+
+// StatsProvider describes an object which reports counters of its wait
+// loop work, see Config.CollectStats. Epoll poller returned by New()
+// implements it.
+type StatsProvider interface {
+	Stats() EpollStats
+}
+
+// Terminator describes an object which could close itself, see
+// Config.FatalPolicy. Epoll poller returned by New() implements it.
+type Terminator interface {
+	// Done returns a channel which is closed when the poller is closed by
+	// Close() or by itself, after callbacks are called with
+	// EventPollerClosed.
+	Done() <-chan struct{}
+	// Err returns the error which made the poller close itself. It is nil
+	// if the poller is open or is closed by Close().
+	Err() error
+}
+
+// Poller интерфейс, который описывает базовые методы для всех платформ
+type Poller interface {
+	Starter
+	Stopper
+	Resumer
+}
+
+// FullPoller describes poller with all available methods.
+// Poller instances returned by New() implement it.
+type FullPoller interface {
+	Starter
+	Stopper
+	Resumer
+	Closer
+	Idler
+}
+
+var _ Poller = FullPoller(nil)
+
 // CallbackFn is a function that will be called on kernel i/o event
 // notification.
+// Events of the same descriptor received within single wait iteration are
+// passed in one call, e.g. as EventRead|EventWrite.
 type CallbackFn func(Event)
 
+// Handler is an interface of objects which receive events of descriptors
+// registered by StartHandler(). Events are the same as passed to CallbackFn.
+type Handler interface {
+	HandleEvent(Event)
+}
+
+// Duplex returns callback which routes read events to onRead and write events
+// to onWrite. That is, onRead receives EventRead and EventReadHup, while
+// onWrite receives EventWrite and EventWriteHup. EventHup, EventErr and
+// EventPollerClosed are passed to both callbacks, since they concern both
+// directions.
+// Any of the callbacks could be nil.
+func Duplex(onRead, onWrite CallbackFn) CallbackFn {
+	const (
+		both  = EventHup | EventErr | EventPollerClosed
+		read  = EventRead | EventReadHup | both
+		write = EventWrite | EventWriteHup | both
+	)
+	return func(event Event) {
+		if ev := event & read; ev != 0 && onRead != nil {
+			onRead(ev)
+		}
+		if ev := event & write; ev != 0 && onWrite != nil {
+			onWrite(ev)
+		}
+	}
+}
+
+// ContextCallback returns callback which passes ctx to fn with each event.
+// Context usually carries request-scoped values such as trace span, and its
+// deadline and cancellation. It is passed as is, so if ctx is cancelled by the
+// time event is received, fn gets cancelled context and could skip the work
+// by checking ctx.Err(). Note that cancellation does not stop the descriptor.
+// Nil ctx is replaced by context.Background().
+func ContextCallback(ctx context.Context, fn func(context.Context, Event)) CallbackFn {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return func(event Event) {
+		fn(ctx, event)
+	}
+}
+
+// StartOption configures registration made by StartWithOptions().
+type StartOption func(*startOptions)
+
+type startOptions struct {
+	onError    func(error)
+	autoResume bool
+	exclusive  bool
+	closeOnHup io.Closer
+	paused     bool
+	lowat      int
+	spurious   bool
+}
+
+// startPaused is an option used by StartPaused() implementations and the
+// package level StartPaused().
+func startPaused(o *startOptions) {
+	o.paused = true
+}
+
+// WithOnError returns an option which makes poller to call fn with errors
+// which are discovered asynchronously about the registration, such as failure
+// of automatic resume.
+// fn is never called while poller locks are held.
+// Without this option errors are passed to Config.OnWaitError or written to
+// Config.ErrorLog.
+func WithOnError(fn func(error)) StartOption {
+	return func(o *startOptions) {
+		o.onError = fn
+	}
+}
+
+// WithAutoResume returns an option which makes poller to resume descriptor
+// configured with EventOneShot right after callback returns. Thus there is no
+// need to call Resume() manually.
+func WithAutoResume() StartOption {
+	return func(o *startOptions) {
+		o.autoResume = true
+	}
+}
+
+// WithExclusive returns an option which sets exclusive wakeup mode for the
+// descriptor. That is, when the same file is registered in multiple poller
+// instances, only one of them is woken up on event. It is useful to avoid
+// thundering herd when listener is observed by many pollers.
+//
+// It is supported only by epoll on Linux 4.5+ and could not be combined with
+// EventOneShot. Exclusive registrations could not be resumed and do not
+// receive EventReadHup.
+func WithExclusive() StartOption {
+	return func(o *startOptions) {
+		o.exclusive = true
+	}
+}
+
+// WithLowWatermark returns an option which makes poller to report
+// EventRead only when at least n bytes are available for reading. It lets
+// to skip wakeups for partially received protocol frames. Values less than
+// 2 have no effect.
+//
+// It is supported by kqueue with NOTE_LOWAT and by epoll for tcp sockets
+// with SO_RCVLOWAT socket option. Note that the socket option is shared
+// with the source connection and is kept after Stop(). Other pollers and
+// descriptors return ErrUnsupportedOption.
+func WithLowWatermark(n int) StartOption {
+	return func(o *startOptions) {
+		o.lowat = n
+	}
+}
+
+// WithSpuriousFilter returns an option which makes poller to skip callback
+// calls for EventRead when no bytes are available for reading. Edge-triggered
+// registrations occasionally are woken up without new data, e.g. after
+// Resume(), and the callback then pays for a read which returns EAGAIN.
+// Events with hangup or error bits are never skipped.
+//
+// It is implemented by epoll with SIOCINQ (FIONREAD) check of the descriptor
+// before the callback is called; skipped events are counted in
+// EpollStats.Suppressed. Other pollers accept the option but do not need it:
+// kqueue reports EventRead only with data or EOF, and poll is
+// level-triggered.
+func WithSpuriousFilter() StartOption {
+	return func(o *startOptions) {
+		o.spurious = true
+	}
+}
+
+// CloseOnHup returns an option which makes poller to stop the descriptor
+// and close c when EventHup, EventReadHup or EventErr is received. It is done
+// right after callback returns, so the callback still could inspect the
+// connection or log the event.
+// Descriptor is always stopped before c is closed, and c is closed exactly
+// once even if hangup events race with each other. After that the
+// registration is never resumed, even with WithAutoResume().
+// Usually c is the connection itself or its Desc.
+func CloseOnHup(c io.Closer) StartOption {
+	return func(o *startOptions) {
+		o.closeOnHup = c
+	}
+}
+
+// errorHandler delivers asynchronous registration errors to the global hooks
+// when there is no OnError callback for the registration.
+type errorHandler struct {
+	onError func(error)
+	log     Logger
+	name    string
+}
+
+func (h errorHandler) handle(op string, fd int, err error) {
+	if h.onError != nil {
+		h.onError(&PollerError{Poller: h.name, Op: op, FD: fd, Err: err})
+		return
+	}
+	logRecord(h.log, LogRecord{
+		Level:   LevelError,
+		Message: "registration error",
+		Poller:  h.name,
+		Op:      op,
+		FD:      fd,
+		Err:     err,
+	})
+}
+
+// withOptions wraps cb to implement behavior described by opts.
+func withOptions(p Poller, desc *Desc, cb CallbackFn, opts *startOptions, h errorHandler) CallbackFn {
+	var (
+		resume = opts.autoResume && desc.event&EventOneShot != 0
+		closer = opts.closeOnHup
+	)
+	if !resume && closer == nil {
+		return cb
+	}
+	onError := func(op string, err error) {
+		h.handle(op, desc.fd(), err)
+	}
+	if fn := opts.onError; fn != nil {
+		onError = func(_ string, err error) {
+			fn(err)
+		}
+	}
+	var hup int32
+	return func(event Event) {
+		cb(event)
+		if event&EventPollerClosed != 0 {
+			return
+		}
+		if closer != nil && event&(EventHup|EventReadHup|EventErr) != 0 {
+			if !atomic.CompareAndSwapInt32(&hup, 0, 1) {
+				return
+			}
+			err := p.Stop(desc)
+			if err != nil && err != ErrClosed && !errors.Is(err, ErrNotRegistered) {
+				onError("stop", err)
+			}
+			if err = closer.Close(); err != nil {
+				onError("close", err)
+			}
+			return
+		}
+		if !resume || atomic.LoadInt32(&hup) != 0 {
+			return
+		}
+		if err := p.Resume(desc); err != nil && err != ErrClosed {
+			desc.setLastError(err)
+			onError("resume", err)
+		}
+	}
+}
+
 // Config contains options for Poller configuration.
 type Config struct {
 	// OnWaitError will be called from goroutine, waiting for events.
+	// It also receives asynchronous errors of registrations which have no
+	// WithOnError() option.
+	// If OnWaitError is nil, errors are written to ErrorLog.
 	OnWaitError func(error)
+
+	// ErrorLog is used to log internally generated messages, including wait
+	// loop errors when OnWaitError is nil.
+	// If ErrorLog is nil, messages are written by the standard log package.
+	ErrorLog Logger
+
+	// Backend selects the poller implementation. BackendAuto picks the best
+	// one for current operating system. It also could be a name passed to
+	// RegisterBackend(). If requested backend is not available, New()
+	// returns ErrBackendUnavailable.
+	Backend Backend
+
+	// OnIdle is called from goroutine, waiting for events, when no events
+	// have been delivered to callbacks for IdleThreshold. It is called once
+	// per quiet period: next call is possible only after some event is
+	// delivered. Its argument is the actual duration of the period so far.
+	// Like callbacks, OnIdle blocks the wait loop while it is running.
+	// OnIdle is not called if IdleThreshold is not positive.
+	OnIdle func(idleFor time.Duration)
+
+	// IdleThreshold is the duration of quiet period after which OnIdle is
+	// called.
+	IdleThreshold time.Duration
+	// ReverseCloseOrder makes Close() to call callbacks of descriptors
+	// which are still registered with EventPollerClosed in reverse order of
+	// registration, which is useful for LIFO teardown. By default they are
+	// called in order of registration. Note that epoll poller with 65536
+	// or more registrations calls them concurrently in batches, see
+	// EpollConfig.CloseWorkers; then only the order of batches is defined.
+	// Kqueue poller does not call them on Close() for now.
+	ReverseCloseOrder bool
+
+	// CollectStats enables measuring of the wait loop work. For now it is
+	// supported by epoll poller only, which reports counters by its Stats()
+	// method, see StatsProvider. TelemetryPoller of telemetry package
+	// includes them in its snapshots.
+	CollectStats bool
+
+	// StaleCheckInterval enables periodic detection of descriptors which
+	// are closed without Stop(). Their registrations are kept by the poller
+	// forever, so Start() of a descriptor reusing the number fails. Each
+	// check validates next StaleCheckBatch registrations, so work per check
+	// is bounded regardless of their total number. For now the checks are
+	// supported by epoll poller only; see EpollConfig.StaleCheckInterval for
+	// details.
+	StaleCheckInterval time.Duration
+	StaleCheckBatch    int
+
+	// OnStaleRegistration is called from goroutine, waiting for events, with
+	// each descriptor found closed by the checks.
+	OnStaleRegistration func(desc *Desc)
+
+	// RemoveStale makes the checks to remove found registrations, as Stop()
+	// does, before OnStaleRegistration is called.
+	RemoveStale bool
+
+	// MaxDescriptors limits the number of registered descriptors. When it
+	// is reached, Start() returns ErrTooManyDescriptors without a system
+	// call, until some descriptor is stopped. It guards the process from
+	// running out of open files limit because of a runaway accept loop.
+	// Zero means no limit.
+	MaxDescriptors int
+
+	// SoftLimit is a fraction of MaxDescriptors, e.g. 0.8, at which
+	// OnSoftLimit is called to warn that the limit is close. OnSoftLimit
+	// is called by Start() which makes occupancy reach the threshold, after
+	// the descriptor is registered. Next call is possible only after
+	// occupancy drops below the threshold by 5% of MaxDescriptors, but at
+	// least by one descriptor, so registrations around the threshold do
+	// not repeat the warning. Its arguments are the number of registered
+	// descriptors and MaxDescriptors. No warnings are made if SoftLimit or
+	// MaxDescriptors is not positive.
+	SoftLimit   float64
+	OnSoftLimit func(current, max int)
+
+	// Name identifies the poller when there are several of them in the
+	// process. It is returned by Name() method of the poller and is
+	// included in wrapped errors, e.g. "netpoll[ingress-0]: start fd=7: ...",
+	// in LogRecord.Poller and in EpollStats.Poller. If Name is empty, unique
+	// name such as "poller-1" is generated.
+	Name string
+
+	// FatalPolicy defines what happens after the wait loop has stopped
+	// because of a fatal error, such as non-temporary epoll_wait() error.
+	// The error is passed to OnWaitError or logged in any case. By default
+	// the poller stays open without the loop, until Close() is called. For
+	// now other policies are supported by epoll poller only.
+	FatalPolicy FatalPolicy
+}
+
+// FatalPolicy is a reaction of the poller on fatal error of its wait loop.
+type FatalPolicy int
+
+// FatalPolicy values that could be set by Config.FatalPolicy.
+const (
+	// FatalContinue leaves the poller open, while its callbacks are not
+	// called anymore.
+	FatalContinue FatalPolicy = iota
+	// FatalCloseSelf makes the wait loop to close the poller as Close()
+	// does, including calls of callbacks with EventPollerClosed. The error
+	// is returned by Err() then, see Terminator.
+	FatalCloseSelf
+	// FatalPanic makes the wait loop to panic with *PollerError, which
+	// crashes the process, so it could be restarted by the supervisor.
+	FatalPanic
+)
+
+// String returns string representation of the policy.
+func (f FatalPolicy) String() string {
+	switch f {
+	case FatalContinue:
+		return "continue"
+	case FatalCloseSelf:
+		return "close"
+	case FatalPanic:
+		return "panic"
+	default:
+		return fmt.Sprintf("FatalPolicy(%d)", int(f))
+	}
+}
+
+// Backend is a name of poller implementation. Besides the built-in ones,
+// backends could be added by RegisterBackend().
+type Backend string
+
+// Built-in Backend values that could be requested by Config.Backend.
+const (
+	// BackendAuto selects epoll on linux, kqueue on bsd and poll_oneoff on
+	// wasip1.
+	BackendAuto Backend = ""
+	// BackendEpoll is the epoll(7) based poller, available on linux.
+	BackendEpoll Backend = "epoll"
+	// BackendKqueue is the kqueue(2) based poller, available on bsd.
+	BackendKqueue Backend = "kqueue"
+	// BackendPoll is the portable poll(2) based poller. It is intended for
+	// debugging mostly, as each wait costs O(n) of registered descriptors.
+	// It does not support EventEdgeTriggered descriptors.
+	BackendPoll Backend = "poll"
+	// BackendURing is reserved for io_uring based poller, which is not
+	// implemented yet.
+	BackendURing Backend = "io_uring"
+	// BackendPollOneoff is the poll_oneoff based poller, available on wasip1.
+	// It does not support EventEdgeTriggered descriptors.
+	BackendPollOneoff Backend = "poll_oneoff"
+)
+
+// String returns a string representation of Backend.
+func (b Backend) String() string {
+	if b == BackendAuto {
+		return "auto"
+	}
+	return string(b)
+}
+
+// ErrBackendUnavailable is returned by New() when requested backend is not
+// available on current operating system.
+type ErrBackendUnavailable struct {
+	Backend Backend
+}
+
+func (e ErrBackendUnavailable) Error() string {
+	return "netpoll: " + e.Backend.String() + " backend is not available"
+}
+
+// ErrUnsupportedPlatform is returned by New(), Handle*() and NewDesc() on
+// operating systems where netpoll is not implemented. Types and constants of
+// the package are still available there, so dependent packages could be
+// built.
+type ErrUnsupportedPlatform struct {
+	GOOS string
+}
+
+func (e ErrUnsupportedPlatform) Error() string {
+	return "netpoll: " + e.GOOS + " platform is not supported"
+}
+
+// PollerError describes failed operation of the poller with given name.
+// Pollers returned by New() wrap into it errors of system calls made by
+// Start*(), Stop(), Resume(), Pause() and Unpause(), and errors passed to
+// Config.OnWaitError on behalf of registrations. Package errors such as
+// ErrRegistered are returned as is, so they could be compared with ==.
+type PollerError struct {
+	// Poller is the name of the poller, see Config.Name.
+	Poller string
+	// Op is the failed operation, such as "start" or "resume".
+	Op string
+	// FD is the descriptor the operation was made for.
+	FD  int
+	Err error
+}
+
+func (e *PollerError) Error() string {
+	return fmt.Sprintf("netpoll[%s]: %s fd=%d: %s", e.Poller, e.Op, e.FD, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *PollerError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns err wrapped into PollerError if it is caused by a system
+// call. Other errors are returned as is.
+func wrapError(name, op string, fd int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	return &PollerError{Poller: name, Op: op, FD: fd, Err: err}
+}
+
+// IsTemporaryError reports whether err is a system call error after which
+// the call could be retried, such as EINTR or EAGAIN. ECONNRESET and
+// ECONNABORTED are also temporary, since accept(2) returns them for
+// connections which are dropped before they are accepted. Wrapped errors,
+// e.g. *os.SyscallError, are unwrapped.
+func IsTemporaryError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno.Temporary() || connAborted(errno)
 }
 
 func (c *Config) withDefaults() (config Config) {
 	if c != nil {
 		config = *c
 	}
-	if config.OnWaitError == nil {
-		config.OnWaitError = defaultOnWaitError
+	if config.ErrorLog == nil {
+		config.ErrorLog = defaultLogger
+	}
+	if config.Backend == "auto" {
+		config.Backend = BackendAuto
+	}
+	if config.Name == "" {
+		config.Name = autoName("poller")
 	}
 	return config
 }
 
-func defaultOnWaitError(err error) {
-	log.Printf("netpoll: wait loop error: %s", err)
+// pollerSeq numbers pollers with generated names.
+var pollerSeq uint64
+
+// autoName returns unique name with given prefix for poller without a name.
+func autoName(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, atomic.AddUint64(&pollerSeq, 1))
+}
+
+// Logger describes an object which is used by the package to log internally
+// generated messages. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// LoggerFunc is an adapter to allow the use of ordinary functions like
+// log.Printf as Logger.
+type LoggerFunc func(format string, args ...interface{})
+
+// Printf implements Logger.
+func (f LoggerFunc) Printf(format string, args ...interface{}) {
+	f(format, args...)
+}
+
+// StdLogger returns Logger which writes messages to l.
+// If l is nil, the standard logger of the log package is used.
+func StdLogger(l *log.Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+var defaultLogger Logger = LoggerFunc(log.Printf)
+
+// LogLevel represents importance of LogRecord.
+type LogLevel int
+
+// LogLevel values in order of increasing importance.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns string representation of the level.
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+}
+
+// LogRecord represents internally generated message in structured form.
+type LogRecord struct {
+	Level   LogLevel
+	Message string
+
+	// Poller is the name of the poller which produced the record, see
+	// Config.Name.
+	Poller string
+
+	// Op is a name of operation which produced the record, such as "add",
+	// "mod", "del", "wait" or "close".
+	Op string
+
+	// FD is a file descriptor the record relates to or -1.
+	FD int
+
+	// Events is a string representation of event mask, if any.
+	Events string
+
+	// Err is an error the record relates to, if any.
+	Err error
+
+	// Iteration is a number of wait loop iteration, if applicable.
+	Iteration uint64
+
+	// Count is a number of descriptors the record relates to, if applicable.
+	Count int
+
+	// Duration is a measured duration of the operation, such as callback
+	// execution time, if applicable.
+	Duration time.Duration
+}
+
+// String returns the record in the form used for plain Logger.
+func (r LogRecord) String() string {
+	str := r.Message
+	if r.FD >= 0 {
+		str += fmt.Sprintf(" fd=%d", r.FD)
+	}
+	if r.Events != "" {
+		str += " events=" + r.Events
+	}
+	if r.Count > 0 {
+		str += fmt.Sprintf(" count=%d", r.Count)
+	}
+	if r.Duration > 0 {
+		str += fmt.Sprintf(" duration=%s", r.Duration)
+	}
+	if r.Err != nil {
+		str += fmt.Sprintf(": %s", r.Err)
+	}
+	return str
+}
+
+// StructuredLogger is a Logger which is able to receive messages in
+// structured form. If Logger passed to the package implements it, then all
+// records are passed to Log() method instead of Printf().
+//
+// Note that some records, such as registration lifecycle at LevelDebug or
+// descriptors left registered at Close() at LevelWarn, are generated only
+// for StructuredLogger.
+type StructuredLogger interface {
+	Logger
+	Log(LogRecord)
+}
+
+// logRecord writes rec to l. Plain Logger receives only records with
+// LevelWarn and above.
+func logRecord(l Logger, rec LogRecord) {
+	if sl, ok := l.(StructuredLogger); ok {
+		sl.Log(rec)
+		return
+	}
+	if rec.Level < LevelWarn {
+		return
+	}
+	if rec.Poller != "" {
+		l.Printf("netpoll[%s]: %s", rec.Poller, rec)
+		return
+	}
+	l.Printf("netpoll: %s", rec)
+}
+
+// structuredLogger returns l as StructuredLogger or nil.
+func structuredLogger(l Logger) StructuredLogger {
+	sl, _ := l.(StructuredLogger)
+	return sl
 }
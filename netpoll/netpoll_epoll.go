@@ -2,72 +2,440 @@
 
 package netpoll
 
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
 // New creates new epoll-based Poller instance with given config.
+// Poll-based instance is created if config requests BackendPoll, and backends
+// added by RegisterBackend() are created by their factories.
+// Returned Poller implements FullPoller.
 func New(c *Config) (Poller, error) {
 	cfg := c.withDefaults()
+	if p, ok, err := registered(cfg); ok {
+		return p, err
+	}
+
+	switch cfg.Backend {
+	case BackendAuto, BackendEpoll:
+	case BackendPoll:
+		p, err := newPollPoller(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, ErrBackendUnavailable{cfg.Backend}
+	}
 
 	epoll, err := EpollCreate(&EpollConfig{
-		OnWaitError: cfg.OnWaitError,
+		OnWaitError:   cfg.OnWaitError,
+		ErrorLog:      cfg.ErrorLog,
+		OnIdle:        cfg.OnIdle,
+		IdleThreshold: cfg.IdleThreshold,
+
+		ReverseCloseOrder: cfg.ReverseCloseOrder,
+		CollectStats:      cfg.CollectStats,
+		MaxDescriptors:    cfg.MaxDescriptors,
+		SoftLimit:         cfg.SoftLimit,
+		OnSoftLimit:       cfg.OnSoftLimit,
+		Name:              cfg.Name,
+		FatalPolicy:       cfg.FatalPolicy,
+
+		StaleCheckInterval: cfg.StaleCheckInterval,
+		StaleCheckBatch:    cfg.StaleCheckBatch,
+		RemoveStale:        cfg.RemoveStale,
+		onStale:            staleHandler(cfg.OnStaleRegistration, cfg.RemoveStale),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return poller{epoll}, nil
+	return poller{epoll, errorHandler{cfg.OnWaitError, cfg.ErrorLog, cfg.Name}}, nil
 }
 
+var (
+	_ FullPoller     = poller{}
+	_ Pauser         = poller{}
+	_ HandlerStarter = poller{}
+	_ PausedStarter  = poller{}
+	_ LazyStarter    = poller{}
+	_ Namer          = poller{}
+	_ StatsProvider  = poller{}
+	_ Terminator     = poller{}
+)
+
+// builtinBackends are names of built-in backends available on current
+// operating system.
+var builtinBackends = []Backend{BackendEpoll, BackendPoll}
+
 // poller implements Poller interface.
 type poller struct {
 	*Epoll
+	errors errorHandler
+}
+
+// String returns name of the backend.
+func (ep poller) String() string {
+	return BackendEpoll.String()
 }
 
 // Start implements Poller.Start() method.
 func (ep poller) Start(desc *Desc, cb CallbackFn) error {
-	return ep.Add(desc.fd(), toEpollEvent(desc.event),
-		func(ep EpollEvent) {
-			var event Event
-
-			if ep&EPOLLHUP != 0 {
-				event |= EventHup
-			}
-			if ep&EPOLLRDHUP != 0 {
-				event |= EventReadHup
-			}
-			if ep&EPOLLIN != 0 {
-				event |= EventRead
-			}
-			if ep&EPOLLOUT != 0 {
-				event |= EventWrite
-			}
-			if ep&EPOLLERR != 0 {
-				event |= EventErr
-			}
-			if ep&_EPOLLCLOSED != 0 {
-				event |= EventPollerClosed
-			}
-
-			cb(event)
-		},
-	)
+	return ep.StartWithOptions(desc, cb)
+}
+
+// StartWithOptions implements Poller.StartWithOptions() method.
+// Without options descriptor itself is stored as epoll handler, as
+// StartHandler() does, so registration does not allocate. Descriptor
+// started in other poller gets its own handler.
+func (ep poller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	if len(opts) == 0 && !desc.registered() {
+		return ep.startDesc(desc, cb, nil)
+	}
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	events := toEpollEvent(desc.event)
+	if o.exclusive {
+		if desc.event&EventOneShot != 0 || o.paused {
+			return ErrUnsupportedOption
+		}
+		// EPOLLRDHUP is not allowed with EPOLLEXCLUSIVE.
+		events = events&^EPOLLRDHUP | EPOLLEXCLUSIVE
+	}
+	if o.lowat > 1 && desc.event&EventRead != 0 {
+		if err := setLowWatermark(desc.fd(), o.lowat); err != nil {
+			return wrapError(ep.name, "start", desc.fd(), err)
+		}
+	}
+
+	user := cb
+	cb = withOptions(ep, desc, func(event Event) {
+		user(event)
+		desc.notify(event)
+	}, &o, ep.errors)
+	fd := desc.fd()
+	h := &descCallback{
+		desc: desc,
+		fd:   fd,
+		cb:   cb,
+	}
+	// Без EPOLLRDHUP конец потока сокета приходит как EPOLLIN без данных,
+	// поэтому фильтр для таких регистраций не включается
+	if o.spurious && events&EPOLLRDHUP != 0 {
+		h.filter = true
+		h.stats = ep.stats
+	}
+	if o.paused {
+		events = 0
+	}
+	// Наблюдатели должны получить и событие, пришедшее сразу после add().
+	desc.register()
+	if _, err := ep.add(fd, events, h, o.paused); err != nil {
+		desc.unregister()
+		return wrapError(ep.name, "start", fd, err)
+	}
+	return nil
+}
+
+// descCallback is epoll handler of descriptors registered by
+// StartWithOptions().
+type descCallback struct {
+	desc *Desc
+	fd   int
+	sock sockState
+	cb   CallbackFn
+
+	// filter is set by WithSpuriousFilter() option. stats is nil unless
+	// EpollConfig.CollectStats is set.
+	filter bool
+	stats  *epollStats
+}
+
+func (h *descCallback) handleEpoll(ev EpollEvent) {
+	if h.filter && spurious(h.fd, ev) {
+		if h.stats != nil {
+			atomic.AddUint64(&h.stats.suppressed, 1)
+		}
+		return
+	}
+	if ev&EPOLLERR != 0 && h.sock.is(h.fd) {
+		if err := socketError(h.fd); err != nil {
+			h.desc.setLastError(err)
+		}
+	}
+	event := fromEpollEvent(ev)
+	h.desc.setLastEvent(event)
+	h.cb(event)
+}
+
+// spurious reports whether ev is a bare EPOLLIN while no bytes are available
+// for reading from fd. Events with any other bit set, including hangup and
+// error ones, are never spurious. So are descriptors which do not support
+// SIOCINQ, such as listening sockets.
+func spurious(fd int, ev EpollEvent) bool {
+	if ev != EPOLLIN {
+		return false
+	}
+	n, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+	return err == nil && n == 0
+}
+
+// staleHandler returns EpollConfig.onStale function, which finds descriptor
+// of the stale registration and passes it to fn. Descriptor of removed
+// registration is marked as stopped.
+func staleHandler(fn func(*Desc), remove bool) func(int, epollHandler) {
+	if fn == nil && !remove {
+		return nil
+	}
+	return func(fd int, h epollHandler) {
+		var desc *Desc
+		switch h := h.(type) {
+		case *Desc:
+			desc = h
+		case *descCallback:
+			desc = h.desc
+		default:
+			return
+		}
+		if remove {
+			desc.unregister()
+		}
+		if fn != nil {
+			fn(desc)
+		}
+	}
+}
+
+// is reports whether fd refers to a socket, checking it on the first call.
+func (s *sockState) is(fd int) bool {
+	switch sockState(atomic.LoadInt32((*int32)(s))) {
+	case sockYes:
+		return true
+	case sockNo:
+		return false
+	}
+	v := sockNo
+	if isSocket(fd) {
+		v = sockYes
+	}
+	atomic.StoreInt32((*int32)(s), int32(v))
+	return v == sockYes
+}
+
+// isSocket reports whether fd refers to a socket.
+func isSocket(fd int) bool {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return false
+	}
+	return st.Mode&unix.S_IFMT == unix.S_IFSOCK
+}
+
+// setLowWatermark emulates kqueue's NOTE_LOWAT with SO_RCVLOWAT option of
+// the tcp socket fd. Linux takes it into account when reporting EPOLLIN only
+// for tcp, while other sockets accept the option but ignore it.
+func setLowWatermark(fd, n int) error {
+	if !isSocket(fd) {
+		return ErrUnsupportedOption
+	}
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+	typ, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+	if domain != unix.AF_INET && domain != unix.AF_INET6 || typ != unix.SOCK_STREAM {
+		return ErrUnsupportedOption
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVLOWAT, n); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// socketError fetches and clears pending error of the socket fd.
+func socketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+	if errno == 0 {
+		return nil
+	}
+	return syscall.Errno(errno)
+}
+
+// StartHandler implements HandlerStarter.StartHandler() method.
+// Descriptor itself is stored as epoll handler, so registration does not
+// allocate. Thus it returns ErrRegistered if desc is started in any poller.
+func (ep poller) StartHandler(desc *Desc, h Handler) error {
+	if desc.registered() {
+		if ep.isClosed() {
+			// Registration is being released by Close().
+			return ErrClosed
+		}
+		// Handler of the working registration must not be replaced.
+		return ErrRegistered
+	}
+	return ep.startDesc(desc, nil, h)
+}
+
+// startDesc registers desc as epoll handler, which calls either cb or h.
+func (ep poller) startDesc(desc *Desc, cb CallbackFn, h Handler) error {
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	fd := desc.fd()
+	desc.cb = cb
+	desc.handler = h
+	desc.sock = sockUnknown
+	desc.register()
+	if _, err := ep.add(fd, toEpollEvent(desc.event), desc, false); err != nil {
+		desc.unregister()
+		desc.cb = nil
+		desc.handler = nil
+		return wrapError(ep.name, "start", fd, err)
+	}
+	return nil
+}
+
+// handleEpoll implements epollHandler for descriptors registered by
+// Start() and StartHandler().
+func (h *Desc) handleEpoll(ev EpollEvent) {
+	if ev&EPOLLERR != 0 && h.sock.is(h.fd()) {
+		if err := socketError(h.fd()); err != nil {
+			h.setLastError(err)
+		}
+	}
+	event := fromEpollEvent(ev)
+	h.setLastEvent(event)
+	if h.handler != nil {
+		h.handler.HandleEvent(event)
+	} else {
+		h.cb(event)
+	}
+	h.notify(event)
+}
+
+// StartDuplex implements Poller.StartDuplex() method.
+func (ep poller) StartDuplex(desc *Desc, onRead, onWrite CallbackFn) error {
+	event := desc.event
+	desc.event |= EventRead | EventWrite
+	if err := ep.Start(desc, Duplex(onRead, onWrite)); err != nil {
+		desc.event = event
+		return err
+	}
+	return nil
+}
+
+// StartPaused implements PausedStarter.StartPaused() method.
+// Paused descriptor is not added to the epoll interest list until Resume().
+func (ep poller) StartPaused(desc *Desc, cb CallbackFn) error {
+	return ep.StartWithOptions(desc, cb, startPaused)
+}
+
+// StartLazy implements LazyStarter.StartLazy() method.
+func (ep poller) StartLazy(desc *Desc, cb CallbackFn) error {
+	return startLazy(ep, desc, cb)
+}
+
+// StartCtxFn implements Poller.StartCtxFn() method.
+func (ep poller) StartCtxFn(desc *Desc, ctx context.Context, fn func(context.Context, Event)) error {
+	return ep.Start(desc, ContextCallback(ctx, fn))
 }
 
 // Stop implements Poller.Stop() method.
 func (ep poller) Stop(desc *Desc) error {
-	return ep.Del(desc.fd())
+	if stopLazy(desc) {
+		return nil
+	}
+	err := ep.Del(desc.fd())
+	if err == nil || isCtlError(err) {
+		// Registration is removed even if kernel reported an error.
+		desc.unregister()
+	}
+	return wrapError(ep.name, "stop", desc.fd(), err)
+}
+
+// isCtlError reports whether err is returned by the kernel, so the
+// registration is removed anyway.
+func isCtlError(err error) bool {
+	var ce *CtlError
+	return errors.As(err, &ce)
 }
 
-// Resume implements Poller.Resume() method.
+// Resume implements Poller.Resume() method. It does nothing for paused
+// descriptor.
 func (ep poller) Resume(desc *Desc) error {
-	return ep.Mod(desc.fd(), toEpollEvent(desc.event))
+	return wrapError(ep.name, "resume", desc.fd(), ep.Mod(desc.fd(), toEpollEvent(desc.event)))
+}
+
+// Pause implements Pauser.Pause() method.
+// Descriptor is modified with empty event set, which still receives EPOLLHUP
+// and EPOLLERR; EPOLLONESHOT makes them to be delivered once.
+// The paused state is kept by Epoll under its lock, so Resume() made
+// concurrently, e.g. by WithAutoResume(), does not re-arm the descriptor.
+func (ep poller) Pause(desc *Desc) error {
+	return wrapError(ep.name, "pause", desc.fd(), ep.pause(desc.fd()))
+}
+
+// Unpause implements Pauser.Unpause() method.
+func (ep poller) Unpause(desc *Desc) error {
+	return wrapError(ep.name, "unpause", desc.fd(), ep.unpause(desc.fd(), toEpollEvent(desc.event)))
+}
+
+func fromEpollEvent(ep EpollEvent) (event Event) {
+	if ep&EPOLLHUP != 0 {
+		event |= EventHup
+	}
+	if ep&EPOLLRDHUP != 0 {
+		event |= EventReadHup
+	}
+	if ep&EPOLLIN != 0 {
+		event |= EventRead
+	}
+	if ep&EPOLLPRI != 0 {
+		event |= EventPriority
+	}
+	if ep&EPOLLOUT != 0 {
+		event |= EventWrite
+	}
+	if ep&EPOLLERR != 0 {
+		event |= EventErr
+	}
+	if ep&_EPOLLCLOSED != 0 {
+		event |= EventPollerClosed
+	}
+	return event
 }
 
 func toEpollEvent(event Event) (ep EpollEvent) {
 	if event&EventRead != 0 {
-		ep |= EPOLLIN | EPOLLRDHUP
+		ep |= EPOLLIN
+		if epollRDHupAvailable {
+			ep |= EPOLLRDHUP
+		}
 	}
 	if event&EventWrite != 0 {
 		ep |= EPOLLOUT
 	}
+	if event&EventPriority != 0 {
+		ep |= EPOLLPRI
+	}
 	if event&EventOneShot != 0 {
 		ep |= EPOLLONESHOT
 	}
@@ -76,3 +444,7 @@ func toEpollEvent(event Event) (ep EpollEvent) {
 	}
 	return ep
 }
+
+// hupOnReadEOF is false, because epoll reports EPOLLHUP only when both
+// directions are shut down.
+const hupOnReadEOF = false
@@ -2,78 +2,269 @@
 
 package netpoll
 
-// New создает новый пулер для OSX c конфигом
+import (
+	"context"
+	"syscall"
+)
+
+// New создает новый пулер для OSX c конфигом.
+// Возвращаемый Poller реализует FullPoller.
+// Если в конфиге запрошен BackendPoll, создается пулер на основе poll(2), а
+// бэкенды, добавленные через RegisterBackend(), создаются их фабриками.
 func New(c *Config) (Poller, error) {
 	cfg := c.withDefaults()
+	if p, ok, err := registered(cfg); ok {
+		return p, err
+	}
+
+	switch cfg.Backend {
+	case BackendAuto, BackendKqueue:
+	case BackendPoll:
+		p, err := newPollPoller(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, ErrBackendUnavailable{cfg.Backend}
+	}
 
 	// Создаем Kqueue обработчик
 	kq, err := KqueueCreate(&KqueueConfig{
-		OnWaitError: cfg.OnWaitError,
+		OnWaitError:   cfg.OnWaitError,
+		ErrorLog:      cfg.ErrorLog,
+		OnIdle:        cfg.OnIdle,
+		IdleThreshold: cfg.IdleThreshold,
+
+		MaxDescriptors: cfg.MaxDescriptors,
+		SoftLimit:      cfg.SoftLimit,
+		OnSoftLimit:    cfg.OnSoftLimit,
+		Name:           cfg.Name,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return poller{kq}, nil
+	return poller{kq, errorHandler{cfg.OnWaitError, cfg.ErrorLog, cfg.Name}}, nil
 }
 
+var (
+	_ FullPoller     = poller{}
+	_ Pauser         = poller{}
+	_ HandlerStarter = poller{}
+	_ PausedStarter  = poller{}
+	_ LazyStarter    = poller{}
+	_ Namer          = poller{}
+)
+
+// builtinBackends are names of built-in backends available on current
+// operating system.
+var builtinBackends = []Backend{BackendKqueue, BackendPoll}
+
 type poller struct {
 	*Kqueue
+	errors errorHandler
 }
 
-func (p poller) Start(desc *Desc, cb CallbackFn) error {
-	n, events := toKevents(desc.event, true)
-	return p.Add(desc.fd(), events, n, func(kev Kevent) {
-		var (
-			event Event
+// String returns name of the backend.
+func (p poller) String() string {
+	return BackendKqueue.String()
+}
 
-			flags  = kev.Flags
-			filter = kev.Filter
-		)
+func (p poller) Start(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
 
-		// Set EventHup for any EOF flag. Below will be more precise detection
-		// of what exatcly HUP occured.
-		if flags&EV_EOF != 0 {
-			event |= EventHup
-		}
+func (p poller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	if desc.proc != nil {
+		return p.startProcess(desc, cb, &o)
+	}
+	if o.exclusive || desc.event&EventPriority != 0 {
+		// В kqueue нет аналога EPOLLEXCLUSIVE, а срочные данные требуют
+		// EVFILT_EXCEPT, который есть не во всех системах.
+		return ErrUnsupportedOption
+	}
 
-		if filter == EVFILT_READ {
-			event |= EventRead
-			if flags&EV_EOF != 0 {
-				event |= EventReadHup
-			}
-		}
-		if filter == EVFILT_WRITE {
-			event |= EventWrite
-			if flags&EV_EOF != 0 {
-				event |= EventWriteHup
+	user := cb
+	cb = withOptions(p, desc, func(event Event) {
+		user(event)
+		desc.notify(event)
+	}, &o, p.errors)
+	desc.lowat = o.lowat
+	n, events := toKevents(desc.event, true)
+	lowWatermark(&events, n, desc.lowat)
+	if o.paused {
+		n = 0
+	}
+	desc.register()
+	// События одного дескриптора, полученные за одну итерацию, объединяются
+	// в один вызов коллбека.
+	err := p.add(desc.fd(), events, n, func(kevs []Kevent) {
+		var event Event
+		for _, kev := range kevs {
+			event |= fromKevent(kev)
+			// Для сокетов при EV_EOF в fflags хранится ошибка сокета.
+			if kev.Flags&EV_EOF != 0 && kev.Fflags != 0 {
+				desc.setLastError(syscall.Errno(kev.Fflags))
 			}
 		}
-		if flags&EV_ERROR != 0 {
-			event |= EventErr
+		desc.setLastEvent(event)
+		cb(event)
+	})
+	if err != nil {
+		desc.unregister()
+		desc.lowat = 0
+		return wrapError(p.name, "start", desc.fd(), err)
+	}
+	desc.armed = 0
+	if !o.paused {
+		desc.armed = desc.event
+	}
+	return nil
+}
+
+func fromKevent(kev Kevent) (event Event) {
+	var (
+		flags  = kev.Flags
+		filter = kev.Filter
+	)
+
+	// Set EventHup for any EOF flag. Below will be more precise detection
+	// of what exatcly HUP occured.
+	if flags&EV_EOF != 0 {
+		event |= EventHup
+	}
+
+	if filter == EVFILT_READ {
+		event |= EventRead
+		if flags&EV_EOF != 0 {
+			event |= EventReadHup
 		}
-		if filter == _EVFILT_CLOSED {
-			event |= EventPollerClosed
+	}
+	if filter == EVFILT_WRITE {
+		event |= EventWrite
+		if flags&EV_EOF != 0 {
+			event |= EventWriteHup
 		}
+	}
+	if flags&EV_ERROR != 0 {
+		event |= EventErr
+	}
+	if filter == _EVFILT_CLOSED {
+		event |= EventPollerClosed
+	}
 
-		cb(event)
-	})
+	return event
+}
+
+func (p poller) StartDuplex(desc *Desc, onRead, onWrite CallbackFn) error {
+	event := desc.event
+	desc.event |= EventRead | EventWrite
+	if err := p.Start(desc, Duplex(onRead, onWrite)); err != nil {
+		desc.event = event
+		return err
+	}
+	return nil
+}
+
+// StartPaused регистрирует коллбек без фильтров: они добавляются в Resume().
+func (p poller) StartPaused(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb, startPaused)
+}
+
+// StartLazy откладывает Start() до вызова desc.Arm().
+func (p poller) StartLazy(desc *Desc, cb CallbackFn) error {
+	return startLazy(p, desc, cb)
+}
+
+func (p poller) StartCtxFn(desc *Desc, ctx context.Context, fn func(context.Context, Event)) error {
+	return p.Start(desc, ContextCallback(ctx, fn))
+}
+
+// StartHandler implements HandlerStarter.StartHandler() method.
+func (p poller) StartHandler(desc *Desc, h Handler) error {
+	return p.Start(desc, h.HandleEvent)
 }
 
 func (p poller) Stop(desc *Desc) error {
+	if stopLazy(desc) {
+		return nil
+	}
+	if desc.proc != nil {
+		return p.stopProcess(desc)
+	}
 	n, events := toKevents(desc.event, false)
 	if err := p.Del(desc.fd()); err != nil {
 		return err
 	}
+	desc.unregister()
+	desc.paused = false
+	desc.lowat = 0
 	if err := p.Mod(desc.fd(), events, n); err != nil && err != ErrNotRegistered {
-		return err
+		return wrapError(p.name, "stop", desc.fd(), err)
 	}
 	return nil
 }
 
 func (p poller) Resume(desc *Desc) error {
-	n, events := toKevents(desc.event, true)
-	return p.Mod(desc.fd(), events, n)
+	if desc.paused {
+		return nil
+	}
+	return wrapError(p.name, "resume", desc.fd(), p.arm(desc, desc.event))
+}
+
+// Pause удаляет фильтры дескриптора, оставляя его зарегистрированным.
+func (p poller) Pause(desc *Desc) error {
+	if desc.paused {
+		return nil
+	}
+	if err := p.arm(desc, 0); err != nil {
+		return wrapError(p.name, "pause", desc.fd(), err)
+	}
+	desc.paused = true
+	return nil
+}
+
+// Unpause добавляет фильтры дескриптора обратно.
+func (p poller) Unpause(desc *Desc) error {
+	if !desc.paused {
+		return nil
+	}
+	if err := p.arm(desc, desc.event); err != nil {
+		return wrapError(p.name, "unpause", desc.fd(), err)
+	}
+	desc.paused = false
+	return nil
+}
+
+// arm приводит фильтры дескриптора в соответствие с event.
+func (p poller) arm(desc *Desc, event Event) error {
+	// Удаляем фильтры, которые больше не запрошены, например, после
+	// Desc.Update(). Сработавший одноразовый фильтр уже удален ядром,
+	// поэтому ENOENT игнорируется
+	for _, filter := range [...]Event{EventRead, EventWrite} {
+		if desc.armed&^event&filter == 0 {
+			continue
+		}
+		n, events := toKevents(filter, false)
+		if err := p.Mod(desc.fd(), events, n); err != nil && err != syscall.ENOENT {
+			return err
+		}
+	}
+	n, events := toKevents(event, true)
+	lowWatermark(&events, n, desc.lowat)
+	if err := p.Mod(desc.fd(), events, n); err != nil {
+		return err
+	}
+	desc.armed = event
+	return nil
 }
 
 func toKevents(event Event, add bool) (n int, ks Kevents) {
@@ -101,3 +292,21 @@ func toKevents(event Event, add bool) (n int, ks Kevents) {
 	}
 	return
 }
+
+// lowWatermark задает NOTE_LOWAT для фильтра чтения, если lowat больше 1.
+// Повторное добавление фильтра без него сбрасывает порог, поэтому он
+// задается при каждом EV_ADD.
+func lowWatermark(ks *Kevents, n, lowat int) {
+	if lowat <= 1 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		if ks[i].Filter == EVFILT_READ && ks[i].Flags&EV_ADD != 0 {
+			ks[i].Fflags |= NOTE_LOWAT
+			ks[i].Data = int64(lowat)
+		}
+	}
+}
+
+// hupOnReadEOF is true, because EventHup is set for any EV_EOF flag.
+const hupOnReadEOF = true
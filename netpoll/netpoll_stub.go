@@ -1,11 +1,25 @@
-// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!wasip1
 
 package netpoll
 
-import "fmt"
+// New returns ErrUnsupportedPlatform to indicate that Poller is not
+// implemented for current operating system, unless config requests backend added by
+// RegisterBackend().
+// If config requests other particular backend, ErrBackendUnavailable is
+// returned.
+func New(c *Config) (Poller, error) {
+	cfg := c.withDefaults()
+	if p, ok, err := registered(cfg); ok {
+		return p, err
+	}
+	if cfg.Backend != BackendAuto {
+		return nil, ErrBackendUnavailable{cfg.Backend}
+	}
+	return nil, platformError()
+}
 
-// New always returns an error to indicate that Poller is not implemented for
+// builtinBackends is empty, because there are no built-in backends for
 // current operating system.
-func New(*Config) (Poller, error) {
-	return nil, fmt.Errorf("poller is not supported on this operating system")
-}
+var builtinBackends []Backend
+
+const hupOnReadEOF = false
@@ -0,0 +1,31 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!wasip1
+
+package netpoll
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestUnsupportedPlatform(t *testing.T) {
+	exp := ErrUnsupportedPlatform{runtime.GOOS}
+	if _, err := New(nil); err != exp {
+		t.Errorf("New() error is %v; want %v", err, exp)
+	}
+	if _, err := New(&Config{Backend: BackendEpoll}); err != (ErrBackendUnavailable{BackendEpoll}) {
+		t.Errorf("New() with epoll backend error is %v; want ErrBackendUnavailable", err)
+	}
+	if _, err := NewDesc(0, EventRead, false); err != exp {
+		t.Errorf("NewDesc() error is %v; want %v", err, exp)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can not listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := HandleListener(ln, EventRead); err != exp {
+		t.Errorf("HandleListener() error is %v; want %v", err, exp)
+	}
+}
@@ -4,10 +4,25 @@ package netpoll
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -109,6 +124,603 @@ func TestPollerReadOnce(t *testing.T) {
 	}
 }
 
+func TestPollerReadWriteCoalesce(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	// Make r readable. It is writable already.
+	if _, err = unix.Write(w, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := NewDesc(r, EventRead|EventWrite|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 2)
+	err = poller.Start(desc, func(event Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if exp := EventRead | EventWrite; event&exp != exp {
+			t.Fatalf("received %s; want %s in single callback", event, exp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected second callback with %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDrainUntilEOF(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// Peer shuts down writing, leaving data unread in the kernel buffer.
+	if err = client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := HandleRead(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	type result struct {
+		event Event
+		data  []byte
+		n     int64
+		err   error
+	}
+	done := make(chan result, 1)
+	err = poller.Start(desc, func(event Event) {
+		if !event.PeerClosedWrite() {
+			return
+		}
+		poller.Stop(desc)
+
+		var buf bytes.Buffer
+		n, err := DrainUntilEOF(conn, &buf)
+		done <- result{event, buf.Bytes(), n, err}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != io.EOF {
+			t.Fatalf("DrainUntilEOF() error is %v; want %v", res.err, io.EOF)
+		}
+		if res.n != int64(len(data)) || !bytes.Equal(res.data, data) {
+			t.Fatalf("drained %d bytes; want %d", res.n, len(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no half-close event received")
+	}
+
+	// Connection is still writable in the other direction.
+	if _, err = conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleProcess(t *testing.T) {
+	if SupportedProcessEvents()&ProcessExit == 0 {
+		t.Fatalf("SupportedProcessEvents() is %v; want ProcessExit", SupportedProcessEvents())
+	}
+	// Child exits with status 3 when its stdin is closed.
+	cmd := exec.Command("sh", "-c", "read x; exit 3")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	desc, err := HandleProcess(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	// Poller must be closed before desc, because the callback reads desc
+	// until the poller is closed.
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	type result struct {
+		state ProcessState
+		err   error
+	}
+	exited := make(chan result, 1)
+	err = poller.Start(desc, func(ev Event) {
+		if ev&EventPollerClosed != 0 {
+			return
+		}
+		state, err := ProcessStatus(desc)
+		if state.Events&ProcessExit == 0 && err == nil {
+			return
+		}
+		select {
+		case exited <- result{state, err}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := ProcessStatus(desc); err != nil || state.Events != 0 {
+		t.Fatalf("ProcessStatus() of running process = %+v, %v; want no events", state, err)
+	}
+
+	stdin.Close()
+	var r result
+	select {
+	case r = <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process exit is not reported")
+	}
+	if r.err != nil {
+		t.Fatalf("ProcessStatus() error is %v", r.err)
+	}
+	if !r.state.Status.Exited() || r.state.Status.ExitStatus() != 3 {
+		t.Errorf("exit status is %#x; want exit code 3", uint32(r.state.Status))
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Descriptor does not reap the process.
+	var exitErr *exec.ExitError
+	if err = cmd.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("Wait() error is %v; want exit code 3", err)
+	}
+
+	if _, err = ProcessStatus(Must(NewDesc(0, EventRead, false))); err != ErrNotProcess {
+		t.Errorf("ProcessStatus() of descriptor without process error is %v; want %v", err, ErrNotProcess)
+	}
+	if _, err = HandleProcess(0); err != ErrInvalidPID {
+		t.Errorf("HandleProcess(0) error is %v; want %v", err, ErrInvalidPID)
+	}
+	if SupportedProcessEvents()&ProcessFork == 0 {
+		_, err = HandleProcessWithOptions(os.Getpid(), ProcessOptions{Fork: true})
+		if err != ErrUnsupportedOption {
+			t.Errorf("HandleProcessWithOptions() with unsupported events error is %v; want %v", err, ErrUnsupportedOption)
+		}
+	}
+}
+
+func TestEventPeerClosedWrite(t *testing.T) {
+	for _, test := range []struct {
+		event Event
+		exp   bool
+	}{
+		{EventRead, false},
+		{EventRead | EventReadHup, true},
+		{EventRead | EventReadHup | EventErr, false},
+		{EventRead | EventReadHup | EventWriteHup, false},
+		{EventHup | EventReadHup, hupOnReadEOF},
+	} {
+		if act := test.event.PeerClosedWrite(); act != test.exp {
+			t.Errorf("%s.PeerClosedWrite() = %v; want %v", test.event, act, test.exp)
+		}
+	}
+}
+
+func TestWriteOrWait(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		event   Event
+		size    int
+		closeRd bool
+	}{
+		{"immediate", EventWrite, 16, false},
+		{"wait", EventWrite, 64 << 10, false},
+		{"wait-oneshot", EventWrite | EventOneShot, 64 << 10, false},
+		{"error", EventWrite, 64 << 10, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+
+			desc, err := NewDesc(w, test.event, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := bytes.Repeat([]byte("x"), test.size)
+			done := make(chan error, 1)
+			err = WriteOrWait(poller, desc, data, func(err error) {
+				done <- err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := make(chan int, 1)
+			if test.closeRd {
+				unix.Close(r)
+			} else {
+				go func() {
+					defer unix.Close(r)
+					var (
+						n   int
+						buf = make([]byte, 4096)
+					)
+					for n < len(data) {
+						m, err := unix.Read(r, buf)
+						if err == unix.EAGAIN {
+							time.Sleep(time.Millisecond)
+							continue
+						}
+						if err != nil || m == 0 {
+							break
+						}
+						n += m
+					}
+					received <- n
+				}()
+			}
+
+			select {
+			case err := <-done:
+				if test.closeRd {
+					if err == nil {
+						t.Fatal("expected write error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("write was not completed")
+			}
+			if n := <-received; n != len(data) {
+				t.Fatalf("received %d bytes; want %d", n, len(data))
+			}
+		})
+	}
+}
+
+func TestPollerStartDuplex(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+
+	if _, err = unix.Write(w, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := NewDesc(r, EventRead|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		reads  = make(chan Event, 1)
+		writes = make(chan Event, 1)
+	)
+	err = poller.StartDuplex(desc,
+		func(event Event) { reads <- event },
+		func(event Event) { writes <- event },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.event != EventRead|EventWrite|EventOneShot {
+		t.Errorf("descriptor event is %s; want it extended with EventWrite", desc.event)
+	}
+
+	for _, test := range []struct {
+		name string
+		ch   chan Event
+		exp  Event
+	}{
+		{"read", reads, EventRead},
+		{"write", writes, EventWrite},
+	} {
+		select {
+		case event := <-test.ch:
+			if event != test.exp {
+				t.Errorf("%s callback received %s; want %s", test.name, event, test.exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s callback was not called", test.name)
+		}
+	}
+
+	// Hangup must be delivered to both callbacks.
+	unix.Close(w)
+	if err = poller.Resume(desc); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		ch   chan Event
+	}{
+		{"read", reads},
+		{"write", writes},
+	} {
+		select {
+		case event := <-test.ch:
+			if event&EventHup == 0 {
+				t.Errorf("%s callback received %s; want %s", test.name, event, EventHup)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s callback was not called on hangup", test.name)
+		}
+	}
+}
+
+func TestDuplex(t *testing.T) {
+	for _, test := range []struct {
+		event Event
+		read  Event
+		write Event
+	}{
+		{EventRead, EventRead, 0},
+		{EventWrite | EventWriteHup, 0, EventWrite | EventWriteHup},
+		{EventRead | EventWrite, EventRead, EventWrite},
+		{EventRead | EventReadHup | EventHup, EventRead | EventReadHup | EventHup, EventHup},
+		{EventErr, EventErr, EventErr},
+		{EventPollerClosed, EventPollerClosed, EventPollerClosed},
+	} {
+		var read, write Event
+		Duplex(
+			func(event Event) { read = event },
+			func(event Event) { write = event },
+		)(test.event)
+		if read != test.read || write != test.write {
+			t.Errorf(
+				"Duplex() routed %s as %s and %s; want %s and %s",
+				test.event, read, write, test.read, test.write,
+			)
+		}
+	}
+
+	// Nil callbacks must be skipped.
+	Duplex(nil, nil)(EventRead | EventWrite)
+}
+
+func TestPollerStartCtxFn(t *testing.T) {
+	desc, peer, _ := socketPairDesc(t)
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "span"))
+	defer cancel()
+
+	errs := make(chan error, 1)
+	err = poller.StartCtxFn(desc, ctx, func(ctx context.Context, event Event) {
+		if event&EventPollerClosed != 0 {
+			return
+		}
+		if v := ctx.Value(key{}); v != "span" {
+			t.Errorf("callback received context value %v; want %q", v, "span")
+		}
+		select {
+		case errs <- ctx.Err():
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data is left unread, so callback is called on each wait iteration.
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("callback received context error %v before cancellation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no callback calls")
+	}
+
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case err := <-errs:
+			if err == context.Canceled {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("callback did not receive cancelled context")
+		}
+	}
+}
+
+// chanHandler is a Handler which sends received events to the channel.
+type chanHandler chan Event
+
+func (h chanHandler) HandleEvent(event Event) { h <- event }
+
+func TestPollerStartHandler(t *testing.T) {
+	desc, peer, _ := socketPairDesc(t)
+	desc.event |= EventOneShot
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chanHandler, 2)
+	if err = StartHandler(poller, desc, events); err != nil {
+		t.Fatal(err)
+	}
+	if err = StartHandler(poller, desc, events); !errors.Is(err, ErrRegistered) {
+		t.Errorf("second StartHandler() error is %v; want %v", err, ErrRegistered)
+	}
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			if event != EventRead {
+				t.Fatalf("handler received %s; want %s", event, EventRead)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler was not called")
+		}
+		if ev, _ := desc.LastEvent(); ev != EventRead {
+			t.Errorf("LastEvent() is %s; want %s", ev, EventRead)
+		}
+		// Data is left unread, so handler is called again only after
+		// Resume().
+		select {
+		case event := <-events:
+			t.Fatalf("handler of one-shot descriptor received %s before Resume()", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err = poller.Resume(desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = poller.(Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event&EventPollerClosed != 0 {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("handler was not called on poller close")
+		}
+	}
+}
+
+func TestPollerWaitIdle(t *testing.T) {
+	desc, peer, _ := socketPairDesc(t)
+	desc.event |= EventOneShot
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+	idler := poller.(Idler)
+
+	if err := idler.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("WaitIdle() of idle poller error: %v", err)
+	}
+
+	var (
+		called  = make(chan struct{})
+		release = make(chan struct{})
+	)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventPollerClosed != 0 {
+			return
+		}
+		close(called)
+		<-release
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-called
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := idler.WaitIdle(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitIdle() error is %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- idler.WaitIdle(context.Background())
+	}()
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitIdle() is not returned after callback is returned")
+	}
+}
+
 func TestPollerWriteOnce(t *testing.T) {
 	poller, err := New(config(t))
 	if err != nil {
@@ -120,90 +732,2819 @@ func TestPollerWriteOnce(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	sendLoWat, err := unix.GetsockoptInt(w, unix.SOL_SOCKET, unix.SO_SNDLOWAT)
+	sendLoWat, err := unix.GetsockoptInt(w, unix.SOL_SOCKET, unix.SO_SNDLOWAT)
+	if err != nil {
+		t.Fatalf("get SO_SNDLOWAT error: %v", err)
+	}
+	sendBuf, err := unix.GetsockoptInt(w, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		t.Fatalf("get SO_SNDBUF error: %v", err)
+	}
+
+	log.Printf("send buf is %d", sendBuf)
+	log.Printf("send low watermark is %d", sendLoWat)
+
+	filled, err := fillSendBuffer(w)
+	if err != nil {
+		t.Fatalf("fill send buffer error: %v", err)
+	}
+	log.Printf("filled send buffer: %d", filled)
+
+	var (
+		writeEvents = new(uint32)
+		writeHup    = new(uint32)
+	)
+
+	wc, err := net.FileConn(os.NewFile(uintptr(w), "w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc := Must(HandleWriteOnce(wc))
+	err = poller.Start(desc, func(e Event) {
+		log.Printf("received event from poller: %s", e)
+		atomic.AddUint32(writeEvents, 1)
+
+		if e&EventHup != 0 {
+			atomic.AddUint32(writeHup, 1)
+			return
+		}
+		if e&EventErr != 0 {
+			return
+		}
+
+		filled, err := fillSendBuffer(w)
+		if err != nil {
+			t.Fatalf("fill send buffer error: %v", err)
+		}
+		log.Printf("filled send buffer: %d", filled)
+
+		if err := poller.Resume(desc); err != nil {
+			t.Fatalf("poller.Resume() error %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("poller.Start(w) error: %v", err)
+	}
+
+	// Read sendLoWat-1 bytes such that next read will trigger write event.
+	if n, err := unix.Read(r, make([]byte, sendLoWat-1)); err != nil {
+		t.Fatalf("unix.Read() error: %v", err)
+	} else {
+		log.Printf("read %d (from %d: SNDLOWAT-1)", n, sendLoWat-1)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadUint32(writeEvents); n > 0 {
+		t.Fatalf("write events: %v; want 0", n)
+	}
+
+	if n, err := unix.Read(r, make([]byte, filled)); err != nil {
+		t.Fatalf("empty receive buffer error: %v", err)
+	} else {
+		log.Printf("emptied receive buffer: %d", n)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadUint32(writeEvents); n != 1 {
+		t.Errorf("write events: %v; want 1", n)
+	}
+
+	if err := unix.Close(r); err != nil {
+		t.Fatalf("unix.Close() error: %v", err)
+	}
+	log.Println("closed read-end of pair")
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadUint32(writeHup); n != 1 {
+		t.Errorf("hup events: %v; want 1", n)
+	}
+}
+
+func TestAsyncWrite(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn, peer := fileConnPair(t)
+	// Each chunk is larger than the socket buffer.
+	chunks := make([][]byte, 3)
+	for i := range chunks {
+		chunks[i] = bytes.Repeat([]byte{'a' + byte(i)}, 1<<20)
+	}
+	type result struct {
+		i   int
+		n   int
+		err error
+	}
+	results := make(chan result, len(chunks)+1)
+	for i, chunk := range chunks {
+		i := i
+		AsyncWrite(poller, conn, chunk, func(n int, err error) {
+			results <- result{i, n, err}
+		})
+	}
+
+	// Reader stalls, so nothing could be written completely.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case r := <-results:
+		t.Fatalf("write #%d is done while reader stalls", r.i)
+	default:
+	}
+
+	var exp bytes.Buffer
+	for _, chunk := range chunks {
+		exp.Write(chunk)
+	}
+	act := make([]byte, exp.Len())
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(peer, act); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(act, exp.Bytes()) {
+		t.Errorf("data is reordered or interleaved")
+	}
+	for i := range chunks {
+		r := <-results
+		if r.i != i || r.n != len(chunks[i]) || r.err != nil {
+			t.Errorf(
+				"done #%d is called with (%d, %v) for write #%d; want (%d, <nil>)",
+				i, r.n, r.err, r.i, len(chunks[i]),
+			)
+		}
+	}
+	select {
+	case r := <-results:
+		t.Errorf("extra done call for write #%d", r.i)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Writes queued after a failed one are done with the same error.
+	for _, chunk := range chunks {
+		AsyncWrite(poller, conn, chunk, func(n int, err error) {
+			results <- result{n: n, err: err}
+		})
+	}
+	peer.Close()
+	var first error
+	for range chunks {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				t.Errorf("done is called with nil error after peer is closed")
+			}
+			if first == nil {
+				first = r.err
+			} else if r.err != first {
+				t.Errorf("queued write is done with %v; want %v", r.err, first)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("done is not called after peer is closed")
+		}
+	}
+
+	AsyncWrite(poller, stubConn{}, []byte("x"), func(n int, err error) {
+		results <- result{n: n, err: err}
+	})
+	if r := <-results; r.err != ErrNotFiler {
+		t.Errorf("done for stub connection is called with %v; want %v", r.err, ErrNotFiler)
+	}
+}
+
+func TestAsyncReadFull(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	read := func(conn net.Conn, buf []byte) (<-chan error, func()) {
+		result := make(chan error, 2)
+		cancel := AsyncReadFull(poller, conn, buf, func(err error) {
+			result <- err
+		})
+		return result, cancel
+	}
+	wait := func(t *testing.T, result <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("done is not called")
+			return nil
+		}
+	}
+
+	t.Run("fragments", func(t *testing.T) {
+		conn, peer := fileConnPair(t)
+		payload := make([]byte, 64<<10)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		buf := make([]byte, len(payload))
+		result, _ := read(conn, buf)
+		go func() {
+			for p := payload; len(p) > 0; {
+				n := 1 + len(p)%4096
+				if n > len(p) {
+					n = len(p)
+				}
+				peer.Write(p[:n])
+				p = p[n:]
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+		if err := wait(t, result); err != nil {
+			t.Fatalf("done is called with %v", err)
+		}
+		if !bytes.Equal(buf, payload) {
+			t.Errorf("received data differs from the sent one")
+		}
+		select {
+		case err := <-result:
+			t.Errorf("extra done call with %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		for _, test := range []struct {
+			sent string
+			err  error
+		}{
+			{"", io.EOF},
+			{"hello", io.ErrUnexpectedEOF},
+		} {
+			conn, peer := fileConnPair(t)
+			result, _ := read(conn, make([]byte, 10))
+			peer.Write([]byte(test.sent))
+			time.Sleep(10 * time.Millisecond)
+			peer.Close()
+
+			err := wait(t, result)
+			var perr *PartialReadError
+			if !errors.As(err, &perr) || !errors.Is(err, test.err) {
+				t.Fatalf("done is called with %v; want PartialReadError with %v", err, test.err)
+			}
+			if act, exp := perr.N, len(test.sent); act != exp {
+				t.Errorf("partial count is %d; want %d", act, exp)
+			}
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		conn, peer := fileConnPair(t)
+		result, cancel := read(conn, make([]byte, 10))
+		cancel()
+		cancel()
+		peer.Write([]byte("hello"))
+		select {
+		case err := <-result:
+			t.Fatalf("done is called with %v after cancel", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		// Data is left in the connection after descriptor is stopped.
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("read %q, %v after cancel; want %q", buf, err, "hello")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		result, _ := read(stubConn{}, nil)
+		if err := wait(t, result); err != nil {
+			t.Errorf("done for empty buffer is called with %v", err)
+		}
+		result, _ = read(stubConn{}, make([]byte, 1))
+		if err := wait(t, result); !errors.Is(err, ErrNotFiler) {
+			t.Errorf("done for stub connection is called with %v; want %v", err, ErrNotFiler)
+		}
+	})
+}
+
+func TestProxy(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		splice bool
+	}{
+		{"copy", false},
+		{"splice", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			// start proxies connections which x and y are connected to.
+			start := func(opts ProxyOptions) (x, y net.Conn, done <-chan ProxyResult) {
+				x, a := tcpConnPair(t)
+				b, y := tcpConnPair(t)
+				opts.Splice = test.splice
+				opts.BufferSize = 4096
+				return x, y, Proxy(poller, a, b, opts)
+			}
+			result := func(done <-chan ProxyResult) ProxyResult {
+				t.Helper()
+				select {
+				case res := <-done:
+					return res
+				case <-time.After(5 * time.Second):
+					t.Fatalf("proxying is not finished")
+				}
+				panic("unreachable")
+			}
+
+			t.Run("transfer", func(t *testing.T) {
+				x, y, done := start(ProxyOptions{})
+				// Data is larger than socket buffers, so both directions
+				// wait for writability.
+				data := make([]byte, 4<<20)
+				for i := range data {
+					data[i] = byte(i * 7)
+				}
+				received := make(chan []byte, 2)
+				for _, conn := range []net.Conn{x, y} {
+					conn := conn
+					go func() {
+						conn.Write(data)
+						conn.(*net.TCPConn).CloseWrite()
+					}()
+					go func() {
+						conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+						p, _ := ioutil.ReadAll(conn)
+						received <- p
+					}()
+				}
+				for i := 0; i < 2; i++ {
+					if p := <-received; !bytes.Equal(p, data) {
+						t.Fatalf("received %d bytes which differ from %d sent", len(p), len(data))
+					}
+				}
+				res := result(done)
+				if res.Err != nil || res.AB != int64(len(data)) || res.BA != int64(len(data)) {
+					t.Fatalf("result is %+v; want %d bytes in both directions", res, len(data))
+				}
+			})
+
+			t.Run("half-close", func(t *testing.T) {
+				x, y, done := start(ProxyOptions{})
+				y.Write([]byte("hello"))
+				y.(*net.TCPConn).CloseWrite()
+				x.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if p, err := ioutil.ReadAll(x); err != nil || string(p) != "hello" {
+					t.Fatalf("received %q, %v; want %q", p, err, "hello")
+				}
+				// Shut down direction does not stop the opposite one.
+				x.Write([]byte("bye"))
+				x.(*net.TCPConn).CloseWrite()
+				y.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if p, err := ioutil.ReadAll(y); err != nil || string(p) != "bye" {
+					t.Fatalf("received %q, %v; want %q", p, err, "bye")
+				}
+				res := result(done)
+				if res != (ProxyResult{AB: 3, BA: 5}) {
+					t.Fatalf("result is %+v; want %+v", res, ProxyResult{AB: 3, BA: 5})
+				}
+			})
+
+			t.Run("limit", func(t *testing.T) {
+				x, _, done := start(ProxyOptions{LimitAB: 10, LimitBA: 10})
+				x.Write([]byte("0123456789"))
+				x.Write([]byte("a"))
+				if res := result(done); res.Err != ErrProxyLimit || res.AB > 10 {
+					t.Fatalf("result is %+v; want at most 10 bytes and %v", res, ErrProxyLimit)
+				}
+
+				x, y, done := start(ProxyOptions{LimitAB: 10})
+				x.Write([]byte("0123456789"))
+				x.(*net.TCPConn).CloseWrite()
+				y.(*net.TCPConn).CloseWrite()
+				if res := result(done); res != (ProxyResult{AB: 10}) {
+					t.Fatalf("result is %+v; want %+v", res, ProxyResult{AB: 10})
+				}
+			})
+
+			t.Run("idle", func(t *testing.T) {
+				const timeout = 50 * time.Millisecond
+				x, y, done := start(ProxyOptions{IdleTimeout: timeout})
+				begin := time.Now()
+				// Activity postpones the timeout.
+				for i := 0; i < 3; i++ {
+					time.Sleep(timeout / 2)
+					x.Write([]byte("ping"))
+				}
+				res := result(done)
+				if res.Err != ErrProxyIdle || res.AB != 12 {
+					t.Fatalf("result is %+v; want 12 bytes and %v", res, ErrProxyIdle)
+				}
+				if elapsed := time.Since(begin); elapsed < timeout*3/2+timeout {
+					t.Fatalf("idle timeout fired after %s of activity", elapsed)
+				}
+				// Connections are closed.
+				y.SetReadDeadline(time.Now().Add(time.Second))
+				if p, err := ioutil.ReadAll(y); err != nil || string(p) != "pingpingping" {
+					t.Fatalf("received %q, %v; want %q", p, err, "pingpingping")
+				}
+			})
+		})
+	}
+}
+
+func TestHandleNonblock(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		handle   func(net.Conn) (*Desc, error)
+		blocking bool
+		exp      bool
+	}{
+		{
+			name:     "edge-triggered",
+			handle:   HandleRead,
+			blocking: true,
+			exp:      true,
+		},
+		{
+			name:     "one-shot",
+			handle:   HandleReadOnce,
+			blocking: true,
+			exp:      false,
+		},
+		{
+			name: "set",
+			handle: func(conn net.Conn) (*Desc, error) {
+				return HandleWithOptions(conn, EventRead, Options{SetNonblock: true})
+			},
+			blocking: true,
+			exp:      true,
+		},
+		{
+			name: "clear",
+			handle: func(conn net.Conn) (*Desc, error) {
+				return HandleWithOptions(conn, EventRead, Options{ClearNonblock: true})
+			},
+			exp: false,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(w)
+
+			conn, err := net.FileConn(os.NewFile(uintptr(r), "r"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			unix.Close(r)
+
+			desc, err := test.handle(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			if test.blocking {
+				// Emulate File() behavior of older Go versions.
+				if err := unix.SetNonblock(desc.fd(), false); err != nil {
+					t.Fatal(err)
+				}
+				if desc, err = test.handle(conn); err != nil {
+					t.Fatal(err)
+				}
+				defer desc.Close()
+			}
+
+			flags, err := unix.FcntlInt(uintptr(desc.fd()), unix.F_GETFL, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act := flags&unix.O_NONBLOCK != 0; act != test.exp {
+				t.Errorf("O_NONBLOCK is %t; want %t", act, test.exp)
+			}
+		})
+	}
+}
+
+func TestHandleWithBehavior(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	conn, err := net.FileConn(os.NewFile(uintptr(r), "r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	unix.Close(r)
+
+	for _, test := range []struct {
+		name     string
+		events   Event
+		behavior Behavior
+		err      error
+	}{
+		{"read", EventRead, BehaviorEdgeTriggered, nil},
+		{"read write", EventRead | EventWrite, BehaviorOneShot, nil},
+		{"no events", 0, BehaviorOneShot, ErrInvalidEvent},
+		{"modifier event", EventRead | EventOneShot, 0, ErrInvalidEvent},
+		{"hup event", EventRead | EventHup, 0, ErrInvalidEvent},
+		{"unknown behavior", EventRead, Behavior(EventRead), ErrInvalidEvent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := HandleWithBehavior(conn, test.events, test.behavior)
+			if err != test.err {
+				t.Fatalf("HandleWithBehavior() error is %v; want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			defer desc.Close()
+			if act, exp := desc.event, test.events|Event(test.behavior); act != exp {
+				t.Errorf("desc event is %s; want %s", act, exp)
+			}
+		})
+	}
+}
+
+func TestHandleBorrow(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn, peer := fileConnPair(t)
+	desc, err := HandleWithOptions(conn, EventRead|EventOneShot, Options{Borrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		if act, exp := desc.fd(), int(fd); act != exp {
+			t.Errorf("borrowed descriptor is %d; want %d", act, exp)
+		}
+	})
+
+	received := make(chan Event, 1)
+	if err = poller.Start(desc, func(ev Event) { received <- ev }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-received:
+		if ev&EventRead == 0 {
+			t.Errorf("received %s; want %s", ev, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Borrowed descriptor is not closed with Desc.
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("connection is closed with descriptor: %v", err)
+	}
+
+	// Connection which does not implement syscall.Conn is not handled.
+	if _, err = HandleWithOptions(stubConn{}, EventRead, Options{Borrow: true}); err != ErrNotFiler {
+		t.Errorf("HandleWithOptions() of stub connection error is %v; want %v", err, ErrNotFiler)
+	}
+}
+
+func TestHandleDeadline(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts Options
+	}{
+		{"dup", Options{}},
+		{"borrow", Options{Borrow: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _ := fileConnPair(t)
+			desc, err := HandleWithOptions(conn, EventRead, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			// Deadline must be served by the runtime, so Read() returns
+			// instead of blocking forever.
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			done := make(chan error, 1)
+			go func() {
+				_, err := conn.Read(make([]byte, 1))
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("Read() error is %v; want %v", err, os.ErrDeadlineExceeded)
+				}
+			case <-time.After(time.Second):
+				conn.Close()
+				t.Fatalf("Read() ignores deadline after descriptor is taken")
+			}
+		})
+	}
+}
+
+func TestHandleTLS(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	raw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	server := tls.Server(raw, testTLSConfig(t))
+	tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	handshake := make(chan error, 1)
+	go func() {
+		handshake <- tc.Handshake()
+	}()
+	if err = server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-handshake; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		conn net.Conn
+	}{
+		{"tls", server},
+		{"unwrapper", unwrapConn{server}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			desc, err := HandleReadOnce(test.conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			received := make(chan Event, 1)
+			if err = poller.Start(desc, func(ev Event) { received <- ev }); err != nil {
+				t.Fatal(err)
+			}
+			defer poller.Stop(desc)
+
+			if _, err = tc.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case ev := <-received:
+				if ev&EventRead == 0 {
+					t.Errorf("received %s; want %s", ev, EventRead)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no event received when encrypted data arrived")
+			}
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(test.conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if act, exp := string(buf), "hello"; act != exp {
+				t.Errorf("read %q; want %q", act, exp)
+			}
+		})
+	}
+
+	// Chain which ends without a file descriptor is not handled.
+	if _, err = Handle(unwrapConn{stubConn{}}, EventRead); err != ErrNotFiler {
+		t.Errorf("Handle() of wrapped stub connection error is %v; want %v", err, ErrNotFiler)
+	}
+}
+
+func TestHandleFiler(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn, peer := fileConnPair(t)
+	var fd int
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(x uintptr) { fd = int(x) })
+
+	// Filer is preferred to File(), which would make a copy.
+	wrapped := filerConn{conn.(*net.UnixConn), fd, nil}
+	for _, c := range []net.Conn{wrapped, unwrapConn{wrapped}} {
+		desc, err := HandleReadOnce(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act, exp := desc.fd(), fd; act != exp {
+			t.Errorf("descriptor of %T is %d; want %d", c, act, exp)
+		}
+		received := make(chan Event, 1)
+		if err = poller.Start(desc, func(ev Event) { received <- ev }); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = peer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-received:
+			if ev&EventRead == 0 {
+				t.Errorf("received %s; want %s", ev, EventRead)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event received")
+		}
+		if err = poller.Stop(desc); err != nil {
+			t.Fatal(err)
+		}
+		if err = desc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Descriptor of Filer is not owned by Desc.
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			t.Errorf("connection is closed with descriptor: %v", err)
+		}
+	}
+
+	desc, err := HandleWithOptions(wrapped, EventRead, Options{Borrow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := desc.fd(), fd; act != exp {
+		t.Errorf("borrowed descriptor is %d; want %d", act, exp)
+	}
+	desc.Close()
+
+	errFd := errors.New("no descriptor")
+	for _, test := range []struct {
+		conn filerConn
+		err  error
+	}{
+		{filerConn{fd: -1, err: errFd}, errFd},
+		{filerConn{fd: -1}, ErrInvalidFD},
+	} {
+		if _, err := Handle(test.conn, EventRead); err != test.err {
+			t.Errorf("Handle() error is %v; want %v", err, test.err)
+		}
+	}
+}
+
+func TestHandleSyscallConn(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn, peer := fileConnPair(t)
+	// Hide net.Conn methods of conn.
+	sc := struct{ syscall.Conn }{conn.(syscall.Conn)}
+
+	desc, err := HandleSyscallConn(sc, EventRead|EventEdgeTriggered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := unix.FcntlInt(uintptr(desc.fd()), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_NONBLOCK == 0 {
+		t.Errorf("edge-triggered descriptor is not in non-blocking mode")
+	}
+
+	received := make(chan Event, 1)
+	if err = poller.Start(desc, func(ev Event) {
+		select {
+		case received <- ev:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-received:
+		if ev&EventRead == 0 {
+			t.Errorf("received %s; want %s", ev, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Source connection must stay open.
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Errorf("connection is closed with descriptor: %v", err)
+	}
+}
+
+func TestHandleFile(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	desc, err := HandleFile(r, EventRead|EventOneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	received := make(chan Event, 1)
+	if err = poller.Start(desc, func(ev Event) { received <- ev }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-received:
+		if ev&EventRead == 0 {
+			t.Errorf("received %s; want %s", ev, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+
+	// Source file must be left in non-blocking mode, so its deadlines still
+	// work.
+	if err = r.SetReadDeadline(time.Now()); err != nil {
+		t.Errorf("SetReadDeadline() error: %v", err)
+	}
+}
+
+func TestHandleFileRegular(t *testing.T) {
+	f, err := ioutil.TempFile("", "netpoll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range builtinBackends {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			desc, err := HandleFile(f, EventRead|EventOneShot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			received := make(chan Event, 1)
+			err = poller.Start(desc, func(ev Event) { received <- ev })
+			if backend == BackendEpoll {
+				// Epoll does not support regular files.
+				if !errors.Is(err, ErrNotPollable) {
+					t.Fatalf("Start() error is %v; want %v", err, ErrNotPollable)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Regular file is readable right away.
+			select {
+			case ev := <-received:
+				if ev&EventRead == 0 {
+					t.Errorf("received %s; want %s", ev, EventRead)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no event received")
+			}
+		})
+	}
+}
+
+func TestDescReset(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn1, _ := fileConnPair(t)
+	conn2, peer2 := fileConnPair(t)
+
+	desc, err := HandleReadOnce(conn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = desc.Reset(conn2, EventRead|EventEdgeTriggered); err != ErrRegistered {
+		t.Fatalf("Reset() of started descriptor error is %v; want %v", err, ErrRegistered)
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	old := desc.file
+	desc.setLastError(ErrClosed)
+	if err = desc.Reset(conn2, EventRead|EventEdgeTriggered); err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Close(); err == nil {
+		t.Errorf("previous file of descriptor is not closed")
+	}
+	if act, exp := desc.event, EventRead|EventEdgeTriggered; act != exp {
+		t.Errorf("desc event is %s; want %s", act, exp)
+	}
+	if err = desc.LastError(); err != nil {
+		t.Errorf("LastError() is %v after Reset(); want nil", err)
+	}
+	// Descriptor is borrowed from conn, not duplicated.
+	fd, err := controlFd(conn2.(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.file != nil || desc.Fd() != fd {
+		t.Errorf("Reset() made descriptor %d with file %v; want borrowed %d", desc.Fd(), desc.file, fd)
+	}
+	if err = desc.Reset(stubConn{}, EventRead); err != ErrNotFiler {
+		t.Errorf("Reset() with stub conn error is %v; want %v", err, ErrNotFiler)
+	}
+	// Connection which implements only syscall.Conn is supported too.
+	conn3, _ := fileConnPair(t)
+	if err = desc.Reset(syscallOnlyConn{Conn: conn3.(syscall.Conn)}, EventRead); err != nil {
+		t.Errorf("Reset() with syscall.Conn error is %v; want nil", err)
+	}
+	if err = desc.Reset(conn2, EventRead|EventEdgeTriggered); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Event, 1)
+	if err = poller.Start(desc, func(ev Event) {
+		select {
+		case received <- ev:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = peer2.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-received:
+		if ev&EventRead == 0 {
+			t.Errorf("received %s; want %s", ev, EventRead)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received after Reset()")
+	}
+}
+
+func TestReleaseDesc(t *testing.T) {
+	EnableDescPool(true)
+	defer EnableDescPool(false)
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	conn, _ := fileConnPair(t)
+	desc, err := HandleRead(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ReleaseDesc(desc); err != ErrRegistered {
+		t.Fatalf("ReleaseDesc() of started descriptor error is %v; want %v", err, ErrRegistered)
+	}
+
+	// Descriptor is registered until it is stopped in all pollers.
+	other, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.(Closer).Close()
+	if err = other.Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = ReleaseDesc(desc); err != ErrRegistered {
+		t.Fatalf("ReleaseDesc() of descriptor started in other poller error is %v; want %v", err, ErrRegistered)
+	}
+	// Closed poller drops its registrations.
+	if err = other.(Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := desc.file
+	desc.setLastError(ErrClosed)
+	if err = ReleaseDesc(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Close(); err == nil {
+		t.Errorf("file of released descriptor is not closed")
+	}
+	if err = ReleaseDesc(desc); err != ErrDescReleased {
+		t.Fatalf("second ReleaseDesc() error is %v; want %v", err, ErrDescReleased)
+	}
+
+	// Descriptor taken from the pool must not keep the previous state.
+	for i := 0; i < 3; i++ {
+		desc, err = HandleReadOnce(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.event != EventRead|EventOneShot || desc.file == nil {
+			t.Fatalf("descriptor is not initialized: event is %s", desc.event)
+		}
+		if err = desc.LastError(); err != nil {
+			t.Fatalf("LastError() of new descriptor is %v; want nil", err)
+		}
+		if err = ReleaseDesc(desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHandle compares descriptors allocation with reuse of released
+// ones.
+func BenchmarkHandle(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, test := range []struct {
+		name    string
+		pool    bool
+		release func(*Desc) error
+	}{
+		{"Close", false, (*Desc).Close},
+		{"Release", true, ReleaseDesc},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			EnableDescPool(test.pool)
+			defer EnableDescPool(false)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				desc, err := HandleRead(conn)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = test.release(desc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEventString(t *testing.T) {
+	for _, test := range []struct {
+		event Event
+		exp   string
+	}{
+		{0, ""},
+		{EventRead | EventEdgeTriggered, "EventRead|EventEdgeTriggered"},
+		{EventReadHup | EventPollerClosed, "EventReadHup|EventPollerClosed"},
+		{EventRead | EventPriority, "EventRead|EventPriority"},
+		{0x200, "0x200"},
+		{EventRead | 0x600 | EventPollerClosed, "EventRead|EventPollerClosed|0x600"},
+	} {
+		if act := test.event.String(); act != test.exp {
+			t.Errorf("String() of %#x is %q; want %q", uint16(test.event), act, test.exp)
+		}
+	}
+}
+
+func TestBehaviorString(t *testing.T) {
+	b := BehaviorOneShot | BehaviorEdgeTriggered
+	if act, exp := b.String(), "BehaviorOneShot|BehaviorEdgeTriggered"; act != exp {
+		t.Errorf("String() = %q; want %q", act, exp)
+	}
+}
+
+func TestHandleWithOptionsConflict(t *testing.T) {
+	_, err := HandleWithOptions(stubConn{}, EventRead, Options{
+		SetNonblock:   true,
+		ClearNonblock: true,
+	})
+	if err != ErrNonblockConflict {
+		t.Fatalf("HandleWithOptions() error is %v; want %v", err, ErrNonblockConflict)
+	}
+}
+
+func TestNewDesc(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(w)
+
+	desc, err := NewDesc(r, EventRead|EventEdgeTriggered, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	err = poller.Start(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		buf := make([]byte, 128)
+		n, _ := unix.Read(r, buf)
+		received <- buf[:n]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	if _, err = unix.Write(w, data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case bts := <-received:
+		if !bytes.Equal(bts, data) {
+			t.Errorf("received %q; want %q", bts, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err = desc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFd(r); err != nil {
+		t.Fatalf("not owned fd is closed: %v", err)
+	}
+
+	owned, err := NewDesc(r, EventRead, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = owned.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkFd(r); err == nil {
+		t.Fatalf("owned fd is not closed")
+	}
+	if err = owned.Close(); err != os.ErrClosed {
+		t.Fatalf("second Close() = %v; want %v", err, os.ErrClosed)
+	}
+}
+
+func TestNewDescInvalid(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	unix.Close(w)
+
+	for _, test := range []struct {
+		name string
+		fd   int
+		ev   Event
+	}{
+		{"negative fd", -1, EventRead},
+		{"closed fd", w, EventRead},
+		{"no events", r, EventOneShot},
+		{"unknown events", r, EventRead | EventHup},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewDesc(test.fd, test.ev, false); err == nil {
+				t.Errorf("NewDesc() error is nil; want error")
+			}
+		})
+	}
+}
+
+func TestPollerFull(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, ok := poller.(FullPoller)
+	if !ok {
+		t.Fatalf("%T does not implement FullPoller", poller)
+	}
+	if err = full.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollerBackend(t *testing.T) {
+	for _, test := range []struct {
+		backend Backend
+		name    string
+	}{
+		{BackendAuto, ""},
+		{BackendPoll, "poll"},
+	} {
+		t.Run(test.backend.String(), func(t *testing.T) {
+			c := config(t)
+			c.Backend = test.backend
+			poller, err := New(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			name := poller.(fmt.Stringer).String()
+			if test.name != "" && name != test.name {
+				t.Errorf("String() is %q; want %q", name, test.name)
+			}
+			if test.name == "" && (name == "" || name == BackendPoll.String()) {
+				t.Errorf("unexpected String() of default backend: %q", name)
+			}
+		})
+	}
+
+	c := config(t)
+	c.Backend = BackendURing
+	_, err := New(c)
+	var e ErrBackendUnavailable
+	if !errors.As(err, &e) || e.Backend != BackendURing {
+		t.Fatalf("New() error is %v; want ErrBackendUnavailable for %s", err, BackendURing)
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	defer func() {
+		registry.mu.Lock()
+		delete(registry.factories, "fake")
+		registry.mu.Unlock()
+	}()
+
+	var (
+		fake = struct{ Poller }{}
+		cfg  *Config
+	)
+	err := RegisterBackend("fake", func(c *Config) (Poller, error) {
+		cfg = c
+		return fake, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RegisterBackend("fake", func(*Config) (Poller, error) { return nil, nil }); err != ErrBackendRegistered {
+		t.Errorf("duplicate RegisterBackend() error is %v; want %v", err, ErrBackendRegistered)
+	}
+	for _, name := range []string{"", "auto", "epoll", "kqueue", "poll", "io_uring"} {
+		if err = RegisterBackend(name, func(*Config) (Poller, error) { return nil, nil }); err != ErrBackendReserved {
+			t.Errorf("RegisterBackend(%q) error is %v; want %v", name, err, ErrBackendReserved)
+		}
+	}
+
+	p, err := New(&Config{Backend: "fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != fake {
+		t.Errorf("New() returned %#v; want poller of the fake backend", p)
+	}
+	if cfg == nil || cfg.ErrorLog == nil {
+		t.Errorf("factory received config without defaults: %#v", cfg)
+	}
+
+	names := Backends()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("Backends() are not sorted: %v", names)
+	}
+	var has bool
+	for _, name := range names {
+		has = has || name == "fake"
+	}
+	if !has {
+		t.Errorf("Backends() does not contain registered backend: %v", names)
+	}
+}
+
+func TestPollerAutoResume(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	// Poller must be closed before r, because the last automatic resume
+	// could be made after the test reads all data.
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	desc, err := NewDesc(r, EventRead|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		data     = []byte("hello")
+		received = make(chan byte, len(data))
+	)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		if event&EventRead == 0 {
+			return
+		}
+		var b [1]byte
+		if n, _ := unix.Read(r, b[:]); n == 1 {
+			received <- b[0]
+		}
+	}, WithAutoResume())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write data at once. One-shot registration will be resumed after each
+	// single byte read.
+	if _, err = unix.Write(w, data); err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		select {
+		case b := <-received:
+			if b != data[i] {
+				t.Fatalf("received %q at %d; want %q", b, i, data[i])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event received for byte #%d", i)
+		}
+	}
+}
+
+func TestPollerCloseOnHup(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		oneShot bool
+		open    func(t *testing.T) (desc *Desc, peer io.Writer, hangup func())
+	}{
+		{
+			name: "close",
+			open: socketPairDesc,
+		},
+		{
+			name: "reset",
+			open: tcpDesc,
+		},
+		{
+			name:    "oneshot",
+			oneShot: true,
+			open:    socketPairDesc,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			desc, peer, hangup := test.open(t)
+			if test.oneShot {
+				desc.event |= EventOneShot
+			}
+
+			var (
+				events = make(chan Event, 16)
+				closed = make(chan error, 16)
+			)
+			closer := closerFunc(func() error {
+				// Descriptor must be stopped before closing.
+				closed <- poller.Resume(desc)
+				return desc.Close()
+			})
+			err = poller.StartWithOptions(desc, func(event Event) {
+				events <- event
+			}, CloseOnHup(closer))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.oneShot {
+				if _, err := peer.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case event := <-events:
+					if event&EventRead == 0 {
+						t.Fatalf("unexpected event: %s", event)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("no event received")
+				}
+				// Hangup arrives while one-shot registration is disabled.
+				hangup()
+				select {
+				case <-closed:
+					t.Fatal("closed before resume")
+				case <-time.After(50 * time.Millisecond):
+				}
+				if err := poller.Resume(desc); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				hangup()
+			}
+
+			select {
+			case err := <-closed:
+				if err != ErrNotRegistered {
+					t.Fatalf("closed before stop: Resume() error is %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("descriptor was not closed")
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := len(closed); n != 0 {
+				t.Fatalf("closed %d more times", n)
+			}
+			for len(events) > 0 {
+				if event := <-events; event&(EventHup|EventReadHup|EventErr) != 0 {
+					return
+				}
+			}
+			t.Fatal("callback has not received hangup event")
+		})
+	}
+}
+
+func TestDescLastError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		open func(t *testing.T) (*Desc, func())
+		exp  error
+	}{
+		{
+			name: "reset",
+			open: func(t *testing.T) (*Desc, func()) {
+				desc, _, reset := tcpDesc(t)
+				return desc, reset
+			},
+			exp: syscall.ECONNRESET,
+		},
+		{
+			name: "pipe",
+			open: func(t *testing.T) (*Desc, func()) {
+				var p [2]int
+				if err := unix.Pipe(p[:]); err != nil {
+					t.Fatal(err)
+				}
+				desc, err := NewDesc(p[1], EventWrite|EventOneShot, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { desc.Close() })
+				return desc, func() { unix.Close(p[0]) }
+			},
+			exp: nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			poller, err := New(config(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			desc, hangup := test.open(t)
+			hangup()
+
+			done := make(chan Event, 1)
+			err = poller.Start(desc, func(event Event) {
+				if event&(EventErr|EventHup) == 0 {
+					return
+				}
+				poller.Stop(desc)
+				done <- event
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("no error event received")
+			}
+			if err := desc.LastError(); err != test.exp {
+				t.Fatalf("LastError() = %v; want %v", err, test.exp)
+			}
+		})
+	}
+}
+
+func TestDescLastEvent(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	desc, err := NewDesc(r, EventRead|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev, at := desc.LastEvent(); ev != 0 || !at.IsZero() {
+		t.Fatalf("LastEvent() = %s, %s; want zero values", ev, at)
+	}
+
+	events := make(chan Event, 4)
+	err = poller.StartWithOptions(desc, func(event Event) {
+		if event&EventReadHup != 0 {
+			// Make automatic resume fail.
+			poller.Stop(desc)
+		}
+		// Drain the data to not receive EventRead again.
+		var buf [1]byte
+		unix.Read(r, buf[:])
+		events <- event
+	}, WithAutoResume(), WithOnError(func(error) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		name   string
+		action func()
+		exp    Event
+		err    error
+	}{
+		{
+			name:   "write",
+			action: func() { unix.Write(w, []byte("x")) },
+			exp:    EventRead,
+		},
+		{
+			name:   "hangup",
+			action: func() { unix.Shutdown(w, unix.SHUT_WR) },
+			exp:    EventRead | EventReadHup,
+			err:    ErrNotRegistered,
+		},
+	} {
+		begin := time.Now().Truncate(time.Millisecond)
+		step.action()
+
+		var event Event
+		select {
+		case event = <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no event received", step.name)
+		}
+		// Let the auto resume finish.
+		time.Sleep(10 * time.Millisecond)
+
+		ev, at := desc.LastEvent()
+		if ev != event || ev&step.exp != step.exp {
+			t.Errorf("%s: LastEvent() is %s; want %s (callback received %s)", step.name, ev, step.exp, event)
+		}
+		if at.Before(begin) || at.After(time.Now()) {
+			t.Errorf("%s: LastEvent() time %s is out of range", step.name, at)
+		}
+		if err := desc.LastError(); err != step.err {
+			t.Errorf("%s: LastError() is %v; want %v", step.name, err, step.err)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	desc, err := NewDesc(r, EventRead|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Observe(desc, func(Event) {}); err != ErrNotRegistered {
+		t.Fatalf("Observe() before Start() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	var primary, observed int32
+	err = poller.StartWithOptions(desc, func(event Event) {
+		var b [1]byte
+		unix.Read(r, b[:])
+		atomic.AddInt32(&primary, 1)
+	}, WithAutoResume(), WithOnError(func(error) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := Observe(desc, func(event Event) {
+		if event&EventRead != 0 {
+			atomic.AddInt32(&observed, 1)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed registration does not allow to observe the descriptor.
+	dup, err := NewDesc(r, EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Start(dup, func(Event) {}); err == nil {
+		t.Fatalf("Start() of registered file descriptor succeeded")
+	}
+	if _, err = Observe(dup, func(Event) {}); err != ErrNotRegistered {
+		t.Fatalf("Observe() after failed Start() error is %v; want %v", err, ErrNotRegistered)
+	}
+
+	// Add and remove other observers concurrently with events.
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cancel, err := Observe(desc, func(Event) {})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cancel()
+			cancel()
+		}
+	}()
+
+	const n = 256
+	if _, err = unix.Write(w, bytes.Repeat([]byte("x"), n)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&primary) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	if p, o := atomic.LoadInt32(&primary), atomic.LoadInt32(&observed); p != n || o != p {
+		t.Fatalf("callback received %d events and observer %d; want %d", p, o, n)
+	}
+
+	if err = poller.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err = Observe(desc, func(Event) {}); err != ErrNotRegistered {
+		t.Fatalf("Observe() after Stop() error is %v; want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestPollerOnError(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		global bool
+	}{
+		{"option", false},
+		{"global", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			onError := func(err error) {
+				errs <- err
+			}
+
+			cfg := config(t)
+			if test.global {
+				cfg.OnWaitError = onError
+			}
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			r, w, err := socketPair()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unix.Close(r)
+			defer unix.Close(w)
+
+			desc, err := NewDesc(r, EventRead|EventOneShot, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				entered = make(chan struct{})
+				stopped = make(chan struct{})
+			)
+			opts := []StartOption{WithAutoResume()}
+			if !test.global {
+				opts = append(opts, WithOnError(func(err error) {
+					// Must not deadlock: no poller locks are held.
+					poller.Stop(desc)
+					onError(err)
+				}))
+			}
+			err = poller.StartWithOptions(desc, func(event Event) {
+				if event&EventPollerClosed != 0 {
+					return
+				}
+				close(entered)
+				<-stopped
+			}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = unix.Write(w, []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			<-entered
+			// Stop the descriptor while callback is running such that
+			// auto-resume fails.
+			if err = poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			close(stopped)
+
+			select {
+			case err := <-errs:
+				if !errors.Is(err, ErrNotRegistered) {
+					t.Errorf("got error %v; want %v", err, ErrNotRegistered)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no error delivered")
+			}
+		})
+	}
+}
+
+func TestPollerOnIdle(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			idle := make(chan time.Duration, 10)
+			cfg := config(t)
+			cfg.Backend = backend
+			cfg.IdleThreshold = threshold
+			cfg.OnIdle = func(d time.Duration) { idle <- d }
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			// Quiet poller reports idleness once.
+			select {
+			case d := <-idle:
+				if d < threshold {
+					t.Fatalf("OnIdle() received %s; want at least %s", d, threshold)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("OnIdle() was not called")
+			}
+			select {
+			case <-idle:
+				t.Fatalf("OnIdle() called twice within one quiet period")
+			case <-time.After(3 * threshold):
+			}
+
+			desc, peer, _ := socketPairDesc(t)
+			err = poller.Start(desc, func(Event) {
+				unix.Read(desc.fd(), make([]byte, 16))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Trickling traffic keeps poller busy.
+			for i := 0; i < 10; i++ {
+				if _, err = peer.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(threshold / 10)
+			}
+			select {
+			case <-idle:
+				t.Fatalf("OnIdle() called while events are delivered")
+			default:
+			}
+			// Delivered events re-arm the hook.
+			select {
+			case <-idle:
+			case <-time.After(time.Second):
+				t.Fatalf("OnIdle() was not called after traffic stopped")
+			}
+			if err = poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPollerCloseOrder(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		for _, reverse := range []bool{false, true} {
+			name := fmt.Sprintf("%s/reverse=%t", backend, reverse)
+			t.Run(name, func(t *testing.T) {
+				cfg := config(t)
+				cfg.Backend = backend
+				cfg.ReverseCloseOrder = reverse
+				poller, err := New(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if poller.(fmt.Stringer).String() == BackendKqueue.String() {
+					poller.(Closer).Close()
+					t.Skip("kqueue poller does not notify descriptors on Close()")
+				}
+
+				const n = 10
+				var (
+					mu    sync.Mutex
+					order []int
+					descs = make([]*Desc, n)
+				)
+				start := func(i int) {
+					err := poller.Start(descs[i], func(event Event) {
+						if event&EventPollerClosed != 0 {
+							mu.Lock()
+							order = append(order, i)
+							mu.Unlock()
+						}
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				for i := range descs {
+					descs[i], _, _ = socketPairDesc(t)
+					start(i)
+				}
+				// Restarted descriptors are moved to the end, stopped ones
+				// are not notified.
+				for _, i := range []int{0, 4, 9} {
+					if err = poller.Stop(descs[i]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				start(4)
+				exp := []int{1, 2, 3, 5, 6, 7, 8, 4}
+				if reverse {
+					exp = []int{4, 8, 7, 6, 5, 3, 2, 1}
+				}
+
+				if err = poller.(Closer).Close(); err != nil {
+					t.Fatal(err)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if fmt.Sprint(order) != fmt.Sprint(exp) {
+					t.Fatalf("descriptors are notified in order %v; want %v", order, exp)
+				}
+			})
+		}
+	}
+}
+
+func TestPollerStartPaused(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kqueue := poller.(fmt.Stringer).String() == BackendKqueue.String()
+
+			events := make(chan Event, 16)
+			cb := func(ev Event) { events <- ev }
+			noEvents := func(name string) {
+				t.Helper()
+				select {
+				case ev := <-events:
+					t.Fatalf("%s: unexpected %s", name, ev)
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+
+			// Descriptor is readable and writable before it is started.
+			desc, peer, _ := socketPairDesc(t)
+			if err := desc.Update(EventRead | EventWrite | EventOneShot); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := peer.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := StartPaused(poller, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			if err := StartPaused(poller, desc, cb); err != ErrRegistered {
+				t.Errorf("repeated StartPaused() error is %v; want %v", err, ErrRegistered)
+			}
+			noEvents("paused")
+			if err := poller.Resume(desc); err != nil {
+				t.Fatal(err)
+			}
+			var got Event
+			for timeout := time.After(time.Second); got&(EventRead|EventWrite) != EventRead|EventWrite; {
+				select {
+				case ev := <-events:
+					got |= ev
+				case <-timeout:
+					t.Fatalf("received %s after Resume(); want %s", got, EventRead|EventWrite)
+				}
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+
+			// Paused descriptor could be stopped and started again, also by
+			// a wrapper which does not implement PausedStarter.
+			if err := StartPaused(struct{ Poller }{poller}, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			noEvents("stopped")
+			if err := StartPaused(poller, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := poller.(Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+			if kqueue {
+				t.Skip("kqueue poller does not notify descriptors on Close()")
+			}
+			select {
+			case ev := <-events:
+				if ev != EventPollerClosed {
+					t.Errorf("paused descriptor received %s on Close(); want %s", ev, Event(EventPollerClosed))
+				}
+			case <-time.After(time.Second):
+				t.Errorf("paused descriptor is not notified on Close()")
+			}
+		})
+	}
+}
+
+func TestPollerStartLazy(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Descriptor stays readable, so events are dropped when the
+			// channel is full.
+			events := make(chan Event, 16)
+			cb := func(ev Event) {
+				select {
+				case events <- ev:
+				default:
+				}
+			}
+
+			desc, peer, _ := socketPairDesc(t)
+			if _, err := peer.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := StartLazy(poller, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			if !desc.Pending() {
+				t.Errorf("Pending() is false before Arm()")
+			}
+			select {
+			case ev := <-events:
+				t.Fatalf("unexpected %s before Arm()", ev)
+			case <-time.After(50 * time.Millisecond):
+			}
+			for i := 0; i < 2; i++ {
+				if err := desc.Arm(); err != nil {
+					t.Fatalf("Arm() #%d error: %v", i, err)
+				}
+			}
+			select {
+			case ev := <-events:
+				if ev&EventRead == 0 {
+					t.Fatalf("received %s after Arm(); want %s", ev, EventRead)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no events after Arm()")
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+
+			// Stop() before Arm() cancels the registration.
+			if err := StartLazy(poller, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			if desc.Pending() {
+				t.Errorf("Pending() is true after Stop()")
+			}
+			if err := desc.Arm(); err != ErrNotRegistered {
+				t.Errorf("Arm() after Stop() error is %v; want %v", err, ErrNotRegistered)
+			}
+			if err := poller.Stop(desc); err != ErrNotRegistered {
+				t.Errorf("repeated Stop() error is %v; want %v", err, ErrNotRegistered)
+			}
+
+			// Errors of the registration are returned by Arm().
+			if err := StartLazy(poller, desc, cb); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.(Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := desc.Arm(); err != ErrClosed {
+				t.Errorf("Arm() after Close() error is %v; want %v", err, ErrClosed)
+			}
+		})
+	}
+}
+
+func TestPollerMaxDescriptors(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			const max = 3
+			cfg := config(t)
+			cfg.Backend = backend
+			cfg.MaxDescriptors = max
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			descs := make([]*Desc, max+1)
+			for i := range descs {
+				descs[i], _, _ = socketPairDesc(t)
+			}
+			for _, desc := range descs[:max] {
+				if err := poller.Start(desc, func(Event) {}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := poller.Start(descs[max], func(Event) {}); err != ErrTooManyDescriptors {
+				t.Fatalf("Start() above the limit error is %v; want %v", err, ErrTooManyDescriptors)
+			}
+			if err := poller.Start(descs[0], func(Event) {}); err != ErrRegistered {
+				t.Fatalf("Start() of registered descriptor error is %v; want %v", err, ErrRegistered)
+			}
+
+			if err := poller.Stop(descs[0]); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.Start(descs[max], func(Event) {}); err != nil {
+				t.Fatalf("Start() after Stop() error is %v", err)
+			}
+		})
+	}
+}
+
+func TestPollerSoftLimit(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			// Threshold is 20 descriptors, band is 2: warning is repeated
+			// only after occupancy drops to 17.
+			const max = 40
+			var calls [][2]int
+			cfg := config(t)
+			cfg.Backend = backend
+			cfg.MaxDescriptors = max
+			cfg.SoftLimit = 0.5
+			cfg.OnSoftLimit = func(current, max int) {
+				calls = append(calls, [2]int{current, max})
+			}
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			descs := make([]*Desc, 20)
+			for i := range descs {
+				descs[i], _, _ = socketPairDesc(t)
+			}
+			start := func(desc *Desc) {
+				if err := poller.Start(desc, func(Event) {}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stop := func(desc *Desc) {
+				if err := poller.Stop(desc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expect := func(n int) {
+				t.Helper()
+				if len(calls) != n {
+					t.Fatalf("OnSoftLimit() is called %d times; want %d", len(calls), n)
+				}
+			}
+
+			for _, desc := range descs[:19] {
+				start(desc)
+			}
+			expect(0)
+			start(descs[19])
+			expect(1)
+			if calls[0] != [2]int{20, max} {
+				t.Fatalf("OnSoftLimit() arguments are %v; want %v", calls[0], [2]int{20, max})
+			}
+
+			// Occupancy around the threshold does not repeat the warning.
+			for i := 0; i < 10; i++ {
+				stop(descs[19])
+				stop(descs[18])
+				start(descs[18])
+				start(descs[19])
+			}
+			expect(1)
+
+			// Leaving the band rearms it.
+			for i := 0; i < 5; i++ {
+				stop(descs[19])
+				stop(descs[18])
+				stop(descs[17])
+				start(descs[17])
+				start(descs[18])
+				expect(i + 1)
+				start(descs[19])
+				expect(i + 2)
+			}
+		})
+	}
+}
+
+func TestPollerName(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			var names []string
+			for i := 0; i < 2; i++ {
+				poller, err := New(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer poller.(Closer).Close()
+				names = append(names, poller.(Namer).Name())
+			}
+			if names[0] == "" || names[0] == names[1] {
+				t.Errorf("generated names are %q; want unique non-empty ones", names)
+			}
+
+			cfg.Name = "ingress-0"
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+			if act := poller.(Namer).Name(); act != cfg.Name {
+				t.Fatalf("Name() is %q; want %q", act, cfg.Name)
+			}
+			if poller.(fmt.Stringer).String() != BackendEpoll.String() {
+				// Only epoll rejects regular files.
+				return
+			}
+
+			f, err := ioutil.TempFile("", "netpoll")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			desc, err := HandleFile(f, EventRead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer desc.Close()
+
+			err = poller.Start(desc, func(Event) {})
+			if !errors.Is(err, ErrNotPollable) {
+				t.Fatalf("Start() error is %v; want %v", err, ErrNotPollable)
+			}
+			prefix := fmt.Sprintf("netpoll[ingress-0]: start fd=%d: ", desc.Fd())
+			if !strings.HasPrefix(err.Error(), prefix) {
+				t.Errorf("error message is %q; want it to start with %q", err, prefix)
+			}
+			var pe *PollerError
+			if !errors.As(err, &pe) || pe.Poller != cfg.Name || pe.Op != "start" {
+				t.Errorf("errors.As() gives %+v; want PollerError of %q start", pe, cfg.Name)
+			}
+		})
+	}
+}
+
+func TestPollerPause(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+			pauser := poller.(Pauser)
+
+			desc, peer, _ := socketPairDesc(t)
+			events := make(chan Event, 16)
+			// Level-triggered events are reported until Stop(), so the extra
+			// ones are dropped.
+			err = poller.Start(desc, func(ev Event) {
+				select {
+				case events <- ev:
+				default:
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := pauser.Pause(desc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Data received during the pause is reported by level-triggered
+			// descriptor after Unpause().
+			if _, err := peer.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.Resume(desc); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case ev := <-events:
+				t.Fatalf("received %s while paused", ev)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if err := pauser.Unpause(desc); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case ev := <-events:
+				if ev&EventRead == 0 {
+					t.Errorf("received %s after Unpause(); want %s", ev, EventRead)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no events after Unpause()")
+			}
+			if err := pauser.Unpause(desc); err != nil {
+				t.Errorf("Unpause() of not paused descriptor error is %v; want nil", err)
+			}
+			if err := poller.Stop(desc); err != nil {
+				t.Fatal(err)
+			}
+			if err := pauser.Pause(desc); err != ErrNotRegistered {
+				t.Errorf("Pause() of stopped descriptor error is %v; want %v", err, ErrNotRegistered)
+			}
+		})
+	}
+}
+
+// TestPollerPauseAutoResume checks that Resume() made by WithAutoResume()
+// concurrently with Pause() and Unpause() does not lose the pause.
+func TestPollerPauseAutoResume(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+			pauser := poller.(Pauser)
+
+			// Data is never read, so each resume leads to the next event.
+			desc, peer, _ := socketPairDesc(t)
+			if err := desc.Update(EventRead | EventOneShot); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := peer.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan Event, 16)
+			err = poller.StartWithOptions(desc, func(ev Event) {
+				select {
+				case events <- ev:
+				default:
+				}
+			}, WithAutoResume())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 200; i++ {
+				if err := pauser.Pause(desc); err != nil {
+					t.Fatal(err)
+				}
+				if err := pauser.Unpause(desc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := pauser.Pause(desc); err != nil {
+				t.Fatal(err)
+			}
+
+			// Callback called before Pause() could still be running.
+			time.Sleep(20 * time.Millisecond)
+			for len(events) > 0 {
+				<-events
+			}
+			select {
+			case ev := <-events:
+				t.Fatalf("received %s while paused", ev)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if err := pauser.Unpause(desc); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-events:
+			case <-time.After(time.Second):
+				t.Fatalf("no events after Unpause()")
+			}
+		})
+	}
+}
+
+func TestPollerDescEvent(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer poller.(Closer).Close()
+
+			desc, peer, _ := socketPairDesc(t)
+			events := make(chan Event, 16)
+			cb := func(ev Event) {
+				if ev&EventPollerClosed == 0 {
+					events <- ev
+				}
+			}
+			// Peer data is never read, so the descriptor is both readable
+			// and writable since the first step. Every step checks that only
+			// the events of the Desc mask are fired.
+			var step string
+			expect := func(want Event) {
+				t.Helper()
+				if act := desc.Event(); act != want|EventOneShot {
+					t.Fatalf("%s: Event() is %s; want %s", step, act, want|EventOneShot)
+				}
+				var got Event
+				timeout := time.After(time.Second)
+				for got != want {
+					select {
+					case ev := <-events:
+						got |= ev & (EventRead | EventWrite)
+						if got&^want != 0 {
+							t.Fatalf("%s: received %s; want %s", step, got, want)
+						}
+					case <-timeout:
+						t.Fatalf("%s: received %s; want %s", step, got, want)
+					}
+				}
+				select {
+				case ev := <-events:
+					t.Fatalf("%s: unexpected %s after %s", step, ev, want)
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+			do := func(name string, err error) {
+				t.Helper()
+				step = name
+				if err != nil {
+					t.Fatalf("%s: %v", step, err)
+				}
+			}
+			if _, err := peer.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+
+			do("Update(read)", desc.Update(EventRead|EventOneShot))
+			do("Start", poller.Start(desc, cb))
+			expect(EventRead)
+			do("Update(write)", desc.Update(EventWrite|EventOneShot))
+			do("Resume", poller.Resume(desc))
+			expect(EventWrite)
+			do("Update(read)", desc.Update(EventRead|EventOneShot))
+			do("Resume", poller.Resume(desc))
+			expect(EventRead)
+			if err := desc.Update(EventRead); err != ErrRegistered {
+				t.Errorf("Update() of behavior of started desc error is %v; want %v", err, ErrRegistered)
+			}
+			do("Resume", poller.Resume(desc))
+			expect(EventRead)
+			do("Stop", poller.Stop(desc))
+			do("Update(write)", desc.Update(EventWrite|EventOneShot))
+			do("Start", poller.Start(desc, cb))
+			expect(EventWrite)
+			do("Stop", poller.Stop(desc))
+			do("Update(read|write)", desc.Update(EventRead|EventWrite|EventOneShot))
+			do("Start", poller.Start(desc, cb))
+			expect(EventRead | EventWrite)
+			do("Stop", poller.Stop(desc))
+
+			if err := desc.Update(EventOneShot); err != ErrInvalidEvent {
+				t.Errorf("Update() with no events error is %v; want %v", err, ErrInvalidEvent)
+			}
+			desc.event = EventOneShot
+			if err := poller.Start(desc, cb); err != ErrInvalidEvent {
+				t.Errorf("Start() with invalid mask error is %v; want %v", err, ErrInvalidEvent)
+			}
+		})
+	}
+}
+
+func TestPollerCloseCallback(t *testing.T) {
+	for _, backend := range []Backend{BackendAuto, BackendPoll} {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if poller.(fmt.Stringer).String() == BackendKqueue.String() {
+				poller.(Closer).Close()
+				t.Skip("kqueue poller does not notify descriptors on Close()")
+			}
+
+			desc, _, _ := socketPairDesc(t)
+			other, _, _ := socketPairDesc(t)
+			nop := func(Event) {}
+			calls := []struct {
+				name string
+				fn   func() error
+			}{
+				{"Stop", func() error { return poller.Stop(desc) }},
+				{"Resume", func() error { return poller.Resume(desc) }},
+				{"Start", func() error { return poller.Start(other, nop) }},
+				{"StartWithOptions", func() error {
+					return poller.StartWithOptions(other, nop, WithAutoResume())
+				}},
+				{"StartDuplex", func() error { return poller.StartDuplex(other, nop, nop) }},
+				{"StartCtxFn", func() error {
+					return poller.StartCtxFn(other, context.Background(), func(context.Context, Event) {})
+				}},
+				{"StartHandler", func() error { return StartHandler(poller, other, chanHandler(nil)) }},
+				{"StartHandler(registered)", func() error { return StartHandler(poller, desc, chanHandler(nil)) }},
+				{"Close", func() error { return poller.(Closer).Close() }},
+				{"Desc.Close", func() error { return desc.Close() }},
+				// Descriptor is closed and invalid at this point.
+				{"Stop(closed)", func() error { return poller.Stop(desc) }},
+				{"Resume(closed)", func() error { return poller.Resume(desc) }},
+			}
+			errs := make(chan []error, 1)
+			err = poller.Start(desc, func(event Event) {
+				if event&EventPollerClosed == 0 {
+					return
+				}
+				var res []error
+				for _, call := range calls {
+					res = append(res, call.fn())
+				}
+				errs <- res
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- poller.(Closer).Close() }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Close() is blocked by the callback")
+			}
+			res := <-errs
+			for i, call := range calls {
+				exp := ErrClosed
+				if call.name == "Desc.Close" {
+					exp = nil
+				}
+				if res[i] != exp {
+					t.Errorf("%s() within close callback error is %v; want %v", call.name, res[i], exp)
+				}
+			}
+		})
+	}
+}
+
+func TestPollerUnsupportedOption(t *testing.T) {
+	poller, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(Closer).Close()
+
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(r)
+	defer unix.Close(w)
+
+	desc, err := NewDesc(r, EventRead|EventOneShot, false)
 	if err != nil {
-		t.Fatalf("get SO_SNDLOWAT error: %v", err)
+		t.Fatal(err)
 	}
-	sendBuf, err := unix.GetsockoptInt(w, unix.SOL_SOCKET, unix.SO_SNDBUF)
-	if err != nil {
-		t.Fatalf("get SO_SNDBUF error: %v", err)
+	err = poller.StartWithOptions(desc, func(Event) {}, WithAutoResume(), WithExclusive())
+	if err != ErrUnsupportedOption {
+		t.Errorf("StartWithOptions() error is %v; want %v", err, ErrUnsupportedOption)
 	}
+	// Descriptor must not be registered after failure.
+	if err = poller.Start(desc, func(Event) {}); err != nil {
+		t.Errorf("Start() after failed StartWithOptions() error: %v", err)
+	}
+}
 
-	log.Printf("send buf is %d", sendBuf)
-	log.Printf("send low watermark is %d", sendLoWat)
+func TestDefaultPoller(t *testing.T) {
+	resetDefault(t)
 
-	filled, err := fillSendBuffer(w)
-	if err != nil {
-		t.Fatalf("fill send buffer error: %v", err)
+	// Lazy initialization.
+	desc, _, _ := socketPairDesc(t)
+	if err := Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
 	}
-	log.Printf("filled send buffer: %d", filled)
+	p := Default()
+	if p == nil {
+		t.Fatalf("default poller is not initialized by Start()")
+	}
+	defer p.(Closer).Close()
+	if err := Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := Resume(desc); err != ErrNotRegistered {
+		t.Fatalf("Resume() of stopped descriptor error is %v; want %v", err, ErrNotRegistered)
+	}
+	if err := Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(desc); err != nil {
+		t.Fatalf("descriptor is not started in Default() poller: %v", err)
+	}
+}
 
-	var (
-		writeEvents = new(uint32)
-		writeHup    = new(uint32)
-	)
+func TestSetDefault(t *testing.T) {
+	resetDefault(t)
 
-	wc, err := net.FileConn(os.NewFile(uintptr(w), "w"))
+	poller, err := New(config(t))
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer poller.(Closer).Close()
+	if err := SetDefault(poller); err != nil {
+		t.Fatal(err)
+	}
+	if !samePoller(Default(), poller) {
+		t.Fatalf("Default() is not the poller passed to SetDefault()")
+	}
+	other, err := New(config(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.(Closer).Close()
+	if err := SetDefault(other); err != ErrDefaultInitialized {
+		t.Fatalf("second SetDefault() error is %v; want %v", err, ErrDefaultInitialized)
+	}
+	if !samePoller(Default(), poller) {
+		t.Fatalf("Default() is replaced by failed SetDefault()")
+	}
 
-	desc := Must(HandleWriteOnce(wc))
-	err = poller.Start(desc, func(e Event) {
-		log.Printf("received event from poller: %s", e)
-		atomic.AddUint32(writeEvents, 1)
-
-		if e&EventHup != 0 {
-			atomic.AddUint32(writeHup, 1)
-			return
-		}
-		if e&EventErr != 0 {
-			return
-		}
+	// SetDefault() after lazy creation.
+	defaultPoller = defaultState{}
+	desc, _, _ := socketPairDesc(t)
+	if err := Start(desc, func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	created := Default()
+	defer created.(Closer).Close()
+	if err := SetDefault(poller); err != ErrDefaultInitialized {
+		t.Fatalf("SetDefault() after Start() error is %v; want %v", err, ErrDefaultInitialized)
+	}
+	if err := created.Stop(desc); err != nil {
+		t.Fatalf("descriptor is not started in created default poller: %v", err)
+	}
+}
 
-		filled, err := fillSendBuffer(w)
-		if err != nil {
-			t.Fatalf("fill send buffer error: %v", err)
-		}
-		log.Printf("filled send buffer: %d", filled)
+func TestDefaultConcurrent(t *testing.T) {
+	resetDefault(t)
 
-		if err := poller.Resume(desc); err != nil {
-			t.Fatalf("poller.Resume() error %v", err)
+	const n = 16
+	var (
+		wg      sync.WaitGroup
+		pollers = make([]Poller, n)
+	)
+	for i := range pollers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pollers[i] = Default()
+		}(i)
+	}
+	wg.Wait()
+	if pollers[0] == nil {
+		t.Fatal("Default() is nil")
+	}
+	defer pollers[0].(Closer).Close()
+	for i, p := range pollers {
+		if !samePoller(p, pollers[0]) {
+			t.Fatalf("Default() #%d returned another poller", i)
 		}
-	})
-	if err != nil {
-		t.Fatalf("poller.Start(w) error: %v", err)
 	}
+}
 
-	// Read sendLoWat-1 bytes such that next read will trigger write event.
-	if n, err := unix.Read(r, make([]byte, sendLoWat-1)); err != nil {
-		t.Fatalf("unix.Read() error: %v", err)
-	} else {
-		log.Printf("read %d (from %d: SNDLOWAT-1)", n, sendLoWat-1)
-	}
+// resetDefault makes the default poller uninitialized for the test.
+func resetDefault(t *testing.T) {
+	defaultPoller = defaultState{}
+	t.Cleanup(func() { defaultPoller = defaultState{} })
+}
 
-	time.Sleep(time.Millisecond * 50)
-	if n := atomic.LoadUint32(writeEvents); n > 0 {
-		t.Fatalf("write events: %v; want 0", n)
+// samePoller compares pollers returned by New() by their unique names, since
+// some of them are not comparable.
+func samePoller(a, b Poller) bool {
+	return a.(Namer).Name() == b.(Namer).Name()
+}
+
+func TestIsTemporaryError(t *testing.T) {
+	for _, test := range []struct {
+		err error
+		exp bool
+	}{
+		{unix.EINTR, true},
+		{unix.EAGAIN, true},
+		{unix.ECONNRESET, true},
+		{unix.ECONNABORTED, true},
+		{os.NewSyscallError("accept", unix.ECONNABORTED), true},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", unix.EMFILE)}, true},
+		{unix.EBADF, false},
+		{os.NewSyscallError("epoll_wait", unix.EINVAL), false},
+		{ErrClosed, false},
+		{nil, false},
+	} {
+		if act := IsTemporaryError(test.err); act != test.exp {
+			t.Errorf("IsTemporaryError(%v) = %t; want %t", test.err, act, test.exp)
+		}
 	}
+}
 
-	if n, err := unix.Read(r, make([]byte, filled)); err != nil {
-		t.Fatalf("empty receive buffer error: %v", err)
-	} else {
-		log.Printf("emptied receive buffer: %d", n)
+func TestLogRecord(t *testing.T) {
+	var logger testLogger
+	logRecord(&logger, LogRecord{
+		Level:   LevelDebug,
+		Message: "debug message",
+		FD:      -1,
+	})
+	logRecord(&logger, LogRecord{
+		Level:   LevelError,
+		Message: "wait loop error",
+		FD:      -1,
+		Err:     fmt.Errorf("test error"),
+	})
+
+	msgs := logger.messages()
+	if n := len(msgs); n != 1 {
+		t.Fatalf("logged %d messages; want 1", n)
 	}
-	time.Sleep(time.Millisecond * 50)
-	if n := atomic.LoadUint32(writeEvents); n != 1 {
-		t.Errorf("write events: %v; want 1", n)
+	if act, exp := msgs[0], "netpoll: wait loop error: test error"; act != exp {
+		t.Errorf("logged %q; want %q", act, exp)
 	}
 
-	if err := unix.Close(r); err != nil {
-		t.Fatalf("unix.Close() error: %v", err)
+	logRecord(&logger, LogRecord{
+		Level:   LevelError,
+		Message: "wait loop error",
+		Poller:  "ingress-0",
+		FD:      -1,
+		Err:     fmt.Errorf("test error"),
+	})
+	msgs = logger.messages()
+	if act, exp := msgs[len(msgs)-1], "netpoll[ingress-0]: wait loop error: test error"; act != exp {
+		t.Errorf("logged %q; want %q", act, exp)
 	}
-	log.Println("closed read-end of pair")
-	time.Sleep(time.Millisecond * 50)
-	if n := atomic.LoadUint32(writeHup); n != 1 {
-		t.Errorf("hup events: %v; want 1", n)
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0))
+	l.Printf("hello, %s", "logger")
+	if act, exp := buf.String(), "hello, logger\n"; act != exp {
+		t.Errorf("logged %q; want %q", act, exp)
 	}
 }
 
@@ -272,6 +3613,268 @@ func socketPair() (r, w int, err error) {
 	return fd[0], fd[1], nil
 }
 
+func TestPollerCloseReleasesCallbacks(t *testing.T) {
+	for _, backend := range builtinBackends {
+		t.Run(backend.String(), func(t *testing.T) {
+			cfg := config(t)
+			cfg.Backend = backend
+			poller, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if backend == BackendKqueue {
+				poller.(Closer).Close()
+				t.Skip("kqueue poller does not release registrations on Close()")
+			}
+
+			// Each registration holds a sentinel which is referenced only by
+			// the callback or the handler, and the descriptor which is not
+			// referenced by the test after registration.
+			const n = 9
+			var (
+				released int32
+				fired    = make(chan struct{}, n)
+				pipes    = openPipes(t, n)
+			)
+			finalize := func(interface{}) {
+				atomic.AddInt32(&released, 1)
+			}
+			for i, pipe := range pipes {
+				desc, err := NewDesc(pipe[0], EventRead|EventOneShot, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := &sentinel{}
+				runtime.SetFinalizer(s, finalize)
+				runtime.SetFinalizer(desc, finalize)
+				cb := func(event Event) {
+					s.events |= event
+					if event&EventPollerClosed == 0 {
+						fired <- struct{}{}
+					}
+				}
+				switch i % 3 {
+				case 0:
+					err = poller.Start(desc, cb)
+				case 1:
+					err = StartPaused(poller, desc, cb)
+				case 2:
+					err = StartHandler(poller, desc, s)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Registration which received an event is released too.
+			if _, err := unix.Write(pipes[0][1], []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+			<-fired
+
+			if err := poller.(Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := poller.(Idler).WaitIdle(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&released) < 2*n; {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d of %d sentinels and descriptors are released after Close()", atomic.LoadInt32(&released), 2*n)
+				}
+				runtime.GC()
+				time.Sleep(time.Millisecond)
+			}
+			// Poller itself is still reachable.
+			runtime.KeepAlive(poller)
+		})
+	}
+}
+
+// sentinel is an object referenced only by a poller registration.
+type sentinel struct {
+	events Event
+	// pad keeps sentinel out of the tiny allocator, which delays
+	// finalizers.
+	pad [16]byte
+}
+
+func (s *sentinel) HandleEvent(event Event) {
+	s.events |= event
+}
+
+func TestWaitForEvent(t *testing.T) {
+	type result struct {
+		ev  Event
+		err error
+	}
+	wait := func(p Poller, desc *Desc, timeout time.Duration) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			ev, err := WaitForEvent(p, desc, EventRead, timeout)
+			ch <- result{ev, err}
+		}()
+		return ch
+	}
+	newPoller := func(t *testing.T) Poller {
+		poller, err := New(config(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { poller.(Closer).Close() })
+		return poller
+	}
+
+	t.Run("event", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, peer, _ := socketPairDesc(t)
+		res := wait(poller, desc, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := peer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		r := <-res
+		if r.err != nil || r.ev&EventRead == 0 {
+			t.Fatalf("WaitForEvent() = %v, %v; want EventRead", r.ev, r.err)
+		}
+		// Временная регистрация должна быть снята.
+		if err := poller.Stop(desc); err != ErrNotRegistered {
+			t.Errorf("Stop() after WaitForEvent() = %v; want %v", err, ErrNotRegistered)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, _, _ := socketPairDesc(t)
+		r := <-wait(poller, desc, 10*time.Millisecond)
+		if r.err != ErrWaitTimeout {
+			t.Fatalf("WaitForEvent() = %v, %v; want %v", r.ev, r.err, ErrWaitTimeout)
+		}
+		if err := poller.Stop(desc); err != ErrNotRegistered {
+			t.Errorf("Stop() after WaitForEvent() = %v; want %v", err, ErrNotRegistered)
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, _, _ := socketPairDesc(t)
+		res := wait(poller, desc, 0)
+		time.Sleep(10 * time.Millisecond)
+		if err := poller.(Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-res:
+			if r.err != ErrClosed {
+				t.Fatalf("WaitForEvent() = %v, %v; want %v", r.ev, r.err, ErrClosed)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WaitForEvent() is not woken by Close()")
+		}
+	})
+	t.Run("same desc", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, peer, _ := socketPairDesc(t)
+		a := wait(poller, desc, time.Second)
+		b := wait(poller, desc, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := peer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range []chan result{a, b} {
+			if r := <-res; r.err != nil {
+				t.Fatalf("WaitForEvent() = %v, %v; want EventRead", r.ev, r.err)
+			}
+		}
+	})
+	t.Run("different descs", func(t *testing.T) {
+		poller := newPoller(t)
+		d1, _, _ := socketPairDesc(t)
+		d2, peer, _ := socketPairDesc(t)
+		a := wait(poller, d1, 50*time.Millisecond)
+		b := wait(poller, d2, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := peer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-b; r.err != nil {
+			t.Fatalf("WaitForEvent(d2) = %v, %v; want EventRead", r.ev, r.err)
+		}
+		if r := <-a; r.err != ErrWaitTimeout {
+			t.Fatalf("WaitForEvent(d1) = %v, %v; want %v", r.ev, r.err, ErrWaitTimeout)
+		}
+	})
+	t.Run("started", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, peer, _ := socketPairDesc(t)
+		calls := make(chan Event, 16)
+		if err := poller.Start(desc, func(ev Event) {
+			select {
+			case calls <- ev:
+			default:
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		res := wait(poller, desc, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := peer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-res; r.err != nil {
+			t.Fatalf("WaitForEvent() = %v, %v; want EventRead", r.ev, r.err)
+		}
+		if ev := <-calls; ev&EventRead == 0 {
+			t.Errorf("callback received %v; want EventRead", ev)
+		}
+		// Регистрация приложения остается на месте.
+		if err := poller.Stop(desc); err != nil {
+			t.Errorf("Stop() after WaitForEvent() = %v; want nil", err)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		poller := newPoller(t)
+		desc, _, _ := socketPairDesc(t)
+		if _, err := WaitForEvent(poller, desc, EventWrite, time.Second); err != ErrInvalidEvent {
+			t.Errorf("WaitForEvent(EventWrite) = %v; want %v", err, ErrInvalidEvent)
+		}
+		if _, err := WaitForEvent(poller, desc, 0, time.Second); err != ErrInvalidEvent {
+			t.Errorf("WaitForEvent(0) = %v; want %v", err, ErrInvalidEvent)
+		}
+		// Ненужное событие сняло бы одноразовую временную регистрацию.
+		if err := desc.Update(EventRead | EventOneShot); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := WaitForEvent(poller, desc, EventRead, time.Second); err != ErrInvalidEvent {
+			t.Errorf("WaitForEvent(one-shot) = %v; want %v", err, ErrInvalidEvent)
+		}
+	})
+	t.Run("repeated", func(t *testing.T) {
+		// Новые вызовы дожидаются снятия временной регистрации последним
+		// ожидающим, а не присоединяются к ней как к регистрации приложения.
+		poller := newPoller(t)
+		desc, _, _ := socketPairDesc(t)
+		const n = 4
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				for j := 0; j < 50; j++ {
+					if _, err := WaitForEvent(poller, desc, EventRead, time.Millisecond); err != ErrWaitTimeout {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("WaitForEvent() error is %v; want %v", err, ErrWaitTimeout)
+			}
+		}
+		if err := poller.Stop(desc); err != ErrNotRegistered {
+			t.Errorf("Stop() after WaitForEvent() = %v; want %v", err, ErrNotRegistered)
+		}
+	})
+}
+
 func config(tb testing.TB) *Config {
 	return &Config{
 		OnWaitError: func(err error) {
@@ -280,6 +3883,172 @@ func config(tb testing.TB) *Config {
 	}
 }
 
+// socketPairDesc returns owned descriptor of one end of the socket pair.
+// Hangup closes the other end.
+func socketPairDesc(t *testing.T) (*Desc, io.Writer, func()) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := NewDesc(r, EventRead, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := os.NewFile(uintptr(w), "w")
+	t.Cleanup(func() {
+		desc.Close()
+		peer.Close()
+	})
+	return desc, peer, func() { peer.Close() }
+}
+
+// tcpDesc returns descriptor of accepted tcp connection.
+// Hangup resets the connection from the client side.
+func tcpDesc(t *testing.T) (*Desc, io.Writer, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	desc, err := HandleRead(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		desc.Close()
+		client.Close()
+	})
+	return desc, client, func() {
+		client.(*net.TCPConn).SetLinger(0)
+		client.Close()
+	}
+}
+
+// tcpConnPair returns connected pair of tcp connections.
+func tcpConnPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return client, conn
+}
+
+// fileConnPair returns connection made from one end of the socket pair and
+// the file of the other end.
+func fileConnPair(t *testing.T) (net.Conn, *os.File) {
+	r, w, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(r), "r")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := os.NewFile(uintptr(w), "w")
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+// syscallOnlyConn is a connection which implements syscall.Conn, but not
+// File().
+type syscallOnlyConn struct {
+	stubConn
+	syscall.Conn
+}
+
+// unwrapConn is a connection wrapper implementing Unwrapper.
+type unwrapConn struct {
+	net.Conn
+}
+
+func (c unwrapConn) Unwrap() net.Conn { return c.Conn }
+
+// filerConn is a connection wrapper implementing Filer.
+type filerConn struct {
+	*net.UnixConn
+	fd  int
+	err error
+}
+
+func (c filerConn) NetpollFd() (int, error) { return c.fd, c.err }
+
+// testTLSConfig returns server config with self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "netpoll"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+}
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error { return fn() }
+
+// testLogger is a Logger which records all messages.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
 type stubConn struct{}
 
 func (s stubConn) Read(b []byte) (n int, err error)   { return 0, nil }
@@ -0,0 +1,32 @@
+// +build wasip1
+
+package netpoll
+
+// New creates new poll_oneoff-based Poller instance with given config.
+// Backends added by RegisterBackend() are created by their factories.
+// Returned Poller implements FullPoller.
+//
+// Note that descriptors of net.Conn could not be duplicated on wasip1, so
+// Handle() fails for them; NewDesc() could be used with descriptors obtained
+// by other means instead.
+func New(c *Config) (Poller, error) {
+	cfg := c.withDefaults()
+	if p, ok, err := registered(cfg); ok {
+		return p, err
+	}
+
+	switch cfg.Backend {
+	case BackendAuto, BackendPollOneoff:
+	default:
+		return nil, ErrBackendUnavailable{cfg.Backend}
+	}
+	return newWasiPoller(cfg), nil
+}
+
+// builtinBackends are names of built-in backends available on current
+// operating system.
+var builtinBackends = []Backend{BackendPollOneoff}
+
+// hupOnReadEOF is true, because EventHup is set for any hangup flag reported
+// by poll_oneoff.
+const hupOnReadEOF = true
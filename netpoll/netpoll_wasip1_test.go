@@ -0,0 +1,102 @@
+// +build wasip1
+
+package netpoll
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+)
+
+// Tests in this file could be run with a WASI runtime, e.g.:
+//
+//	GOOS=wasip1 GOARCH=wasm go test -exec wasmtime
+
+func TestWasiLayout(t *testing.T) {
+	if n := unsafe.Sizeof(wasiSubscription{}); n != 48 {
+		t.Errorf("size of subscription is %d; want 48", n)
+	}
+	if n := unsafe.Sizeof(wasiEvent{}); n != 32 {
+		t.Errorf("size of event is %d; want 32", n)
+	}
+	if n := unsafe.Offsetof(wasiEvent{}.flags); n != 24 {
+		t.Errorf("offset of event flags is %d; want 24", n)
+	}
+
+	var s wasiSubscription
+	s.setFd(42, wasiEventtypeFdWrite, 7)
+	if s.userdata != 42 || s.u[0] != wasiEventtypeFdWrite || s.u[1] != 7 {
+		t.Errorf("unexpected fd subscription: %+v", s)
+	}
+}
+
+func TestFromWasiEvent(t *testing.T) {
+	for _, test := range []struct {
+		ev  wasiEvent
+		exp Event
+	}{
+		{
+			ev:  wasiEvent{typ: wasiEventtypeFdRead},
+			exp: EventRead,
+		},
+		{
+			ev:  wasiEvent{typ: wasiEventtypeFdWrite},
+			exp: EventWrite,
+		},
+		{
+			ev:  wasiEvent{typ: wasiEventtypeFdRead, flags: wasiFdReadwriteHangup},
+			exp: EventRead | EventReadHup | EventHup,
+		},
+		{
+			ev:  wasiEvent{typ: wasiEventtypeFdWrite, errno: 8},
+			exp: EventWrite | EventErr,
+		},
+	} {
+		if act := fromWasiEvent(test.ev); act != test.exp {
+			t.Errorf("fromWasiEvent(%+v) = %s; want %s", test.ev, act, test.exp)
+		}
+	}
+}
+
+func TestWasiPoller(t *testing.T) {
+	p, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.(fmt.Stringer).String(); s != "poll_oneoff" {
+		t.Errorf("String() is %q; want %q", s, "poll_oneoff")
+	}
+	if _, err := New(&Config{Backend: BackendEpoll}); err != (ErrBackendUnavailable{BackendEpoll}) {
+		t.Errorf("New() with epoll backend error is %v; want ErrBackendUnavailable", err)
+	}
+
+	desc, err := NewDesc(1, EventWrite|EventEdgeTriggered, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(desc, func(Event) {}); err != ErrUnsupportedOption {
+		t.Errorf("Start() of edge-triggered desc error is %v; want %v", err, ErrUnsupportedOption)
+	}
+
+	// Stdout is expected to be writable and pollable, e.g. a pipe. Some
+	// runtimes fail to poll regular files.
+	desc, err = NewDesc(1, EventWrite|EventOneShot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 1)
+	if err := p.Start(desc, func(ev Event) {
+		select {
+		case events <- ev:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev&EventWrite == 0 {
+		t.Errorf("received %s; want EventWrite", ev)
+	}
+	if err := p.(Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
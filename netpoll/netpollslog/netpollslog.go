@@ -0,0 +1,127 @@
+// +build go1.21
+
+/*
+Package netpollslog provides netpoll.Logger implementation which writes
+records to log/slog.
+
+Records produced by the netpoll package are mapped to slog levels as is:
+registration lifecycle is written at Debug level, descriptors left registered
+at Close() at Warn level and wait loop errors at Error level.
+
+Records have following stable attribute keys:
+
+	poller    – name of the poller, see netpoll.Config.Name;
+	op        – name of operation: "add", "mod", "del", "wait" or "close";
+	fd        – file descriptor, if the record relates to one;
+	events    – event mask in string form;
+	errno     – system error number, if the error is caused by syscall.Errno;
+	error     – error message;
+	iteration – wait loop iteration number;
+	count     – number of descriptors;
+	duration  – measured duration, such as callback execution time.
+
+Usage:
+
+	poller, err := netpoll.New(&netpoll.Config{
+		ErrorLog: netpollslog.WithSlog(slog.Default()),
+	})
+*/
+package netpollslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// Attribute keys used for records.
+const (
+	KeyPoller    = "poller"
+	KeyOp        = "op"
+	KeyFD        = "fd"
+	KeyEvents    = "events"
+	KeyErrno     = "errno"
+	KeyError     = "error"
+	KeyIteration = "iteration"
+	KeyCount     = "count"
+	KeyDuration  = "duration"
+)
+
+// Logger implements netpoll.StructuredLogger.
+type Logger struct {
+	l *slog.Logger
+}
+
+var _ netpoll.StructuredLogger = (*Logger)(nil)
+
+// WithSlog returns Logger which writes records to l.
+// If l is nil, slog.Default() is used.
+func WithSlog(l *slog.Logger) *Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &Logger{l}
+}
+
+// Printf implements netpoll.Logger. It writes message at Info level.
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.l.Info(fmt.Sprintf(format, args...))
+}
+
+// Log implements netpoll.StructuredLogger.
+func (l *Logger) Log(rec netpoll.LogRecord) {
+	level := slogLevel(rec.Level)
+	ctx := context.Background()
+	if !l.l.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 9)
+	if rec.Poller != "" {
+		attrs = append(attrs, slog.String(KeyPoller, rec.Poller))
+	}
+	if rec.Op != "" {
+		attrs = append(attrs, slog.String(KeyOp, rec.Op))
+	}
+	if rec.FD >= 0 {
+		attrs = append(attrs, slog.Int(KeyFD, rec.FD))
+	}
+	if rec.Events != "" {
+		attrs = append(attrs, slog.String(KeyEvents, rec.Events))
+	}
+	if rec.Err != nil {
+		var errno syscall.Errno
+		if errors.As(rec.Err, &errno) {
+			attrs = append(attrs, slog.Int(KeyErrno, int(errno)))
+		}
+		attrs = append(attrs, slog.String(KeyError, rec.Err.Error()))
+	}
+	if rec.Op == "wait" {
+		attrs = append(attrs, slog.Uint64(KeyIteration, rec.Iteration))
+	}
+	if rec.Count > 0 {
+		attrs = append(attrs, slog.Int(KeyCount, rec.Count))
+	}
+	if rec.Duration > 0 {
+		attrs = append(attrs, slog.Duration(KeyDuration, rec.Duration))
+	}
+
+	l.l.LogAttrs(ctx, level, rec.Message, attrs...)
+}
+
+func slogLevel(level netpoll.LogLevel) slog.Level {
+	switch level {
+	case netpoll.LevelDebug:
+		return slog.LevelDebug
+	case netpoll.LevelInfo:
+		return slog.LevelInfo
+	case netpoll.LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -0,0 +1,155 @@
+// +build go1.21
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpollslog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+func TestLoggerLifecycle(t *testing.T) {
+	var h recordHandler
+	poller, err := netpoll.New(&netpoll.Config{
+		ErrorLog: WithSlog(slog.New(&h)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	desc, err := netpoll.NewDesc(fds[0], netpoll.EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Start(desc, func(netpoll.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = poller.Start(desc, func(netpoll.Event) {}); err != netpoll.ErrRegistered {
+		t.Fatalf("second Start() = %v; want %v", err, netpoll.ErrRegistered)
+	}
+
+	recs := h.records()
+	if n := len(recs); n != 2 {
+		t.Fatalf("got %d records; want 2", n)
+	}
+	for i, rec := range recs {
+		if rec.Level != slog.LevelDebug {
+			t.Errorf("record #%d level is %s; want %s", i, rec.Level, slog.LevelDebug)
+		}
+		attrs := recordAttrs(rec)
+		if act, exp := attrs[KeyOp], "add"; act != exp {
+			t.Errorf("record #%d %q attribute is %v; want %v", i, KeyOp, act, exp)
+		}
+		if act, exp := attrs[KeyFD], int64(fds[0]); act != exp {
+			t.Errorf("record #%d %q attribute is %v; want %v", i, KeyFD, act, exp)
+		}
+		if _, ok := attrs[KeyEvents]; !ok {
+			t.Errorf("record #%d has no %q attribute", i, KeyEvents)
+		}
+	}
+	if _, ok := recordAttrs(recs[1])[KeyError]; !ok {
+		t.Errorf("failed registration record has no %q attribute", KeyError)
+	}
+}
+
+func TestLoggerRecord(t *testing.T) {
+	var h recordHandler
+	l := WithSlog(slog.New(&h))
+	l.Log(netpoll.LogRecord{
+		Level:     netpoll.LevelError,
+		Message:   "wait loop error",
+		Poller:    "ingress-0",
+		Op:        "wait",
+		FD:        -1,
+		Err:       syscall.EBADF,
+		Iteration: 42,
+	})
+	l.Log(netpoll.LogRecord{
+		Level:    netpoll.LevelWarn,
+		Message:  "descriptors are still registered on close",
+		Op:       "close",
+		FD:       -1,
+		Count:    3,
+		Duration: time.Second,
+	})
+
+	recs := h.records()
+	if n := len(recs); n != 2 {
+		t.Fatalf("got %d records; want 2", n)
+	}
+	if recs[0].Level != slog.LevelError {
+		t.Errorf("wait error level is %s; want %s", recs[0].Level, slog.LevelError)
+	}
+	attrs := recordAttrs(recs[0])
+	if act, exp := attrs[KeyErrno], int64(syscall.EBADF); act != exp {
+		t.Errorf("%q attribute is %v; want %v", KeyErrno, act, exp)
+	}
+	if act, exp := attrs[KeyPoller], "ingress-0"; act != exp {
+		t.Errorf("%q attribute is %v; want %v", KeyPoller, act, exp)
+	}
+	if act, exp := attrs[KeyIteration], uint64(42); act != exp {
+		t.Errorf("%q attribute is %v; want %v", KeyIteration, act, exp)
+	}
+	if _, ok := attrs[KeyFD]; ok {
+		t.Errorf("unexpected %q attribute", KeyFD)
+	}
+
+	if recs[1].Level != slog.LevelWarn {
+		t.Errorf("close leak level is %s; want %s", recs[1].Level, slog.LevelWarn)
+	}
+	attrs = recordAttrs(recs[1])
+	if _, ok := attrs[KeyPoller]; ok {
+		t.Errorf("unexpected %q attribute", KeyPoller)
+	}
+	if act, exp := attrs[KeyCount], int64(3); act != exp {
+		t.Errorf("%q attribute is %v; want %v", KeyCount, act, exp)
+	}
+	if act, exp := attrs[KeyDuration], time.Second; act != exp {
+		t.Errorf("%q attribute is %v; want %v", KeyDuration, act, exp)
+	}
+}
+
+// recordHandler is a slog.Handler which stores all records.
+type recordHandler struct {
+	mu   sync.Mutex
+	recs []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, rec slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recs = append(h.recs, rec.Clone())
+	return nil
+}
+
+func (h *recordHandler) records() []slog.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]slog.Record(nil), h.recs...)
+}
+
+func recordAttrs(rec slog.Record) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	rec.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.Any()
+		return true
+	})
+	return attrs
+}
@@ -0,0 +1,400 @@
+/*
+Package netpolltest provides conformance test suite for netpoll.Poller
+implementations.
+
+Backend could prove that it follows netpoll.Poller contract by single call
+in its tests:
+
+	func TestPoller(t *testing.T) {
+		netpolltest.TestPoller(t, func() (netpoll.Poller, error) {
+			return mybackend.New()
+		})
+	}
+
+Suite runs against real loopback tcp connections. Subtests for optional
+capabilities are skipped if poller does not declare them (see Capable).
+*/
+package netpolltest
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// Capability describes optional feature of a poller checked by the suite.
+type Capability uint
+
+const (
+	// CapOneShot means that poller supports netpoll.EventOneShot
+	// descriptors.
+	CapOneShot Capability = 1 << iota
+
+	// CapEdgeTriggered means that poller supports
+	// netpoll.EventEdgeTriggered descriptors.
+	CapEdgeTriggered
+
+	// CapClose means that poller implements netpoll.Closer and delivers
+	// netpoll.EventPollerClosed to registered callbacks on Close().
+	CapClose
+
+	// CapLowWatermark means that poller supports netpoll.WithLowWatermark()
+	// option for tcp connections.
+	CapLowWatermark
+
+	// CapAll contains all capabilities.
+	CapAll = CapOneShot | CapEdgeTriggered | CapClose | CapLowWatermark
+)
+
+// Capable is an optional interface of a poller which declares its
+// capabilities. Pollers which do not implement it are considered to have
+// CapAll capabilities, for example, ones returned by netpoll.New().
+//
+// Note that CapClose subtests are skipped if poller does not implement
+// netpoll.Closer regardless of declared capabilities.
+type Capable interface {
+	Capabilities() Capability
+}
+
+// timeout is the time to wait for an expected event.
+const timeout = time.Second
+
+// silence is the time during which unexpected events are awaited.
+const silence = 100 * time.Millisecond
+
+// TestPoller runs conformance suite against pollers returned by factory.
+// Factory is called for each subtest, and returned poller is closed (if it
+// implements netpoll.Closer) once subtest is done.
+func TestPoller(t *testing.T, factory func() (netpoll.Poller, error)) {
+	for _, test := range []struct {
+		name string
+		cap  Capability
+		fn   func(*testing.T, *env)
+	}{
+		{"StartRegistered", 0, testStartRegistered},
+		{"StopNotRegistered", 0, testStopNotRegistered},
+		{"ResumeNotRegistered", 0, testResumeNotRegistered},
+		{"Read", 0, testRead},
+		{"NoCallbackAfterStop", 0, testNoCallbackAfterStop},
+		{"StartAfterStop", 0, testStartAfterStop},
+		{"Hup", 0, testHup},
+		{"Reset", 0, testReset},
+		{"OneShot", CapOneShot, testOneShot},
+		{"EdgeTriggered", CapEdgeTriggered, testEdgeTriggered},
+		{"Close", CapClose, testClose},
+		{"LowWatermark", CapLowWatermark | CapOneShot, testLowWatermark},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			e := newEnv(t, factory)
+			if e.caps&test.cap != test.cap {
+				t.Skip("capability is not declared by the poller")
+			}
+			test.fn(t, e)
+		})
+	}
+}
+
+func testStartRegistered(t *testing.T, e *env) {
+	desc := e.desc(t, e.pair(t), netpoll.EventRead)
+	if err := e.poller.Start(desc, e.callback(nil)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	err := e.poller.Start(desc, e.callback(nil))
+	if !errors.Is(err, netpoll.ErrRegistered) {
+		t.Fatalf("second Start() error is %v; want %v", err, netpoll.ErrRegistered)
+	}
+}
+
+func testStopNotRegistered(t *testing.T, e *env) {
+	desc := e.desc(t, e.pair(t), netpoll.EventRead)
+	if err := e.poller.Stop(desc); !errors.Is(err, netpoll.ErrNotRegistered) {
+		t.Fatalf("Stop() of not started descriptor error is %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+	if err := e.poller.Start(desc, e.callback(nil)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := e.poller.Stop(desc); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	if err := e.poller.Stop(desc); !errors.Is(err, netpoll.ErrNotRegistered) {
+		t.Fatalf("second Stop() error is %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+}
+
+func testResumeNotRegistered(t *testing.T, e *env) {
+	desc := e.desc(t, e.pair(t), netpoll.EventRead|netpoll.EventOneShot)
+	if err := e.poller.Resume(desc); !errors.Is(err, netpoll.ErrNotRegistered) {
+		t.Fatalf("Resume() of not started descriptor error is %v; want %v", err, netpoll.ErrNotRegistered)
+	}
+}
+
+func testRead(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead)
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+}
+
+func testNoCallbackAfterStop(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead)
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := e.poller.Stop(desc); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	// Note that callback which was already taken by poller's wait loop could
+	// still be running when Stop() returns. So only events occurred after
+	// Stop() are checked.
+	p.send(t)
+	e.silent(t, events)
+}
+
+func testStartAfterStop(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead)
+	if err := e.poller.Start(desc, e.callback(nil)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := e.poller.Stop(desc); err != nil {
+		t.Fatalf("Stop() error: %v", err)
+	}
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() after Stop() error: %v", err)
+	}
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+}
+
+func testHup(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead)
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	p.client.Close()
+	e.expect(t, events, netpoll.EventReadHup|netpoll.EventHup)
+}
+
+func testReset(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead)
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	// Zero linger makes close to send RST to the peer.
+	if err := p.client.(*net.TCPConn).SetLinger(0); err != nil {
+		t.Fatal(err)
+	}
+	p.client.Close()
+	e.expect(t, events, netpoll.EventReadHup|netpoll.EventHup|netpoll.EventErr)
+}
+
+func testOneShot(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead|netpoll.EventOneShot)
+	events := make(chan netpoll.Event, 2)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+	// Descriptor must not receive events until Resume() even if data is
+	// still unread.
+	p.send(t)
+	e.silent(t, events)
+
+	if err := e.poller.Resume(desc); err != nil {
+		t.Fatalf("Resume() error: %v", err)
+	}
+	e.expect(t, events, netpoll.EventRead)
+	if err := e.poller.Stop(desc); err != nil {
+		t.Fatalf("Stop() of one-shot descriptor error: %v", err)
+	}
+}
+
+func testEdgeTriggered(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead|netpoll.EventEdgeTriggered)
+	events := make(chan netpoll.Event, 2)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+	// Unread data must not produce events without new data.
+	e.silent(t, events)
+
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+}
+
+func testClose(t *testing.T, e *env) {
+	c, ok := e.poller.(netpoll.Closer)
+	if !ok {
+		t.Skip("poller does not implement netpoll.Closer")
+	}
+	desc := e.desc(t, e.pair(t), netpoll.EventRead)
+	events := make(chan netpoll.Event, 1)
+	if err := e.poller.Start(desc, e.callback(events)); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	e.expect(t, events, netpoll.EventPollerClosed)
+
+	desc = e.desc(t, e.pair(t), netpoll.EventRead)
+	err := e.poller.Start(desc, e.callback(nil))
+	if !errors.Is(err, netpoll.ErrClosed) {
+		t.Fatalf("Start() after Close() error is %v; want %v", err, netpoll.ErrClosed)
+	}
+}
+
+func testLowWatermark(t *testing.T, e *env) {
+	p := e.pair(t)
+	desc := e.desc(t, p, netpoll.EventRead|netpoll.EventOneShot)
+	events := make(chan netpoll.Event, 2)
+	// Header of 8 bytes is sent in two chunks of 4 bytes.
+	err := e.poller.StartWithOptions(desc, e.callback(events), netpoll.WithLowWatermark(8))
+	if err != nil {
+		t.Fatalf("StartWithOptions() error: %v", err)
+	}
+	p.send(t)
+	e.silent(t, events)
+
+	p.send(t)
+	e.expect(t, events, netpoll.EventRead)
+	e.silent(t, events)
+}
+
+// env holds resources of single subtest.
+type env struct {
+	poller netpoll.Poller
+	caps   Capability
+
+	descs []*netpoll.Desc
+	conns []net.Conn
+}
+
+func newEnv(t *testing.T, factory func() (netpoll.Poller, error)) *env {
+	p, err := factory()
+	if err != nil {
+		t.Fatalf("can not create poller: %v", err)
+	}
+	e := &env{
+		poller: p,
+		caps:   CapAll,
+	}
+	if c, ok := p.(Capable); ok {
+		e.caps = c.Capabilities()
+	}
+	t.Cleanup(func() {
+		// Poller is closed first to not receive events about closed
+		// descriptors.
+		if c, ok := e.poller.(netpoll.Closer); ok {
+			c.Close()
+		}
+		for _, desc := range e.descs {
+			desc.Close()
+		}
+		for _, conn := range e.conns {
+			conn.Close()
+		}
+	})
+	return e
+}
+
+// connPair is a connected pair of tcp connections. Descriptors are made of
+// server side, while client side is used to produce events.
+type connPair struct {
+	server net.Conn
+	client net.Conn
+}
+
+func (p connPair) send(t *testing.T) {
+	if _, err := p.client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *env) pair(t *testing.T) connPair {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.conns = append(e.conns, client)
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.conns = append(e.conns, server)
+
+	return connPair{server, client}
+}
+
+func (e *env) desc(t *testing.T, p connPair, event netpoll.Event) *netpoll.Desc {
+	desc, err := netpoll.Handle(p.server, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.descs = append(e.descs, desc)
+	return desc
+}
+
+// callback returns callback which sends received events to ch without
+// blocking. Nil ch means that events are ignored.
+func (e *env) callback(ch chan<- netpoll.Event) netpoll.CallbackFn {
+	return func(ev netpoll.Event) {
+		if ch == nil {
+			return
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// expect waits for an event having any of bits of exp.
+func (e *env) expect(t *testing.T, events <-chan netpoll.Event, exp netpoll.Event) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		if ev&exp == 0 {
+			t.Fatalf("received %s; want any of %s", ev, exp)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no event received in %s; want any of %s", timeout, exp)
+	}
+}
+
+// silent checks that no events are received for a while.
+func (e *env) silent(t *testing.T, events <-chan netpoll.Event) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event received: %s", ev)
+	case <-time.After(silence):
+	}
+}
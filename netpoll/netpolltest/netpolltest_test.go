@@ -0,0 +1,46 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpolltest
+
+import (
+	"testing"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+func TestNetpoll(t *testing.T) {
+	TestPoller(t, func() (netpoll.Poller, error) {
+		return netpoll.New(nil)
+	})
+}
+
+func TestNetpollPollBackend(t *testing.T) {
+	TestPoller(t, func() (netpoll.Poller, error) {
+		p, err := netpoll.New(&netpoll.Config{
+			Backend: netpoll.BackendPoll,
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Poll backend does not support edge-triggered descriptors.
+		return declared{p.(netpoll.FullPoller), CapOneShot | CapClose}, nil
+	})
+}
+
+// declared is a poller which declares given capabilities.
+type declared struct {
+	netpoll.FullPoller
+	caps Capability
+}
+
+func (d declared) Capabilities() Capability { return d.caps }
+
+func TestCapabilities(t *testing.T) {
+	TestPoller(t, func() (netpoll.Poller, error) {
+		p, err := netpoll.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		return declared{p.(netpoll.FullPoller), 0}, nil
+	})
+}
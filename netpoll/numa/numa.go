@@ -0,0 +1,32 @@
+/*
+Package numa provides allocation of memory bound to a NUMA node.
+
+On multi-socket machines memory is attached to sockets, and access to memory
+of another node goes through the interconnect. Buffers which are written by
+the kernel on behalf of a thread, such as epoll_wait(2) event arrays, are
+better placed on the node this thread runs on:
+
+	node, err := numa.CurrentNode()
+	if err != nil {
+		// handle error
+	}
+	buf, err := numa.NumaAlloc(64<<10, node)
+	if err != nil {
+		// handle error
+	}
+	defer numa.NumaFree(buf)
+
+Memory returned by NumaAlloc() is not managed by Go garbage collector: it
+must not hold Go pointers and must be released by NumaFree().
+
+Note that placement helps only if the goroutine using the memory runs on the
+same node, e.g. the process is bound to the node by numactl(8), since Go
+scheduler may move goroutines between threads and threads between CPUs.
+*/
+package numa
+
+import "fmt"
+
+// ErrUnsupported is returned on operating systems which do not expose NUMA
+// memory policies, and on linux kernels built without NUMA support.
+var ErrUnsupported = fmt.Errorf("numa: memory policies are not supported")
@@ -0,0 +1,99 @@
+// +build linux
+
+package numa
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// NumaAlloc returns size bytes of zeroed anonymous memory which pages are
+// placed on NUMA node. Negative node means CurrentNode().
+//
+// Memory is bound to the node by mbind(2) with MPOL_BIND before the pages are
+// touched, so all of them are allocated there, or the program fails on their
+// first access. Pages are faulted in by NumaAlloc() itself, so first use of
+// the buffer does not. Note that MAP_POPULATE is not used: it would fault the
+// pages in before the binding, that is, on the node of the calling thread.
+func NumaAlloc(size, node int) ([]byte, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("numa: invalid size %d", size)
+	}
+	if node < 0 {
+		var err error
+		if node, err = CurrentNode(); err != nil {
+			return nil, err
+		}
+	}
+	b, err := unix.Mmap(-1, 0, size,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS,
+	)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	if err := mbind(b, node); err != nil {
+		unix.Munmap(b)
+		return nil, err
+	}
+	page := os.Getpagesize()
+	for i := 0; i < len(b); i += page {
+		b[i] = 0
+	}
+	return b, nil
+}
+
+// NumaFree releases memory returned by NumaAlloc(). It must not be used after
+// that.
+func NumaFree(b []byte) error {
+	if err := unix.Munmap(b); err != nil {
+		return os.NewSyscallError("munmap", err)
+	}
+	return nil
+}
+
+// CurrentNode returns NUMA node of the CPU the calling thread runs on at the
+// moment.
+func CurrentNode() (int, error) {
+	var cpu, node uint32
+	_, _, errno := unix.Syscall(unix.SYS_GETCPU,
+		uintptr(unsafe.Pointer(&cpu)),
+		uintptr(unsafe.Pointer(&node)),
+		0,
+	)
+	if errno != 0 {
+		return 0, os.NewSyscallError("getcpu", errno)
+	}
+	return int(node), nil
+}
+
+// mbind binds pages of b to node.
+func mbind(b []byte, node int) error {
+	const wordBits = 64
+	mask := make([]uint64, node/wordBits+1)
+	mask[node/wordBits] = 1 << uint(node%wordBits)
+	// Kernel reads maxnode-1 bits of the mask.
+	maxnode := len(mask)*wordBits + 1
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND,
+		uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)),
+		unix.MPOL_BIND,
+		uintptr(unsafe.Pointer(&mask[0])),
+		uintptr(maxnode),
+		unix.MPOL_MF_STRICT,
+	)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOSYS:
+		return ErrUnsupported
+	case syscall.EINVAL:
+		return fmt.Errorf("numa: node %d is not available: %w", node, os.NewSyscallError("mbind", errno))
+	default:
+		return os.NewSyscallError("mbind", errno)
+	}
+}
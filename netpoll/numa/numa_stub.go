@@ -0,0 +1,19 @@
+// +build !linux
+
+package numa
+
+// NumaAlloc returns ErrUnsupported, because memory policies are implemented
+// for linux only.
+func NumaAlloc(size, node int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// NumaFree returns ErrUnsupported.
+func NumaFree(b []byte) error {
+	return ErrUnsupported
+}
+
+// CurrentNode returns ErrUnsupported.
+func CurrentNode() (int, error) {
+	return 0, ErrUnsupported
+}
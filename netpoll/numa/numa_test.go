@@ -0,0 +1,41 @@
+// +build linux
+
+package numa
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNumaAlloc(t *testing.T) {
+	node, err := CurrentNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NumaAlloc(3<<12+1, node)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b); n != 3<<12+1 {
+		t.Fatalf("len(NumaAlloc()) is %d; want %d", n, 3<<12+1)
+	}
+	for i := range b {
+		if b[i] != 0 {
+			t.Fatalf("byte #%d is %d; want 0", i, b[i])
+		}
+		b[i] = byte(i)
+	}
+	if err := NumaFree(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NumaAlloc(1, 1<<10); err == nil {
+		t.Errorf("NumaAlloc() on node %d succeeded; want error", 1<<10)
+	}
+	if _, err := NumaAlloc(0, node); err == nil {
+		t.Errorf("NumaAlloc() of 0 bytes succeeded; want error")
+	}
+}
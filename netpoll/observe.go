@@ -0,0 +1,117 @@
+package netpoll
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// observer holds a function passed to Observe(). It is compared by pointer on
+// cancellation.
+type observer struct {
+	fn func(Event)
+}
+
+// observers is a copy-on-write list of descriptor's observers. Its mutex
+// also guards changes of Desc.regs, so observers are not added to the
+// descriptor which is being stopped.
+type observers struct {
+	mu   sync.Mutex
+	list atomic.Value // []*observer
+}
+
+// Observe adds fn to the list of desc observers. Observers receive all events
+// of the registration right after its callback returns. They are called in
+// poller's goroutine, so they must not block and must not call Stop() or
+// Resume() for desc.
+//
+// Observers are cancelled automatically when desc is stopped or the poller
+// is closed. In the latter case they receive EventPollerClosed.
+//
+// It returns ErrNotRegistered if desc is not started in any poller.
+// Returned cancel function removes fn from the list. It is safe to call it
+// multiple times and from any goroutine.
+func Observe(desc *Desc, fn func(Event)) (cancel func(), err error) {
+	o := &desc.observers
+	obs := &observer{fn}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !desc.registered() {
+		return nil, ErrNotRegistered
+	}
+	prev, _ := o.list.Load().([]*observer)
+	list := make([]*observer, len(prev), len(prev)+1)
+	copy(list, prev)
+	o.list.Store(append(list, obs))
+
+	return func() { o.remove(obs) }, nil
+}
+
+func (o *observers) remove(obs *observer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prev, _ := o.list.Load().([]*observer)
+	for i, x := range prev {
+		if x != obs {
+			continue
+		}
+		list := make([]*observer, 0, len(prev)-1)
+		list = append(list, prev[:i]...)
+		list = append(list, prev[i+1:]...)
+		o.list.Store(list)
+		return
+	}
+}
+
+// clear cancels all observers. It must be called with mu held.
+func (o *observers) clear() {
+	if list, _ := o.list.Load().([]*observer); len(list) > 0 {
+		o.list.Store([]*observer(nil))
+	}
+}
+
+// notify calls observers with event. It does not take any locks.
+func (o *observers) notify(event Event) {
+	list, _ := o.list.Load().([]*observer)
+	for _, obs := range list {
+		obs.fn(event)
+	}
+}
+
+// register counts registration of the descriptor in one more poller,
+// allowing Observe() calls.
+func (h *Desc) register() {
+	h.observers.mu.Lock()
+	atomic.AddInt32(&h.regs, 1)
+	h.observers.mu.Unlock()
+}
+
+// unregister is called when the descriptor is removed from a poller.
+// Observers are cancelled when it is not registered anywhere else.
+func (h *Desc) unregister() {
+	o := &h.observers
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := atomic.LoadInt32(&h.regs)
+	if n == 0 {
+		return
+	}
+	atomic.StoreInt32(&h.regs, n-1)
+	if n == 1 {
+		o.clear()
+	}
+}
+
+// registered reports whether the descriptor is registered in any poller.
+func (h *Desc) registered() bool {
+	return atomic.LoadInt32(&h.regs) != 0
+}
+
+// notify passes event of the registration to observers. EventPollerClosed
+// means that the registration is gone with the poller.
+func (h *Desc) notify(event Event) {
+	h.observers.notify(event)
+	if event&EventPollerClosed != 0 {
+		h.unregister()
+	}
+}
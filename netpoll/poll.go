@@ -0,0 +1,528 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollPoller is a portable Poller implementation based on poll(2).
+//
+// Set of polled descriptors is kept in the pollfd array which is updated in
+// place on registration changes. The wait loop polls its own copy of the
+// array, which is refreshed only when set of descriptors has changed since
+// previous round. Resumed descriptors are patched in the copy individually.
+// Still, each poll(2) call costs O(n) of registered descriptors in kernel.
+type pollPoller struct {
+	mu     sync.Mutex
+	closed bool
+	descs  map[int]*pollEntry
+
+	// fds is the pollfd array of registered descriptors. Its first item is
+	// the wake pipe. Disarmed descriptors have negative Fd, so they are
+	// ignored by poll(2). entries[i] is the registration of fds[i].
+	fds     []unix.PollFd
+	entries []*pollEntry
+	// dirty is true when fds were changed structurally since the wait loop
+	// copied them. Otherwise resumed contains indices of fds to be patched
+	// in the copy.
+	dirty   bool
+	resumed []int
+
+	// wake is a pipe used to interrupt poll(2) when registrations change or
+	// poller is closed. woken is true when wake is written and not drained
+	// yet.
+	wake     [2]int
+	woken    bool
+	waitDone chan struct{}
+	idle     idleTracker
+
+	// seq is a number of the last registration.
+	seq          uint64
+	reverseClose bool
+	// maxDescs is Config.MaxDescriptors.
+	maxDescs int
+	soft     softLimit
+
+	name   string
+	errors errorHandler
+}
+
+// pollEntry holds registration of a descriptor.
+type pollEntry struct {
+	desc   *Desc
+	cb     CallbackFn
+	events int16
+	// event is desc.event at the last Start() or Resume(). Wait loop uses
+	// it instead of desc.event, which could be changed by Update().
+	event Event
+	// index is a position of the descriptor in pollPoller.fds.
+	index int
+	// armed is false for one-shot descriptors which received an event and
+	// are not resumed yet.
+	armed bool
+	// seq orders the registration on Close().
+	seq uint64
+}
+
+// pollReady is an event received by the wait loop.
+type pollReady struct {
+	desc  *Desc
+	cb    CallbackFn
+	event Event
+}
+
+var (
+	_ FullPoller     = (*pollPoller)(nil)
+	_ Pauser         = (*pollPoller)(nil)
+	_ HandlerStarter = (*pollPoller)(nil)
+	_ PausedStarter  = (*pollPoller)(nil)
+	_ LazyStarter    = (*pollPoller)(nil)
+	_ Namer          = (*pollPoller)(nil)
+)
+
+func newPollPoller(cfg Config) (*pollPoller, error) {
+	p := &pollPoller{
+		descs:    make(map[int]*pollEntry),
+		waitDone: make(chan struct{}),
+		name:     cfg.Name,
+		errors:   errorHandler{cfg.OnWaitError, cfg.ErrorLog, cfg.Name},
+
+		reverseClose: cfg.ReverseCloseOrder,
+		maxDescs:     cfg.MaxDescriptors,
+		soft:         newSoftLimit(cfg.SoftLimit, cfg.MaxDescriptors, cfg.OnSoftLimit),
+	}
+	if err := unix.Pipe(p.wake[:]); err != nil {
+		return nil, err
+	}
+	p.fds = []unix.PollFd{{
+		Fd:     int32(p.wake[0]),
+		Events: unix.POLLIN,
+	}}
+	p.entries = []*pollEntry{nil}
+	for _, fd := range p.wake {
+		unix.CloseOnExec(fd)
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(p.wake[0])
+			unix.Close(p.wake[1])
+			return nil, err
+		}
+	}
+	go p.wait(cfg)
+	return p, nil
+}
+
+// String returns name of the backend.
+func (p *pollPoller) String() string {
+	return BackendPoll.String()
+}
+
+// Name implements Namer.Name() method.
+func (p *pollPoller) Name() string {
+	return p.name
+}
+
+// Start implements Poller.Start() method.
+func (p *pollPoller) Start(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
+
+// StartWithOptions implements Poller.StartWithOptions() method.
+func (p *pollPoller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	if o.exclusive || o.lowat > 1 || desc.event&EventEdgeTriggered != 0 {
+		return ErrUnsupportedOption
+	}
+	fd := desc.fd()
+	if fd < 0 {
+		return ErrInvalidFD
+	}
+
+	user := cb
+	cb = withOptions(p, desc, func(event Event) {
+		user(event)
+		desc.notify(event)
+	}, &o, p.errors)
+
+	// OnSoftLimit is called after the lock is released.
+	var soft int
+	defer func() { p.soft.notify(soft) }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if _, has := p.descs[fd]; has {
+		return ErrRegistered
+	}
+	if p.maxDescs > 0 && len(p.descs) >= p.maxDescs {
+		return ErrTooManyDescriptors
+	}
+	p.seq++
+	e := &pollEntry{
+		desc:   desc,
+		cb:     cb,
+		events: toPollEvents(desc.event),
+		event:  desc.event,
+		index:  len(p.fds),
+		armed:  !o.paused,
+		seq:    p.seq,
+	}
+	pfd := unix.PollFd{
+		Fd:     int32(fd),
+		Events: e.events,
+	}
+	if o.paused {
+		// Ignored by poll(2) until Resume(), like fired one-shot descriptor.
+		pfd.Fd = -1
+	}
+	desc.register()
+	p.descs[fd] = e
+	p.fds = append(p.fds, pfd)
+	p.entries = append(p.entries, e)
+	p.dirty = true
+	soft = p.soft.added(len(p.descs))
+	return wrapError(p.name, "start", fd, p.notify())
+}
+
+// StartDuplex implements Poller.StartDuplex() method.
+func (p *pollPoller) StartDuplex(desc *Desc, onRead, onWrite CallbackFn) error {
+	event := desc.event
+	desc.event |= EventRead | EventWrite
+	if err := p.Start(desc, Duplex(onRead, onWrite)); err != nil {
+		desc.event = event
+		return err
+	}
+	return nil
+}
+
+// StartCtxFn implements Poller.StartCtxFn() method.
+func (p *pollPoller) StartCtxFn(desc *Desc, ctx context.Context, fn func(context.Context, Event)) error {
+	return p.Start(desc, ContextCallback(ctx, fn))
+}
+
+// StartHandler implements HandlerStarter.StartHandler() method.
+func (p *pollPoller) StartHandler(desc *Desc, h Handler) error {
+	return p.Start(desc, h.HandleEvent)
+}
+
+// StartPaused implements PausedStarter.StartPaused() method.
+func (p *pollPoller) StartPaused(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb, startPaused)
+}
+
+// StartLazy implements LazyStarter.StartLazy() method.
+func (p *pollPoller) StartLazy(desc *Desc, cb CallbackFn) error {
+	return startLazy(p, desc, cb)
+}
+
+// Stop implements Poller.Stop() method.
+func (p *pollPoller) Stop(desc *Desc) error {
+	if stopLazy(desc) {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	fd := desc.fd()
+	e, has := p.descs[fd]
+	if !has {
+		return ErrNotRegistered
+	}
+	delete(p.descs, fd)
+	p.soft.removed(len(p.descs))
+	// Move the last descriptor into the freed position.
+	last := len(p.fds) - 1
+	if e.index != last {
+		p.fds[e.index] = p.fds[last]
+		p.entries[e.index] = p.entries[last]
+		p.entries[e.index].index = e.index
+	}
+	p.fds = p.fds[:last]
+	p.entries[last] = nil
+	p.entries = p.entries[:last]
+	p.dirty = true
+	desc.unregister()
+	desc.paused = false
+	return wrapError(p.name, "stop", fd, p.notify())
+}
+
+// Resume implements Poller.Resume() method.
+func (p *pollPoller) Resume(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	if desc.paused {
+		return nil
+	}
+	return wrapError(p.name, "resume", desc.fd(), p.arm(e, desc.event))
+}
+
+// Pause implements Pauser.Pause() method.
+// Paused descriptor is polled with empty event set, which still receives
+// POLLHUP and POLLERR; it is disarmed after them like one-shot one.
+func (p *pollPoller) Pause(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	if desc.paused {
+		return nil
+	}
+	desc.paused = true
+	return wrapError(p.name, "pause", desc.fd(), p.arm(e, EventOneShot))
+}
+
+// Unpause implements Pauser.Unpause() method.
+func (p *pollPoller) Unpause(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	if !desc.paused {
+		return nil
+	}
+	desc.paused = false
+	return wrapError(p.name, "unpause", desc.fd(), p.arm(e, desc.event))
+}
+
+// arm makes e to be polled for event. It must be called with p.mu held.
+func (p *pollPoller) arm(e *pollEntry, event Event) error {
+	e.events = toPollEvents(event)
+	e.event = event
+	e.armed = true
+	p.fds[e.index] = unix.PollFd{
+		Fd:     int32(e.desc.fd()),
+		Events: e.events,
+	}
+	if !p.dirty {
+		p.resumed = append(p.resumed, e.index)
+	}
+	return p.notify()
+}
+
+// Close implements Closer.Close() method.
+func (p *pollPoller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	err := p.notify()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-p.waitDone
+	unix.Close(p.wake[0])
+	unix.Close(p.wake[1])
+
+	p.mu.Lock()
+	descs := p.descs
+	// Registrations are dropped from all the tables, so callbacks and
+	// descriptors are not kept alive by the closed poller.
+	p.descs = nil
+	p.fds, p.entries, p.resumed = nil, nil, nil
+	p.mu.Unlock()
+
+	entries := make([]*pollEntry, 0, len(descs))
+	for _, e := range descs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if p.reverseClose {
+			return entries[i].seq > entries[j].seq
+		}
+		return entries[i].seq < entries[j].seq
+	})
+
+	p.idle.begin()
+	defer p.idle.end()
+	for _, e := range entries {
+		e.cb(EventPollerClosed)
+	}
+	return nil
+}
+
+// WaitIdle implements Idler.WaitIdle() method.
+func (p *pollPoller) WaitIdle(ctx context.Context) error {
+	return p.idle.wait(ctx)
+}
+
+// notify wakes up the wait loop. It must be called with p.mu held.
+func (p *pollPoller) notify() error {
+	if p.woken {
+		return nil
+	}
+	_, err := unix.Write(p.wake[1], []byte{0})
+	if err == unix.EAGAIN {
+		// Wait loop is going to wake up anyway.
+		err = nil
+	}
+	p.woken = err == nil
+	return err
+}
+
+func (p *pollPoller) wait(cfg Config) {
+	defer close(p.waitDone)
+
+	var (
+		fds   []unix.PollFd
+		ready []pollReady
+		buf   [64]byte
+		quiet = newQuietHook(cfg.IdleThreshold, cfg.OnIdle)
+	)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		if p.dirty || fds == nil {
+			fds = append(fds[:0], p.fds...)
+		} else {
+			for _, i := range p.resumed {
+				fds[i] = p.fds[i]
+			}
+		}
+		p.dirty = false
+		p.resumed = p.resumed[:0]
+		p.mu.Unlock()
+
+		n, err := unix.Poll(fds, quiet.msec())
+		if err != nil {
+			if IsTemporaryError(err) {
+				continue
+			}
+			if cfg.OnWaitError != nil {
+				cfg.OnWaitError(err)
+			} else {
+				logRecord(cfg.ErrorLog, LogRecord{
+					Level:   LevelError,
+					Message: "wait loop error",
+					Poller:  cfg.Name,
+					Op:      "wait",
+					FD:      -1,
+					Err:     err,
+				})
+			}
+			return
+		}
+		if fds[0].Revents != 0 {
+			n--
+			p.mu.Lock()
+			// Drain wake up notifications.
+			for {
+				if m, _ := unix.Read(p.wake[0], buf[:]); m <= 0 {
+					break
+				}
+			}
+			p.woken = false
+			p.mu.Unlock()
+		}
+
+		ready = ready[:0]
+		p.mu.Lock()
+		// Scan stops after n ready descriptors are found.
+		for i := 1; i < len(fds) && n > 0; i++ {
+			pfd := &fds[i]
+			if pfd.Revents == 0 {
+				continue
+			}
+			n--
+			revents := pfd.Revents
+			e, has := p.descs[int(pfd.Fd)]
+			if !has || !e.armed {
+				// Descriptor was stopped during poll(2).
+				continue
+			}
+			// Closed descriptor is reported on each call until it is
+			// stopped, so it is disarmed like one-shot one.
+			if e.event&EventOneShot != 0 || revents&unix.POLLNVAL != 0 {
+				e.armed = false
+				p.fds[e.index].Fd = -1
+				if !p.dirty && e.index < len(fds) && fds[e.index].Fd == int32(e.desc.fd()) {
+					fds[e.index].Fd = -1
+				} else {
+					p.dirty = true
+				}
+			}
+			ready = append(ready, pollReady{e.desc, e.cb, fromPollEvents(revents)})
+		}
+		p.mu.Unlock()
+
+		p.idle.begin()
+		for _, r := range ready {
+			r.desc.setLastEvent(r.event)
+			r.cb(r.event)
+		}
+		p.idle.end()
+		quiet.update(len(ready) > 0)
+	}
+}
+
+func toPollEvents(event Event) (ev int16) {
+	if event&EventRead != 0 {
+		ev |= unix.POLLIN | pollRDHUP
+	}
+	if event&EventWrite != 0 {
+		ev |= unix.POLLOUT
+	}
+	if event&EventPriority != 0 {
+		ev |= unix.POLLPRI
+	}
+	return ev
+}
+
+func fromPollEvents(ev int16) (event Event) {
+	if ev&unix.POLLHUP != 0 {
+		event |= EventHup
+	}
+	if ev&pollRDHUP != 0 {
+		event |= EventReadHup
+	}
+	if ev&unix.POLLIN != 0 {
+		event |= EventRead
+	}
+	if ev&unix.POLLOUT != 0 {
+		event |= EventWrite
+	}
+	if ev&unix.POLLPRI != 0 {
+		event |= EventPriority
+	}
+	if ev&(unix.POLLERR|unix.POLLNVAL) != 0 {
+		event |= EventErr
+	}
+	return event
+}
@@ -0,0 +1,7 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+// pollRDHUP is zero, because bsd poll(2) does not report half-closed
+// connections. EventReadHup is never set by poll backend there.
+const pollRDHUP = 0
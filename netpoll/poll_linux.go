@@ -0,0 +1,5 @@
+package netpoll
+
+// pollRDHUP is POLLRDHUP flag, which reports that peer has shut down writing
+// half of connection. It is linux specific.
+const pollRDHUP = 0x2000
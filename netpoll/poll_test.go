@@ -0,0 +1,175 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPollPollerMany(t *testing.T) {
+	p, err := newPollPoller(config(t).withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const n = 100
+	var (
+		pipes  = openPipes(t, n)
+		descs  = make([]*Desc, n)
+		events = make(chan int, n)
+	)
+	for i := range pipes {
+		i := i
+		descs[i], err = NewDesc(pipes[i][0], EventRead|EventOneShot, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Start(descs[i], func(Event) { events <- i }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stop descriptors in different positions of pollfd array to make the
+	// last ones to be moved.
+	stopped := make(map[int]bool)
+	for i := 0; i < n; i += 3 {
+		if err := p.Stop(descs[i]); err != nil {
+			t.Fatal(err)
+		}
+		stopped[i] = true
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := range pipes {
+			if _, err := unix.Write(pipes[i][1], []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received := make(map[int]bool)
+		timeout := time.After(time.Second)
+		for len(received) < n-len(stopped) {
+			select {
+			case i := <-events:
+				if stopped[i] || received[i] {
+					t.Fatalf("round #%d: unexpected event for pipe #%d", round, i)
+				}
+				received[i] = true
+			case <-timeout:
+				t.Fatalf("round #%d: received %d events; want %d", round, len(received), n-len(stopped))
+			}
+		}
+		select {
+		case i := <-events:
+			t.Fatalf("round #%d: unexpected event for pipe #%d", round, i)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// Drain pipes and resume one-shot descriptors.
+		buf := make([]byte, 16)
+		for i := range pipes {
+			unix.Read(pipes[i][0], buf)
+			if !stopped[i] {
+				if err := p.Resume(descs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkPollPoller measures the cost of a wait round with few ready
+// descriptors among many idle ones.
+func BenchmarkPollPoller(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			benchmarkPollRound(b, n, 3)
+		})
+	}
+}
+
+func benchmarkPollRound(b *testing.B, n, hot int) {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		b.Fatal(err)
+	}
+	if need := uint64(n + 2*hot + 64); uint64(lim.Cur) < need {
+		b.Skipf("limit of open files is %d; want at least %d", lim.Cur, need)
+	}
+
+	p, err := newPollPoller(config(b).withDefaults())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+
+	// Both ends of idle pipes are registered for reading, so they are never
+	// ready.
+	for _, fds := range openPipes(b, n/2) {
+		for _, fd := range fds {
+			desc, err := NewDesc(fd, EventRead, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := p.Start(desc, func(Event) {}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	var (
+		pipes  = openPipes(b, hot)
+		descs  = make([]*Desc, hot)
+		events = make(chan struct{}, hot)
+	)
+	for i := range pipes {
+		descs[i], err = NewDesc(pipes[i][0], EventRead|EventOneShot, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := p.Start(descs[i], func(Event) { events <- struct{}{} }); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, fds := range pipes {
+			unix.Write(fds[1], buf)
+		}
+		for range pipes {
+			<-events
+		}
+		for j, fds := range pipes {
+			unix.Read(fds[0], buf)
+			if err := p.Resume(descs[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// openPipes opens n non-blocking pipes which are closed when test finishes.
+func openPipes(tb testing.TB, n int) [][2]int {
+	pipes := make([][2]int, n)
+	for i := range pipes {
+		if err := unix.Pipe(pipes[i][:]); err != nil {
+			tb.Fatal(err)
+		}
+		fds := pipes[i]
+		tb.Cleanup(func() {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+		})
+		for _, fd := range fds {
+			if err := unix.SetNonblock(fd, true); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	return pipes
+}
@@ -0,0 +1,109 @@
+/*
+Package pool provides pool of descriptors to reduce garbage produced by
+connection churn.
+
+Instead of creating new netpoll.Desc by netpoll.Handle() for each accepted
+connection, descriptors are reconfigured by netpoll.Desc.Reset():
+
+	p := pool.New(netpoll.EventRead | netpoll.EventEdgeTriggered)
+
+	conn, _ := ln.Accept()
+	pc, err := p.Handle(conn)
+	if err != nil {
+		// handle error
+	}
+	poller.Start(pc.Desc(), func(ev netpoll.Event) {
+		if ev&(netpoll.EventReadHup|netpoll.EventHup) != 0 {
+			poller.Stop(pc.Desc())
+			p.Put(pc)
+			return
+		}
+		...
+	})
+*/
+package pool
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// PooledConn holds connection and its descriptor.
+type PooledConn struct {
+	desc  netpoll.Desc
+	conn  net.Conn
+	event netpoll.Event
+}
+
+// Reset makes c to hold conn. Its descriptor is reconfigured as if it was
+// created by netpoll.Handle(conn, event) with event of the pool.
+func (c *PooledConn) Reset(conn net.Conn) error {
+	if err := c.desc.Reset(conn, c.event); err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// Desc returns descriptor of the connection.
+// It must not be used after c is returned to the pool.
+func (c *PooledConn) Desc() *netpoll.Desc {
+	return &c.desc
+}
+
+// Conn returns connection held by c. It returns nil if Reset() was not called
+// since c was taken from the pool.
+func (c *PooledConn) Conn() net.Conn {
+	return c.conn
+}
+
+// release closes descriptor and connection.
+func (c *PooledConn) release() {
+	c.desc.Close()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// ConnPool is a pool of PooledConn. It is safe to use it from multiple
+// goroutines.
+type ConnPool struct {
+	event netpoll.Event
+	pool  sync.Pool
+}
+
+// New creates ConnPool which configures descriptors with given event.
+func New(event netpoll.Event) *ConnPool {
+	p := &ConnPool{event: event}
+	p.pool.New = func() interface{} {
+		return &PooledConn{event: event}
+	}
+	return p
+}
+
+// Get returns PooledConn from the pool. Caller must call its Reset() method
+// before using it.
+func (p *ConnPool) Get() *PooledConn {
+	return p.pool.Get().(*PooledConn)
+}
+
+// Put closes connection and descriptor of c and returns it to the pool.
+// Descriptor must be stopped before, and c must not be used after Put.
+func (p *ConnPool) Put(c *PooledConn) {
+	c.release()
+	p.pool.Put(c)
+}
+
+// Handle is a helper which takes PooledConn from the pool and resets it with
+// conn. On error PooledConn is returned to the pool, while conn is left open.
+func (p *ConnPool) Handle(conn net.Conn) (*PooledConn, error) {
+	c := p.Get()
+	if err := c.Reset(conn); err != nil {
+		p.pool.Put(c)
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,172 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package pool
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+	"golang.org/x/sys/unix"
+)
+
+func TestConnPool(t *testing.T) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.(netpoll.Closer).Close()
+
+	p := New(netpoll.EventRead | netpoll.EventOneShot)
+	seen := make(map[*netpoll.Desc]bool)
+	for i := 0; i < 10; i++ {
+		conn, peer := connPair(t)
+		pc, err := p.Handle(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc.Conn() != conn {
+			t.Fatalf("Conn() returned unexpected connection")
+		}
+		seen[pc.Desc()] = true
+		echo(t, poller, pc, peer)
+		p.Put(pc)
+		if pc.Conn() != nil {
+			t.Fatalf("Conn() is not nil after Put()")
+		}
+		// Connection must be closed by Put().
+		if _, err := conn.Write([]byte("x")); err == nil {
+			t.Fatalf("connection is not closed by Put()")
+		}
+	}
+	t.Logf("%d distinct descriptors used for 10 connections", len(seen))
+}
+
+func TestConnPoolHandleError(t *testing.T) {
+	p := New(netpoll.EventRead)
+	if _, err := p.Handle(nil); err != netpoll.ErrNotFiler {
+		t.Fatalf("Handle() error is %v; want %v", err, netpoll.ErrNotFiler)
+	}
+}
+
+func BenchmarkConnPool(b *testing.B) {
+	p := New(netpoll.EventRead | netpoll.EventOneShot)
+	benchmarkAcceptEcho(b,
+		func(conn net.Conn) (*netpoll.Desc, func()) {
+			pc, err := p.Handle(conn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return pc.Desc(), func() { p.Put(pc) }
+		},
+	)
+}
+
+func BenchmarkHandle(b *testing.B) {
+	benchmarkAcceptEcho(b,
+		func(conn net.Conn) (*netpoll.Desc, func()) {
+			desc, err := netpoll.HandleReadOnce(conn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return desc, func() {
+				desc.Close()
+				conn.Close()
+			}
+		},
+	)
+}
+
+// benchmarkAcceptEcho simulates connection churn of echo server: each
+// iteration handles new connection, echoes single message and releases it.
+func benchmarkAcceptEcho(b *testing.B, handle func(net.Conn) (*netpoll.Desc, func())) {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer poller.(netpoll.Closer).Close()
+
+	var (
+		msg  = []byte("ping")
+		resp = make([]byte, len(msg))
+		done = make(chan struct{}, 1)
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, peer := newConnPair(b)
+		desc, release := handle(conn)
+		err := poller.Start(desc, func(ev netpoll.Event) {
+			buf := make([]byte, len(msg))
+			n, _ := conn.Read(buf)
+			conn.Write(buf[:n])
+			done <- struct{}{}
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		peer.Write(msg)
+		<-done
+		peer.Read(resp)
+		poller.Stop(desc)
+		release()
+		peer.Close()
+	}
+}
+
+func echo(t *testing.T, poller netpoll.Poller, pc *PooledConn, peer *os.File) {
+	received := make(chan []byte, 1)
+	err := poller.Start(pc.Desc(), func(ev netpoll.Event) {
+		buf := make([]byte, 64)
+		n, _ := pc.Conn().Read(buf)
+		pc.Conn().Write(buf[:n])
+		received <- buf[:n]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(pc.Desc())
+
+	if _, err := peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if string(p) != "hello" {
+			t.Fatalf("received %q; want %q", p, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data received")
+	}
+	resp := make([]byte, 64)
+	if n, err := peer.Read(resp); err != nil || string(resp[:n]) != "hello" {
+		t.Fatalf("echo is %q (%v); want %q", resp[:n], err, "hello")
+	}
+}
+
+// connPair returns connection made from one end of unix socket pair and the
+// file of the other end. Both are closed at the end of the test.
+func connPair(tb testing.TB) (net.Conn, *os.File) {
+	conn, peer := newConnPair(tb)
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+func newConnPair(tb testing.TB) (net.Conn, *os.File) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "conn")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn, os.NewFile(uintptr(fds[1]), "peer")
+}
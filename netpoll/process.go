@@ -0,0 +1,154 @@
+package netpoll
+
+import "sync/atomic"
+
+// ProcessEvent describes process lifecycle events watched by descriptors
+// made by HandleProcess().
+type ProcessEvent uint8
+
+// ProcessEvent values.
+const (
+	// ProcessExit means that the process has exited.
+	ProcessExit ProcessEvent = 1 << iota
+	// ProcessFork means that the process has created a child.
+	ProcessFork
+	// ProcessExec means that the process has executed a new image.
+	ProcessExec
+)
+
+// String returns a string representation of ProcessEvent.
+func (ev ProcessEvent) String() (str string) {
+	name := func(event ProcessEvent, name string) {
+		if ev&event == 0 {
+			return
+		}
+		if str != "" {
+			str += "|"
+		}
+		str += name
+	}
+	name(ProcessExit, "ProcessExit")
+	name(ProcessFork, "ProcessFork")
+	name(ProcessExec, "ProcessExec")
+	return
+}
+
+// ProcessOptions contains options for HandleProcessWithOptions(). Process
+// exit is always watched.
+type ProcessOptions struct {
+	// Fork and Exec make the descriptor to report fork(2) and exec(2) of
+	// the process.
+	Fork bool
+	Exec bool
+}
+
+// ProcessState is returned by ProcessStatus().
+type ProcessState struct {
+	// Events are process events received by the descriptor. ProcessExit is
+	// reported by every call after the process has exited, while
+	// ProcessFork and ProcessExec are reported once.
+	Events ProcessEvent
+	// Status is the exit status of the process. It is valid when Events has
+	// ProcessExit and ProcessStatus() returns nil error.
+	Status ExitStatus
+}
+
+// SupportedProcessEvents returns process events which could be watched on
+// current operating system. Linux reports only ProcessExit, by pidfd
+// descriptors; kqueue systems report all of them by EVFILT_PROC filter.
+// It returns zero if processes could not be watched at all.
+func SupportedProcessEvents() ProcessEvent {
+	return supportedProcessEvents
+}
+
+// HandleProcess creates new Desc which watches process with given pid for
+// exit. It is the same as HandleProcessWithOptions(pid, ProcessOptions{}).
+func HandleProcess(pid int) (*Desc, error) {
+	return HandleProcessWithOptions(pid, ProcessOptions{})
+}
+
+// HandleProcessWithOptions creates new Desc which watches process with given
+// pid. Descriptor is started in a poller as usual: the callback receives
+// EventRead on process events, and ProcessStatus() called from there tells
+// which ones have happened.
+//
+// On linux descriptor holds pidfd of the process, which becomes readable
+// when the process exits, thus it could be started in epoll and poll
+// pollers; it requires Linux 5.3+. On kqueue systems descriptor has no file
+// descriptor and could be started in kqueue poller only.
+// Note that descriptor does not reap the process: it still must be waited
+// for, e.g. by exec.Cmd.Wait().
+//
+// It returns ErrUnsupportedOption if requested events are not in
+// SupportedProcessEvents().
+func HandleProcessWithOptions(pid int, opts ProcessOptions) (*Desc, error) {
+	if err := platformError(); err != nil {
+		return nil, err
+	}
+	events := ProcessExit
+	if opts.Fork {
+		events |= ProcessFork
+	}
+	if opts.Exec {
+		events |= ProcessExec
+	}
+	if events&^supportedProcessEvents != 0 {
+		return nil, ErrUnsupportedOption
+	}
+	if pid <= 0 {
+		return nil, ErrInvalidPID
+	}
+	return handleProcess(pid, events)
+}
+
+// ProcessStatus returns events of the process watched by desc, which is
+// made by HandleProcess(), and its exit status. It is intended to be called
+// from the callback receiving EventRead.
+//
+// It returns ErrNoExitStatus along with ProcessExit when the process has
+// exited, but its status could not be retrieved: linux reports it only for
+// children of the current process on Linux 5.4+, and darwin only for
+// children.
+func ProcessStatus(desc *Desc) (ProcessState, error) {
+	if desc.proc == nil {
+		return ProcessState{}, ErrNotProcess
+	}
+	return processStatus(desc)
+}
+
+// procWatch holds process state of descriptors made by HandleProcess().
+type procWatch struct {
+	pid    int
+	events ProcessEvent
+
+	// received holds ProcessEvent bits which are received by kqueue poller
+	// and not yet returned by ProcessStatus(), except ProcessExit which is
+	// kept. status is the exit status. Both are accessed atomically.
+	received uint32
+	status   uint32
+	// noStatus is set when the exit status is not reported by the system.
+	noStatus bool
+}
+
+// receive records events and exit status received by the poller.
+func (w *procWatch) receive(ev ProcessEvent, status uint32) {
+	if ev&ProcessExit != 0 {
+		atomic.StoreUint32(&w.status, status)
+	}
+	for {
+		old := atomic.LoadUint32(&w.received)
+		if atomic.CompareAndSwapUint32(&w.received, old, old|uint32(ev)) {
+			return
+		}
+	}
+}
+
+// take returns received events, leaving only ProcessExit in place.
+func (w *procWatch) take() ProcessEvent {
+	for {
+		old := atomic.LoadUint32(&w.received)
+		if atomic.CompareAndSwapUint32(&w.received, old, old&uint32(ProcessExit)) {
+			return ProcessEvent(old)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+// +build dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+// noteExitStatus is zero, because NOTE_EXIT always carries the exit status
+// of the process here.
+const noteExitStatus = 0
@@ -0,0 +1,7 @@
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// noteExitStatus makes NOTE_EXIT to carry the exit status of the process.
+// darwin allows it for children only.
+const noteExitStatus = unix.NOTE_EXITSTATUS
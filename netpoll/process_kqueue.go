@@ -0,0 +1,110 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package netpoll
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// supportedProcessEvents are reported by EVFILT_PROC filter.
+const supportedProcessEvents = ProcessExit | ProcessFork | ProcessExec
+
+// handleProcess returns descriptor without file descriptor: kqueue watches
+// the process by its ID.
+func handleProcess(pid int, events ProcessEvent) (*Desc, error) {
+	// EPERM означает, что процесс существует, но сигналы ему слать нельзя
+	if err := unix.Kill(pid, 0); err == unix.ESRCH {
+		return nil, os.NewSyscallError("kill", err)
+	}
+	desc := acquireDesc()
+	atomic.StoreInt32(&desc.sysfd, -1)
+	desc.event = EventRead
+	desc.proc = &procWatch{pid: pid, events: events}
+	return desc, nil
+}
+
+func processStatus(desc *Desc) (ProcessState, error) {
+	w := desc.proc
+	state := ProcessState{Events: w.take()}
+	if state.Events&ProcessExit == 0 {
+		return state, nil
+	}
+	if w.noStatus {
+		return state, ErrNoExitStatus
+	}
+	state.Status = syscall.WaitStatus(atomic.LoadUint32(&w.status))
+	return state, nil
+}
+
+// procNotes returns fflags of EVFILT_PROC filter for events.
+func procNotes(events ProcessEvent) uint32 {
+	notes := uint32(unix.NOTE_EXIT)
+	if events&ProcessFork != 0 {
+		notes |= unix.NOTE_FORK
+	}
+	if events&ProcessExec != 0 {
+		notes |= unix.NOTE_EXEC
+	}
+	return notes
+}
+
+// fromProcNotes returns process events of fflags of EVFILT_PROC filter.
+func fromProcNotes(notes uint32) (events ProcessEvent) {
+	if notes&unix.NOTE_EXIT != 0 {
+		events |= ProcessExit
+	}
+	if notes&unix.NOTE_FORK != 0 {
+		events |= ProcessFork
+	}
+	if notes&unix.NOTE_EXEC != 0 {
+		events |= ProcessExec
+	}
+	return events
+}
+
+// startProcess registers descriptor made by HandleProcess().
+func (p poller) startProcess(desc *Desc, cb CallbackFn, o *startOptions) error {
+	if o.exclusive || o.paused || o.lowat > 1 {
+		return ErrUnsupportedOption
+	}
+	w := desc.proc
+	user := cb
+	cb = withOptions(p, desc, func(event Event) {
+		user(event)
+		desc.notify(event)
+	}, o, p.errors)
+	handler := func(kevs []Kevent) {
+		for _, kev := range kevs {
+			w.receive(fromProcNotes(kev.Fflags), uint32(kev.Data))
+		}
+		desc.setLastEvent(EventRead)
+		cb(EventRead)
+	}
+
+	notes := procNotes(w.events)
+	desc.register()
+	err := p.addProc(w.pid, notes|noteExitStatus, handler)
+	if err == unix.EACCES && noteExitStatus != 0 {
+		// darwin сообщает код завершения только дочерних процессов
+		w.noStatus = true
+		err = p.addProc(w.pid, notes, handler)
+	}
+	if err != nil {
+		desc.unregister()
+		return wrapError(p.name, "start", w.pid, err)
+	}
+	return nil
+}
+
+// stopProcess removes registration of descriptor made by HandleProcess().
+func (p poller) stopProcess(desc *Desc) error {
+	if err := p.delProc(desc.proc.pid); err != nil {
+		return wrapError(p.name, "stop", desc.proc.pid, err)
+	}
+	desc.unregister()
+	return nil
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// supportedProcessEvents are reported by pidfd, which becomes readable on
+// exit only.
+const supportedProcessEvents = ProcessExit
+
+const (
+	// pPidfd is P_PIDFD id type of waitid(2), Linux 5.4+.
+	pPidfd = 3
+
+	// Values of si_code for SIGCHLD.
+	cldExited = 1
+	cldKilled = 2
+	cldDumped = 3
+)
+
+func handleProcess(pid int, events ProcessEvent) (*Desc, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("pidfd_open", err)
+	}
+	desc := acquireDesc()
+	atomic.StoreInt32(&desc.sysfd, int32(fd))
+	desc.owned = true
+	desc.event = EventRead
+	desc.proc = &procWatch{pid: pid, events: events}
+	return desc, nil
+}
+
+// processStatus asks the exit status by waitid(2) with WNOWAIT, so the
+// process is left to be reaped by its owner. For processes which are not
+// children of the current one, or when P_PIDFD is not supported, exit is
+// detected by readability of pidfd.
+func processStatus(desc *Desc) (ProcessState, error) {
+	fd := desc.fd()
+	var info unix.Siginfo
+	err := unix.Waitid(pPidfd, fd, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+	for err == unix.EINTR {
+		err = unix.Waitid(pPidfd, fd, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil)
+	}
+	switch {
+	case err == nil && siginfoField(&info, 0) == 0:
+		// Процесс еще работает
+		return ProcessState{}, nil
+	case err == nil:
+		return ProcessState{
+			Events: ProcessExit,
+			Status: waitStatus(info.Code, siginfoField(&info, 8)),
+		}, nil
+	case err != unix.ECHILD && err != unix.EINVAL:
+		return ProcessState{}, os.NewSyscallError("waitid", err)
+	}
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	for err == unix.EINTR {
+		n, err = unix.Poll(fds, 0)
+	}
+	if err != nil {
+		return ProcessState{}, os.NewSyscallError("poll", err)
+	}
+	if n == 0 {
+		return ProcessState{}, nil
+	}
+	return ProcessState{Events: ProcessExit}, ErrNoExitStatus
+}
+
+// siginfoField returns int32 field of SIGCHLD siginfo at given offset of the
+// union following si_signo, si_errno and si_code: si_pid is at 0 and
+// si_status is at 8. The union is aligned to the pointer size.
+func siginfoField(info *unix.Siginfo, off uintptr) int32 {
+	const align = unsafe.Sizeof(uintptr(0))
+	base := (3*unsafe.Sizeof(int32(0)) + align - 1) &^ (align - 1)
+	return *(*int32)(unsafe.Pointer(uintptr(unsafe.Pointer(info)) + base + off))
+}
+
+// waitStatus encodes si_code and si_status of SIGCHLD as wait(2) does.
+func waitStatus(code, status int32) syscall.WaitStatus {
+	switch code {
+	case cldExited:
+		return syscall.WaitStatus(status&0xff) << 8
+	case cldKilled:
+		return syscall.WaitStatus(status & 0x7f)
+	case cldDumped:
+		return syscall.WaitStatus(status&0x7f | 0x80)
+	}
+	return 0
+}
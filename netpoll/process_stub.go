@@ -0,0 +1,15 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package netpoll
+
+// supportedProcessEvents is zero, because processes could not be watched on
+// current operating system.
+const supportedProcessEvents ProcessEvent = 0
+
+func handleProcess(pid int, events ProcessEvent) (*Desc, error) {
+	return nil, ErrUnsupportedOption
+}
+
+func processStatus(desc *Desc) (ProcessState, error) {
+	return ProcessState{}, ErrUnsupportedOption
+}
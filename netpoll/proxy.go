@@ -0,0 +1,484 @@
+package netpoll
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultProxyBufferSize is the buffer size used by Proxy() when
+// ProxyOptions.BufferSize is zero.
+const DefaultProxyBufferSize = 32 << 10
+
+// ProxyOptions contains options for Proxy().
+type ProxyOptions struct {
+	// BufferSize is the size of buffer of each direction, which is used
+	// when data is copied, and the maximum number of bytes moved by single
+	// splice(2) call. If zero, DefaultProxyBufferSize is used.
+	BufferSize int
+
+	// Splice makes data to be moved by splice(2) through a pipe, so it is
+	// never copied to user space. It is supported on linux only and is
+	// ignored on other systems. Data of connections which do not support
+	// splice is copied anyway.
+	Splice bool
+
+	// LimitAB and LimitBA are the maximum numbers of bytes forwarded from a
+	// to b and from b to a. When more data is received, proxying is
+	// terminated with ErrProxyLimit. Zero means no limit.
+	LimitAB int64
+	LimitBA int64
+
+	// IdleTimeout terminates proxying with ErrProxyIdle when no data is
+	// moved in either direction for given duration. Zero means no timeout.
+	IdleTimeout time.Duration
+}
+
+// ProxyResult is the result of Proxy().
+type ProxyResult struct {
+	// AB and BA are the numbers of bytes forwarded from a to b and from b
+	// to a.
+	AB int64
+	BA int64
+
+	// Err is the error which terminated proxying. It is nil if both
+	// directions reached the end of stream.
+	Err error
+}
+
+// Proxy forwards data between a and b in both directions without blocking
+// and returns channel which receives the result when proxying is finished.
+//
+// Both connections are registered in p with edge-triggered read descriptors,
+// and each direction is pumped on EventRead until EAGAIN. If the destination
+// is not ready for writing, the source is not read until the rest of data is
+// written: a one-shot write descriptor of the destination reports EventWrite
+// then. So a stalled side does not make data to be buffered without limit,
+// while the opposite direction keeps working.
+//
+// When one side shuts down writing, the rest of its data is forwarded and
+// then the write side of the other connection is shut down. Proxying is
+// finished when both directions reach end of stream, or at once on any
+// error, exceeded limit or idle timeout. Then descriptors are stopped and
+// closed, and both connections are closed.
+//
+// Note that idle timeout is served by a runtime timer, since pollers have no
+// timers of their own.
+func Proxy(p Poller, a, b net.Conn, opts ProxyOptions) (done <-chan ProxyResult) {
+	ch := make(chan ProxyResult, 1)
+	s := &proxySession{
+		p:       p,
+		conns:   [2]net.Conn{a, b},
+		done:    ch,
+		timeout: opts.IdleTimeout,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.init(opts); err != nil {
+		s.finish(err)
+		return ch
+	}
+	for _, f := range s.flows {
+		if err := p.Start(f.src.read, f.onRead); err != nil {
+			s.finish(err)
+			return ch
+		}
+	}
+	if s.timeout > 0 {
+		s.active = time.Now()
+		s.timer = time.AfterFunc(s.timeout, s.onIdle)
+	}
+	return ch
+}
+
+// proxySession is a pair of proxied connections.
+type proxySession struct {
+	p       Poller
+	conns   [2]net.Conn
+	ends    [2]*proxyEnd
+	flows   [2]*proxyFlow
+	done    chan ProxyResult
+	timeout time.Duration
+
+	// mu serializes callbacks of all descriptors and the timer, which could
+	// be called by different goroutines, and guards the state of flows.
+	mu       sync.Mutex
+	finished bool
+	timer    *time.Timer
+	// active is the time when data was moved last time. It is updated
+	// only if idle timeout is set.
+	active time.Time
+}
+
+// proxyEnd holds descriptors of one of the connections. Read descriptor is
+// started by Proxy(), while write one is started only when the connection is
+// not ready for writing.
+type proxyEnd struct {
+	read  *Desc
+	write *Desc
+}
+
+func (s *proxySession) init(opts ProxyOptions) error {
+	for i, conn := range s.conns {
+		read, err := HandleRead(conn)
+		if err != nil {
+			return err
+		}
+		write, err := HandleWriteOnce(conn)
+		if err != nil {
+			read.Close()
+			return err
+		}
+		s.ends[i] = &proxyEnd{read, write}
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = DefaultProxyBufferSize
+	}
+	limits := [2]int64{opts.LimitAB, opts.LimitBA}
+	for i := range s.flows {
+		f := &proxyFlow{
+			s:     s,
+			src:   s.ends[i],
+			dst:   s.ends[1-i],
+			size:  size,
+			limit: limits[i],
+			pipe:  [2]int{-1, -1},
+		}
+		s.flows[i] = f
+		if !opts.Splice {
+			continue
+		}
+		pipe, err := newSplicePipe()
+		switch {
+		case spliceUnsupported(err):
+		case err != nil:
+			return os.NewSyscallError("pipe2", err)
+		default:
+			f.pipe = pipe
+		}
+	}
+	return nil
+}
+
+// finish releases all resources of the session and sends the result. It must
+// be called with s.mu held. It is safe to call it multiple times.
+func (s *proxySession) finish(err error) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	var res ProxyResult
+	if f := s.flows[0]; f != nil {
+		res.AB = f.n
+	}
+	if f := s.flows[1]; f != nil {
+		res.BA = f.n
+	}
+	res.Err = err
+
+	// Stop() returns ErrClosed when the poller is closed and an error for
+	// write descriptors which are not started; both are fine here.
+	for _, e := range s.ends {
+		if e != nil {
+			s.p.Stop(e.read)
+			s.p.Stop(e.write)
+			e.read.Close()
+			e.write.Close()
+		}
+	}
+	for _, f := range s.flows {
+		if f != nil {
+			f.closePipe()
+		}
+	}
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.done <- res
+	close(s.done)
+}
+
+// flowDone is called when one of directions is finished. It finishes the
+// session when both of them are.
+func (s *proxySession) flowDone() {
+	if s.flows[0].done && s.flows[1].done {
+		s.finish(nil)
+	}
+}
+
+// touch records that data is moved.
+func (s *proxySession) touch() {
+	if s.timeout > 0 {
+		s.active = time.Now()
+	}
+}
+
+func (s *proxySession) onIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	idle := time.Since(s.active)
+	if idle >= s.timeout {
+		s.finish(ErrProxyIdle)
+		return
+	}
+	s.timer.Reset(s.timeout - idle)
+}
+
+// proxyFlow moves data from src to dst.
+type proxyFlow struct {
+	s    *proxySession
+	src  *proxyEnd
+	dst  *proxyEnd
+	size int
+
+	// limit is the maximum number of bytes read from src, if positive.
+	limit int64
+	// read is the number of bytes read from src, and n is the number of
+	// bytes written to dst.
+	read int64
+	n    int64
+
+	// pipe is used by splice(2). It holds buffered bytes which are not
+	// written to dst yet. Fields are -1 when splice is not used.
+	pipe     [2]int
+	buffered int
+
+	// buf is used to copy data when splice is not used. Its pending part is
+	// not written to dst yet.
+	buf     []byte
+	pending []byte
+
+	// waiting is set while dst is not ready for writing.
+	waiting bool
+	// started is set when dst.write is started in the poller.
+	started bool
+	eof     bool
+	done    bool
+}
+
+func (f *proxyFlow) spliced() bool {
+	return f.pipe[0] != -1
+}
+
+func (f *proxyFlow) closePipe() {
+	if f.spliced() {
+		closeFd(f.pipe[0])
+		closeFd(f.pipe[1])
+		f.pipe = [2]int{-1, -1}
+	}
+}
+
+// onRead is called when src has data or is shut down by the peer.
+func (f *proxyFlow) onRead(ev Event) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.s.finished {
+		return
+	}
+	if ev&EventPollerClosed != 0 {
+		f.s.finish(ErrClosed)
+		return
+	}
+	// Hangup and errors are reported by read together with the rest of
+	// data.
+	f.pump()
+}
+
+// onWritable is called when dst is ready for writing the rest of data.
+func (f *proxyFlow) onWritable(ev Event) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.s.finished {
+		return
+	}
+	if ev&EventPollerClosed != 0 {
+		f.s.finish(ErrClosed)
+		return
+	}
+	// Errors of dst are reported by the next write.
+	f.waiting = false
+	f.pump()
+}
+
+// pump moves data until src has nothing to read or dst is not ready for
+// writing. When src reaches the end of stream, the write side of dst is shut
+// down. It must be called with f.s.mu held.
+func (f *proxyFlow) pump() {
+	for !f.waiting && !f.done && !f.s.finished {
+		var err error
+		switch {
+		case f.buffered > 0:
+			err = f.drainPipe()
+		case len(f.pending) > 0:
+			err = f.drainBuf()
+		case f.eof:
+			err = shutdownWrite(f.dst.write.fd())
+			if err != nil {
+				err = os.NewSyscallError("shutdown", err)
+			}
+			f.done = true
+			if err == nil {
+				f.s.flowDone()
+			}
+		case f.limit > 0 && f.read == f.limit:
+			err = f.probe()
+		case f.spliced():
+			err = f.fillPipe()
+		default:
+			err = f.fillBuf()
+		}
+		if err == errAgain {
+			// Wait for EventRead of src.
+			return
+		}
+		if err != nil {
+			f.s.finish(err)
+			return
+		}
+	}
+}
+
+// chunk returns the maximum number of bytes to read from src.
+func (f *proxyFlow) chunk() int {
+	if f.limit > 0 && f.limit-f.read < int64(f.size) {
+		return int(f.limit - f.read)
+	}
+	return f.size
+}
+
+// fillPipe moves data from src to the pipe.
+func (f *proxyFlow) fillPipe() error {
+	n, err := splice(f.pipe[1], f.src.read.fd(), f.chunk())
+	switch {
+	case spliceUnsupported(err):
+		// Source does not support splice; pipe is empty, so the rest of
+		// data is copied.
+		f.closePipe()
+		return nil
+	case err == errAgain:
+		return err
+	case err != nil:
+		return os.NewSyscallError("splice", err)
+	case n == 0:
+		f.eof = true
+	}
+	f.buffered += n
+	f.read += int64(n)
+	f.s.touch()
+	return nil
+}
+
+// drainPipe moves data from the pipe to dst.
+func (f *proxyFlow) drainPipe() error {
+	n, err := splice(f.dst.write.fd(), f.pipe[0], f.buffered)
+	switch {
+	case err == errAgain:
+		return f.arm()
+	case spliceUnsupported(err):
+		// Destination does not support splice; buffered data is moved
+		// from the pipe to the buffer and copied.
+		return f.unsplice()
+	case err != nil:
+		return os.NewSyscallError("splice", err)
+	}
+	f.buffered -= n
+	f.n += int64(n)
+	f.s.touch()
+	return nil
+}
+
+// unsplice moves buffered data from the pipe to the buffer and closes the
+// pipe.
+func (f *proxyFlow) unsplice() error {
+	if f.buf == nil {
+		f.buf = make([]byte, f.size)
+	}
+	// Pipe holds at most f.size bytes, since they are spliced by chunks.
+	n, err := readNonblock(uintptr(f.pipe[0]), f.buf[:f.buffered])
+	if err != nil {
+		return os.NewSyscallError("read", err)
+	}
+	f.pending = f.buf[:n]
+	f.buffered = 0
+	f.closePipe()
+	return nil
+}
+
+// fillBuf reads data from src into the buffer.
+func (f *proxyFlow) fillBuf() error {
+	if f.buf == nil {
+		f.buf = make([]byte, f.size)
+	}
+	n, err := readNonblock(uintptr(f.src.read.fd()), f.buf[:f.chunk()])
+	if err == errAgain {
+		return err
+	}
+	if err != nil {
+		return os.NewSyscallError("read", err)
+	}
+	if n == 0 {
+		f.eof = true
+	}
+	f.pending = f.buf[:n]
+	f.read += int64(n)
+	f.s.touch()
+	return nil
+}
+
+// drainBuf writes data from the buffer to dst.
+func (f *proxyFlow) drainBuf() error {
+	n, err := writeNonblock(f.dst.write.fd(), f.pending)
+	f.pending = f.pending[n:]
+	f.n += int64(n)
+	if n > 0 {
+		f.s.touch()
+	}
+	if err == errAgain {
+		return f.arm()
+	}
+	if err != nil {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+// probe checks whether src has more data after the limit is reached.
+func (f *proxyFlow) probe() error {
+	var b [1]byte
+	n, err := readNonblock(uintptr(f.src.read.fd()), b[:])
+	switch {
+	case err == errAgain:
+		return err
+	case err != nil:
+		return os.NewSyscallError("read", err)
+	case n > 0:
+		return ErrProxyLimit
+	}
+	f.eof = true
+	return nil
+}
+
+// arm starts waiting for EventWrite of dst. Source is not read until then,
+// so data is not buffered without limit.
+func (f *proxyFlow) arm() error {
+	var err error
+	if f.started {
+		err = f.s.p.Resume(f.dst.write)
+	} else {
+		err = f.s.p.Start(f.dst.write, f.onWritable)
+		f.started = err == nil
+	}
+	if err != nil {
+		return err
+	}
+	f.waiting = true
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package ringbuf
+
+import "fmt"
+
+func read(fd uintptr, p []byte) (n int, err error) {
+	return 0, fmt.Errorf("read is not supported on this operating system")
+}
+
+// errAgain is never returned on current operating system.
+var errAgain = fmt.Errorf("operation would block")
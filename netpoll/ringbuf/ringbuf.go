@@ -0,0 +1,182 @@
+/*
+Package ringbuf provides lock-free single-producer single-consumer ring
+buffer for connection data.
+
+It is intended to be filled by netpoll callback and drained by a user
+goroutine without any allocations or locks in the read path:
+
+	rb := ringbuf.New(64 << 10)
+	poller.Start(desc, func(ev netpoll.Event) {
+		// Producer.
+		rb.WriteFrom(conn)
+	})
+
+	go func() {
+		// Consumer.
+		p := make([]byte, 4096)
+		for {
+			n, err := rb.ReadTo(p)
+			...
+		}
+	}()
+*/
+package ringbuf
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// ErrFull is returned by RingBuffer.WriteFrom() when there is no free space
+// in the buffer.
+var ErrFull = fmt.Errorf("ring buffer is full")
+
+// RingBuffer is a ring buffer which could be written by one goroutine and
+// read by another one concurrently.
+type RingBuffer struct {
+	// head is the read position. It is written by consumer only.
+	head uint64
+	// tail is the write position. It is written by producer only.
+	tail uint64
+	// eof is set by producer when end of stream is reached.
+	eof uint32
+
+	buf  []byte
+	mask uint64
+
+	// Producer's state, kept to avoid allocations on each read.
+	conn   syscall.Conn
+	rc     syscall.RawConn
+	readFn func(uintptr) bool
+	dst    []byte
+	rn     int
+	rerr   error
+}
+
+// New creates RingBuffer of at least size bytes. Actual size is rounded up to
+// the power of two.
+func New(size int) *RingBuffer {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	rb := &RingBuffer{
+		buf:  make([]byte, n),
+		mask: uint64(n - 1),
+	}
+	rb.readFn = func(fd uintptr) bool {
+		rb.rn, rb.rerr = read(fd, rb.dst)
+		// Do not wait for readiness.
+		return true
+	}
+	return rb
+}
+
+// Cap returns size of the buffer.
+func (rb *RingBuffer) Cap() int {
+	return len(rb.buf)
+}
+
+// Len returns number of bytes available for reading.
+func (rb *RingBuffer) Len() int {
+	return int(atomic.LoadUint64(&rb.tail) - atomic.LoadUint64(&rb.head))
+}
+
+// WriteFrom reads data available in conn into the buffer. It must be called
+// by producer only.
+//
+// It makes non-blocking reads and returns zero and nil error if there is no
+// data available. It returns io.EOF when end of stream is reached and
+// ErrFull when there is no free space in the buffer.
+// Note that conn must implement syscall.Conn, otherwise netpoll.ErrNotFiler
+// is returned.
+func (rb *RingBuffer) WriteFrom(conn net.Conn) (n int, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, netpoll.ErrNotFiler
+	}
+	if rb.conn != sc {
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		rb.conn, rb.rc = sc, rc
+	}
+
+	var (
+		head = atomic.LoadUint64(&rb.head)
+		tail = rb.tail
+	)
+	if tail-head == uint64(len(rb.buf)) {
+		return 0, ErrFull
+	}
+	// Free space could be split into two parts by the end of the buffer.
+	for tail-head < uint64(len(rb.buf)) {
+		i := tail & rb.mask
+		end := uint64(len(rb.buf))
+		if h := head & rb.mask; h > i {
+			end = h
+		}
+		rb.dst = rb.buf[i:end]
+		err = rb.rc.Read(rb.readFn)
+		m, rerr := rb.rn, rb.rerr
+		rb.dst, rb.rerr = nil, nil
+		if err == nil {
+			err = rerr
+		}
+		if m > 0 {
+			n += m
+			tail += uint64(m)
+			// Publish written bytes to consumer.
+			atomic.StoreUint64(&rb.tail, tail)
+		}
+		switch {
+		case err == errAgain:
+			return n, nil
+		case err != nil:
+			return n, err
+		case m == 0:
+			atomic.StoreUint32(&rb.eof, 1)
+			return n, io.EOF
+		case m < len(rb.buf[i:end]):
+			// Short read means that there is no more data.
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+// ReadTo copies buffered data into b. It must be called by consumer only.
+//
+// It returns zero and nil error if buffer is empty, and io.EOF if buffer is
+// empty and producer reached end of stream.
+func (rb *RingBuffer) ReadTo(b []byte) (n int, err error) {
+	var (
+		head = rb.head
+		tail = atomic.LoadUint64(&rb.tail)
+	)
+	if head == tail {
+		if atomic.LoadUint32(&rb.eof) != 0 && atomic.LoadUint64(&rb.tail) == head {
+			return 0, io.EOF
+		}
+		return 0, nil
+	}
+	for n < len(b) && head < tail {
+		i := head & rb.mask
+		end := uint64(len(rb.buf))
+		if rest := tail - head; rest < end-i {
+			end = i + rest
+		}
+		m := copy(b[n:], rb.buf[i:end])
+		n += m
+		head += uint64(m)
+	}
+	// Release read bytes to producer.
+	atomic.StoreUint64(&rb.head, head)
+	return n, nil
+}
@@ -0,0 +1,223 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package ringbuf
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRingBufferWrap(t *testing.T) {
+	src, dst := connPair(t)
+	rb := New(10)
+	if rb.Cap() != 16 {
+		t.Fatalf("Cap() is %d; want 16", rb.Cap())
+	}
+
+	var (
+		p   = make([]byte, 16)
+		exp []byte
+		act []byte
+	)
+	// Write and read in chunks which are not aligned to the buffer size to
+	// make data wrap around the end.
+	for i := 0; i < 10; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i)}, 11)
+		exp = append(exp, chunk...)
+		if _, err := src.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		waitWriteFrom(t, rb, dst, len(chunk))
+		n, err := rb.ReadTo(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		act = append(act, p[:n]...)
+	}
+	if !bytes.Equal(act, exp) {
+		t.Fatalf("read %q; want %q", act, exp)
+	}
+}
+
+func TestRingBufferFullAndEOF(t *testing.T) {
+	src, dst := connPair(t)
+	rb := New(4)
+
+	if _, err := src.Write([]byte("123456")); err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	waitWriteFrom(t, rb, dst, 4)
+	if _, err := rb.WriteFrom(dst); err != ErrFull {
+		t.Fatalf("WriteFrom() error is %v; want %v", err, ErrFull)
+	}
+
+	p := make([]byte, 3)
+	if n, err := rb.ReadTo(p); n != 3 || err != nil || string(p) != "123" {
+		t.Fatalf("ReadTo() = %d, %v (%q); want 3, nil", n, err, p)
+	}
+	if n, err := rb.WriteFrom(dst); n != 2 || err != nil {
+		t.Fatalf("WriteFrom() = %d, %v; want 2, nil", n, err)
+	}
+	if n, err := rb.WriteFrom(dst); n != 0 || err != io.EOF {
+		t.Fatalf("WriteFrom() = %d, %v; want 0, EOF", n, err)
+	}
+	if n, err := rb.ReadTo(p); n != 3 || err != nil || string(p) != "456" {
+		t.Fatalf("ReadTo() = %d, %v (%q); want 3, nil", n, err, p)
+	}
+	if _, err := rb.ReadTo(p); err != io.EOF {
+		t.Fatalf("ReadTo() error is %v; want EOF", err)
+	}
+}
+
+func TestRingBufferConcurrent(t *testing.T) {
+	src, dst := connPair(t)
+	rb := New(256)
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		src.Write(data)
+		src.Close()
+	}()
+	go func() {
+		for {
+			n, err := rb.WriteFrom(dst)
+			if err == io.EOF {
+				return
+			}
+			if n == 0 {
+				// Let consumer and writer to make progress.
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	var (
+		act = make([]byte, 0, len(data))
+		p   = make([]byte, 100)
+	)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n, err := rb.ReadTo(p)
+		act = append(act, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if n == 0 {
+			runtime.Gosched()
+		}
+	}
+	if !bytes.Equal(act, data) {
+		t.Fatalf("received %d bytes which differ from sent %d bytes", len(act), len(data))
+	}
+}
+
+func BenchmarkRingBuffer(b *testing.B) {
+	rb := New(64 << 10)
+	benchmarkConcurrent(b,
+		func(conn net.Conn) { rb.WriteFrom(conn) },
+		func(p []byte) int { n, _ := rb.ReadTo(p); return n },
+	)
+}
+
+func BenchmarkBytesBuffer(b *testing.B) {
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+		tmp = make([]byte, 64<<10)
+	)
+	benchmarkConcurrent(b,
+		func(conn net.Conn) {
+			conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+			n, _ := conn.Read(tmp)
+			mu.Lock()
+			buf.Write(tmp[:n])
+			mu.Unlock()
+		},
+		func(p []byte) int {
+			mu.Lock()
+			n, _ := buf.Read(p)
+			mu.Unlock()
+			return n
+		},
+	)
+}
+
+func benchmarkConcurrent(b *testing.B, produce func(net.Conn), consume func([]byte) int) {
+	src, dst := connPair(b)
+	chunk := make([]byte, 4096)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				produce(dst)
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	p := make([]byte, len(chunk))
+	for i := 0; i < b.N; i++ {
+		if _, err := src.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+		for n := 0; n < len(chunk); {
+			m := consume(p)
+			if m == 0 {
+				runtime.Gosched()
+			}
+			n += m
+		}
+	}
+}
+
+func waitWriteFrom(tb testing.TB, rb *RingBuffer, conn net.Conn, n int) {
+	deadline := time.Now().Add(time.Second)
+	for rb.Len() < n && time.Now().Before(deadline) {
+		if _, err := rb.WriteFrom(conn); err != nil && err != io.EOF {
+			tb.Fatal(err)
+		}
+	}
+	if rb.Len() < n {
+		tb.Fatalf("buffered %d bytes; want %d", rb.Len(), n)
+	}
+}
+
+// connPair returns connected pair of unix stream connections.
+func connPair(tb testing.TB) (net.Conn, net.Conn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		conns[i] = conn
+		tb.Cleanup(func() { conn.Close() })
+	}
+	return conns[0], conns[1]
+}
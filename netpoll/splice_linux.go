@@ -0,0 +1,32 @@
+// +build linux
+
+package netpoll
+
+import "golang.org/x/sys/unix"
+
+// newSplicePipe creates non-blocking pipe to move data by splice(2).
+func newSplicePipe() (p [2]int, err error) {
+	err = unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC)
+	return p, err
+}
+
+// splice moves up to n bytes from src to dst without blocking. It retries on
+// EINTR.
+func splice(dst, src, n int) (int, error) {
+	for {
+		m, err := unix.Splice(src, nil, dst, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err == unix.EINTR {
+			continue
+		}
+		if m < 0 {
+			m = 0
+		}
+		return int(m), err
+	}
+}
+
+// spliceUnsupported reports whether err means that descriptor could not be
+// spliced.
+func spliceUnsupported(err error) bool {
+	return err == unix.EINVAL
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package netpoll
+
+import "fmt"
+
+// errNoSplice is returned by splice functions on systems without splice(2).
+var errNoSplice = fmt.Errorf("splice is not supported")
+
+func newSplicePipe() (p [2]int, err error) {
+	return p, errNoSplice
+}
+
+func splice(dst, src, n int) (int, error) {
+	return 0, errNoSplice
+}
+
+func spliceUnsupported(err error) bool {
+	return err == errNoSplice
+}
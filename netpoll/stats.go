@@ -0,0 +1,52 @@
+package netpoll
+
+import "time"
+
+// EpollStats contains counters of the wait loop work collected since
+// EpollCreate() when EpollConfig.CollectStats is set.
+//
+// The wait loop is busy from the return of epoll_wait() until its next
+// call, that is, while it dispatches events to callbacks. BusyPerEvent()
+// compared to the time of handling single event by the application tells
+// whether the loop is CPU-bound: large number of small events makes the
+// overhead of the loop itself noticeable. Note that it is measured by
+// monotonic clock, not by CPU cycles, thus callbacks blocked on I/O are
+// counted as busy time too.
+//
+// Stats are returned by pollers which implement StatsProvider, e.g. by
+// epoll poller returned by New(), and are included in snapshots of
+// telemetry package. They could also be published by expvar package:
+//
+//	expvar.Publish("netpoll."+ep.Name(), expvar.Func(func() interface{} {
+//		return ep.Stats()
+//	}))
+type EpollStats struct {
+	// Poller is the name of the instance, see EpollConfig.Name. It lets to
+	// label metrics of several pollers, so like Descriptors it is reported
+	// even if EpollConfig.CollectStats is not set.
+	Poller string
+	// Iterations is the number of successful epoll_wait() calls, including
+	// the ones which returned no events due to OnIdle timeout.
+	Iterations uint64
+	// Events is the number of callback calls made by the wait loop.
+	Events uint64
+	// BusyTime is the total time spent by the wait loop out of
+	// epoll_wait().
+	BusyTime time.Duration
+	// Descriptors is the number of registered descriptors. Unlike other
+	// fields it is reported even if EpollConfig.CollectStats is not set.
+	Descriptors int
+	// Suppressed is the number of events which were not passed to callbacks
+	// of registrations made with WithSpuriousFilter() option. They are
+	// counted in Events too.
+	Suppressed uint64
+}
+
+// BusyPerEvent returns the average busy time of the wait loop per
+// dispatched event. It returns zero if there were no events.
+func (s EpollStats) BusyPerEvent() time.Duration {
+	if s.Events == 0 {
+		return 0
+	}
+	return s.BusyTime / time.Duration(s.Events)
+}
@@ -0,0 +1,20 @@
+/*
+Package stress contains stress tests of netpoll pollers with large number of
+registered descriptors.
+
+Some bugs, such as races of descriptor number reuse or slow growth of poller
+internal structures, only appear with tens of thousands of descriptors, which
+regular tests never reach. Tests of this package raise RLIMIT_NOFILE as far as
+permitted, open as many socket pairs as fit into the limit and register all of
+them in the poller. Then they run scenarios of broadcasting events to every
+descriptor, churning registrations and closing the poller with everything
+registered.
+
+Tests are built only with stress tag:
+
+	go test -tags=stress -run Stress
+
+Number of socket pairs is limited by -stress.pairs flag, and churning time is
+set by -stress.churn flag.
+*/
+package stress
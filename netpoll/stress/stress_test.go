@@ -0,0 +1,350 @@
+// +build stress
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package stress
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll"
+	"github.com/mailru/easygo/netpoll/telemetry"
+)
+
+var (
+	maxPairs = flag.Int("stress.pairs", 100000, "maximum number of socket pairs")
+	churnFor = flag.Duration("stress.churn", 5*time.Second, "duration of churn scenario")
+	backend  = flag.String("stress.backend", "", "poller backend")
+)
+
+// reserved is the number of descriptors left for the poller, runtime and
+// test binary itself.
+const reserved = 256
+
+// timeout is the time to wait for events of all descriptors.
+const timeout = 30 * time.Second
+
+func TestStressBroadcast(t *testing.T) {
+	e := newEnv(t)
+	for round := 0; round < 3; round++ {
+		e.broadcast(round)
+	}
+}
+
+func TestStressChurn(t *testing.T) {
+	e := newEnv(t)
+	var (
+		n       = len(e.pairs)
+		step    = 100 * time.Millisecond
+		perStep = n / 100 // 10% per second.
+		churned int
+	)
+	if perStep == 0 {
+		perStep = 1
+	}
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+	for end := time.Now().Add(*churnFor); time.Now().Before(end); {
+		<-ticker.C
+		for i := 0; i < perStep; i++ {
+			// Closed descriptor numbers are reused by new socket pairs
+			// right away, so stale registrations would be noticed.
+			e.replace(rand.Intn(n))
+			churned++
+			// Keep some events flowing during churn.
+			p := e.pairs[rand.Intn(n)]
+			unix.Write(p.fds[1], []byte{1})
+		}
+	}
+	t.Logf("churned %d registrations", churned)
+
+	// Callbacks which were taken by the poller before Stop() could still be
+	// running. Only events occurred after that are checked.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.poller.WaitIdle(ctx); err != nil {
+		e.fatalf("WaitIdle() error: %v", err)
+	}
+	e.drain()
+	atomic.StoreInt64(&e.stale, 0)
+	e.broadcast(0)
+	if n := atomic.LoadInt64(&e.stale); n != 0 {
+		e.fatalf("%d events received by stopped registrations", n)
+	}
+}
+
+func TestStressClose(t *testing.T) {
+	e := newEnv(t)
+	if fmt.Sprint(e.raw) == netpoll.BackendKqueue.String() {
+		t.Skip("kqueue poller does not notify callbacks on Close()")
+	}
+	if err := e.poller.Close(); err != nil {
+		e.fatalf("Close() error: %v", err)
+	}
+	e.wait("EventPollerClosed", &e.closed)
+}
+
+// env holds the poller and registered socket pairs of single test.
+type env struct {
+	t      *testing.T
+	raw    netpoll.Poller
+	poller *telemetry.TelemetryPoller
+	pairs  []*pair
+
+	received int64
+	stale    int64
+	closed   int64
+}
+
+// pair is a socket pair. Its first end is registered in the poller, while
+// the second one is written to produce events.
+type pair struct {
+	fds  [2]int
+	desc *netpoll.Desc
+
+	// mu guards stopped flag, which is set before the pair is stopped and
+	// closed. Callback could still be running after Stop() returns, so it
+	// must not touch the descriptor after that: its number could be already
+	// reused by another pair.
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newEnv(t *testing.T) *env {
+	limit := raiseLimit(t)
+	raw, err := netpoll.New(&netpoll.Config{
+		Backend:      netpoll.Backend(*backend),
+		CollectStats: true,
+		OnWaitError: func(err error) {
+			t.Error(err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &env{
+		t:      t,
+		raw:    raw,
+		poller: telemetry.Wrap(raw),
+	}
+	t.Cleanup(func() {
+		e.poller.Close()
+		for _, p := range e.pairs {
+			unix.Close(p.fds[0])
+			unix.Close(p.fds[1])
+		}
+	})
+
+	want := int(limit-reserved) / 2
+	if want > *maxPairs {
+		want = *maxPairs
+	}
+	begin := time.Now()
+	for len(e.pairs) < want {
+		p, err := e.open()
+		if err == unix.EMFILE || err == unix.ENFILE {
+			break
+		}
+		if err != nil {
+			t.Fatalf("can not open socket pair #%d: %v", len(e.pairs), err)
+		}
+		e.pairs = append(e.pairs, p)
+	}
+	if len(e.pairs) == 0 {
+		t.Fatalf("no socket pairs could be opened")
+	}
+	t.Logf(
+		"%s: registered %d of %d socket pairs in %s",
+		raw, len(e.pairs), want, time.Since(begin),
+	)
+	return e
+}
+
+// raiseLimit sets soft limit of open files as close to the hard limit as
+// permitted and returns the result.
+func raiseLimit(t *testing.T) uint64 {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	orig := lim.Cur
+	// Hard limit could be above the kernel limit (e.g. infinity on darwin),
+	// so lower values are tried on failure.
+	for cur := lim.Max; cur > orig; cur = orig + (cur-orig)/2 {
+		lim.Cur = cur
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &lim); err == nil {
+			break
+		}
+		lim.Cur = orig
+	}
+	t.Logf("RLIMIT_NOFILE: soft limit is %d (was %d), hard limit is %d", lim.Cur, orig, lim.Max)
+	return uint64(lim.Cur)
+}
+
+// open opens and registers new socket pair.
+func (e *env) open() (*pair, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &pair{fds: fds}
+	fail := func(err error) (*pair, error) {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return nil, err
+	}
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			return fail(err)
+		}
+	}
+	p.desc, err = netpoll.NewDesc(fds[0], netpoll.EventRead|netpoll.EventOneShot, false)
+	if err != nil {
+		return fail(err)
+	}
+	if err := e.poller.Start(p.desc, func(ev netpoll.Event) {
+		e.handle(p, ev)
+	}); err != nil {
+		return fail(err)
+	}
+	return p, nil
+}
+
+// replace stops and closes i-th pair and opens new one instead.
+func (e *env) replace(i int) {
+	old := e.pairs[i]
+	old.mu.Lock()
+	old.stopped = true
+	old.mu.Unlock()
+	if err := e.poller.Stop(old.desc); err != nil {
+		e.fatalf("Stop() error: %v", err)
+	}
+	unix.Close(old.fds[0])
+	unix.Close(old.fds[1])
+
+	p, err := e.open()
+	if err != nil {
+		e.fatalf("can not reopen socket pair: %v", err)
+	}
+	e.pairs[i] = p
+}
+
+func (e *env) handle(p *pair, ev netpoll.Event) {
+	if ev&netpoll.EventPollerClosed != 0 {
+		atomic.AddInt64(&e.closed, 1)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		atomic.AddInt64(&e.stale, 1)
+		return
+	}
+	// Events which were queued before the data is read by drain() have
+	// nothing to read and are not counted.
+	var (
+		buf  [64]byte
+		read int
+	)
+	for {
+		n, err := unix.Read(p.fds[0], buf[:])
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil && err != unix.EAGAIN {
+			e.t.Errorf("read error: %v", err)
+			return
+		}
+		if err != nil || n == 0 {
+			break
+		}
+		read += n
+	}
+	if read > 0 {
+		atomic.AddInt64(&e.received, 1)
+	}
+	if err := e.poller.Resume(p.desc); err != nil {
+		e.t.Errorf("Resume() error: %v", err)
+	}
+}
+
+// broadcast writes to every pair and waits until each of them receives an
+// event.
+func (e *env) broadcast(round int) {
+	atomic.StoreInt64(&e.received, 0)
+	begin := time.Now()
+	for i, p := range e.pairs {
+		if _, err := unix.Write(p.fds[1], []byte{1}); err != nil {
+			e.fatalf("round #%d: write to pair #%d error: %v", round, i, err)
+		}
+	}
+	e.wait("EventRead", &e.received)
+	e.t.Logf("round #%d: %d events received in %s", round, len(e.pairs), time.Since(begin))
+}
+
+// drain reads data left in all pairs by churn scenario and waits for the
+// callbacks to finish.
+func (e *env) drain() {
+	var buf [64]byte
+	for _, p := range e.pairs {
+		for {
+			if _, err := unix.Read(p.fds[0], buf[:]); err != nil && err != unix.EINTR {
+				break
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.poller.WaitIdle(ctx); err != nil {
+		e.fatalf("WaitIdle() error: %v", err)
+	}
+}
+
+// wait waits until counter reaches number of pairs.
+func (e *env) wait(name string, counter *int64) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(counter) < int64(len(e.pairs)) {
+		if time.Now().After(deadline) {
+			e.fatalf(
+				"%d of %d pairs received %s in %s",
+				atomic.LoadInt64(counter), len(e.pairs), name, timeout,
+			)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give a chance to receive extra events.
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt64(counter); n != int64(len(e.pairs)) {
+		e.fatalf("%d %s events received by %d pairs", n, name, len(e.pairs))
+	}
+}
+
+// fatalf dumps diagnostic snapshot of the poller and fails the test.
+func (e *env) fatalf(format string, args ...interface{}) {
+	e.t.Helper()
+	s := e.poller.Snapshot()
+	e.t.Logf(
+		"telemetry: elapsed=%s active=%d registered=%d deregistered=%d events=%v callback p50=%s p99=%s",
+		s.Elapsed, s.Active(), s.Registered, s.Deregistered, s.Events,
+		s.CallbackLatencyP50, s.CallbackLatencyP99,
+	)
+	// Statistics of the wait loop are available only for some backends.
+	if m := reflect.ValueOf(e.raw).MethodByName("Stats"); m.IsValid() && m.Type().NumIn() == 0 {
+		e.t.Logf("stats: %+v", m.Call(nil)[0].Interface())
+	}
+	e.t.Logf(
+		"pairs=%d received=%d stale=%d closed=%d",
+		len(e.pairs), atomic.LoadInt64(&e.received),
+		atomic.LoadInt64(&e.stale), atomic.LoadInt64(&e.closed),
+	)
+	e.t.Fatalf(format, args...)
+}
@@ -0,0 +1,324 @@
+/*
+Package telemetry provides netpoll.Poller wrapper which collects metrics of
+poller usage.
+
+Wrapped poller counts registrations and deregistrations of descriptors,
+events received by callbacks and measures callback latency:
+
+	p, err := netpoll.New(nil)
+	if err != nil {
+		// handle error
+	}
+	tp := telemetry.Wrap(p)
+
+	// Use tp as usual poller.
+	tp.Start(desc, cb)
+
+	s := tp.Snapshot()
+	log.Printf("active=%d reads/s=%.1f p99=%s",
+		s.Active(), s.EventsPerSecond[netpoll.EventRead], s.CallbackLatencyP99,
+	)
+
+All counters are updated atomically, so Snapshot() could be called
+concurrently with poller usage.
+*/
+package telemetry
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// DefaultLatencySamples is the default number of last callback latency
+// samples used to compute percentiles.
+const DefaultLatencySamples = 1024
+
+// eventBits is the number of bits in netpoll.Event.
+const eventBits = 16
+
+// TelemetryOption configures TelemetryPoller.
+type TelemetryOption func(*TelemetryPoller)
+
+// WithLatencySamples returns an option which sets number of last callback
+// latency samples used to compute percentiles. Non-positive n means
+// DefaultLatencySamples.
+func WithLatencySamples(n int) TelemetryOption {
+	return func(p *TelemetryPoller) {
+		if n <= 0 {
+			n = DefaultLatencySamples
+		}
+		p.samples = make([]time.Duration, n)
+	}
+}
+
+// WithClock returns an option which makes TelemetryPoller to use now instead
+// of time.Now() for time measurements.
+func WithClock(now func() time.Time) TelemetryOption {
+	return func(p *TelemetryPoller) {
+		p.now = now
+	}
+}
+
+// TelemetryPoller is a netpoll.Poller which collects metrics of the wrapped
+// poller usage.
+type TelemetryPoller struct {
+	p     netpoll.Poller
+	name  string
+	now   func() time.Time
+	start time.Time
+
+	registered   uint64
+	deregistered uint64
+	events       [eventBits]uint64
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+var (
+	_ netpoll.FullPoller = (*TelemetryPoller)(nil)
+	_ netpoll.Namer      = (*TelemetryPoller)(nil)
+)
+
+// Wrap returns TelemetryPoller which collects metrics of p usage.
+func Wrap(p netpoll.Poller, opts ...TelemetryOption) *TelemetryPoller {
+	t := &TelemetryPoller{
+		p:   p,
+		now: time.Now,
+	}
+	if n, ok := p.(netpoll.Namer); ok {
+		t.name = n.Name()
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.samples == nil {
+		t.samples = make([]time.Duration, DefaultLatencySamples)
+	}
+	t.start = t.now()
+	return t
+}
+
+// Start implements netpoll.Poller.
+func (t *TelemetryPoller) Start(desc *netpoll.Desc, cb netpoll.CallbackFn) error {
+	return t.register(t.p.Start(desc, t.callback(cb)))
+}
+
+// StartWithOptions implements netpoll.Poller.
+func (t *TelemetryPoller) StartWithOptions(desc *netpoll.Desc, cb netpoll.CallbackFn, opts ...netpoll.StartOption) error {
+	return t.register(t.p.StartWithOptions(desc, t.callback(cb), opts...))
+}
+
+// StartDuplex implements netpoll.Poller.
+func (t *TelemetryPoller) StartDuplex(desc *netpoll.Desc, onRead, onWrite netpoll.CallbackFn) error {
+	// Events passed to both callbacks, such as netpoll.EventHup, are counted
+	// by onRead only.
+	const write = netpoll.EventWrite | netpoll.EventWriteHup
+	return t.register(t.p.StartDuplex(desc,
+		t.count(onRead, ^netpoll.Event(write)),
+		t.count(onWrite, write),
+	))
+}
+
+// StartCtxFn implements netpoll.Poller.
+func (t *TelemetryPoller) StartCtxFn(desc *netpoll.Desc, ctx context.Context, fn func(context.Context, netpoll.Event)) error {
+	cb := t.callback(func(event netpoll.Event) {
+		fn(ctx, event)
+	})
+	return t.register(t.p.StartCtxFn(desc, ctx, func(_ context.Context, event netpoll.Event) {
+		cb(event)
+	}))
+}
+
+// Stop implements netpoll.Poller. Stop() which cancels registration deferred
+// by netpoll.StartLazy() is not counted, since such registration is counted
+// by desc.Arm() only.
+func (t *TelemetryPoller) Stop(desc *netpoll.Desc) error {
+	pending := desc.Pending()
+	err := t.p.Stop(desc)
+	if err == nil && !pending {
+		atomic.AddUint64(&t.deregistered, 1)
+	}
+	return err
+}
+
+// Resume implements netpoll.Poller.
+func (t *TelemetryPoller) Resume(desc *netpoll.Desc) error {
+	return t.p.Resume(desc)
+}
+
+// Name returns the name of wrapped poller if it implements netpoll.Namer.
+// Otherwise it returns empty string.
+func (t *TelemetryPoller) Name() string {
+	return t.name
+}
+
+// Close closes wrapped poller if it implements netpoll.Closer. Otherwise it
+// does nothing and returns nil.
+func (t *TelemetryPoller) Close() error {
+	if c, ok := t.p.(netpoll.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WaitIdle calls WaitIdle() of wrapped poller if it implements netpoll.Idler.
+// Otherwise it does nothing and returns nil.
+func (t *TelemetryPoller) WaitIdle(ctx context.Context) error {
+	if i, ok := t.p.(netpoll.Idler); ok {
+		return i.WaitIdle(ctx)
+	}
+	return nil
+}
+
+func (t *TelemetryPoller) register(err error) error {
+	if err == nil {
+		atomic.AddUint64(&t.registered, 1)
+	}
+	return err
+}
+
+func (t *TelemetryPoller) callback(cb netpoll.CallbackFn) netpoll.CallbackFn {
+	return t.count(cb, ^netpoll.Event(0))
+}
+
+// count returns callback which counts events within mask and measures cb
+// latency. Note that cb could be nil.
+func (t *TelemetryPoller) count(cb netpoll.CallbackFn, mask netpoll.Event) netpoll.CallbackFn {
+	return func(event netpoll.Event) {
+		counted := event & mask
+		for i := 0; i < eventBits; i++ {
+			if counted&(1<<uint(i)) != 0 {
+				atomic.AddUint64(&t.events[i], 1)
+			}
+		}
+		if counted&netpoll.EventPollerClosed != 0 {
+			// Registration is released by the poller.
+			atomic.AddUint64(&t.deregistered, 1)
+		}
+		if cb == nil {
+			return
+		}
+
+		begin := t.now()
+		cb(event)
+		t.observe(t.now().Sub(begin))
+	}
+}
+
+func (t *TelemetryPoller) observe(d time.Duration) {
+	t.mu.Lock()
+	t.samples[t.next] = d
+	t.next++
+	if t.next == len(t.samples) {
+		t.next = 0
+		t.full = true
+	}
+	t.mu.Unlock()
+}
+
+// TelemetrySnapshot contains metrics collected by TelemetryPoller.
+type TelemetrySnapshot struct {
+	// Poller is the name of wrapped poller, see TelemetryPoller.Name(). It
+	// is intended to be used as a label of exported metrics.
+	Poller string
+
+	// Elapsed is the time passed since Wrap() call.
+	Elapsed time.Duration
+
+	// Registered is the number of successful Start() and StartWithOptions()
+	// calls.
+	Registered uint64
+
+	// Deregistered is the number of successful Stop() calls and
+	// registrations released due to poller close.
+	// Note that Stop() calls made by the wrapped poller itself (for example,
+	// due to netpoll.CloseOnHup() option) are not counted.
+	Deregistered uint64
+
+	// Events holds number of callback invocations with each single event bit
+	// set, such as netpoll.EventRead or netpoll.EventHup.
+	Events map[netpoll.Event]uint64
+
+	// EventsPerSecond holds average rate of Events over Elapsed time.
+	EventsPerSecond map[netpoll.Event]float64
+
+	// CallbackLatencyP50 and CallbackLatencyP99 are percentiles of callback
+	// execution time among last latency samples.
+	CallbackLatencyP50 time.Duration
+	CallbackLatencyP99 time.Duration
+
+	// Loop holds counters of the wait loop work if wrapped poller
+	// implements netpoll.StatsProvider, e.g. epoll poller returned by
+	// netpoll.New(). It is nil otherwise. Note that most of the counters
+	// are zero unless netpoll.Config.CollectStats is set.
+	Loop *netpoll.EpollStats
+}
+
+// Active returns number of descriptors which are currently registered.
+func (s TelemetrySnapshot) Active() int64 {
+	return int64(s.Registered) - int64(s.Deregistered)
+}
+
+// Snapshot returns current metrics.
+func (t *TelemetryPoller) Snapshot() TelemetrySnapshot {
+	s := TelemetrySnapshot{
+		Poller:          t.name,
+		Elapsed:         t.now().Sub(t.start),
+		Registered:      atomic.LoadUint64(&t.registered),
+		Deregistered:    atomic.LoadUint64(&t.deregistered),
+		Events:          make(map[netpoll.Event]uint64),
+		EventsPerSecond: make(map[netpoll.Event]float64),
+	}
+	if sp, ok := t.p.(netpoll.StatsProvider); ok {
+		loop := sp.Stats()
+		s.Loop = &loop
+	}
+	sec := s.Elapsed.Seconds()
+	for i := 0; i < eventBits; i++ {
+		n := atomic.LoadUint64(&t.events[i])
+		if n == 0 {
+			continue
+		}
+		ev := netpoll.Event(1 << uint(i))
+		s.Events[ev] = n
+		if sec > 0 {
+			s.EventsPerSecond[ev] = float64(n) / sec
+		}
+	}
+
+	t.mu.Lock()
+	n := t.next
+	if t.full {
+		n = len(t.samples)
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, t.samples)
+	t.mu.Unlock()
+
+	if n > 0 {
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i] < samples[j]
+		})
+		s.CallbackLatencyP50 = percentile(samples, 50)
+		s.CallbackLatencyP99 = percentile(samples, 99)
+	}
+	return s
+}
+
+// percentile returns p-th percentile of sorted samples using nearest-rank
+// method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
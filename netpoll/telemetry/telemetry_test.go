@@ -0,0 +1,314 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+func TestTelemetryPoller(t *testing.T) {
+	var (
+		p   = newStubPoller()
+		clk clock
+	)
+	tp := Wrap(p, WithClock(clk.now), WithLatencySamples(100))
+
+	descs := make([]*netpoll.Desc, 3)
+	for i := range descs {
+		descs[i] = &netpoll.Desc{}
+		i := i
+		err := tp.Start(descs[i], func(netpoll.Event) {
+			// Callback of i-th descriptor takes i+1 milliseconds.
+			clk.advance(time.Duration(i+1) * time.Millisecond)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tp.Start(descs[0], func(netpoll.Event) {}); err != netpoll.ErrRegistered {
+		t.Fatalf("unexpected Start() error: %v", err)
+	}
+
+	p.fire(descs[0], netpoll.EventRead)
+	p.fire(descs[1], netpoll.EventRead|netpoll.EventWrite)
+	p.fire(descs[2], netpoll.EventRead|netpoll.EventHup)
+
+	if err := tp.Stop(descs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Stop(descs[0]); err != netpoll.ErrNotRegistered {
+		t.Fatalf("unexpected Stop() error: %v", err)
+	}
+	p.fire(descs[1], netpoll.EventPollerClosed)
+
+	s := tp.Snapshot()
+	if s.Registered != 3 {
+		t.Errorf("Registered = %d; want 3", s.Registered)
+	}
+	if s.Deregistered != 2 {
+		t.Errorf("Deregistered = %d; want 2", s.Deregistered)
+	}
+	if s.Active() != 1 {
+		t.Errorf("Active() = %d; want 1", s.Active())
+	}
+	for ev, exp := range map[netpoll.Event]uint64{
+		netpoll.EventRead:         3,
+		netpoll.EventWrite:        1,
+		netpoll.EventHup:          1,
+		netpoll.EventPollerClosed: 1,
+	} {
+		if act := s.Events[ev]; act != exp {
+			t.Errorf("Events[%s] = %d; want %d", ev, act, exp)
+		}
+	}
+	if n := len(s.Events); n != 4 {
+		t.Errorf("unexpected events: %v", s.Events)
+	}
+	// Total time spent in callbacks is 1+2+3+2 milliseconds.
+	if s.Elapsed != 8*time.Millisecond {
+		t.Errorf("Elapsed = %s; want 8ms", s.Elapsed)
+	}
+	if act, exp := s.EventsPerSecond[netpoll.EventRead], 3/0.008; act != exp {
+		t.Errorf("EventsPerSecond[EventRead] = %f; want %f", act, exp)
+	}
+	if s.CallbackLatencyP50 != 2*time.Millisecond {
+		t.Errorf("CallbackLatencyP50 = %s; want 2ms", s.CallbackLatencyP50)
+	}
+	if s.CallbackLatencyP99 != 3*time.Millisecond {
+		t.Errorf("CallbackLatencyP99 = %s; want 3ms", s.CallbackLatencyP99)
+	}
+}
+
+func TestTelemetryDuplex(t *testing.T) {
+	p := newStubPoller()
+	tp := Wrap(p)
+
+	var reads, writes int
+	desc := &netpoll.Desc{}
+	err := tp.StartDuplex(desc,
+		func(netpoll.Event) { reads++ },
+		func(netpoll.Event) { writes++ },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.fire(desc, netpoll.EventRead|netpoll.EventWrite|netpoll.EventHup)
+
+	if reads != 1 || writes != 1 {
+		t.Fatalf("callbacks called %d and %d times; want 1 and 1", reads, writes)
+	}
+	s := tp.Snapshot()
+	for _, ev := range []netpoll.Event{
+		netpoll.EventRead, netpoll.EventWrite, netpoll.EventHup,
+	} {
+		if n := s.Events[ev]; n != 1 {
+			t.Errorf("Events[%s] = %d; want 1", ev, n)
+		}
+	}
+	if s.Registered != 1 {
+		t.Errorf("Registered = %d; want 1", s.Registered)
+	}
+}
+
+func TestTelemetryStartLazy(t *testing.T) {
+	p := newStubPoller()
+	tp := Wrap(p)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	desc, err := netpoll.NewDesc(int(r.Fd()), netpoll.EventRead, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := netpoll.StartLazy(tp, desc, func(netpoll.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if s := tp.Snapshot(); s.Registered != 0 {
+		t.Errorf("Registered = %d before Arm(); want 0", s.Registered)
+	}
+	if err := desc.Arm(); err != nil {
+		t.Fatal(err)
+	}
+	if s := tp.Snapshot(); s.Registered != 1 {
+		t.Errorf("Registered = %d after Arm(); want 1", s.Registered)
+	}
+	if err := tp.Stop(desc); err != nil {
+		t.Fatal(err)
+	}
+	if s := tp.Snapshot(); s.Active() != 0 {
+		t.Errorf("Active() = %d after Stop(); want 0", s.Active())
+	}
+}
+
+func TestTelemetryStartCtxFn(t *testing.T) {
+	p := newStubPoller()
+	tp := Wrap(p)
+
+	type key struct{}
+	var (
+		ctx  = context.WithValue(context.Background(), key{}, "span")
+		desc = &netpoll.Desc{}
+		got  interface{}
+	)
+	err := tp.StartCtxFn(desc, ctx, func(ctx context.Context, _ netpoll.Event) {
+		got = ctx.Value(key{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.fire(desc, netpoll.EventRead)
+	if got != "span" {
+		t.Errorf("callback received context value %v; want %q", got, "span")
+	}
+	if s := tp.Snapshot(); s.Events[netpoll.EventRead] != 1 || s.Registered != 1 {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+}
+
+func TestTelemetryLatencyWindow(t *testing.T) {
+	var (
+		p   = newStubPoller()
+		clk clock
+	)
+	tp := Wrap(p, WithClock(clk.now), WithLatencySamples(2))
+
+	var d time.Duration
+	desc := &netpoll.Desc{}
+	err := tp.Start(desc, func(netpoll.Event) {
+		clk.advance(d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d = range []time.Duration{
+		time.Second, time.Millisecond, time.Millisecond,
+	} {
+		p.fire(desc, netpoll.EventRead)
+	}
+	// First sample must be evicted.
+	if s := tp.Snapshot(); s.CallbackLatencyP99 != time.Millisecond {
+		t.Errorf("CallbackLatencyP99 = %s; want 1ms", s.CallbackLatencyP99)
+	}
+}
+
+func TestTelemetryClose(t *testing.T) {
+	p := newStubPoller()
+	if err := Wrap(p).Close(); err != errStubClosed {
+		t.Fatalf("Close() = %v; want %v", err, errStubClosed)
+	}
+	if err := Wrap(struct{ netpoll.Poller }{p}).Close(); err != nil {
+		t.Fatalf("Close() = %v; want nil", err)
+	}
+}
+
+func TestTelemetryName(t *testing.T) {
+	tp := Wrap(namedPoller{newStubPoller(), "ingress-0"})
+	if act := tp.Name(); act != "ingress-0" {
+		t.Errorf("Name() = %q; want %q", act, "ingress-0")
+	}
+	if act := tp.Snapshot().Poller; act != "ingress-0" {
+		t.Errorf("Snapshot().Poller = %q; want %q", act, "ingress-0")
+	}
+	if act := Wrap(newStubPoller()).Snapshot().Poller; act != "" {
+		t.Errorf("Snapshot().Poller of unnamed poller = %q; want empty", act)
+	}
+}
+
+func TestTelemetryLoopStats(t *testing.T) {
+	exp := netpoll.EpollStats{Iterations: 3, Events: 5, Descriptors: 2}
+	s := Wrap(statsPoller{newStubPoller(), exp}).Snapshot()
+	if s.Loop == nil || *s.Loop != exp {
+		t.Errorf("Snapshot().Loop = %+v; want %+v", s.Loop, exp)
+	}
+	if s := Wrap(newStubPoller()).Snapshot(); s.Loop != nil {
+		t.Errorf("Snapshot().Loop of poller without stats = %+v; want nil", s.Loop)
+	}
+}
+
+// statsPoller adds netpoll.StatsProvider to the stub.
+type statsPoller struct {
+	*stubPoller
+	stats netpoll.EpollStats
+}
+
+func (p statsPoller) Stats() netpoll.EpollStats { return p.stats }
+
+// namedPoller adds netpoll.Namer to the stub.
+type namedPoller struct {
+	*stubPoller
+	name string
+}
+
+func (p namedPoller) Name() string { return p.name }
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+var errStubClosed = errors.New("stub poller closed")
+
+// stubPoller is a netpoll.Poller which calls callbacks only by fire() calls.
+type stubPoller struct {
+	callbacks map[*netpoll.Desc]netpoll.CallbackFn
+}
+
+func newStubPoller() *stubPoller {
+	return &stubPoller{
+		callbacks: make(map[*netpoll.Desc]netpoll.CallbackFn),
+	}
+}
+
+func (p *stubPoller) Start(desc *netpoll.Desc, cb netpoll.CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
+
+func (p *stubPoller) StartWithOptions(desc *netpoll.Desc, cb netpoll.CallbackFn, _ ...netpoll.StartOption) error {
+	if _, has := p.callbacks[desc]; has {
+		return netpoll.ErrRegistered
+	}
+	p.callbacks[desc] = cb
+	return nil
+}
+
+func (p *stubPoller) StartDuplex(desc *netpoll.Desc, onRead, onWrite netpoll.CallbackFn) error {
+	return p.Start(desc, netpoll.Duplex(onRead, onWrite))
+}
+
+func (p *stubPoller) StartCtxFn(desc *netpoll.Desc, ctx context.Context, fn func(context.Context, netpoll.Event)) error {
+	return p.Start(desc, netpoll.ContextCallback(ctx, fn))
+}
+
+func (p *stubPoller) Stop(desc *netpoll.Desc) error {
+	if _, has := p.callbacks[desc]; !has {
+		return netpoll.ErrNotRegistered
+	}
+	delete(p.callbacks, desc)
+	return nil
+}
+
+func (p *stubPoller) Resume(desc *netpoll.Desc) error {
+	return nil
+}
+
+func (p *stubPoller) Close() error {
+	return errStubClosed
+}
+
+func (p *stubPoller) fire(desc *netpoll.Desc, event netpoll.Event) {
+	p.callbacks[desc](event)
+	if event&netpoll.EventPollerClosed != 0 {
+		delete(p.callbacks, desc)
+	}
+}
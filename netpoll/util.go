@@ -1,11 +0,0 @@
-package netpoll
-
-import "syscall"
-
-func temporaryErr(err error) bool {
-	errno, ok := err.(syscall.Errno)
-	if !ok {
-		return false
-	}
-	return errno.Temporary()
-}
@@ -0,0 +1,47 @@
+/*
+Package vmsplice provides connection writer which transfers data from a
+memory-mapped ring buffer into a socket without copying it in userspace.
+
+Data written to VmspliceConn is put into the ring buffer. Then its pages are
+attached to a pipe with vmsplice(2) and moved into the socket with splice(2).
+When socket is not ready for writing, VmspliceConn arms EventWrite
+notification of the poller and continues with Flush() when it fires:
+
+	c, err := vmsplice.NewConn(conn, poller, 1<<20)
+	if err != nil {
+		// handle error
+	}
+	for {
+		n, err := c.Write(p)
+		p = p[n:]
+		if err == vmsplice.ErrFull {
+			// Wait for kernel to release pages of the buffer.
+			err = c.WaitWritable(ctx)
+		}
+		...
+	}
+
+Since the kernel references pages of the buffer instead of copying them, the
+space is reused only when the kernel reports that data is no longer queued in
+the socket, e.g. acknowledged by TCP peer.
+*/
+package vmsplice
+
+import "fmt"
+
+var (
+	// ErrFull is returned by VmspliceConn.Write() when there is no free
+	// space in the buffer for the whole data.
+	ErrFull = fmt.Errorf("vmsplice buffer is full")
+
+	// ErrClosed is returned by VmspliceConn methods after Close().
+	ErrClosed = fmt.Errorf("vmsplice conn is closed")
+
+	// ErrPollerClosed is returned by VmspliceConn methods when poller is
+	// closed while data is waiting for socket readiness.
+	ErrPollerClosed = fmt.Errorf("poller is closed")
+)
+
+// DefaultSize is the size of the buffer used when NewConn() is called with
+// non-positive size.
+const DefaultSize = 1 << 20
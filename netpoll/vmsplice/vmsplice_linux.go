@@ -0,0 +1,389 @@
+// +build linux
+
+package vmsplice
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+const (
+	// siocOutq is SIOCOUTQ request of ioctl(2) which returns number of bytes
+	// queued in the socket send buffer. For TCP it includes sent but not yet
+	// acknowledged bytes.
+	siocOutq = unix.TIOCOUTQ
+
+	// minWait and maxWait are bounds of interval WaitWritable() checks the
+	// socket queue with.
+	minWait = 50 * time.Microsecond
+	maxWait = time.Millisecond
+)
+
+// VmspliceConn is a writer which transfers data to a socket using
+// vmsplice(2) and splice(2). It is safe for concurrent use.
+type VmspliceConn struct {
+	conn   net.Conn
+	rc     syscall.RawConn
+	poller netpoll.Poller
+	desc   *netpoll.Desc
+
+	mu      sync.Mutex
+	closed  bool
+	err     error
+	started bool
+	armed   bool
+	// space is closed and replaced when buffer space is released.
+	space chan struct{}
+
+	// buf is the memory-mapped ring buffer. Positions below are monotonic
+	// and satisfy released <= sent <= piped <= written.
+	buf      []byte
+	written  uint64 // Bytes copied into buf.
+	piped    uint64 // Bytes attached to the pipe by vmsplice(2).
+	sent     uint64 // Bytes moved to the socket by splice(2).
+	released uint64 // Bytes not referenced by the socket anymore.
+
+	pipe [2]int
+
+	// State of splice(2) made by rc, kept to avoid allocations.
+	spliceFn func(uintptr) bool
+	sn       int
+	serr     error
+	outqFn   func(uintptr)
+	outq     int
+	oerr     error
+}
+
+// NewConn creates VmspliceConn writing to conn with buffer of at least size
+// bytes. Actual size is rounded up to the page size.
+// Socket readiness is waited using given poller.
+//
+// Note that conn should not be written directly after this call.
+func NewConn(conn net.Conn, poller netpoll.Poller, size int) (*VmspliceConn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("vmsplice: %T does not implement syscall.Conn", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = DefaultSize
+	}
+	page := os.Getpagesize()
+	size = (size + page - 1) / page * page
+
+	desc, err := netpoll.HandleWriteOnce(conn)
+	if err != nil {
+		return nil, err
+	}
+	c := &VmspliceConn{
+		conn:   conn,
+		rc:     rc,
+		poller: poller,
+		desc:   desc,
+		space:  make(chan struct{}),
+	}
+	if err := unix.Pipe2(c.pipe[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		desc.Close()
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	// Larger pipe lets to move more data with single splice(2) call. Size
+	// is limited by /proc/sys/fs/pipe-max-size, so error is ignored.
+	unix.FcntlInt(uintptr(c.pipe[1]), unix.F_SETPIPE_SZ, size)
+
+	c.buf, err = unix.Mmap(-1, 0, size,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS,
+	)
+	if err != nil {
+		unix.Close(c.pipe[0])
+		unix.Close(c.pipe[1])
+		desc.Close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	c.spliceFn = func(fd uintptr) bool {
+		for {
+			// unix.Splice() returns int64 on 64-bit platforms and int on
+			// 32-bit ones, so the result is converted right away.
+			n, err := unix.Splice(c.pipe[0], nil, int(fd), nil,
+				int(c.piped-c.sent), unix.SPLICE_F_NONBLOCK|unix.SPLICE_F_MOVE,
+			)
+			if c.sn, c.serr = int(n), err; err != unix.EINTR {
+				break
+			}
+		}
+		if c.sn < 0 {
+			c.sn = 0
+		}
+		// Do not wait for readiness.
+		return true
+	}
+	c.outqFn = func(fd uintptr) {
+		c.outq, c.oerr = unix.IoctlGetInt(int(fd), siocOutq)
+	}
+	return c, nil
+}
+
+// Conn returns underlying connection.
+func (c *VmspliceConn) Conn() net.Conn {
+	return c.conn
+}
+
+// Cap returns size of the buffer.
+func (c *VmspliceConn) Cap() int {
+	return len(c.buf)
+}
+
+// Buffered returns number of bytes written to c which are still referenced
+// by the buffer, that is, not flushed or not released by the kernel yet.
+func (c *VmspliceConn) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.written - c.released)
+}
+
+// Write copies p into the buffer and flushes it. If there is no space for
+// the whole p, it copies as much as possible and returns ErrFull.
+// It never blocks.
+func (c *VmspliceConn) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	if c.free() < len(p) {
+		c.release()
+	}
+	for n < len(p) && c.free() > 0 {
+		i := int(c.written % uint64(len(c.buf)))
+		end := len(c.buf)
+		if f := i + c.free(); f < end {
+			end = f
+		}
+		m := copy(c.buf[i:end], p[n:])
+		c.written += uint64(m)
+		n += m
+	}
+	if err := c.flush(); err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, ErrFull
+	}
+	return n, nil
+}
+
+// Flush moves buffered data into the socket as much as possible without
+// blocking. If socket is not ready, the rest of data is flushed when poller
+// reports EventWrite.
+func (c *VmspliceConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// WaitWritable blocks until there is free space in the buffer, an error
+// occurs or ctx is done.
+func (c *VmspliceConn) WaitWritable(ctx context.Context) error {
+	wait := minWait
+	for {
+		c.mu.Lock()
+		if err := c.check(); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.release()
+		if c.free() > 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		space := c.space
+		c.mu.Unlock()
+
+		// Acknowledgements of the peer do not produce any notifications
+		// while there is no data to send, so the queue is checked
+		// periodically.
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-space:
+		case <-t.C:
+		}
+		t.Stop()
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+// Close stops waiting for socket readiness, releases the buffer and closes
+// underlying connection. Data which is not flushed yet is discarded.
+func (c *VmspliceConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	if c.started {
+		c.poller.Stop(c.desc)
+	}
+	c.desc.Close()
+	unix.Close(c.pipe[0])
+	unix.Close(c.pipe[1])
+	// Pages which are still referenced by the kernel are kept until it
+	// releases them.
+	unix.Munmap(c.buf)
+	c.buf = nil
+	return c.conn.Close()
+}
+
+func (c *VmspliceConn) check() error {
+	if c.closed {
+		return ErrClosed
+	}
+	return c.err
+}
+
+func (c *VmspliceConn) free() int {
+	return len(c.buf) - int(c.written-c.released)
+}
+
+// flush must be called with c.mu held.
+func (c *VmspliceConn) flush() error {
+	for progress := true; progress; {
+		progress = false
+		if c.piped < c.written {
+			n, err := c.vmsplice()
+			if err != nil && err != unix.EAGAIN {
+				return c.fail(os.NewSyscallError("vmsplice", err))
+			}
+			c.piped += uint64(n)
+			progress = n > 0
+		}
+		if c.sent < c.piped {
+			if err := c.rc.Write(c.spliceFn); err != nil {
+				return c.fail(err)
+			}
+			if c.serr != nil && c.serr != unix.EAGAIN {
+				return c.fail(os.NewSyscallError("splice", c.serr))
+			}
+			c.sent += uint64(c.sn)
+			progress = progress || c.sn > 0
+		}
+	}
+	c.release()
+	if c.sent < c.written {
+		return c.arm()
+	}
+	return nil
+}
+
+// vmsplice attaches unpiped part of the buffer to the pipe.
+func (c *VmspliceConn) vmsplice() (int, error) {
+	var (
+		size = uint64(len(c.buf))
+		i    = c.piped % size
+		j    = c.written % size
+		iovs [2]unix.Iovec
+		n    = 1
+	)
+	iovs[0].Base = &c.buf[i]
+	if j > i {
+		iovs[0].SetLen(int(j - i))
+	} else {
+		iovs[0].SetLen(int(size - i))
+		if j > 0 {
+			iovs[1].Base = &c.buf[0]
+			iovs[1].SetLen(int(j))
+			n = 2
+		}
+	}
+	for {
+		m, err := unix.Vmsplice(c.pipe[1], iovs[:n], unix.SPLICE_F_NONBLOCK)
+		if err == unix.EINTR {
+			continue
+		}
+		if m < 0 {
+			m = 0
+		}
+		return m, err
+	}
+}
+
+// release marks data which is not queued in the socket anymore as free.
+func (c *VmspliceConn) release() {
+	if c.released == c.sent {
+		return
+	}
+	if err := c.rc.Control(c.outqFn); err != nil || c.oerr != nil {
+		return
+	}
+	queued := uint64(c.outq)
+	if queued >= c.sent-c.released {
+		// Nothing is released. Note that socket could also contain data
+		// written before NewConn().
+		return
+	}
+	c.released = c.sent - queued
+	close(c.space)
+	c.space = make(chan struct{})
+}
+
+func (c *VmspliceConn) arm() error {
+	if c.armed {
+		return nil
+	}
+	var err error
+	if c.started {
+		err = c.poller.Resume(c.desc)
+	} else {
+		err = c.poller.Start(c.desc, c.onWrite)
+		c.started = err == nil
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	c.armed = true
+	return nil
+}
+
+func (c *VmspliceConn) onWrite(ev netpoll.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.armed = false
+	if c.closed || c.err != nil {
+		return
+	}
+	if ev&netpoll.EventPollerClosed != 0 {
+		c.fail(ErrPollerClosed)
+		return
+	}
+	// Hangup and errors are reported by splice(2).
+	c.flush()
+}
+
+// fail stores err to be returned by further calls and wakes up waiters.
+func (c *VmspliceConn) fail(err error) error {
+	c.err = err
+	close(c.space)
+	c.space = make(chan struct{})
+	return err
+}
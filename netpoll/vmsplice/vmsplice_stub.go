@@ -0,0 +1,40 @@
+// +build !linux
+
+package vmsplice
+
+import (
+	"context"
+	"net"
+	"runtime"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+// VmspliceConn is not implemented for current operating system.
+type VmspliceConn struct{}
+
+// NewConn returns netpoll.ErrUnsupportedPlatform, because vmsplice(2) is
+// available on linux only.
+func NewConn(conn net.Conn, poller netpoll.Poller, size int) (*VmspliceConn, error) {
+	return nil, netpoll.ErrUnsupportedPlatform{GOOS: runtime.GOOS}
+}
+
+func (c *VmspliceConn) Conn() net.Conn { return nil }
+func (c *VmspliceConn) Cap() int       { return 0 }
+func (c *VmspliceConn) Buffered() int  { return 0 }
+
+func (c *VmspliceConn) Write(p []byte) (int, error) {
+	return 0, netpoll.ErrUnsupportedPlatform{GOOS: runtime.GOOS}
+}
+
+func (c *VmspliceConn) Flush() error {
+	return netpoll.ErrUnsupportedPlatform{GOOS: runtime.GOOS}
+}
+
+func (c *VmspliceConn) WaitWritable(ctx context.Context) error {
+	return netpoll.ErrUnsupportedPlatform{GOOS: runtime.GOOS}
+}
+
+func (c *VmspliceConn) Close() error {
+	return netpoll.ErrUnsupportedPlatform{GOOS: runtime.GOOS}
+}
@@ -0,0 +1,193 @@
+// +build linux
+
+package vmsplice
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mailru/easygo/netpoll"
+)
+
+func TestVmspliceConn(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := tcpPair(t)
+	c, err := NewConn(conn, poller, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Data is larger than the buffer and socket buffers, so it could not be
+	// flushed without waiting for EventWrite and peer acknowledgements.
+	data := make([]byte, 8<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		p, _ := ioutil.ReadAll(io.LimitReader(peer, int64(len(data))))
+		received <- p
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for p := data; len(p) > 0; {
+		n, err := c.Write(p)
+		p = p[n:]
+		if err == ErrFull {
+			err = c.WaitWritable(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if act := <-received; !bytes.Equal(act, data) {
+		t.Fatalf("received %d bytes which differ from sent %d bytes", len(act), len(data))
+	}
+}
+
+func TestVmspliceConnClose(t *testing.T) {
+	poller := newPoller(t)
+	conn, _ := tcpPair(t)
+	c, err := NewConn(conn, poller, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Cap() <= 0 || c.Cap()%4096 != 0 {
+		t.Errorf("Cap() is %d; want multiple of page size", c.Cap())
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write() error is %v; want %v", err, ErrClosed)
+	}
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("Close() error is %v; want %v", err, ErrClosed)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("connection is not closed by Close()")
+	}
+}
+
+func TestVmsplicePeerClosed(t *testing.T) {
+	poller := newPoller(t)
+	conn, peer := tcpPair(t)
+	c, err := NewConn(conn, poller, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	peer.Close()
+
+	p := make([]byte, 4096)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err = c.Write(p)
+		if err == ErrFull {
+			err = c.WaitWritable(context.Background())
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Fatalf("no error after peer closed connection")
+	}
+}
+
+func BenchmarkVmspliceConn(b *testing.B) {
+	poller := newPoller(b)
+	benchmarkStream(b, func(conn net.Conn) func([]byte) error {
+		c, err := NewConn(conn, poller, 1<<20)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { c.Close() })
+		ctx := context.Background()
+		return func(p []byte) error {
+			for len(p) > 0 {
+				n, err := c.Write(p)
+				p = p[n:]
+				if err == ErrFull {
+					err = c.WaitWritable(ctx)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	})
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkStream(b, func(conn net.Conn) func([]byte) error {
+		return func(p []byte) error {
+			_, err := conn.Write(p)
+			return err
+		}
+	})
+}
+
+func benchmarkStream(b *testing.B, writer func(net.Conn) func([]byte) error) {
+	conn, peer := tcpPair(b)
+	go io.Copy(ioutil.Discard, peer)
+
+	write := writer(conn)
+	chunk := make([]byte, 256<<10)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newPoller(tb testing.TB) netpoll.Poller {
+	poller, err := netpoll.New(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { poller.(netpoll.Closer).Close() })
+	return poller
+}
+
+// tcpPair returns connected pair of tcp connections.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		tb.FailNow()
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
@@ -0,0 +1,180 @@
+package netpoll
+
+import (
+	"sync"
+	"time"
+)
+
+// waitAlways are events which wake WaitForEvent() regardless of the wanted
+// ones.
+const waitAlways = EventHup | EventReadHup | EventWriteHup | EventErr | EventPollerClosed
+
+// WaitForEvent blocks until desc receives one of want events, or timeout
+// expires. Non-positive timeout means no timeout. It returns received event
+// on success, which could also be EventHup or EventErr along with want ones,
+// ErrWaitTimeout on timeout and ErrClosed if p is closed while waiting.
+//
+// If desc is already started in p, the wait piggybacks on that registration
+// as Observe() does, so its callback still receives all events. Otherwise
+// desc is started temporarily and stopped before WaitForEvent returns; want
+// must be a subset of desc events then, and desc must not be one-shot, since
+// an unwanted event would consume the registration. Concurrent calls for the same desc
+// share the registration and all of them are woken by a suitable event.
+// Note that edge-triggered temporary registration reports readiness once, so
+// calls joining an already made registration receive only new events.
+//
+// WaitForEvent must not be called from the poller callbacks.
+func WaitForEvent(p Poller, desc *Desc, want Event, timeout time.Duration) (Event, error) {
+	if want == 0 || want&^(EventRead|EventWrite|EventPriority) != 0 {
+		return 0, ErrInvalidEvent
+	}
+	w := &eventWaiter{want: want, fired: make(chan Event, 1)}
+	done, err := addEventWaiter(p, desc, w)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case ev := <-w.fired:
+		if ev&EventPollerClosed != 0 {
+			return ev, ErrClosed
+		}
+		return ev, nil
+	case <-expired:
+		return 0, ErrWaitTimeout
+	}
+}
+
+// eventWaiter is a single WaitForEvent() call.
+type eventWaiter struct {
+	want  Event
+	fired chan Event
+}
+
+func (w *eventWaiter) notify(ev Event) {
+	if ev&(w.want|waitAlways) == 0 {
+		return
+	}
+	select {
+	case w.fired <- ev:
+	default:
+	}
+}
+
+// tempWaits holds temporary registrations made by WaitForEvent() for
+// descriptors which are not started by the application.
+var tempWaits = struct {
+	mu sync.Mutex
+	m  map[*Desc]*tempWait
+}{m: make(map[*Desc]*tempWait)}
+
+// tempWait is a temporary registration shared by concurrent waiters. It is
+// stopped by the last of them.
+type tempWait struct {
+	// ready is closed when Start() is done; err holds its result.
+	ready chan struct{}
+	err   error
+	// stopped is closed when Stop() made by the last waiter is done.
+	stopped chan struct{}
+	// waiters and stopping are guarded by tempWaits.mu.
+	waiters  map[*eventWaiter]struct{}
+	stopping bool
+}
+
+// dispatch is the callback of temporary registration.
+func (t *tempWait) dispatch(ev Event) {
+	tempWaits.mu.Lock()
+	list := make([]*eventWaiter, 0, len(t.waiters))
+	for w := range t.waiters {
+		list = append(list, w)
+	}
+	tempWaits.mu.Unlock()
+
+	for _, w := range list {
+		w.notify(ev)
+	}
+}
+
+func (t *tempWait) remove(p Poller, desc *Desc, w *eventWaiter) {
+	tempWaits.mu.Lock()
+	delete(t.waiters, w)
+	if len(t.waiters) > 0 || tempWaits.m[desc] != t {
+		tempWaits.mu.Unlock()
+		return
+	}
+	// Запись остается в tempWaits.m до конца Stop(), чтобы новый вызов
+	// дождался его, а не принял регистрацию за регистрацию приложения.
+	// Сам Stop() делаем без блокировки: он может ждать коллбек dispatch().
+	t.stopping = true
+	tempWaits.mu.Unlock()
+
+	p.Stop(desc)
+
+	tempWaits.mu.Lock()
+	delete(tempWaits.m, desc)
+	tempWaits.mu.Unlock()
+	close(t.stopped)
+}
+
+// addEventWaiter subscribes w to events of desc. Returned done function
+// unsubscribes it.
+func addEventWaiter(p Poller, desc *Desc, w *eventWaiter) (done func(), err error) {
+	for {
+		tempWaits.mu.Lock()
+		t := tempWaits.m[desc]
+		if t == nil && desc.registered() {
+			tempWaits.mu.Unlock()
+			cancel, err := Observe(desc, w.notify)
+			if err == ErrNotRegistered {
+				// Дескриптор успели остановить, пробуем снова.
+				continue
+			}
+			return cancel, err
+		}
+		if t != nil && t.stopping {
+			tempWaits.mu.Unlock()
+			<-t.stopped
+			continue
+		}
+		if t != nil {
+			t.waiters[w] = struct{}{}
+			tempWaits.mu.Unlock()
+			<-t.ready
+			if t.err != nil {
+				return nil, t.err
+			}
+			return func() { t.remove(p, desc, w) }, nil
+		}
+		if w.want&^desc.event != 0 || desc.event&EventOneShot != 0 {
+			tempWaits.mu.Unlock()
+			return nil, ErrInvalidEvent
+		}
+
+		// Ожидающий добавляется до регистрации, чтобы не пропустить
+		// событие, о котором сообщит сам Start().
+		t = &tempWait{
+			ready:   make(chan struct{}),
+			stopped: make(chan struct{}),
+			waiters: map[*eventWaiter]struct{}{w: {}},
+		}
+		tempWaits.m[desc] = t
+		tempWaits.mu.Unlock()
+
+		t.err = p.Start(desc, t.dispatch)
+		close(t.ready)
+		if t.err != nil {
+			tempWaits.mu.Lock()
+			delete(tempWaits.m, desc)
+			tempWaits.mu.Unlock()
+			return nil, t.err
+		}
+		return func() { t.remove(p, desc, w) }, nil
+	}
+}
@@ -0,0 +1,532 @@
+// +build wasip1
+
+package netpoll
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// WASI preview 1 has no persistent interest set like epoll or kqueue. Thus
+// wasiPoller builds subscriptions for all armed descriptors on each round and
+// passes them to poll_oneoff. The call is made with short timeout, because
+// wasm program has single thread and blocking host call would block all
+// goroutines. When there are no events, the wait loop sleeps, letting the
+// runtime to wait for its own descriptors and timers.
+
+const (
+	wasiEventtypeClock   = 0
+	wasiEventtypeFdRead  = 1
+	wasiEventtypeFdWrite = 2
+
+	wasiClockMonotonic = 1
+
+	// wasiFdReadwriteHangup is set in event flags when peer has closed
+	// the connection.
+	wasiFdReadwriteHangup = 1
+
+	wasiEINTR = 27
+)
+
+const (
+	// wasiPollTimeout is a timeout of each poll_oneoff call. Some runtimes,
+	// e.g. node, report only the clock event if timeout is zero, so minimal
+	// resolution of their timers is used.
+	wasiPollTimeout = time.Millisecond
+
+	// wasiMinIdle and wasiMaxIdle are bounds of sleep interval between
+	// rounds without events. Interval is doubled on each idle round.
+	wasiMinIdle = 50 * time.Microsecond
+	wasiMaxIdle = 10 * time.Millisecond
+)
+
+// wasiSubscription is the subscription struct of poll_oneoff.
+// Its union contains a tag in the first byte and the body after 8 bytes.
+type wasiSubscription struct {
+	userdata uint64
+	u        [5]uint64
+}
+
+// wasiEvent is the event struct of poll_oneoff.
+type wasiEvent struct {
+	userdata uint64
+	errno    uint16
+	typ      uint8
+	nbytes   uint64
+	flags    uint16
+}
+
+// setFd makes s a subscription for given fd and event type.
+func (s *wasiSubscription) setFd(userdata uint64, typ uint8, fd int) {
+	*s = wasiSubscription{userdata: userdata}
+	*(*uint8)(unsafe.Pointer(&s.u[0])) = typ
+	*(*int32)(unsafe.Pointer(&s.u[1])) = int32(fd)
+}
+
+// setClock makes s a relative monotonic clock subscription.
+func (s *wasiSubscription) setClock(userdata uint64, timeout time.Duration) {
+	*s = wasiSubscription{userdata: userdata}
+	*(*uint8)(unsafe.Pointer(&s.u[0])) = wasiEventtypeClock
+	*(*uint32)(unsafe.Pointer(&s.u[1])) = wasiClockMonotonic
+	s.u[2] = uint64(timeout)
+	// Precision.
+	s.u[3] = 1e3
+}
+
+//go:wasmimport wasi_snapshot_preview1 poll_oneoff
+//go:noescape
+func wasiPollOneoff(in, out unsafe.Pointer, nsubscriptions uint32, nevents unsafe.Pointer) uint32
+
+// wasiPoller is a Poller implementation based on poll_oneoff of WASI
+// preview 1. It supports level-triggered and one-shot descriptors only.
+type wasiPoller struct {
+	mu     sync.Mutex
+	closed bool
+	descs  map[int]*wasiEntry
+
+	done     chan struct{}
+	waitDone chan struct{}
+	idle     idleTracker
+
+	// seq is a number of the last registration.
+	seq          uint64
+	reverseClose bool
+	// maxDescs is Config.MaxDescriptors.
+	maxDescs int
+	soft     softLimit
+
+	name   string
+	errors errorHandler
+}
+
+// wasiEntry holds registration of a descriptor.
+type wasiEntry struct {
+	desc *Desc
+	cb   CallbackFn
+	// event is desc.event at the last Start() or Resume(). Wait loop uses
+	// it instead of desc.event, which could be changed by Update().
+	event Event
+	// armed is false for one-shot descriptors which received an event and
+	// are not resumed yet.
+	armed bool
+	// seq orders the registration on Close().
+	seq uint64
+}
+
+// wasiReady is an event received by the wait loop.
+type wasiReady struct {
+	desc  *Desc
+	cb    CallbackFn
+	event Event
+}
+
+var (
+	_ FullPoller     = (*wasiPoller)(nil)
+	_ Pauser         = (*wasiPoller)(nil)
+	_ HandlerStarter = (*wasiPoller)(nil)
+	_ PausedStarter  = (*wasiPoller)(nil)
+	_ LazyStarter    = (*wasiPoller)(nil)
+	_ Namer          = (*wasiPoller)(nil)
+)
+
+func newWasiPoller(cfg Config) *wasiPoller {
+	p := &wasiPoller{
+		descs:    make(map[int]*wasiEntry),
+		done:     make(chan struct{}),
+		waitDone: make(chan struct{}),
+		name:     cfg.Name,
+		errors:   errorHandler{cfg.OnWaitError, cfg.ErrorLog, cfg.Name},
+
+		reverseClose: cfg.ReverseCloseOrder,
+		maxDescs:     cfg.MaxDescriptors,
+		soft:         newSoftLimit(cfg.SoftLimit, cfg.MaxDescriptors, cfg.OnSoftLimit),
+	}
+	go p.wait(cfg)
+	return p
+}
+
+// String returns name of the backend.
+func (p *wasiPoller) String() string {
+	return BackendPollOneoff.String()
+}
+
+// Name implements Namer.Name() method.
+func (p *wasiPoller) Name() string {
+	return p.name
+}
+
+// Start implements Poller.Start() method.
+func (p *wasiPoller) Start(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb)
+}
+
+// StartWithOptions implements Poller.StartWithOptions() method.
+// It returns ErrUnsupportedOption for edge-triggered descriptors,
+// EventPriority, WithExclusive() and WithLowWatermark() options.
+func (p *wasiPoller) StartWithOptions(desc *Desc, cb CallbackFn, opts ...StartOption) error {
+	var o startOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := validEvent(desc.event); err != nil {
+		return err
+	}
+	if o.exclusive || o.lowat > 1 || desc.event&(EventEdgeTriggered|EventPriority) != 0 {
+		return ErrUnsupportedOption
+	}
+	fd := desc.fd()
+	if fd < 0 {
+		return ErrInvalidFD
+	}
+
+	user := cb
+	cb = withOptions(p, desc, func(event Event) {
+		user(event)
+		desc.notify(event)
+	}, &o, p.errors)
+
+	// OnSoftLimit is called after the lock is released.
+	var soft int
+	defer func() { p.soft.notify(soft) }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if _, has := p.descs[fd]; has {
+		return ErrRegistered
+	}
+	if p.maxDescs > 0 && len(p.descs) >= p.maxDescs {
+		return ErrTooManyDescriptors
+	}
+	p.seq++
+	desc.register()
+	p.descs[fd] = &wasiEntry{
+		desc:  desc,
+		cb:    cb,
+		event: desc.event,
+		armed: !o.paused,
+		seq:   p.seq,
+	}
+	soft = p.soft.added(len(p.descs))
+	return nil
+}
+
+// StartDuplex implements Poller.StartDuplex() method.
+func (p *wasiPoller) StartDuplex(desc *Desc, onRead, onWrite CallbackFn) error {
+	event := desc.event
+	desc.event |= EventRead | EventWrite
+	if err := p.Start(desc, Duplex(onRead, onWrite)); err != nil {
+		desc.event = event
+		return err
+	}
+	return nil
+}
+
+// StartCtxFn implements Poller.StartCtxFn() method.
+func (p *wasiPoller) StartCtxFn(desc *Desc, ctx context.Context, fn func(context.Context, Event)) error {
+	return p.Start(desc, ContextCallback(ctx, fn))
+}
+
+// StartHandler implements HandlerStarter.StartHandler() method.
+func (p *wasiPoller) StartHandler(desc *Desc, h Handler) error {
+	return p.Start(desc, h.HandleEvent)
+}
+
+// StartPaused implements PausedStarter.StartPaused() method.
+func (p *wasiPoller) StartPaused(desc *Desc, cb CallbackFn) error {
+	return p.StartWithOptions(desc, cb, startPaused)
+}
+
+// StartLazy implements LazyStarter.StartLazy() method.
+func (p *wasiPoller) StartLazy(desc *Desc, cb CallbackFn) error {
+	return startLazy(p, desc, cb)
+}
+
+// Stop implements Poller.Stop() method.
+func (p *wasiPoller) Stop(desc *Desc) error {
+	if stopLazy(desc) {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	fd := desc.fd()
+	if _, has := p.descs[fd]; !has {
+		return ErrNotRegistered
+	}
+	delete(p.descs, fd)
+	p.soft.removed(len(p.descs))
+	desc.unregister()
+	desc.paused = false
+	return nil
+}
+
+// Resume implements Poller.Resume() method.
+func (p *wasiPoller) Resume(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	if desc.paused {
+		return nil
+	}
+	e.event = desc.event
+	e.armed = true
+	return nil
+}
+
+// Pause implements Pauser.Pause() method.
+// Paused descriptor has no subscriptions, so it does not receive any
+// events.
+func (p *wasiPoller) Pause(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	desc.paused = true
+	e.event = 0
+	return nil
+}
+
+// Unpause implements Pauser.Unpause() method.
+func (p *wasiPoller) Unpause(desc *Desc) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	e, has := p.descs[desc.fd()]
+	if !has {
+		return ErrNotRegistered
+	}
+	if !desc.paused {
+		return nil
+	}
+	desc.paused = false
+	e.event = desc.event
+	e.armed = true
+	return nil
+}
+
+// Close implements Closer.Close() method.
+func (p *wasiPoller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	<-p.waitDone
+
+	p.mu.Lock()
+	descs := p.descs
+	p.descs = nil
+	p.mu.Unlock()
+
+	entries := make([]*wasiEntry, 0, len(descs))
+	for _, e := range descs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if p.reverseClose {
+			return entries[i].seq > entries[j].seq
+		}
+		return entries[i].seq < entries[j].seq
+	})
+
+	p.idle.begin()
+	defer p.idle.end()
+	for _, e := range entries {
+		e.cb(EventPollerClosed)
+	}
+	return nil
+}
+
+// WaitIdle implements Idler.WaitIdle() method.
+func (p *wasiPoller) WaitIdle(ctx context.Context) error {
+	return p.idle.wait(ctx)
+}
+
+func (p *wasiPoller) wait(cfg Config) {
+	defer close(p.waitDone)
+
+	var (
+		subs  []wasiSubscription
+		evs   []wasiEvent
+		ready []wasiReady
+		sleep = wasiMinIdle
+		quiet = newQuietHook(cfg.IdleThreshold, cfg.OnIdle)
+	)
+	for {
+		// Clock subscription limits the time poll_oneoff blocks.
+		subs = append(subs[:0], wasiSubscription{})
+		subs[0].setClock(0, wasiPollTimeout)
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		for fd, e := range p.descs {
+			if !e.armed {
+				continue
+			}
+			if e.event&EventRead != 0 {
+				var s wasiSubscription
+				s.setFd(uint64(fd)+1, wasiEventtypeFdRead, fd)
+				subs = append(subs, s)
+			}
+			if e.event&EventWrite != 0 {
+				var s wasiSubscription
+				s.setFd(uint64(fd)+1, wasiEventtypeFdWrite, fd)
+				subs = append(subs, s)
+			}
+		}
+		p.mu.Unlock()
+		if len(subs) == 1 {
+			// Nothing to poll.
+			if !p.sleep(&sleep) {
+				return
+			}
+			quiet.update(false)
+			continue
+		}
+
+		if cap(evs) < len(subs) {
+			evs = make([]wasiEvent, len(subs))
+		}
+		evs = evs[:len(subs)]
+		var n uint32
+		errno := wasiPollOneoff(
+			unsafe.Pointer(&subs[0]), unsafe.Pointer(&evs[0]),
+			uint32(len(subs)), unsafe.Pointer(&n),
+		)
+		if errno != 0 {
+			if errno == wasiEINTR {
+				continue
+			}
+			err := syscall.Errno(errno)
+			if cfg.OnWaitError != nil {
+				cfg.OnWaitError(err)
+			} else {
+				logRecord(cfg.ErrorLog, LogRecord{
+					Level:   LevelError,
+					Message: "wait loop error",
+					Poller:  cfg.Name,
+					Op:      "wait",
+					FD:      -1,
+					Err:     err,
+				})
+			}
+			return
+		}
+
+		// Events of the same descriptor are merged, since read and write
+		// readiness are reported separately.
+		ready = ready[:0]
+		p.mu.Lock()
+		for _, ev := range evs[:n] {
+			if ev.userdata == 0 {
+				continue
+			}
+			fd := int(ev.userdata - 1)
+			e, has := p.descs[fd]
+			if !has || !e.armed {
+				continue
+			}
+			event := fromWasiEvent(ev)
+			merged := false
+			for i := range ready {
+				if ready[i].desc == e.desc {
+					ready[i].event |= event
+					merged = true
+				}
+			}
+			if !merged {
+				ready = append(ready, wasiReady{e.desc, e.cb, event})
+			}
+		}
+		for _, r := range ready {
+			// Descriptor with error, e.g. closed one, is reported on each
+			// call until it is stopped, so it is disarmed like one-shot one.
+			e := p.descs[r.desc.fd()]
+			if e.event&EventOneShot != 0 || r.event&EventErr != 0 {
+				e.armed = false
+			}
+		}
+		p.mu.Unlock()
+
+		if len(ready) == 0 {
+			if !p.sleep(&sleep) {
+				return
+			}
+			quiet.update(false)
+			continue
+		}
+		sleep = wasiMinIdle
+
+		p.idle.begin()
+		for _, r := range ready {
+			r.desc.setLastEvent(r.event)
+			r.cb(r.event)
+		}
+		p.idle.end()
+		quiet.update(true)
+	}
+}
+
+// sleep waits for given interval and doubles it up to wasiMaxIdle.
+// It returns false if poller is closed.
+func (p *wasiPoller) sleep(d *time.Duration) bool {
+	t := time.NewTimer(*d)
+	defer t.Stop()
+	select {
+	case <-p.done:
+		return false
+	case <-t.C:
+	}
+	if *d *= 2; *d > wasiMaxIdle {
+		*d = wasiMaxIdle
+	}
+	return true
+}
+
+func fromWasiEvent(ev wasiEvent) (event Event) {
+	if ev.errno != 0 {
+		event |= EventErr
+	}
+	switch ev.typ {
+	case wasiEventtypeFdRead:
+		event |= EventRead
+		if ev.flags&wasiFdReadwriteHangup != 0 {
+			event |= EventReadHup | EventHup
+		}
+	case wasiEventtypeFdWrite:
+		event |= EventWrite
+		if ev.flags&wasiFdReadwriteHangup != 0 {
+			event |= EventWriteHup | EventHup
+		}
+	}
+	return event
+}